@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/routeman"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/black-desk/lib/go/logger"
+	"github.com/spf13/cobra"
+)
+
+// cleanupCmd represents the cleanup command
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove everything left by a cgtproxy not exited normally",
+	Long: `Remove the cgtproxy nftable or bpf programs of the bpf backend,
+routes in route-table and the fire wall mark rules looking it up,
+as well as rules and routes of routes in the configuration,
+which are left if cgtproxy did not exit normally, e.g. killed by SIGKILL.
+
+cgtproxy does this itself when it starts,
+so this is only needed to get rid of leftovers without starting cgtproxy again.
+It refuses to run while cgtproxy is running.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = cleanupCmdRun()
+		return
+	},
+}
+
+func cleanupCmdRun() (err error) {
+	defer Wrap(&err)
+
+	var lock *os.File
+	lock, err = lockRunning()
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+
+	log := logger.Get("cgtproxy")
+
+	var cfg *config.Config
+	cfg, err = loadConfig(log)
+	if err != nil {
+		return
+	}
+
+	var nft interfaces.NFTManager
+	nft, err = newBackend(cfg, log)
+	if err != nil {
+		return
+	}
+	defer nft.Release()
+
+	var m *routeman.RouteManager
+	m, err = routeman.New(
+		routeman.WithConfig(cfg),
+		routeman.WithNFTMan(nft),
+		routeman.WithLogger(log),
+	)
+	if err != nil {
+		return
+	}
+
+	err = m.Cleanup()
+	return
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupCmd)
+}
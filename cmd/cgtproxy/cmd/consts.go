@@ -12,4 +12,6 @@ Go to check
 for some help.
 `
 	CGTProxyCfgPath = "/etc/cgtproxy/config.yaml"
+	// CGTProxyLockPath is locked by a running cgtproxy.
+	CGTProxyLockPath = "/run/cgtproxy/cgtproxy.lock"
 )
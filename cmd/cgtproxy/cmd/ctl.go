@@ -0,0 +1,232 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/control"
+	"github.com/black-desk/cgtproxy/pkg/control/client"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/spf13/cobra"
+)
+
+var ctlFlags struct {
+	Socket string
+	JSON   bool
+}
+
+// ctlCmd represents the ctl command
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Talk to a running cgtproxy",
+	Long: `Talk to a running cgtproxy through its control socket.
+Only root and the user running cgtproxy are allowed to do this.`,
+}
+
+var ctlCGroupsCmd = &cobra.Command{
+	Use:   "cgroups",
+	Short: "List cgroups tracked by cgtproxy and their targets",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		var routes []types.Route
+		routes, err = c.CGroups()
+		if err != nil {
+			return
+		}
+
+		err = printCGroups(cmd.OutOrStdout(), routes)
+		return
+	},
+}
+
+var ctlTProxiesCmd = &cobra.Command{
+	Use:   "tproxies",
+	Short: "List tproxies used by cgtproxy",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		var tproxies []*config.TProxy
+		tproxies, err = c.TProxies()
+		if err != nil {
+			return
+		}
+
+		err = printTProxies(cmd.OutOrStdout(), tproxies)
+		return
+	},
+}
+
+var ctlResyncCmd = &cobra.Command{
+	Use:   "resync",
+	Short: "Make cgtproxy go through cgroupfs again",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		err = c.Resync()
+		return
+	},
+}
+
+var ctlReconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Make cgtproxy fix cgroups whose events have been missed",
+	Long: `Make cgtproxy go through cgroupfs and fix differences
+between cgroups in it and the cgroup map,
+then print how many of them have been fixed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		var drift *types.Drift
+		drift, err = c.Reconcile()
+		if err != nil {
+			return
+		}
+
+		w := cmd.OutOrStdout()
+		if ctlFlags.JSON {
+			err = printJSON(w, drift)
+			return
+		}
+
+		fmt.Fprintf(w, "created: %d\ndeleted: %d\nstale: %d\norphans: %d\n",
+			drift.Created, drift.Deleted, drift.Stale, drift.Orphans,
+		)
+		return
+	},
+}
+
+var ctlVersionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show version and configuration hash of cgtproxy",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		var v *control.Version
+		v, err = c.Version()
+		if err != nil {
+			return
+		}
+
+		w := cmd.OutOrStdout()
+		if ctlFlags.JSON {
+			err = printJSON(w, v)
+			return
+		}
+
+		fmt.Fprintf(w, "version: %s\nconfig hash: %s\n", v.Version, v.ConfigHash)
+		return
+	},
+}
+
+func newCtlClient() (*client.Client, error) {
+	return client.New(client.WithSocketPath(ctlFlags.Socket))
+}
+
+func printJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func printCGroups(w io.Writer, routes []types.Route) (err error) {
+	if ctlFlags.JSON {
+		return printJSON(w, routes)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CGROUP\tTARGET\tCHAIN")
+	for i := range routes {
+		chain := routes[i].Target.Chain
+		if chain == "" {
+			chain = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\n",
+			routes[i].Path, routes[i].Target.Op, chain,
+		)
+	}
+
+	return tw.Flush()
+}
+
+func printTProxies(w io.Writer, tproxies []*config.TProxy) (err error) {
+	if ctlFlags.JSON {
+		return printJSON(w, tproxies)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPORT\tMARK\tNO-UDP\tNO-IPV6")
+	for i := range tproxies {
+		tp := tproxies[i]
+		fmt.Fprintf(tw, "%s\t%d\t%#x\t%t\t%t\n",
+			tp.Name, tp.Port, uint32(tp.Mark), tp.NoUDP, tp.NoIPv6,
+		)
+	}
+
+	return tw.Flush()
+}
+
+func init() {
+	ctlCmd.PersistentFlags().StringVarP(
+		&ctlFlags.Socket,
+		"socket", "s", control.DefaultSocketPath,
+		"path to the control socket of cgtproxy",
+	)
+	ctlCmd.PersistentFlags().BoolVar(
+		&ctlFlags.JSON,
+		"json", false,
+		"print results in JSON",
+	)
+
+	ctlCmd.AddCommand(ctlCGroupsCmd)
+	ctlCmd.AddCommand(ctlTProxiesCmd)
+	ctlCmd.AddCommand(ctlResyncCmd)
+	ctlCmd.AddCommand(ctlReconcileCmd)
+	ctlCmd.AddCommand(ctlVersionCmd)
+
+	rootCmd.AddCommand(ctlCmd)
+}
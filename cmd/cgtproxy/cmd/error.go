@@ -5,6 +5,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 )
@@ -16,3 +17,18 @@ type ErrCancelBySignal struct {
 func (e *ErrCancelBySignal) Error() string {
 	return fmt.Sprintf("Cancelled by signal (%v).", e.Signal)
 }
+
+var (
+	ErrTargetInvalid = errors.New("target is invalid.")
+	ErrNoRuleMatched = errors.New("no rule matches the cgroup.")
+	ErrRunning       = errors.New("another cgtproxy is running.")
+	ErrNoNftable     = errors.New("backend in configuration uses no nftable.")
+)
+
+type ErrScopeJobFailed struct {
+	Result string
+}
+
+func (e *ErrScopeJobFailed) Error() string {
+	return fmt.Sprintf("Job to start scope finished with result %q.", e.Result)
+}
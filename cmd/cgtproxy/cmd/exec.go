@@ -0,0 +1,167 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/control"
+	"github.com/black-desk/cgtproxy/pkg/control/client"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/spf13/cobra"
+)
+
+var execFlags struct {
+	Target  string
+	Socket  string
+	Timeout time.Duration
+}
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec --target <target> -- <command> [args...]",
+	Short: "Run a command under a chosen target",
+	Long: `Run a command in a transient scope
+in slice "cgtproxy-<target>.slice" created through systemd.
+
+The command is executed only after the running cgtproxy
+has installed rules for the scope,
+so that no packet sent by the command escapes.
+It fails if no rule in the configuration matches the scope.
+
+The scope is created by the systemd user instance,
+or by the system instance if running as root.`,
+	Example: `  cgtproxy exec --target proxy -- curl https://example.com
+  cgtproxy exec --target direct -- ssh example.com`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = execCmdRun(cmd.Context(), args)
+		return
+	},
+}
+
+func execCmdRun(ctx context.Context, args []string) (err error) {
+	defer Wrap(&err)
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	target := execFlags.Target
+	if target == "" || strings.ContainsAny(target, "/.\\") {
+		err = fmt.Errorf("target %q: %w", target, ErrTargetInvalid)
+		return
+	}
+
+	var path string
+	path, err = exec.LookPath(args[0])
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, execFlags.Timeout)
+	defer cancel()
+
+	err = startScope(ctx, "cgtproxy-"+target+".slice", args)
+	if err != nil {
+		return
+	}
+
+	var c *client.Client
+	c, err = client.New(client.WithSocketPath(execFlags.Socket))
+	if err != nil {
+		return
+	}
+
+	var route *types.Route
+	route, err = c.SelfRoute(ctx)
+	if err != nil {
+		return
+	}
+
+	if route.Target.Op == types.TargetNoop {
+		err = fmt.Errorf("cgroup %s: %w", route.Path, ErrNoRuleMatched)
+		return
+	}
+
+	err = syscall.Exec(path, args, os.Environ())
+	return
+}
+
+// startScope moves the current process into a new transient scope
+// in slice through systemd D-Bus API.
+func startScope(ctx context.Context, slice string, args []string) (err error) {
+	defer Wrap(&err, "start scope in %s", slice)
+
+	var conn *dbus.Conn
+	if os.Geteuid() == 0 {
+		conn, err = dbus.NewSystemConnectionContext(ctx)
+	} else {
+		conn, err = dbus.NewUserConnectionContext(ctx)
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	name := fmt.Sprintf("cgtproxy-exec-%d.scope", os.Getpid())
+
+	ch := make(chan string, 1)
+	_, err = conn.StartTransientUnitContext(ctx, name, "fail", []dbus.Property{
+		dbus.PropDescription("cgtproxy exec " + strings.Join(args, " ")),
+		dbus.PropSlice(slice),
+		dbus.PropPids(uint32(os.Getpid())),
+	}, ch)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case result := <-ch:
+		if result != "done" {
+			err = &ErrScopeJobFailed{Result: result}
+			return
+		}
+	}
+
+	return
+}
+
+func init() {
+	execCmd.Flags().StringVarP(
+		&execFlags.Target,
+		"target", "t", "",
+		"the target to run command under, e.g. proxy, direct or drop",
+	)
+	execCmd.MarkFlagRequired("target")
+
+	execCmd.Flags().StringVarP(
+		&execFlags.Socket,
+		"socket", "s", control.DefaultSocketPath,
+		"path to the control socket of cgtproxy",
+	)
+
+	execCmd.Flags().DurationVar(
+		&execFlags.Timeout,
+		"timeout", 10*time.Second,
+		"how long to wait for cgtproxy to install rules",
+	)
+
+	// Flags after the command belong to the command.
+	execCmd.Flags().SetInterspersed(false)
+
+	rootCmd.AddCommand(execCmd)
+}
@@ -0,0 +1,279 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/black-desk/cgtproxy/pkg/cgpath"
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/routeman"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var explainFlags struct {
+	JSON bool
+}
+
+// explainCmd represents the explain command
+var explainCmd = &cobra.Command{
+	Use:   "explain <cgroup-path|pid>",
+	Short: "Show which rule matches a cgroup or a process",
+	Long: `Show which rule in the configuration matches a cgroup,
+or the cgroup of a process if a PID is given.
+
+The output-mangle chain looks up the cgroup of a packet level by level,
+from the deepest one to the top most one,
+so the verdict is decided by the deepest cgroup
+which has an element in the cgroup map.
+This command shows the rule matched on every level,
+and the element the running cgtproxy actually has in the cgroup map.
+
+With the bpf backend,
+a cgroup is handled by programs of the deepest cgroup with programs attached,
+and "in cgroup map" tells whether programs of cgtproxy
+are attached to the cgroup.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = explainCmdRun(cmd.OutOrStdout(), args[0])
+		return
+	},
+}
+
+// explainLevel describes how a cgroup on some level is handled.
+type explainLevel struct {
+	Level  int    `json:"level"`
+	CGroup string `json:"cgroup"`
+	// Rule is the index of the matched rule, -1 if no rule matches.
+	Rule     int           `json:"rule"`
+	RuleText string        `json:"rule_text,omitempty"`
+	Target   *types.Target `json:"target,omitempty"`
+	// InMap tells whether the running cgtproxy has an element
+	// for this cgroup in the cgroup map,
+	// it is nil if the cgroup map cannot be read.
+	InMap *bool `json:"in_map,omitempty"`
+}
+
+type explanation struct {
+	CGroup string `json:"cgroup"`
+	// Levels are the cgroup and its ancestors, deepest first.
+	Levels []explainLevel `json:"levels"`
+	// Decider is the index in Levels of the cgroup
+	// deciding the verdict according to the configuration,
+	// -1 if traffic of the cgroup is not touched by cgtproxy.
+	Decider int `json:"decider"`
+	// MapError is why the cgroup map cannot be read.
+	MapError string `json:"map_error,omitempty"`
+}
+
+func explainCmdRun(w io.Writer, arg string) (err error) {
+	defer Wrap(&err)
+
+	var cfg *config.Config
+	cfg, err = loadConfig(zap.NewNop().Sugar())
+	if err != nil {
+		return
+	}
+
+	var path string
+	path, err = resolveCGroup(cfg.CgroupRoot, arg)
+	if err != nil {
+		return
+	}
+
+	var e *explanation
+	e, err = explain(cfg, path)
+	if err != nil {
+		return
+	}
+
+	if explainFlags.JSON {
+		err = printJSON(w, e)
+		return
+	}
+
+	err = printExplanation(w, cfg, e)
+	return
+}
+
+// resolveCGroup returns the path in cgroupfs of the cgroup arg refers to,
+// arg is a PID or a path either in cgroupfs or relative to cgroup root.
+func resolveCGroup(root config.CGroupRoot, arg string) (ret string, err error) {
+	defer Wrap(&err, "resolve cgroup of %s", arg)
+
+	rootPath := filepath.Clean(string(root))
+
+	if pid, convErr := strconv.Atoi(arg); convErr == nil {
+		var rel string
+		rel, err = cgpath.OfPID(pid)
+		if err != nil {
+			return
+		}
+
+		ret = filepath.Join(rootPath, rel)
+		return
+	}
+
+	path := filepath.Clean(arg)
+	if path != rootPath && !strings.HasPrefix(path, rootPath+"/") {
+		path = filepath.Join(rootPath, path)
+	}
+
+	ret = path
+	return
+}
+
+func explain(cfg *config.Config, path string) (ret *explanation, err error) {
+	rootPath := filepath.Clean(string(cfg.CgroupRoot))
+	rel := strings.TrimPrefix(path, rootPath)
+
+	e := &explanation{
+		CGroup:  path,
+		Levels:  []explainLevel{},
+		Decider: -1,
+	}
+
+	// NOTE:
+	// Level of a cgroup is counted in the same way
+	// as rules in output-mangle chain are generated by nftman.
+	for level := strings.Count(rel, "/"); level > 0; level-- {
+		l := explainLevel{
+			Level:  level,
+			CGroup: path,
+		}
+
+		var target types.Target
+		l.Rule, target, err = routeman.Match(cfg, path)
+		if err != nil {
+			return
+		}
+
+		if l.Rule >= 0 {
+			l.RuleText = cfg.Rules[l.Rule].String()
+			l.Target = &target
+
+			if e.Decider < 0 {
+				e.Decider = len(e.Levels)
+			}
+		}
+
+		e.Levels = append(e.Levels, l)
+		path = filepath.Dir(path)
+	}
+
+	e.MapError = lookupCGroupMap(cfg, e.Levels)
+
+	ret = e
+	return
+}
+
+// lookupCGroupMap fills elements of cgroups in the cgroup map into levels,
+// or whether programs are attached to cgroups with the bpf backend,
+// it returns why the map cannot be read if anything goes wrong.
+func lookupCGroupMap(cfg *config.Config, levels []explainLevel) string {
+	nft, err := newBackend(cfg, zap.NewNop().Sugar())
+	if err != nil {
+		return err.Error()
+	}
+	defer nft.Release()
+
+	inMap := make([]bool, len(levels))
+	for i := range levels {
+		inMap[i], err = nft.HasCGroup(levels[i].CGroup)
+		if err != nil {
+			return err.Error()
+		}
+	}
+
+	for i := range levels {
+		levels[i].InMap = &inMap[i]
+	}
+
+	return ""
+}
+
+func formatTarget(target *types.Target) string {
+	if target == nil {
+		return "-"
+	}
+
+	if target.Chain == "" {
+		return target.Op.String()
+	}
+
+	return target.Op.String() + " " + target.Chain
+}
+
+func formatInMap(inMap *bool) string {
+	if inMap == nil {
+		return "unknown"
+	}
+
+	if *inMap {
+		return "yes"
+	}
+
+	return "no"
+}
+
+func printExplanation(w io.Writer, cfg *config.Config, e *explanation) (err error) {
+	fmt.Fprintf(w, "cgroup: %s\n", e.CGroup)
+
+	if e.Decider < 0 {
+		fmt.Fprintln(w, "rule: none, traffic is not touched by cgtproxy")
+	} else {
+		decider := &e.Levels[e.Decider]
+		fmt.Fprintf(w, "rule: #%d %s\n", decider.Rule, decider.RuleText)
+		fmt.Fprintf(w, "target: %s\n", formatTarget(decider.Target))
+		fmt.Fprintf(w, "decided by: level %d %s\n", decider.Level, decider.CGroup)
+		fmt.Fprintf(w, "in cgroup map: %s\n", formatInMap(decider.InMap))
+	}
+
+	if e.MapError != "" {
+		fmt.Fprintf(w, "cannot read cgroup map: %s\n", e.MapError)
+	}
+
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LEVEL\tCGROUP\tRULE\tTARGET\tIN MAP")
+	for i := range e.Levels {
+		l := &e.Levels[i]
+
+		rule := "-"
+		if l.Rule >= 0 {
+			rule = "#" + strconv.Itoa(l.Rule)
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n",
+			l.Level,
+			strings.TrimPrefix(l.CGroup, string(cfg.CgroupRoot)),
+			rule,
+			formatTarget(l.Target),
+			formatInMap(l.InMap),
+		)
+	}
+
+	err = tw.Flush()
+	return
+}
+
+func init() {
+	explainCmd.Flags().BoolVar(
+		&explainFlags.JSON,
+		"json", false,
+		"print explanation in JSON",
+	)
+
+	rootCmd.AddCommand(explainCmd)
+}
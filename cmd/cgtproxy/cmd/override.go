@@ -0,0 +1,182 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/black-desk/cgtproxy/pkg/cgpath"
+	"github.com/black-desk/cgtproxy/pkg/control/client"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/spf13/cobra"
+)
+
+var overrideFlags struct {
+	Target  string
+	Subtree bool
+	Persist bool
+}
+
+// overrideCmd represents the override command
+var overrideCmd = &cobra.Command{
+	Use:   "override",
+	Short: "Pin cgroups to a target regardless of rules",
+	Long: `Pin a cgroup, or a cgroup and all its descendants,
+to a target regardless of rules in the configuration of a running cgtproxy.
+
+Overrides are lost when cgtproxy exits,
+unless they are persisted to the overrides-file in the configuration.`,
+}
+
+var overrideSetCmd = &cobra.Command{
+	Use:   "set --target <target> <cgroup-path|pid>",
+	Short: "Pin a cgroup to a target",
+	Long: `Pin a cgroup, or the cgroup of a process if a PID is given, to a target.
+The override of the same cgroup is replaced.
+
+Target is one of:
+  direct
+  drop
+  reject[:REASON]
+  tproxy:NAME
+  redirect:NAME
+  route:NAME
+  mark:VALUE[/MASK]`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var path string
+		path, err = overridePath(args[0])
+		if err != nil {
+			return
+		}
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		err = c.SetOverride(types.Override{
+			Path:    path,
+			Subtree: overrideFlags.Subtree,
+			Target:  overrideFlags.Target,
+			Persist: overrideFlags.Persist,
+		})
+		return
+	},
+}
+
+var overrideListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List overrides in use",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		var overrides []types.Override
+		overrides, err = c.Overrides()
+		if err != nil {
+			return
+		}
+
+		err = printOverrides(cmd.OutOrStdout(), overrides)
+		return
+	},
+}
+
+var overrideRemoveCmd = &cobra.Command{
+	Use:   "remove <cgroup-path|pid>",
+	Short: "Remove the override of a cgroup",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		defer Wrap(&err)
+
+		var path string
+		path, err = overridePath(args[0])
+		if err != nil {
+			return
+		}
+
+		var c *client.Client
+		c, err = newCtlClient()
+		if err != nil {
+			return
+		}
+
+		err = c.RemoveOverride(path)
+		return
+	},
+}
+
+// overridePath returns the path of the cgroup arg refers to,
+// arg is a PID or a path either in cgroupfs or relative to cgroup root.
+// The running cgtproxy joins relative paths onto its cgroup root.
+func overridePath(arg string) (ret string, err error) {
+	pid, convErr := strconv.Atoi(arg)
+	if convErr != nil {
+		ret = arg
+		return
+	}
+
+	ret, err = cgpath.OfPID(pid)
+	return
+}
+
+func printOverrides(w io.Writer, overrides []types.Override) (err error) {
+	if ctlFlags.JSON {
+		return printJSON(w, overrides)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CGROUP\tSUBTREE\tTARGET\tPERSIST")
+	for i := range overrides {
+		o := &overrides[i]
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%t\n",
+			o.Path, o.Subtree, o.Target, o.Persist,
+		)
+	}
+
+	return tw.Flush()
+}
+
+func init() {
+	overrideSetCmd.Flags().StringVarP(
+		&overrideFlags.Target,
+		"target", "t", "",
+		"target to pin the cgroup to",
+	)
+	overrideSetCmd.MarkFlagRequired("target")
+	overrideSetCmd.Flags().BoolVar(
+		&overrideFlags.Subtree,
+		"subtree", false,
+		"apply to descendants of the cgroup as well",
+	)
+	overrideSetCmd.Flags().BoolVar(
+		&overrideFlags.Persist,
+		"persist", false,
+		"keep the override across restarts of cgtproxy",
+	)
+
+	// Share flags of ctl to reach the control socket.
+	overrideCmd.PersistentFlags().AddFlagSet(ctlCmd.PersistentFlags())
+
+	overrideCmd.AddCommand(overrideSetCmd)
+	overrideCmd.AddCommand(overrideListCmd)
+	overrideCmd.AddCommand(overrideRemoveCmd)
+
+	rootCmd.AddCommand(overrideCmd)
+}
@@ -5,14 +5,21 @@
 package cmd
 
 import (
+	"github.com/black-desk/cgtproxy/pkg/batcher"
+	"github.com/black-desk/cgtproxy/pkg/bpfman"
 	"github.com/black-desk/cgtproxy/pkg/cgfsmon"
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy"
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace/recorder"
+	"github.com/black-desk/cgtproxy/pkg/control"
+	"github.com/black-desk/cgtproxy/pkg/inotifymon"
 	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
 	"github.com/black-desk/cgtproxy/pkg/nftman"
 	"github.com/black-desk/cgtproxy/pkg/nftman/connector"
 	"github.com/black-desk/cgtproxy/pkg/nftman/lastingconnector"
 	"github.com/black-desk/cgtproxy/pkg/routeman"
+	"github.com/black-desk/cgtproxy/pkg/systemdmon"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	"go.uber.org/zap"
 )
@@ -35,22 +42,52 @@ func provideLastringNetlinkConnector() (ret interfaces.NetlinkConnector, err err
 }
 
 func provideNFTManager(
+	cfg *config.Config,
 	connector interfaces.NetlinkConnector,
 	root config.CGroupRoot,
 	bypass config.Bypass,
 	logger *zap.SugaredLogger,
+	m interfaces.Metrics,
 ) (
 	ret interfaces.NFTManager,
 	err error,
 ) {
+	if cfg.Backend == config.BackendBPF {
+		return bpfman.New(
+			bpfman.WithCgroupRoot(root),
+			bpfman.WithBypass(bypass),
+			bpfman.WithLogger(logger),
+			bpfman.WithMetrics(m),
+		)
+	}
+
 	return nftman.New(
 		nftman.WithCgroupRoot(root),
 		nftman.WithBypass(bypass),
 		nftman.WithLogger(logger),
 		nftman.WithConnFactory(connector),
+		nftman.WithMetrics(m),
 	)
 }
 
+// newBackend creates a manager of the backend in cfg
+// which never shares netlink connection,
+// to read or clean up what cgtproxy has put into kernel.
+func newBackend(
+	cfg *config.Config, logger *zap.SugaredLogger,
+) (
+	ret interfaces.NFTManager, err error,
+) {
+	if cfg.Backend == config.BackendBPF {
+		return bpfman.New(
+			bpfman.WithCgroupRoot(cfg.CgroupRoot),
+			bpfman.WithLogger(logger),
+		)
+	}
+
+	return nftman.New(nftman.WithLogger(logger))
+}
+
 func provideRuleManager(
 	t interfaces.NFTManager,
 	cfg *config.Config,
@@ -67,18 +104,97 @@ func provideRuleManager(
 	)
 }
 
+// provideCgrougMontior provides the cgroup monitor of the backend in cfg,
+// wrapped by a recorder if events should be recorded,
+// and by a batcher coalescing events.
 func provideCgrougMontior(
+	cfg *config.Config,
 	cgroupRoot config.CGroupRoot,
 	logger *zap.SugaredLogger,
+	m interfaces.Metrics,
 ) (
-	interfaces.CGroupMonitor, error,
+	ret interfaces.CGroupMonitor, err error,
 ) {
-	return cgfsmon.New(
-		cgfsmon.WithCgroupRoot(cgroupRoot),
-		cgfsmon.WithLogger(logger),
+	var mon interfaces.CGroupMonitor
+	switch cfg.Monitor.Backend {
+	case config.MonitorINotify:
+		mon, err = inotifymon.New(
+			inotifymon.WithCgroupRoot(cgroupRoot),
+			inotifymon.WithBufferSize(cfg.Monitor.BufferSize),
+			inotifymon.WithLogger(logger),
+			inotifymon.WithMetrics(m),
+		)
+	case config.MonitorSystemd:
+		mon, err = systemdmon.New(
+			systemdmon.WithCgroupRoot(cgroupRoot),
+			systemdmon.WithBufferSize(cfg.Monitor.BufferSize),
+			systemdmon.WithLogger(logger),
+			systemdmon.WithMetrics(m),
+		)
+	default:
+		mon, err = cgfsmon.New(
+			cgfsmon.WithCgroupRoot(cgroupRoot),
+			cgfsmon.WithBufferSize(cfg.Monitor.BufferSize),
+			cgfsmon.WithLogger(logger),
+			cgfsmon.WithMetrics(m),
+		)
+	}
+	if err != nil {
+		return
+	}
+
+	// NOTE:
+	// Events are recorded before being coalesced,
+	// so that traces have events the same as the monitor sends.
+	if flags.recordEvents != "" {
+		mon, err = recorder.New(
+			recorder.WithCGroupMonitor(mon),
+			recorder.WithCgroupRoot(cgroupRoot),
+			recorder.WithPath(flags.recordEvents),
+			recorder.WithLogger(logger),
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	return batcher.New(
+		batcher.WithCGroupMonitor(mon),
+		batcher.WithMaxDelay(*cfg.Monitor.MaxBatchDelay),
+		batcher.WithMaxSize(cfg.Monitor.MaxBatchSize),
+		batcher.WithLogger(logger),
 	)
 }
 
+func provideMetrics(
+	cfg *config.Config,
+	logger *zap.SugaredLogger,
+) (
+	ret interfaces.Metrics, err error,
+) {
+	// NOTE:
+	// Counters are read when metrics are scraped,
+	// which happens in other goroutines than the one maintaining the table,
+	// so they are read by another nft manager
+	// which never shares netlink connection.
+	var nft interfaces.NFTManager
+	nft, err = newBackend(cfg, logger)
+	if err != nil {
+		return
+	}
+
+	opts := []metrics.Opt{
+		metrics.WithLogger(logger),
+		metrics.WithNFTManager(nft),
+	}
+
+	if cfg.Metrics != nil {
+		opts = append(opts, metrics.WithConfig(cfg.Metrics))
+	}
+
+	return metrics.New(opts...)
+}
+
 func provideCgroupRoot(cfg *config.Config) config.CGroupRoot {
 	return cfg.CgroupRoot
 }
@@ -92,6 +208,8 @@ func provideCGTProxy(
 	man interfaces.RouteManager,
 	logger *zap.SugaredLogger,
 	cfg *config.Config,
+	m interfaces.Metrics,
+	ctl interfaces.ControlServer,
 ) (
 	interfaces.CGTProxy, error,
 ) {
@@ -100,5 +218,20 @@ func provideCGTProxy(
 		cgtproxy.WithLogger(logger),
 		cgtproxy.WithCGroupMonitor(mon),
 		cgtproxy.WithRouteManager(man),
+		cgtproxy.WithMetrics(m),
+		cgtproxy.WithControlServer(ctl),
+	)
+}
+
+func provideControlServer(
+	man interfaces.RouteManager,
+	logger *zap.SugaredLogger,
+) (
+	interfaces.ControlServer, error,
+) {
+	return control.New(
+		control.WithRouteManager(man),
+		control.WithVersion(version()),
+		control.WithLogger(logger),
 	)
 }
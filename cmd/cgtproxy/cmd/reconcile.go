@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"go.uber.org/zap"
+)
+
+func requestReconcile(reconcileCh chan<- struct{}) {
+	select {
+	case reconcileCh <- struct{}{}:
+	default:
+		// A reconciliation is already pending.
+	}
+}
+
+// runReconciler reconciles cgroups when requested by SIGUSR1,
+// in addition to those done periodically by the route manager.
+func runReconciler(
+	ctx context.Context,
+	c interfaces.CGTProxy,
+	log *zap.SugaredLogger,
+	reconcileCh <-chan struct{},
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reconcileCh:
+		}
+
+		log.Infow("Reconciling cgroups.")
+
+		drift, err := c.Reconcile()
+		if err != nil {
+			log.Errorw("Failed to reconcile cgroups.",
+				"error", err,
+			)
+			continue
+		}
+
+		log.Infow("Cgroups reconciled.",
+			"created", drift.Created,
+			"deleted", drift.Deleted,
+			"stale", drift.Stale,
+			"orphans", drift.Orphans,
+		)
+	}
+}
@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/rjeczalik/notify"
+	"go.uber.org/zap"
+)
+
+// Editors usually write a file in several steps,
+// wait for a while to reload configuration only once.
+const configWatchDelay = 500 * time.Millisecond
+
+func requestReload(reloadCh chan<- struct{}) {
+	select {
+	case reloadCh <- struct{}{}:
+	default:
+		// A reload is already pending.
+	}
+}
+
+func runReloader(
+	ctx context.Context,
+	c interfaces.CGTProxy,
+	log *zap.SugaredLogger,
+	reloadCh <-chan struct{},
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloadCh:
+		}
+
+		log.Infow("Reloading configuration.",
+			"file", flags.cfgPath,
+		)
+
+		cfg, err := reloadConfig(log)
+		if err != nil {
+			log.Errorw("Failed to load new configuration, keep using the old one.",
+				"error", err,
+			)
+			continue
+		}
+
+		err = c.Reload(cfg)
+		if err != nil {
+			log.Errorw("Failed to apply new configuration, keep using the old one.",
+				"error", err,
+			)
+			continue
+		}
+
+		log.Infow("Configuration reloaded.")
+	}
+}
+
+func watchConfig(
+	ctx context.Context,
+	log *zap.SugaredLogger,
+	reloadCh chan<- struct{},
+) {
+	path, err := filepath.Abs(flags.cfgPath)
+	if err != nil {
+		log.Errorw("Failed to get absolute path of configuration.",
+			"file", flags.cfgPath,
+			"error", err,
+		)
+		return
+	}
+
+	// Watch the directory instead of the file,
+	// as editors may replace the file by renaming a new one.
+	eventsIn := make(chan notify.EventInfo, 16)
+	err = notify.Watch(
+		filepath.Dir(path), eventsIn,
+		notify.Create, notify.Write, notify.Rename,
+	)
+	if err != nil {
+		log.Errorw("Failed to watch configuration.",
+			"file", path,
+			"error", err,
+		)
+		return
+	}
+	defer notify.Stop(eventsIn)
+
+	log.Infow("Watching configuration.",
+		"file", path,
+	)
+
+	timer := time.NewTimer(configWatchDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case eventInfo := <-eventsIn:
+			if eventInfo.Path() != path {
+				continue
+			}
+
+			log.Debugw("Configuration changed.",
+				"event", eventInfo.Event().String(),
+			)
+
+			timer.Reset(configWatchDelay)
+		case <-timer.C:
+			requestReload(reloadCh)
+		}
+	}
+}
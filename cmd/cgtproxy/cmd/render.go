@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/nftman"
+	"github.com/black-desk/cgtproxy/pkg/nftman/memconnector"
+	"github.com/black-desk/cgtproxy/pkg/routeman"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var renderFlags struct {
+	CgroupRoot string
+}
+
+// renderCmd represents the render command
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Print the nftable cgtproxy would create",
+	Long: `Print the nftable cgtproxy would create for the configuration
+and the cgroups currently under cgroup root,
+in the syntax ` + "`nft -f`" + ` takes, without touching netlink.
+
+The cgroup tree is read from the cgroup-root in the configuration,
+or from --cgroup-root, which can be a directory snapshot of a cgroupfs.
+Keys of cgroup maps are printed as paths relative to cgroup root,
+which nft resolves against the cgroupfs when loading them.
+Ip rules and routes are not printed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = renderCmdRun(cmd.OutOrStdout())
+		return
+	},
+}
+
+func renderCmdRun(w io.Writer) (err error) {
+	defer Wrap(&err)
+
+	var cfg *config.Config
+	cfg, err = loadConfig(zap.NewNop().Sugar())
+	if err != nil {
+		return
+	}
+
+	if cfg.Backend != config.BackendNFTables {
+		err = ErrNoNftable
+		return
+	}
+
+	if renderFlags.CgroupRoot != "" {
+		var root string
+		root, err = filepath.Abs(renderFlags.CgroupRoot)
+		if err != nil {
+			return
+		}
+
+		cfg.CgroupRoot = config.CGroupRoot(root)
+	}
+
+	var mem *memconnector.Connector
+	mem, err = memconnector.New()
+	if err != nil {
+		return
+	}
+
+	var nft *nftman.NFTManager
+	nft, err = nftman.New(
+		nftman.WithCgroupRoot(cfg.CgroupRoot),
+		nftman.WithBypass(cfg.Bypass),
+		nftman.WithConnFactory(mem),
+	)
+	if err != nil {
+		return
+	}
+
+	var m *routeman.RouteManager
+	m, err = routeman.New(
+		routeman.WithConfig(cfg),
+		routeman.WithNFTMan(nft),
+	)
+	if err != nil {
+		return
+	}
+
+	err = m.FillNftable()
+	if err != nil {
+		return
+	}
+
+	var cgroups map[uint64]string
+	cgroups, err = cgroupInodes(cfg.CgroupRoot)
+	if err != nil {
+		return
+	}
+
+	err = mem.Render(w, cgroups)
+	return
+}
+
+// cgroupInodes maps inodes of cgroups under root
+// to their paths relative to root.
+func cgroupInodes(root config.CGroupRoot) (ret map[uint64]string, err error) {
+	defer Wrap(&err, "get inodes of cgroups under %s", root)
+
+	rootPath := filepath.Clean(string(root))
+	inodes := map[uint64]string{}
+
+	err = filepath.WalkDir(rootPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() || path == rootPath {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		inodes[info.Sys().(*syscall.Stat_t).Ino] = strings.TrimPrefix(path, rootPath)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	ret = inodes
+	return
+}
+
+func init() {
+	renderCmd.Flags().StringVar(
+		&renderFlags.CgroupRoot,
+		"cgroup-root", "",
+		"directory to read the cgroup tree from instead of cgroup-root in configuration",
+	)
+
+	rootCmd.AddCommand(renderCmd)
+}
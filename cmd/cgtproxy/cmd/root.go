@@ -20,9 +20,12 @@ import (
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
 	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/black-desk/lib/go/logger"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
 )
 
 var (
@@ -35,17 +38,21 @@ var flags struct {
 	cpuProfile         string
 	blockProfile       string
 	lastingNetlinkConn bool
+	watchConfig        bool
+	recordEvents       string
+}
+
+func version() string {
+	if GitDescription == "" {
+		return Version
+	}
+	return Version + " ( git describe: " + GitDescription + " )"
 }
 
 var rootCmd = &cobra.Command{
-	Version: func() string {
-		if GitDescription == "" {
-			return Version
-		}
-		return Version + " ( git describe: " + GitDescription + " )"
-	}(),
-	Use:   "cgtproxy",
-	Short: "A transparent network proxy manager.",
+	Version: version(),
+	Use:     "cgtproxy",
+	Short:   "A transparent network proxy manager.",
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		defer func() {
 			if err == nil {
@@ -138,29 +145,22 @@ func rootCmdRun() (err error) {
 		}
 	}
 
-	content, err := os.ReadFile(flags.cfgPath)
-	if errors.Is(err, os.ErrNotExist) && flags.cfgPath == CGTProxyCfgPath {
-		log.Errorw("Configuration file missing fallback to default config.")
-
-		content = []byte(config.DefaultConfig)
-		err = nil
-	} else if err != nil {
-		log.Errorw("Failed to read configuration from file",
-			"file", flags.cfgPath,
-			"error", err)
-
-		return err
-	}
-
 	var cfg *config.Config
+	cfg, err = loadConfig(log)
+	if err != nil {
+		return
+	}
 
-	cfg, err = config.New(
-		config.WithContent(content),
-		config.WithLogger(log),
-	)
+	// NOTE:
+	// cgtproxy removes leftovers of previous cgtproxy when it starts,
+	// which would break another cgtproxy still running.
+	// The lock is held until cgtproxy exits.
+	var lock *os.File
+	lock, err = lockRunning()
 	if err != nil {
 		return
 	}
+	defer lock.Close()
 
 	var c interfaces.CGTProxy
 	if flags.lastingNetlinkConn {
@@ -174,15 +174,40 @@ func rootCmdRun() (err error) {
 	}
 
 	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	reloadCh := make(chan struct{}, 1)
+	reconcileCh := make(chan struct{}, 1)
 
 	go func() {
 		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		signal.Notify(sigCh,
+			syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1,
+		)
+
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				requestReload(reloadCh)
+				continue
+			}
 
-		sig := <-sigCh
-		cancel(&ErrCancelBySignal{sig})
+			if sig == syscall.SIGUSR1 {
+				requestReconcile(reconcileCh)
+				continue
+			}
+
+			cancel(&ErrCancelBySignal{sig})
+			return
+		}
 	}()
 
+	if flags.watchConfig {
+		go watchConfig(ctx, log, reloadCh)
+	}
+
+	go runReloader(ctx, c, log, reloadCh)
+	go runReconciler(ctx, c, log, reconcileCh)
+
 	err = c.RunCGTProxy(ctx)
 	if err == nil {
 		return
@@ -205,6 +230,89 @@ func rootCmdRun() (err error) {
 	return
 }
 
+// lockRunning takes the lock file,
+// which fails with ErrRunning if another cgtproxy holds it.
+// The lock is released when the returned file is closed
+// or the process exits, even if killed by SIGKILL.
+func lockRunning() (ret *os.File, err error) {
+	defer Wrap(&err, "lock %s", CGTProxyLockPath)
+
+	err = os.MkdirAll(filepath.Dir(CGTProxyLockPath), 0755)
+	if err != nil {
+		return
+	}
+
+	var file *os.File
+	file, err = os.OpenFile(CGTProxyLockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		file.Close()
+		err = ErrRunning
+		return
+	} else if err != nil {
+		file.Close()
+		return
+	}
+
+	ret = file
+	return
+}
+
+// loadConfig loads configuration from the configure file,
+// the default configuration is used
+// if the default configure file does not exist.
+func loadConfig(log *zap.SugaredLogger) (ret *config.Config, err error) {
+	content, err := os.ReadFile(flags.cfgPath)
+	if errors.Is(err, os.ErrNotExist) && flags.cfgPath == CGTProxyCfgPath {
+		log.Errorw("Configuration file missing fallback to default config.")
+
+		content = []byte(config.DefaultConfig)
+		err = nil
+	} else if err != nil {
+		log.Errorw("Failed to read configuration from file",
+			"file", flags.cfgPath,
+			"error", err)
+
+		return
+	}
+
+	ret, err = parseConfig(log, content)
+	return
+}
+
+// reloadConfig loads configuration from the configure file
+// for a running cgtproxy.
+//
+// NOTE:
+// Unlike loadConfig, it never falls back to the default configuration,
+// which has no rule and would make traffic of all cgroups go direct
+// if the configure file is removed or moved away.
+func reloadConfig(log *zap.SugaredLogger) (ret *config.Config, err error) {
+	content, err := os.ReadFile(flags.cfgPath)
+	if err != nil {
+		return
+	}
+
+	ret, err = parseConfig(log, content)
+	return
+}
+
+func parseConfig(log *zap.SugaredLogger, content []byte) (ret *config.Config, err error) {
+	ret, err = config.New(
+		config.WithContent(content),
+		config.WithLogger(log),
+	)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -249,4 +357,20 @@ func init() {
 		"reuse-netlink-socket", true,
 		"use lasting netlink socket",
 	)
+
+	rootCmd.Flags().BoolVar(
+		&flags.watchConfig,
+		"watch-config", false,
+		""+
+			"reload configuration when the configure file changed, "+
+			"configuration can always be reloaded by sending SIGHUP",
+	)
+
+	rootCmd.Flags().StringVar(
+		&flags.recordEvents,
+		"record-events", "",
+		""+
+			"write every batch of cgroup events to the given file, "+
+			"which can be replayed to reproduce bugs",
+	)
 }
@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/black-desk/cgtproxy/pkg/nftman"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/spf13/cobra"
+)
+
+var statsFlags struct {
+	JSON bool
+}
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show traffic counters",
+	Long: `Show packets and bytes handled by each target and rule,
+read from named counters in the cgtproxy nftable.`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		err = statsCmdRun(cmd.OutOrStdout())
+		return
+	},
+}
+
+func statsCmdRun(w io.Writer) (err error) {
+	defer Wrap(&err)
+
+	var nft *nftman.NFTManager
+	nft, err = nftman.New()
+	if err != nil {
+		return
+	}
+	defer nft.Release()
+
+	var counters []types.Counter
+	counters, err = nft.Counters()
+	if err != nil {
+		return
+	}
+
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Target != counters[j].Target {
+			return counters[i].Target < counters[j].Target
+		}
+		if counters[i].Family != counters[j].Family {
+			return counters[i].Family < counters[j].Family
+		}
+		return counters[i].Proto < counters[j].Proto
+	})
+
+	if statsFlags.JSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(counters)
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tFAMILY\tPROTO\tPACKETS\tBYTES")
+	for i := range counters {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n",
+			counters[i].Target,
+			counters[i].Family,
+			counters[i].Proto,
+			counters[i].Packets,
+			counters[i].Bytes,
+		)
+	}
+
+	err = tw.Flush()
+	return
+}
+
+func init() {
+	statsCmd.Flags().BoolVar(
+		&statsFlags.JSON,
+		"json", false,
+		"print counters in JSON",
+	)
+
+	rootCmd.AddCommand(statsCmd)
+}
@@ -36,6 +36,8 @@ var set = wire.NewSet(
 	provideCGroupEventChan,
 	provideCgrougMontior,
 	provideCgroupRoot,
+	provideControlServer,
+	provideMetrics,
 	provideNFTManager,
 	provideNetlinkConnector,
 	provideRuleManager,
@@ -47,7 +49,9 @@ var lastingConnectorSet = wire.NewSet(
 	provideCGroupEventChan,
 	provideCgrougMontior,
 	provideCgroupRoot,
+	provideControlServer,
 	provideLastringNetlinkConnector,
+	provideMetrics,
 	provideNFTManager,
 	provideRuleManager,
 )
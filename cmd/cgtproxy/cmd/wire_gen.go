@@ -17,7 +17,11 @@ import (
 
 func injectedCGTProxy(configConfig *config.Config, sugaredLogger *zap.SugaredLogger) (interfaces.CGTProxy, error) {
 	cGroupRoot := provideCgroupRoot(configConfig)
-	cGroupMonitor, err := provideCgrougMontior(cGroupRoot, sugaredLogger)
+	metrics, err := provideMetrics(configConfig, sugaredLogger)
+	if err != nil {
+		return nil, err
+	}
+	cGroupMonitor, err := provideCgrougMontior(configConfig, cGroupRoot, sugaredLogger, metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -26,7 +30,7 @@ func injectedCGTProxy(configConfig *config.Config, sugaredLogger *zap.SugaredLog
 		return nil, err
 	}
 	bypass := provideBypass(configConfig)
-	nftManager, err := provideNFTManager(netlinkConnector, cGroupRoot, bypass, sugaredLogger)
+	nftManager, err := provideNFTManager(configConfig, netlinkConnector, cGroupRoot, bypass, sugaredLogger, metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -35,7 +39,11 @@ func injectedCGTProxy(configConfig *config.Config, sugaredLogger *zap.SugaredLog
 	if err != nil {
 		return nil, err
 	}
-	cgtProxy, err := provideCGTProxy(cGroupMonitor, routeManager, sugaredLogger, configConfig)
+	controlServer, err := provideControlServer(routeManager, sugaredLogger)
+	if err != nil {
+		return nil, err
+	}
+	cgtProxy, err := provideCGTProxy(cGroupMonitor, routeManager, sugaredLogger, configConfig, metrics, controlServer)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +52,11 @@ func injectedCGTProxy(configConfig *config.Config, sugaredLogger *zap.SugaredLog
 
 func injectedLastingCGTProxy(configConfig *config.Config, sugaredLogger *zap.SugaredLogger) (interfaces.CGTProxy, error) {
 	cGroupRoot := provideCgroupRoot(configConfig)
-	cGroupMonitor, err := provideCgrougMontior(cGroupRoot, sugaredLogger)
+	metrics, err := provideMetrics(configConfig, sugaredLogger)
+	if err != nil {
+		return nil, err
+	}
+	cGroupMonitor, err := provideCgrougMontior(configConfig, cGroupRoot, sugaredLogger, metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +65,7 @@ func injectedLastingCGTProxy(configConfig *config.Config, sugaredLogger *zap.Sug
 		return nil, err
 	}
 	bypass := provideBypass(configConfig)
-	nftManager, err := provideNFTManager(netlinkConnector, cGroupRoot, bypass, sugaredLogger)
+	nftManager, err := provideNFTManager(configConfig, netlinkConnector, cGroupRoot, bypass, sugaredLogger, metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +74,11 @@ func injectedLastingCGTProxy(configConfig *config.Config, sugaredLogger *zap.Sug
 	if err != nil {
 		return nil, err
 	}
-	cgtProxy, err := provideCGTProxy(cGroupMonitor, routeManager, sugaredLogger, configConfig)
+	controlServer, err := provideControlServer(routeManager, sugaredLogger)
+	if err != nil {
+		return nil, err
+	}
+	cgtProxy, err := provideCGTProxy(cGroupMonitor, routeManager, sugaredLogger, configConfig, metrics, controlServer)
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +93,8 @@ var set = wire.NewSet(
 	provideCGroupEventChan,
 	provideCgrougMontior,
 	provideCgroupRoot,
+	provideControlServer,
+	provideMetrics,
 	provideNFTManager,
 	provideNetlinkConnector,
 	provideRuleManager,
@@ -88,7 +106,9 @@ var lastingConnectorSet = wire.NewSet(
 	provideCGroupEventChan,
 	provideCgrougMontior,
 	provideCgroupRoot,
+	provideControlServer,
 	provideLastringNetlinkConnector,
+	provideMetrics,
 	provideNFTManager,
 	provideRuleManager,
 )
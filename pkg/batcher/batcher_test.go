@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package batcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestBatcher(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Batcher Suite")
+}
+
+// fakeMonitor sends batches given by specs until stopped.
+type fakeMonitor struct {
+	events  chan types.CGroupEvents
+	stopped chan struct{}
+}
+
+func (m *fakeMonitor) Events() <-chan types.CGroupEvents {
+	return m.events
+}
+
+func (m *fakeMonitor) RunCGroupMonitor(ctx context.Context) error {
+	defer close(m.events)
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-m.stopped:
+		return nil
+	}
+}
+
+func newEvent(path string) types.CGroupEvent {
+	return types.CGroupEvent{Path: path, EventType: types.CgroupEventTypeNew}
+}
+
+func deleteEvent(path string) types.CGroupEvent {
+	return types.CGroupEvent{Path: path, EventType: types.CgroupEventTypeDelete}
+}
+
+var _ = Describe("New", func() {
+	It("should fail when no cgroup monitor is provided", func() {
+		_, err := New()
+		Expect(err).To(MatchError(ErrCGroupMonitorMissing))
+	})
+
+	It("should fail on negative max delay", func() {
+		_, err := New(WithMaxDelay(-time.Second))
+		Expect(err).To(MatchError(ErrMaxDelayInvalid))
+	})
+
+	It("should fail on max size not positive", func() {
+		_, err := New(WithMaxSize(0))
+		Expect(err).To(MatchError(ErrMaxSizeInvalid))
+	})
+})
+
+var _ = Describe("Batcher", func() {
+	var (
+		mon  *fakeMonitor
+		send func(events ...types.CGroupEvent)
+		run  func(opts ...Opt) *Batcher
+	)
+
+	BeforeEach(func() {
+		mon = &fakeMonitor{
+			events:  make(chan types.CGroupEvents),
+			stopped: make(chan struct{}),
+		}
+
+		send = func(events ...types.CGroupEvent) {
+			Eventually(mon.events).Should(BeSent(types.CGroupEvents{Events: events}))
+		}
+
+		run = func(opts ...Opt) *Batcher {
+			b, err := New(append([]Opt{WithCGroupMonitor(mon)}, opts...)...)
+			Expect(err).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- b.RunCGroupMonitor(ctx) }()
+			DeferCleanup(func() {
+				cancel()
+				Eventually(done).Should(Receive())
+			})
+
+			return b
+		}
+	})
+
+	Context("waiting long", func() {
+		var b *Batcher
+
+		BeforeEach(func() {
+			b = run(WithMaxDelay(time.Hour), WithMaxSize(3))
+		})
+
+		It("should coalesce batches until the wrapped monitor stops", func() {
+			send()
+			send(newEvent("/a"))
+			send(deleteEvent("/b"))
+			Consistently(b.Events(), "100ms").ShouldNot(Receive())
+
+			close(mon.stopped)
+			Eventually(b.Events()).Should(Receive(Equal(types.CGroupEvents{
+				Events: []types.CGroupEvent{newEvent("/a"), deleteEvent("/b")},
+			})))
+			Eventually(b.Events()).Should(BeClosed())
+		})
+
+		It("should cancel out cgroups removed right after created", func() {
+			send(newEvent("/a"), newEvent("/a/b"))
+			send(deleteEvent("/a/b"), deleteEvent("/a"), newEvent("/c"))
+			send(newEvent("/c"))
+
+			close(mon.stopped)
+			Eventually(b.Events()).Should(Receive(Equal(types.CGroupEvents{
+				Events: []types.CGroupEvent{newEvent("/c")},
+			})))
+			Eventually(b.Events()).Should(BeClosed())
+		})
+
+		It("should send nothing if all events are cancelled out", func() {
+			send(newEvent("/a"))
+			send(deleteEvent("/a"))
+
+			close(mon.stopped)
+			Eventually(b.Events()).Should(BeClosed())
+		})
+
+		It("should send cgroups created again after removed in order", func() {
+			send(deleteEvent("/a"), newEvent("/b"))
+			send(newEvent("/a"))
+			Eventually(b.Events()).Should(Receive(Equal(types.CGroupEvents{
+				Events: []types.CGroupEvent{deleteEvent("/a"), newEvent("/b")},
+			})))
+
+			close(mon.stopped)
+			Eventually(b.Events()).Should(Receive(Equal(types.CGroupEvents{
+				Events: []types.CGroupEvent{newEvent("/a")},
+			})))
+		})
+
+		It("should send full batches without waiting", func() {
+			send(newEvent("/a"), newEvent("/b"), newEvent("/c"), newEvent("/d"))
+			Eventually(b.Events()).Should(Receive(Equal(types.CGroupEvents{
+				Events: []types.CGroupEvent{
+					newEvent("/a"), newEvent("/b"), newEvent("/c"),
+				},
+			})))
+			Consistently(b.Events(), "100ms").ShouldNot(Receive())
+		})
+
+		It("should send the result to all batches coalesced", func() {
+			results := []chan error{make(chan error, 1), make(chan error, 1)}
+			Eventually(mon.events).Should(BeSent(types.CGroupEvents{
+				Events: []types.CGroupEvent{newEvent("/a")},
+				Result: results[0],
+			}))
+			Eventually(mon.events).Should(BeSent(types.CGroupEvents{
+				Events: []types.CGroupEvent{deleteEvent("/b")},
+				Result: results[1],
+			}))
+			close(mon.stopped)
+
+			var batch types.CGroupEvents
+			Eventually(b.Events()).Should(Receive(&batch))
+			Expect(batch.Events).To(Equal([]types.CGroupEvent{
+				newEvent("/a"), deleteEvent("/b"),
+			}))
+
+			errFailed := errors.New("failed")
+			batch.Result <- errFailed
+
+			for i := range results {
+				Eventually(results[i]).Should(Receive(MatchError(errFailed)))
+				Eventually(results[i]).Should(BeClosed())
+			}
+		})
+	})
+
+	It("should send batches after max delay", func() {
+		b := run(WithMaxDelay(50 * time.Millisecond))
+
+		send(newEvent("/a"))
+		send(newEvent("/b"))
+		Eventually(b.Events(), "1s").Should(Receive(Equal(types.CGroupEvents{
+			Events: []types.CGroupEvent{newEvent("/a"), newEvent("/b")},
+		})))
+
+		send(newEvent("/c"))
+		Eventually(b.Events(), "1s").Should(Receive(Equal(types.CGroupEvents{
+			Events: []types.CGroupEvent{newEvent("/c")},
+		})))
+	})
+})
@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package batcher
+
+import "errors"
+
+var (
+	ErrCGroupMonitorMissing = errors.New("cgroup monitor is missing.")
+	ErrMaxDelayInvalid      = errors.New("max delay of batches must not be negative.")
+	ErrMaxSizeInvalid       = errors.New("max size of batches must be positive.")
+	ErrLoggerMissing        = errors.New("logger is missing.")
+)
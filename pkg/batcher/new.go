@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package batcher
+
+import (
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"go.uber.org/zap"
+)
+
+// Batcher is an interfaces.CGroupMonitor wrapping another one,
+// it coalesces batches of events sent by the wrapped monitor
+// in a short time into one,
+// as every batch makes the route manager rebuild the nftable.
+// A create and a delete of the same cgroup in a batch cancel out.
+type Batcher struct {
+	monitor  interfaces.CGroupMonitor
+	maxDelay time.Duration
+	maxSize  int
+	log      *zap.SugaredLogger
+
+	eventsOut chan types.CGroupEvents
+
+	// timer fires when the pending batch has waited for maxDelay.
+	timer *time.Timer
+	// events of the pending batch,
+	// events cancelled out are left with empty paths.
+	events []types.CGroupEvent
+	// index records positions of events in events by paths.
+	index map[string]int
+	// results are channels of batches merged into the pending batch,
+	// to which the result of the pending batch is sent.
+	results []chan<- error
+	// cancelled is the number of events cancelled out in the pending batch.
+	cancelled int
+	// due means the pending batch should be sent without waiting any more.
+	due bool
+
+	// rest are events of the batch received last
+	// which have not been merged into the pending batch.
+	rest []types.CGroupEvent
+	// result is the channel of the batch received last,
+	// which is moved to results once all its events are merged.
+	result chan<- error
+}
+
+type Opt = (func(*Batcher) (*Batcher, error))
+
+func New(opts ...Opt) (ret *Batcher, err error) {
+	defer Wrap(&err, "create cgroup events batcher")
+
+	b := &Batcher{
+		maxDelay: config.DefaultMaxBatchDelay,
+		maxSize:  config.DefaultMaxBatchSize,
+	}
+
+	for i := range opts {
+		b, err = opts[i](b)
+		if err != nil {
+			return
+		}
+	}
+
+	if b.log == nil {
+		b.log = zap.NewNop().Sugar()
+	}
+
+	if b.monitor == nil {
+		err = ErrCGroupMonitorMissing
+		return
+	}
+
+	b.eventsOut = make(chan types.CGroupEvents)
+	b.index = map[string]int{}
+
+	ret = b
+
+	b.log.Debugw("Create a cgroup events batcher.",
+		"max_delay", b.maxDelay,
+		"max_size", b.maxSize,
+	)
+
+	return
+}
+
+func WithCGroupMonitor(mon interfaces.CGroupMonitor) Opt {
+	return func(b *Batcher) (ret *Batcher, err error) {
+		if mon == nil {
+			err = ErrCGroupMonitorMissing
+			return
+		}
+
+		b.monitor = mon
+		ret = b
+		return
+	}
+}
+
+// WithMaxDelay sets how long events wait for others,
+// 0 means batches are sent as soon as the route manager is ready.
+func WithMaxDelay(delay time.Duration) Opt {
+	return func(b *Batcher) (ret *Batcher, err error) {
+		if delay < 0 {
+			err = ErrMaxDelayInvalid
+			return
+		}
+
+		b.maxDelay = delay
+		ret = b
+		return
+	}
+}
+
+// WithMaxSize sets the number of events in a batch at most.
+func WithMaxSize(size int) Opt {
+	return func(b *Batcher) (ret *Batcher, err error) {
+		if size <= 0 {
+			err = ErrMaxSizeInvalid
+			return
+		}
+
+		b.maxSize = size
+		ret = b
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(b *Batcher) (ret *Batcher, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		b.log = log
+		ret = b
+		return
+	}
+}
@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package batcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+)
+
+// forward coalesces and passes on events of the wrapped monitor,
+// until the wrapped monitor stops sending events
+// and all events pending have been sent, or ctx is done.
+//
+// NOTE:
+// No more events are received while a batch is waiting to be sent,
+// so events pile up in the wrapped monitor
+// while the route manager is busy,
+// and are coalesced into the next batch.
+func (b *Batcher) forward(ctx context.Context) {
+	in := b.monitor.Events()
+
+	var ready *types.CGroupEvents
+
+	for {
+		if in == nil && !b.empty() {
+			b.due = true
+		}
+
+		if ready == nil && b.due {
+			ready = b.flush(ctx)
+			b.merge()
+			continue
+		}
+
+		if in == nil && ready == nil && b.empty() {
+			return
+		}
+
+		var recv <-chan types.CGroupEvents
+		if in != nil && ready == nil && len(b.rest) == 0 {
+			recv = in
+		}
+
+		var out chan<- types.CGroupEvents
+		var batch types.CGroupEvents
+		if ready != nil {
+			out = b.eventsOut
+			batch = *ready
+		}
+
+		var timeout <-chan time.Time
+		if !b.due && !b.empty() {
+			timeout = b.timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case events, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+
+			b.rest = events.Events
+			b.result = events.Result
+			b.merge()
+		case <-timeout:
+			b.due = true
+		case out <- batch:
+			b.log.Debugw("Cgroup events sent.",
+				"size", len(batch.Events),
+			)
+			ready = nil
+		}
+	}
+}
+
+// merge moves events received last into the pending batch,
+// until the pending batch is full
+// or an event cannot be merged,
+// which makes the pending batch due.
+// The timer starts when the pending batch gets its first event.
+func (b *Batcher) merge() {
+	if b.empty() && (len(b.rest) != 0 || b.result != nil) {
+		b.timer.Reset(b.maxDelay)
+	}
+
+	for len(b.rest) != 0 {
+		if len(b.index) >= b.maxSize {
+			b.due = true
+			return
+		}
+
+		event := b.rest[0]
+
+		i, ok := b.index[event.Path]
+		if !ok {
+			b.index[event.Path] = len(b.events)
+			b.events = append(b.events, event)
+			b.rest = b.rest[1:]
+			continue
+		}
+
+		switch {
+		case b.events[i].EventType == event.EventType:
+			// The same event again, e.g. a cgroup found twice.
+		case b.events[i].EventType == types.CgroupEventTypeNew:
+			// A cgroup removed right after created.
+			b.events[i].Path = ""
+			delete(b.index, event.Path)
+			b.cancelled += 2
+		default:
+			// NOTE:
+			// A cgroup created again right after removed
+			// must be handled after the removal,
+			// while events in a batch are not handled in order.
+			b.due = true
+			return
+		}
+
+		b.rest = b.rest[1:]
+	}
+
+	if b.result != nil {
+		b.results = append(b.results, b.result)
+		b.result = nil
+	}
+
+	if len(b.index) >= b.maxSize {
+		b.due = true
+	}
+}
+
+// flush returns the pending batch and starts a new one,
+// it returns nil if there is nothing to send.
+// The result of the batch returned is sent to all batches merged into it.
+func (b *Batcher) flush(ctx context.Context) (ret *types.CGroupEvents) {
+	events := make([]types.CGroupEvent, 0, len(b.index))
+	for i := range b.events {
+		if b.events[i].Path == "" {
+			continue
+		}
+
+		events = append(events, b.events[i])
+	}
+
+	results := b.results
+
+	if b.cancelled != 0 {
+		b.log.Debugw("Events of short-lived cgroups cancelled out.",
+			"cancelled", b.cancelled,
+			"size", len(events),
+		)
+	}
+
+	b.timer.Stop()
+	b.events = nil
+	b.index = map[string]int{}
+	b.results = nil
+	b.cancelled = 0
+	b.due = false
+
+	if len(events) == 0 && len(results) == 0 {
+		return
+	}
+
+	batch := types.CGroupEvents{Events: events}
+
+	if len(results) != 0 {
+		result := make(chan error, 1)
+		batch.Result = result
+
+		go func() {
+			var err error
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case err = <-result:
+			}
+
+			for i := range results {
+				results[i] <- err
+				close(results[i])
+			}
+		}()
+	}
+
+	ret = &batch
+	return
+}
+
+// empty tells whether the pending batch has nothing to send.
+func (b *Batcher) empty() bool {
+	return len(b.events) == 0 && len(b.results) == 0
+}
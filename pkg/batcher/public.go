@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package batcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+func (b *Batcher) Events() <-chan types.CGroupEvents {
+	return b.eventsOut
+}
+
+// RunCGroupMonitor runs the wrapped monitor
+// and sends batches of events it sends coalesced until it exits.
+// Events pending are sent once the wrapped monitor stops sending events.
+func (b *Batcher) RunCGroupMonitor(ctx context.Context) (err error) {
+	defer Wrap(&err, "run cgroup events batcher")
+	defer close(b.eventsOut)
+
+	b.timer = time.NewTimer(b.maxDelay)
+	b.timer.Stop()
+	defer b.timer.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.monitor.RunCGroupMonitor(ctx)
+	}()
+
+	b.forward(ctx)
+
+	err = <-done
+	return
+}
@@ -0,0 +1,424 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func TestBPFMan(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "BPFMan Suite")
+}
+
+const needRootMessage = "" +
+	"Skip tests loading bpf programs as they require root. " +
+	"If you really want to run them, run them as root " +
+	"with CGTPROXY_TEST_BPFMAN=1 and " +
+	"CGTPROXY_TEST_CGROUP_ROOT set to a writable cgroupv2 mount point."
+
+var _ = Describe("Action", func() {
+	var m *BPFManager
+
+	BeforeEach(func() {
+		var err error
+		m, err = New(
+			WithCgroupRoot("/sys/fs/cgroup"),
+			WithBypass(config.Bypass{"10.0.0.0/8"}),
+		)
+		Expect(err).To(Succeed())
+
+		Expect(m.AddChainAndRulesForTProxies([]*config.TProxy{{
+			Name:   "clash",
+			Port:   7893,
+			NoUDP:  true,
+			Bypass: config.Bypass{"192.168.0.1"},
+		}})).To(Succeed())
+		Expect(m.AddChainAndRulesForRedirects([]*config.Redirect{{
+			Name:   "redsocks",
+			Port:   12345,
+			NoIPv6: true,
+		}})).To(Succeed())
+	})
+
+	It("should send tcp of tproxy to its port with both bypass", func() {
+		a, err := m.actionOf(types.Target{
+			Op: types.TargetTProxy, Chain: "clash-MARK",
+		})
+		Expect(err).To(Succeed())
+
+		Expect(a.port).To(Equal(uint16(7893)))
+		Expect(a.bypass).To(Equal(config.Bypass{"10.0.0.0/8", "192.168.0.1"}))
+		Expect(m.bypass).To(HaveLen(1))
+	})
+
+	It("should send tcp of redirect to its port with bypass", func() {
+		a, err := m.actionOf(types.Target{
+			Op: types.TargetRedirect, Chain: "redsocks-REDIRECT",
+		})
+		Expect(err).To(Succeed())
+
+		Expect(a.port).To(Equal(uint16(12345)))
+		Expect(a.bypass).To(Equal(config.Bypass{"10.0.0.0/8"}))
+	})
+
+	It("should leave ipv6 untouched if redirect has no ipv6", func() {
+		a, err := m.actionOf(types.Target{
+			Op: types.TargetRedirect, Chain: "redsocks-REDIRECT",
+		})
+		Expect(err).To(Succeed())
+
+		insns := a.instructions(hooks[1], nil, nil)
+		Expect(insns).To(HaveLen(3))
+	})
+
+	It("should refuse targets cannot be done by programs", func() {
+		for _, target := range []types.Target{
+			{Op: types.TargetRoute, Chain: "wg-ROUTE"},
+			{Op: types.TargetMark, Mark: 0x100},
+			{Op: types.TargetDirect, Log: &config.Log{}},
+		} {
+			_, err := m.actionOf(target)
+			Expect(err).To(MatchError(ErrTargetNotSupported))
+		}
+
+		Expect(m.AddChainAndRulesForRoutes([]*config.Route{{Name: "wg"}})).
+			To(MatchError(ErrRoutesNotSupported))
+	})
+
+	It("should fail on unknown tproxies", func() {
+		_, err := m.actionOf(types.Target{
+			Op: types.TargetTProxy, Chain: "unknown-MARK",
+		})
+		Expect(err).To(MatchError(ErrTProxyNotFound))
+	})
+
+	It("should fail on unknown redirects", func() {
+		_, err := m.actionOf(types.Target{
+			Op: types.TargetRedirect, Chain: "unknown-REDIRECT",
+		})
+		Expect(err).To(MatchError(ErrRedirectNotFound))
+	})
+})
+
+var _ = Describe("Programs", Ordered, func() {
+	var (
+		root     string
+		cgroup   string
+		original string
+		m        *BPFManager
+	)
+
+	BeforeAll(func() {
+		if os.Geteuid() != 0 || os.Getenv("CGTPROXY_TEST_BPFMAN") != "1" {
+			Skip(needRootMessage)
+		}
+
+		root = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		cgroup = filepath.Join(root, "cgtproxy-bpfman-test-"+strconv.Itoa(rand.Int()))
+		Expect(os.Mkdir(cgroup, 0755)).To(Succeed())
+		DeferCleanup(os.Remove, cgroup)
+
+		data, err := os.ReadFile("/proc/self/cgroup")
+		Expect(err).To(Succeed())
+		for _, line := range strings.Split(string(data), "\n") {
+			if path, ok := strings.CutPrefix(line, "0::"); ok {
+				original = filepath.Join(root, path)
+			}
+		}
+		Expect(original).ToNot(BeEmpty())
+
+		// Sockets of this process are what programs handle,
+		// so this process is moved into the cgroup for tests.
+		Expect(moveTo(cgroup)).To(Succeed())
+		DeferCleanup(moveTo, original)
+	})
+
+	BeforeEach(func() {
+		var err error
+		m, err = New(WithCgroupRoot(config.CGroupRoot(root)))
+		Expect(err).To(Succeed())
+
+		Expect(m.InitStructure()).To(Succeed())
+
+		DeferCleanup(func() {
+			Expect(m.Clear()).To(Succeed())
+			Expect(m.Release()).To(Succeed())
+		})
+	})
+
+	It("should send tcp of redirect cgroups to the redirect", func() {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		Expect(err).To(Succeed())
+		defer l.Close()
+
+		port := uint16(l.Addr().(*net.TCPAddr).Port)
+		Expect(m.AddChainAndRulesForRedirects([]*config.Redirect{{
+			Name: "test", Port: port,
+		}})).To(Succeed())
+
+		Expect(m.AddRoutes([]types.Route{{
+			Path:   cgroup,
+			Target: types.Target{Op: types.TargetRedirect, Chain: "test-REDIRECT"},
+		}})).To(Succeed())
+
+		Expect(m.HasCGroup(cgroup)).To(BeTrue())
+
+		conn, err := net.DialTimeout("tcp4", "192.0.2.1:80", time.Second)
+		Expect(err).To(Succeed())
+		defer conn.Close()
+
+		Expect(conn.RemoteAddr().String()).To(Equal(l.Addr().String()))
+
+		accepted, err := l.Accept()
+		Expect(err).To(Succeed())
+		defer accepted.Close()
+
+		Expect(originalDst(accepted, unix.SOL_IP)).To(Equal("192.0.2.1:80"))
+
+		_, err = originalDst(accepted, unix.SOL_IPV6)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should send tcp of tproxy cgroups to the tproxy", func() {
+		l, err := net.Listen("tcp", ":0")
+		Expect(err).To(Succeed())
+		defer l.Close()
+
+		ip := "127.0.0.53"
+		ip6 := "::1"
+		Expect(m.AddChainAndRulesForTProxies([]*config.TProxy{{
+			Name:  "test",
+			Port:  uint16(l.Addr().(*net.TCPAddr).Port),
+			NoUDP: true,
+			DNSHijack: &config.DNSHijack{
+				IP: &ip, IP6: &ip6, Port: 53,
+			},
+		}})).To(Succeed())
+
+		Expect(m.AddRoutes([]types.Route{{
+			Path:   cgroup,
+			Target: types.Target{Op: types.TargetTProxy, Chain: "test-MARK"},
+		}})).To(Succeed())
+
+		// Clients of ipv4 are seen by the dual stack server
+		// with ipv4-mapped addresses.
+		conn, err := net.DialTimeout("tcp4", "192.0.2.1:443", time.Second)
+		Expect(err).To(Succeed())
+		defer conn.Close()
+
+		accepted, err := l.Accept()
+		Expect(err).To(Succeed())
+		defer accepted.Close()
+
+		Expect(originalDst(accepted, unix.SOL_IP)).To(Equal("192.0.2.1:443"))
+
+		conn6, err := net.DialTimeout("tcp6", "[2001:db8::1]:443", time.Second)
+		if err != nil {
+			Skip("ipv6 loopback is not available: " + err.Error())
+		}
+		defer conn6.Close()
+
+		accepted6, err := l.Accept()
+		Expect(err).To(Succeed())
+		defer accepted6.Close()
+
+		Expect(originalDst(accepted6, unix.SOL_IPV6)).To(Equal("[2001:db8::1]:443"))
+	})
+
+	It("should leave bypassed destinations untouched", func() {
+		redirect, err := net.Listen("tcp4", "127.0.0.1:0")
+		Expect(err).To(Succeed())
+		defer redirect.Close()
+
+		other, err := net.Listen("tcp4", "127.0.0.2:0")
+		Expect(err).To(Succeed())
+		defer other.Close()
+
+		m.bypass = config.Bypass{"127.0.0.2", "fd00::/8"}
+
+		ip := "127.0.0.53"
+		Expect(m.AddChainAndRulesForRedirects([]*config.Redirect{{
+			Name: "test",
+			Port: uint16(redirect.Addr().(*net.TCPAddr).Port),
+		}})).To(Succeed())
+
+		Expect(m.AddRoutes([]types.Route{{
+			Path: cgroup,
+			Target: types.Target{
+				Op:    types.TargetRedirect,
+				Chain: "test-REDIRECT",
+				DNS:   &config.DNSHijack{IP: &ip, Port: 5353, DropDoT: true},
+			},
+		}})).To(Succeed())
+
+		conn, err := net.DialTimeout("tcp4", other.Addr().String(), time.Second)
+		Expect(err).To(Succeed())
+		Expect(conn.RemoteAddr().String()).To(Equal(other.Addr().String()))
+		conn.Close()
+
+		port := strconv.Itoa(other.Addr().(*net.TCPAddr).Port)
+		conn, err = net.DialTimeout("tcp4", "127.0.0.3:"+port, time.Second)
+		Expect(err).To(Succeed())
+		Expect(conn.RemoteAddr().String()).To(Equal(redirect.Addr().String()))
+		conn.Close()
+
+		_, err = net.DialTimeout("tcp4", "192.0.2.1:853", time.Second)
+		Expect(errors.Is(err, syscall.EPERM)).To(BeTrue())
+	})
+
+	It("should restore the source of dns replies", func() {
+		server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		Expect(err).To(Succeed())
+		defer server.Close()
+
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, addr, err := server.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				_, _ = server.WriteTo(buf[:n], addr)
+			}
+		}()
+
+		ip := "127.0.0.1"
+		Expect(m.AddRoutes([]types.Route{{
+			Path: cgroup,
+			Target: types.Target{
+				Op: types.TargetDirect,
+				DNS: &config.DNSHijack{
+					IP:   &ip,
+					Port: uint16(server.LocalAddr().(*net.UDPAddr).Port),
+				},
+			},
+		}})).To(Succeed())
+
+		dns := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+
+		conn, err := net.ListenUDP("udp4", nil)
+		Expect(err).To(Succeed())
+		defer conn.Close()
+
+		_, err = conn.WriteTo([]byte("request"), dns)
+		Expect(err).To(Succeed())
+
+		Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		Expect(err).To(Succeed())
+		Expect(string(buf[:n])).To(Equal("request"))
+		Expect(addr.String()).To(Equal(dns.String()))
+
+		connected, err := net.DialUDP("udp4", nil, dns)
+		Expect(err).To(Succeed())
+		defer connected.Close()
+
+		_, err = connected.Write([]byte("connected"))
+		Expect(err).To(Succeed())
+
+		Expect(connected.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+		n, addr, err = connected.ReadFrom(buf)
+		Expect(err).To(Succeed())
+		Expect(string(buf[:n])).To(Equal("connected"))
+		Expect(addr.String()).To(Equal(dns.String()))
+	})
+
+	It("should refuse sockets of reject cgroups", func() {
+		Expect(m.AddRoutes([]types.Route{{
+			Path:   cgroup,
+			Target: types.Target{Op: types.TargetReject},
+		}})).To(Succeed())
+
+		_, err := net.DialTimeout("tcp4", "192.0.2.1:80", time.Second)
+		Expect(errors.Is(err, syscall.EPERM)).To(BeTrue())
+
+		Expect(m.RemoveRoutes([]string{cgroup})).To(Succeed())
+		Expect(m.HasCGroup(cgroup)).To(BeFalse())
+	})
+
+	It("should find programs left by a previous manager", func() {
+		left, err := New(WithCgroupRoot(config.CGroupRoot(root)))
+		Expect(err).To(Succeed())
+		Expect(left.InitStructure()).To(Succeed())
+
+		Expect(left.AddRoutes([]types.Route{{
+			Path:   cgroup,
+			Target: types.Target{Op: types.TargetDrop},
+		}})).To(Succeed())
+		Expect(left.Release()).To(Succeed())
+
+		Expect(m.RemoveLeftover()).To(BeTrue())
+		Expect(m.HasCGroup(cgroup)).To(BeFalse())
+		Expect(m.RemoveLeftover()).To(BeFalse())
+	})
+})
+
+// originalDst asks SO_ORIGINAL_DST of conn at level,
+// like a proxy server does.
+func originalDst(conn net.Conn, level int) (ret string, err error) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, unix.SizeofSockaddrInet6)
+	size := uint32(len(buf))
+
+	cerr := raw.Control(func(fd uintptr) {
+		_, _, errno := unix.Syscall6(
+			unix.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0,
+		)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	port := int(binary.BigEndian.Uint16(buf[2:]))
+	switch binary.NativeEndian.Uint16(buf) {
+	case unix.AF_INET:
+		ret = (&net.TCPAddr{IP: net.IP(buf[4:8]), Port: port}).String()
+	case unix.AF_INET6:
+		ret = (&net.TCPAddr{IP: net.IP(buf[8:24]), Port: port}).String()
+	default:
+		err = syscall.EAFNOSUPPORT
+	}
+
+	return
+}
+
+func moveTo(cgroup string) error {
+	return os.WriteFile(
+		filepath.Join(cgroup, "cgroup.procs"),
+		[]byte(strconv.Itoa(os.Getpid())),
+		0,
+	)
+}
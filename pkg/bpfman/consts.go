@@ -0,0 +1,10 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+// ProgramNamePrefix is the prefix of names of bpf programs
+// loaded by cgtproxy,
+// which is how programs left by a previous cgtproxy are found.
+const ProgramNamePrefix = "cgtproxy_"
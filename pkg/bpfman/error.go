@@ -0,0 +1,17 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+import "errors"
+
+var (
+	ErrLoggerMissing      = errors.New("logger is missing.")
+	ErrCGroupRootMissing  = errors.New("cgroupv2 file system mount point is missing.")
+	ErrMetricsMissing     = errors.New("metrics is missing.")
+	ErrTargetNotSupported = errors.New("target is not supported by bpf backend.")
+	ErrTProxyNotFound     = errors.New("tproxy of target is not known.")
+	ErrRedirectNotFound   = errors.New("redirect of target is not known.")
+	ErrRoutesNotSupported = errors.New("routes are not supported by bpf backend.")
+)
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/cilium/ebpf"
+	"go.uber.org/zap"
+)
+
+// BPFManager is the other implementation of interfaces.NFTManager,
+// which attaches cgroup sock_addr bpf programs to cgroups
+// instead of maintaining a nftable.
+// Programs decide what to do with a socket when it connects
+// or sends a datagram without connecting:
+// they rewrite the destination to a tproxy, a redirect or a dns server,
+// refuse it, or leave it untouched.
+// Sources of replies to rewritten udp sockets are set back
+// to the original destinations when they are received,
+// and servers receiving rewritten tcp sockets
+// get the original destinations by SO_ORIGINAL_DST.
+type BPFManager struct {
+	cgroupRoot config.CGroupRoot
+	bypass     config.Bypass
+	log        *zap.SugaredLogger
+
+	metrics interfaces.Metrics
+
+	tproxies  map[string]*config.TProxy
+	redirects map[string]*config.Redirect
+
+	// programs records programs loaded for targets,
+	// keyed by what they do.
+	programs map[string]*programs
+	// cgroups records the key of programs attached to cgroups,
+	// keyed by paths of cgroups.
+	cgroups map[string]string
+	// origins is where programs remember original destinations
+	// of sockets they rewrite.
+	// It is shared by all programs and kept across reloads,
+	// so that replies to sockets created before are still restored.
+	origins *ebpf.Map
+	// root is programs reading origins attached to the cgroup root,
+	// it is loaded along with origins.
+	root *rootPrograms
+}
+
+type Opt = (func(*BPFManager) (*BPFManager, error))
+
+func New(opts ...Opt) (ret *BPFManager, err error) {
+	defer Wrap(&err, "create bpf manager")
+
+	m := &BPFManager{}
+
+	for i := range opts {
+		m, err = opts[i](m)
+		if err != nil {
+			m = nil
+			return
+		}
+	}
+
+	if m.log == nil {
+		m.log = zap.NewNop().Sugar()
+	}
+
+	if m.metrics == nil {
+		var mt *metrics.Metrics
+		mt, err = metrics.New(metrics.WithLogger(m.log))
+		if err != nil {
+			return
+		}
+
+		m.metrics = mt
+	}
+
+	m.tproxies = map[string]*config.TProxy{}
+	m.redirects = map[string]*config.Redirect{}
+	m.programs = map[string]*programs{}
+	m.cgroups = map[string]string{}
+
+	ret = m
+	m.log.Debugw("BPFManager created.")
+
+	return
+}
+
+func WithCgroupRoot(root config.CGroupRoot) Opt {
+	return func(m *BPFManager) (ret *BPFManager, err error) {
+		if root == "" {
+			err = ErrCGroupRootMissing
+			return
+		}
+
+		m.cgroupRoot = root
+		return m, nil
+	}
+}
+
+func WithBypass(bypass config.Bypass) Opt {
+	return func(m *BPFManager) (ret *BPFManager, err error) {
+		m.bypass = bypass
+		return m, nil
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(m *BPFManager) (ret *BPFManager, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		m.log = log
+		return m, nil
+	}
+}
+
+func WithMetrics(mt interfaces.Metrics) Opt {
+	return func(m *BPFManager) (ret *BPFManager, err error) {
+		if mt == nil {
+			err = ErrMetricsMissing
+			return
+		}
+
+		m.metrics = mt
+		return m, nil
+	}
+}
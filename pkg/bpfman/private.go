@@ -0,0 +1,452 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// actionOf tells what programs of target should do.
+func (m *BPFManager) actionOf(target types.Target) (ret *action, err error) {
+	defer Wrap(&err, "generate action of target %s", target.Op)
+
+	if target.Log != nil {
+		err = ErrTargetNotSupported
+		return
+	}
+
+	a := &action{dns: target.DNS}
+
+	switch target.Op {
+	case types.TargetDirect:
+
+	case types.TargetDrop, types.TargetReject:
+		a.deny = true
+
+	case types.TargetTProxy:
+		tp, ok := m.tproxies[strings.TrimSuffix(target.Chain, "-MARK")]
+		if !ok {
+			err = ErrTProxyNotFound
+			return
+		}
+
+		a.port = tp.Port
+		a.noIPv6 = tp.NoIPv6
+		a.bypass = append(slices.Clone(m.bypass), tp.Bypass...)
+		a.hijack = tp.DNSHijack
+
+	case types.TargetRedirect:
+		redirect, ok := m.redirects[strings.TrimSuffix(target.Chain, "-REDIRECT")]
+		if !ok {
+			err = ErrRedirectNotFound
+			return
+		}
+
+		a.port = redirect.Port
+		a.noIPv6 = redirect.NoIPv6
+		a.bypass = m.bypass
+
+	default:
+		err = ErrTargetNotSupported
+		return
+	}
+
+	ret = a
+	return
+}
+
+// programsOf returns programs of target and the key of them,
+// programs are loaded if no cgroup with the same target has them.
+func (m *BPFManager) programsOf(target types.Target) (key string, ret *programs, err error) {
+	var data []byte
+	data, err = json.Marshal(target)
+	if err != nil {
+		return
+	}
+
+	key = string(data)
+
+	if p, ok := m.programs[key]; ok {
+		ret = p
+		return
+	}
+
+	var a *action
+	a, err = m.actionOf(target)
+	if err != nil {
+		return
+	}
+
+	if m.origins == nil {
+		err = m.loadOrigins()
+		if err != nil {
+			return
+		}
+	}
+
+	ret, err = a.load(m.origins)
+	if err != nil {
+		return
+	}
+
+	m.log.Debugw("BPF programs loaded for target.",
+		"target", key,
+	)
+
+	m.programs[key] = ret
+	return
+}
+
+// loadOrigins creates the origins map
+// and attaches programs reading it to the cgroup root.
+func (m *BPFManager) loadOrigins() (err error) {
+	var origins *ebpf.Map
+	origins, err = newOriginsMap()
+	if err != nil {
+		return
+	}
+
+	var root *rootPrograms
+	root, err = loadRoot(origins)
+	if err != nil {
+		origins.Close()
+		return
+	}
+
+	err = attachRoot(string(m.cgroupRoot), root)
+	if err != nil {
+		root.close()
+		origins.Close()
+		return
+	}
+
+	m.origins = origins
+	m.root = root
+	return
+}
+
+// closeOrigins detaches programs reading the origins map
+// from the cgroup root if detach is true,
+// and closes them and the map.
+func (m *BPFManager) closeOrigins(detach bool) (err error) {
+	if m.root != nil {
+		if detach {
+			err = detachRoot(string(m.cgroupRoot), m.root)
+		}
+
+		m.root.close()
+		m.root = nil
+	}
+
+	if m.origins != nil {
+		m.origins.Close()
+		m.origins = nil
+	}
+
+	return
+}
+
+// restore attaches programs of keys in old to cgroups again,
+// cgroups with empty key get programs detached.
+func (m *BPFManager) restore(old map[string]string) {
+	for path, key := range old {
+		var err error
+		if key == "" {
+			err = detach(path, m.programs[m.cgroups[path]])
+			delete(m.cgroups, path)
+		} else {
+			err = attach(path, m.programs[key])
+			m.cgroups[path] = key
+		}
+
+		if err == nil {
+			continue
+		}
+
+		m.log.Errorw("Failed to restore bpf programs of cgroup.",
+			"cgroup", path,
+			"error", err,
+		)
+	}
+}
+
+// gc closes programs not attached to any cgroup.
+func (m *BPFManager) gc() {
+	used := map[string]struct{}{}
+	for _, key := range m.cgroups {
+		used[key] = struct{}{}
+	}
+
+	for key, p := range m.programs {
+		if _, ok := used[key]; ok {
+			continue
+		}
+
+		p.close()
+		delete(m.programs, key)
+	}
+}
+
+func (m *BPFManager) closePrograms() {
+	for _, p := range m.programs {
+		p.close()
+	}
+
+	m.programs = map[string]*programs{}
+}
+
+// observeApply records an attempt to change programs of cgroups
+// started at start, and the number of cgroups with programs if succeeded.
+func (m *BPFManager) observeApply(op string, start time.Time, err *error) {
+	m.metrics.ObserveApply(op, time.Since(start), *err)
+
+	if *err != nil {
+		return
+	}
+
+	m.metrics.SetCGroups(len(m.cgroups))
+}
+
+// attach attaches programs to the cgroup at path for all hooks.
+//
+// NOTE:
+// Programs are attached with BPF_F_ALLOW_OVERRIDE,
+// so that programs of a cgroup replace those inherited from its parents,
+// which makes a cgroup handled by the target of the deepest cgroup routed,
+// the same as lookups of cgroups level by level in the nft backend.
+// Attaching again replaces programs attached before.
+func attach(path string, p *programs) (err error) {
+	defer Wrap(&err, "attach bpf programs to cgroup %s", path)
+
+	var dir *os.File
+	dir, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	for i, h := range hooks {
+		err = link.RawAttachProgram(link.RawAttachProgramOptions{
+			Target:  int(dir.Fd()),
+			Program: p.progs[i],
+			Attach:  h.attach,
+			Flags:   unix.BPF_F_ALLOW_OVERRIDE,
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// detach detaches programs from the cgroup at path for all hooks,
+// it does nothing if the cgroup has been removed.
+func detach(path string, p *programs) (err error) {
+	defer Wrap(&err, "detach bpf programs from cgroup %s", path)
+
+	var dir *os.File
+	dir, err = os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	errs := []error{}
+	for i, h := range hooks {
+		err = link.RawDetachProgram(link.RawDetachProgramOptions{
+			Target:  int(dir.Fd()),
+			Program: p.progs[i],
+			Attach:  h.attach,
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		errs = append(errs, err)
+	}
+
+	err = errors.Join(errs...)
+	return
+}
+
+// attachRoot attaches programs to the cgroup root at path
+// for all root hooks.
+//
+// NOTE:
+// Programs are attached with BPF_F_ALLOW_MULTI,
+// so that they run along with programs attached to cgroups below,
+// and programs attached to the cgroup root by others are kept.
+func attachRoot(path string, p *rootPrograms) (err error) {
+	defer Wrap(&err, "attach bpf programs to cgroup root %s", path)
+
+	var dir *os.File
+	dir, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	for i, h := range rootHooks {
+		err = link.RawAttachProgram(link.RawAttachProgramOptions{
+			Target:  int(dir.Fd()),
+			Program: p.progs[i],
+			Attach:  h.attach,
+			Flags:   unix.BPF_F_ALLOW_MULTI,
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		return
+	}
+
+	_ = detachRoot(path, p)
+	return
+}
+
+// detachRoot detaches programs from the cgroup root at path
+// for all root hooks.
+func detachRoot(path string, p *rootPrograms) (err error) {
+	defer Wrap(&err, "detach bpf programs from cgroup root %s", path)
+
+	var dir *os.File
+	dir, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	errs := []error{}
+	for i, h := range rootHooks {
+		err = link.RawDetachProgram(link.RawDetachProgramOptions{
+			Target:  int(dir.Fd()),
+			Program: p.progs[i],
+			Attach:  h.attach,
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		errs = append(errs, err)
+	}
+
+	err = errors.Join(errs...)
+	return
+}
+
+// attachedPrograms returns programs of cgtproxy
+// attached to the cgroup at path for h.
+func attachedPrograms(path string, h hook) (ret []*ebpf.Program, err error) {
+	defer Wrap(&err, "query bpf programs of cgroup %s", path)
+
+	var dir *os.File
+	dir, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	var result *link.QueryResult
+	result, err = link.QueryPrograms(link.QueryOptions{
+		Target: int(dir.Fd()),
+		Attach: h.attach,
+	})
+	if err != nil {
+		return
+	}
+
+	progs := []*ebpf.Program{}
+	for i := range result.Programs {
+		var prog *ebpf.Program
+		prog, err = ebpf.NewProgramFromID(result.Programs[i].ID)
+		if errors.Is(err, os.ErrNotExist) {
+			// Detached since queried.
+			continue
+		}
+		if err != nil {
+			break
+		}
+
+		var info *ebpf.ProgramInfo
+		info, err = prog.Info()
+		if err != nil {
+			prog.Close()
+			break
+		}
+
+		if !strings.HasPrefix(info.Name, ProgramNamePrefix) {
+			prog.Close()
+			continue
+		}
+
+		progs = append(progs, prog)
+	}
+
+	if err != nil {
+		for i := range progs {
+			progs[i].Close()
+		}
+		return
+	}
+
+	ret = progs
+	return
+}
+
+// detachLeftover detaches programs of cgtproxy
+// from the cgroup at path for all hooks and root hooks.
+// It reports whether there was any such program.
+func detachLeftover(path string) (ret bool, err error) {
+	defer Wrap(&err, "detach leftover bpf programs from cgroup %s", path)
+
+	var dir *os.File
+	dir, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	for _, h := range append(hooks[:], rootHooks[:]...) {
+		var progs []*ebpf.Program
+		progs, err = attachedPrograms(path, h)
+		if err != nil {
+			return
+		}
+
+		for _, prog := range progs {
+			err = link.RawDetachProgram(link.RawDetachProgramOptions{
+				Target:  int(dir.Fd()),
+				Program: prog,
+				Attach:  h.attach,
+			})
+			prog.Close()
+			if err != nil {
+				return
+			}
+
+			ret = true
+		}
+	}
+
+	return
+}
@@ -0,0 +1,987 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// Offsets of fields in struct bpf_sock_addr.
+const (
+	offUserIP4  = 4
+	offUserIP6  = 8
+	offUserPort = 24
+	offType     = 32
+)
+
+// Offsets of fields in struct bpf_sock_ops.
+const (
+	offOpsOp        = 0
+	offOpsFamily    = 20
+	offOpsLocalIP4  = 28
+	offOpsLocalIP6  = 48
+	offOpsLocalPort = 68
+)
+
+// Offsets of fields in struct bpf_sockopt.
+const (
+	offOptSK     = 0
+	offOptVal    = 8
+	offOptValEnd = 16
+	offOptLevel  = 24
+	offOptName   = 28
+	offOptLen    = 32
+	offOptRetval = 36
+)
+
+// Offsets of fields in struct bpf_sock.
+const (
+	offSockFamily  = 4
+	offSockDstPort = 48
+	offSockDstIP4  = 52
+	offSockDstIP6  = 56
+)
+
+// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+// of netfilter, which are the same.
+const soOriginalDst = 80
+
+// Layout of the key and the value of the origins map on stack.
+// The key is struct { u64 cookie; u32 ip[4]; u32 port; u32 pad; },
+// the value is struct { u32 ip[4]; u32 port; }.
+// Ipv4 addresses use the first word of ip, others are zero.
+//
+// There are three kinds of entries:
+//   - { cookie, addr, port } of an udp socket rewritten to addr and port,
+//     see restoreInstructions;
+//   - { cookie, 0, 0 } of a tcp socket rewritten to a port,
+//     which lasts until the socket connects, see sockOpsInstructions;
+//   - { 0, addr, port } of the local address of that tcp socket,
+//     see getsockoptInstructions.
+const (
+	originKeySize   = 32
+	originValueSize = 20
+	originKeyOff    = -originKeySize
+	originValueOff  = originKeyOff - 24
+
+	originsMaxEntries = 1 << 16
+)
+
+type hook struct {
+	name   string
+	attach ebpf.AttachType
+	ipv6   bool
+}
+
+// hooks are where programs are attached in a cgroup.
+// connect(2) of both tcp and udp sockets goes through connect hooks,
+// sendmsg(2) of udp sockets not connected goes through sendmsg hooks,
+// recvmsg(2) of udp sockets goes through recvmsg hooks.
+var hooks = [...]hook{
+	{ProgramNamePrefix + "c4", ebpf.AttachCGroupInet4Connect, false},
+	{ProgramNamePrefix + "c6", ebpf.AttachCGroupInet6Connect, true},
+	{ProgramNamePrefix + "s4", ebpf.AttachCGroupUDP4Sendmsg, false},
+	{ProgramNamePrefix + "s6", ebpf.AttachCGroupUDP6Sendmsg, true},
+	{ProgramNamePrefix + "r4", ebpf.AttachCGroupUDP4Recvmsg, false},
+	{ProgramNamePrefix + "r6", ebpf.AttachCGroupUDP6Recvmsg, true},
+}
+
+// rootHooks are where programs shared by all cgroups are attached
+// in the cgroup root, with BPF_F_ALLOW_MULTI,
+// so that they run for sockets of every cgroup,
+// including those of servers receiving connections sent to their ports.
+var rootHooks = [...]hook{
+	{ProgramNamePrefix + "so", ebpf.AttachCGroupSockOps, false},
+	{ProgramNamePrefix + "go", ebpf.AttachCGroupGetsockopt, false},
+}
+
+func (h hook) programType() ebpf.ProgramType {
+	switch h.attach {
+	case ebpf.AttachCGroupSockOps:
+		return ebpf.SockOps
+	case ebpf.AttachCGroupGetsockopt:
+		return ebpf.CGroupSockopt
+	default:
+		return ebpf.CGroupSockAddr
+	}
+}
+
+func (h hook) connect() bool {
+	return h.attach == ebpf.AttachCGroupInet4Connect ||
+		h.attach == ebpf.AttachCGroupInet6Connect
+}
+
+func (h hook) recvmsg() bool {
+	return h.attach == ebpf.AttachCGroupUDP4Recvmsg ||
+		h.attach == ebpf.AttachCGroupUDP6Recvmsg
+}
+
+// action describes what programs of a target do with a socket.
+type action struct {
+	// deny means that connecting or sending is refused with EPERM.
+	deny bool
+	// dns is where dns requests are sent to before anything else.
+	dns *config.DNSHijack
+
+	// port is the port on loopback address tcp sockets are sent to,
+	// 0 means sockets are left untouched.
+	// Only tcp sockets are sent to port,
+	// as the server learns their original destinations by SO_ORIGINAL_DST,
+	// which is not available to datagrams.
+	port uint16
+	// noIPv6 means that ipv6 sockets are not sent to port.
+	noIPv6 bool
+	// bypass are destinations not sent to port.
+	bypass config.Bypass
+	// hijack is where dns requests to be sent to port
+	// are sent to instead.
+	hijack *config.DNSHijack
+}
+
+// programs are programs loaded for an action,
+// one for each hook.
+type programs struct {
+	progs [len(hooks)]*ebpf.Program
+	maps  []*ebpf.Map
+}
+
+func (p *programs) close() {
+	for i := range p.progs {
+		if p.progs[i] == nil {
+			continue
+		}
+
+		p.progs[i].Close()
+	}
+
+	for i := range p.maps {
+		p.maps[i].Close()
+	}
+}
+
+// rootPrograms are programs attached to the cgroup root,
+// one for each root hook.
+type rootPrograms struct {
+	progs [len(rootHooks)]*ebpf.Program
+}
+
+func (p *rootPrograms) close() {
+	for i := range p.progs {
+		if p.progs[i] == nil {
+			continue
+		}
+
+		p.progs[i].Close()
+	}
+}
+
+// load loads programs of a,
+// which record original destinations of sockets they rewrite
+// in origins.
+func (a *action) load(origins *ebpf.Map) (ret *programs, err error) {
+	defer Wrap(&err, "load bpf programs")
+
+	p := &programs{}
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		p.close()
+	}()
+
+	var bypass4, bypass6 *ebpf.Map
+	bypass4, bypass6, err = a.loadBypassMaps()
+	if err != nil {
+		return
+	}
+
+	for _, m := range []*ebpf.Map{bypass4, bypass6} {
+		if m != nil {
+			p.maps = append(p.maps, m)
+		}
+	}
+
+	for i, h := range hooks {
+		bypass := bypass4
+		if h.ipv6 {
+			bypass = bypass6
+		}
+
+		p.progs[i], err = ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         h.name,
+			Type:         h.programType(),
+			AttachType:   h.attach,
+			Instructions: a.instructions(h, bypass, origins),
+			License:      "GPL",
+		})
+		if err != nil {
+			var verr *ebpf.VerifierError
+			if errors.As(err, &verr) {
+				Wrap(&err, "%+v", verr)
+			}
+			return
+		}
+	}
+
+	ret = p
+	return
+}
+
+// loadBypassMaps creates lpm tries of destinations in bypass,
+// a trie is nil if there is no destination of its family.
+func (a *action) loadBypassMaps() (ipv4, ipv6 *ebpf.Map, err error) {
+	defer Wrap(&err, "load bypass maps")
+
+	keys4 := [][]byte{}
+	keys6 := [][]byte{}
+
+	for i := range a.bypass {
+		var ipnet *net.IPNet
+		ipnet, err = parseBypass(a.bypass[i])
+		if err != nil {
+			return
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		key := binary.NativeEndian.AppendUint32(nil, uint32(ones))
+
+		if ip := ipnet.IP.To4(); ip != nil {
+			keys4 = append(keys4, append(key, ip...))
+		} else {
+			keys6 = append(keys6, append(key, ipnet.IP.To16()...))
+		}
+	}
+
+	ipv4, err = newBypassMap(ProgramNamePrefix+"b4", net.IPv4len, keys4)
+	if err != nil {
+		return
+	}
+
+	ipv6, err = newBypassMap(ProgramNamePrefix+"b6", net.IPv6len, keys6)
+	if err != nil {
+		if ipv4 != nil {
+			ipv4.Close()
+			ipv4 = nil
+		}
+		return
+	}
+
+	return
+}
+
+func parseBypass(bypass string) (ret *net.IPNet, err error) {
+	ip := net.ParseIP(bypass)
+	if ip == nil {
+		_, ret, err = net.ParseCIDR(bypass)
+		return
+	}
+
+	bits := net.IPv6len * 8
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = net.IPv4len * 8
+	}
+
+	ret = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	return
+}
+
+func newBypassMap(name string, size int, keys [][]byte) (ret *ebpf.Map, err error) {
+	if len(keys) == 0 {
+		return
+	}
+
+	var m *ebpf.Map
+	m, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       name,
+		Type:       ebpf.LPMTrie,
+		KeySize:    uint32(4 + size),
+		ValueSize:  1,
+		MaxEntries: uint32(len(keys)),
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+	if err != nil {
+		return
+	}
+
+	for i := range keys {
+		err = m.Put(keys[i], []byte{1})
+		if err != nil {
+			m.Close()
+			return
+		}
+	}
+
+	ret = m
+	return
+}
+
+// instructions generates the program of a for h,
+// which looks like:
+//
+//	if dns request { remember if udp; send to dns server; return 1 }
+//	if dns over tls { return 0 }
+//	if ipv6 and noIPv6 { return 1 }
+//	if destination in bypass { return 1 }
+//	if dns request { remember if udp; send to dns server of hijack; return 1 }
+//	if udp { return 1 }
+//	remember if tcp; send to port on loopback address; return 1
+//
+// Return value 1 lets the socket go on, 0 makes it fail with EPERM.
+// Programs of recvmsg hooks are the same for all actions,
+// see restoreInstructions.
+func (a *action) instructions(h hook, bypass, origins *ebpf.Map) asm.Instructions {
+	const (
+		allow = "allow"
+		deny  = "deny"
+	)
+
+	if h.recvmsg() {
+		return restoreInstructions(h, origins)
+	}
+
+	if a.deny {
+		return asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		}
+	}
+
+	insns := asm.Instructions{
+		// r6 = ctx
+		asm.Mov.Reg(asm.R6, asm.R1),
+	}
+
+	// NOTE:
+	// The verifier refuses unreachable instructions,
+	// so the exit refusing the socket is only added if jumped to.
+	denied := false
+
+	if a.dns != nil {
+		insns = append(insns, dnsInstructions(h, a.dns, origins, "rule_dns", allow)...)
+
+		if a.dns.DropDoT {
+			insns = append(insns,
+				// r2 = ctx->user_port
+				asm.LoadMem(asm.R2, asm.R6, offUserPort, asm.Word),
+				asm.JNE.Imm(asm.R2, int32(nport(853)), "dot"),
+				// r2 = ctx->type
+				asm.LoadMem(asm.R2, asm.R6, offType, asm.Word),
+				asm.JEq.Imm(asm.R2, unix.SOCK_STREAM, deny),
+				landing("dot"),
+			)
+			denied = true
+		}
+	}
+
+	if a.port != 0 && !(h.ipv6 && a.noIPv6) {
+		if bypass != nil {
+			insns = append(insns, bypassInstructions(h, bypass, allow)...)
+		}
+
+		if a.hijack != nil {
+			insns = append(insns, dnsInstructions(h, a.hijack, origins, "hijack_dns", allow)...)
+		}
+
+		insns = append(insns,
+			// r2 = ctx->type
+			asm.LoadMem(asm.R2, asm.R6, offType, asm.Word),
+			asm.JNE.Imm(asm.R2, unix.SOCK_STREAM, allow),
+		)
+
+		loopback := net.IPv4(127, 0, 0, 1)
+		zero := net.IPv4zero
+		if h.ipv6 {
+			loopback = net.IPv6loopback
+			zero = net.IPv6zero
+		}
+
+		if origins != nil && h.connect() {
+			// See originalDstInstructions.
+			insns = append(insns, rememberInstructions(h, origins, zero, 0)...)
+		}
+
+		insns = append(insns, rewriteInstructions(h, loopback, a.port)...)
+	}
+
+	insns = append(insns,
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(allow),
+		asm.Return(),
+	)
+
+	if denied {
+		insns = append(insns,
+			asm.Mov.Imm(asm.R0, 0).WithSymbol(deny),
+			asm.Return(),
+		)
+	}
+
+	return insns
+}
+
+// landing is an instruction doing nothing
+// but marking where to jump to with sym.
+func landing(sym string) asm.Instruction {
+	return asm.Mov.Imm(asm.R2, 0).WithSymbol(sym)
+}
+
+// dnsInstructions sends dns requests to the dns server described in dns
+// and jumps to allow,
+// other sockets go on with instructions after them,
+// which are marked with skip.
+// Original destinations of udp sockets are remembered in origins.
+// Nothing is generated for a family dns has no address of.
+func dnsInstructions(
+	h hook, dns *config.DNSHijack, origins *ebpf.Map, skip, allow string,
+) asm.Instructions {
+	var addr net.IP
+	if !h.ipv6 && dns.IP != nil {
+		addr = net.ParseIP(*dns.IP)
+	} else if h.ipv6 && dns.IP6 != nil {
+		addr = net.ParseIP(*dns.IP6)
+	}
+
+	if addr == nil {
+		return nil
+	}
+
+	insns := asm.Instructions{
+		// r2 = ctx->user_port
+		asm.LoadMem(asm.R2, asm.R6, offUserPort, asm.Word),
+		asm.JNE.Imm(asm.R2, int32(nport(53)), skip),
+	}
+
+	if !dns.TCP {
+		insns = append(insns,
+			// r2 = ctx->type
+			asm.LoadMem(asm.R2, asm.R6, offType, asm.Word),
+			asm.JNE.Imm(asm.R2, unix.SOCK_DGRAM, skip),
+		)
+	}
+
+	if origins != nil {
+		remembered := skip + "_remembered"
+
+		if h.connect() {
+			insns = append(insns,
+				// r2 = ctx->type
+				asm.LoadMem(asm.R2, asm.R6, offType, asm.Word),
+				asm.JNE.Imm(asm.R2, unix.SOCK_DGRAM, remembered),
+			)
+		}
+
+		insns = append(insns, rememberInstructions(h, origins, addr, dns.Port)...)
+		insns = append(insns, landing(remembered))
+	}
+
+	insns = append(insns, rewriteInstructions(h, addr, dns.Port)...)
+
+	return append(insns,
+		asm.Ja.Label(allow),
+		landing(skip),
+	)
+}
+
+// rememberInstructions records the destination in origins
+// before it is rewritten to addr and port,
+// so that programs of recvmsg hooks can restore the source of replies.
+// Resolvers refuse replies not from the address requests are sent to.
+// Tcp sockets are recorded with zero addr and port,
+// see sockOpsInstructions.
+func rememberInstructions(
+	h hook, origins *ebpf.Map, addr net.IP, port uint16,
+) asm.Instructions {
+	insns := asm.Instructions{}
+
+	ip := addr.To16()
+	src := int16(offUserIP6)
+	if !h.ipv6 {
+		ip = append(addr.To4(), make(net.IP, net.IPv6len-net.IPv4len)...)
+		src = offUserIP4
+	}
+
+	// value = { ctx->user_ip, ctx->user_port }
+	for off := int16(0); off < net.IPv6len; off += 4 {
+		if !h.ipv6 && off != 0 {
+			insns = append(insns,
+				asm.StoreImm(asm.RFP, originValueOff+off, 0, asm.Word),
+			)
+			continue
+		}
+
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R6, src+off, asm.Word),
+			asm.StoreMem(asm.RFP, originValueOff+off, asm.R2, asm.Word),
+		)
+	}
+
+	insns = append(insns,
+		asm.LoadMem(asm.R2, asm.R6, offUserPort, asm.Word),
+		asm.StoreMem(asm.RFP, originValueOff+net.IPv6len, asm.R2, asm.Word),
+	)
+
+	// key = { cookie, addr, port }
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, originKeyOff, asm.R0, asm.DWord),
+	)
+
+	for off := 0; off < net.IPv6len; off += 4 {
+		insns = append(insns,
+			asm.StoreImm(asm.RFP, originKeyOff+8+int16(off),
+				int64(int32(binary.NativeEndian.Uint32(ip[off:]))), asm.Word),
+		)
+	}
+
+	return append(insns,
+		asm.StoreImm(asm.RFP, originKeyOff+8+net.IPv6len,
+			int64(int32(nport(port))), asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+12+net.IPv6len, 0, asm.Word),
+
+		asm.LoadMapPtr(asm.R1, origins.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, originKeyOff),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, originValueOff),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+	)
+}
+
+// restoreInstructions generates the program of recvmsg hooks,
+// which sets the source of a datagram
+// back to the destination remembered in origins
+// if the socket sent to the source in place of that destination.
+// Return value of recvmsg programs must be 1.
+func restoreInstructions(h hook, origins *ebpf.Map) asm.Instructions {
+	const done = "done"
+
+	if origins == nil {
+		return asm.Instructions{
+			asm.Mov.Imm(asm.R0, 1),
+			asm.Return(),
+		}
+	}
+
+	insns := asm.Instructions{
+		// r6 = ctx
+		asm.Mov.Reg(asm.R6, asm.R1),
+
+		// key = { cookie, ctx->user_ip, ctx->user_port }
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, originKeyOff, asm.R0, asm.DWord),
+	}
+
+	dst := int16(offUserIP6)
+	if !h.ipv6 {
+		dst = offUserIP4
+	}
+
+	for off := int16(0); off < net.IPv6len; off += 4 {
+		if !h.ipv6 && off != 0 {
+			insns = append(insns,
+				asm.StoreImm(asm.RFP, originKeyOff+8+off, 0, asm.Word),
+			)
+			continue
+		}
+
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R6, dst+off, asm.Word),
+			asm.StoreMem(asm.RFP, originKeyOff+8+off, asm.R2, asm.Word),
+		)
+	}
+
+	insns = append(insns,
+		asm.LoadMem(asm.R2, asm.R6, offUserPort, asm.Word),
+		asm.StoreMem(asm.RFP, originKeyOff+8+net.IPv6len, asm.R2, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+12+net.IPv6len, 0, asm.Word),
+
+		asm.LoadMapPtr(asm.R1, origins.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, originKeyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, done),
+	)
+
+	// ctx->user_ip, ctx->user_port = *value
+	for off := int16(0); off < net.IPv6len; off += 4 {
+		if !h.ipv6 && off != 0 {
+			break
+		}
+
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R0, off, asm.Word),
+			asm.StoreMem(asm.R6, dst+off, asm.R2, asm.Word),
+		)
+	}
+
+	return append(insns,
+		asm.LoadMem(asm.R2, asm.R0, net.IPv6len, asm.Word),
+		asm.StoreMem(asm.R6, offUserPort, asm.R2, asm.Word),
+
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(done),
+		asm.Return(),
+	)
+}
+
+// sockOpsInstructions generates the program of the sock_ops root hook,
+// which moves the original destination of a tcp socket
+// remembered by rememberInstructions
+// to an entry keyed by the local address of the socket
+// when it connects,
+// which is the peer address seen by the server accepting the connection.
+// Return value of sock_ops programs is ignored for this operation.
+func sockOpsInstructions(origins *ebpf.Map) asm.Instructions {
+	const (
+		done = "done"
+		ipv6 = "ipv6"
+		port = "port"
+	)
+
+	insns := asm.Instructions{
+		// r6 = ctx
+		asm.Mov.Reg(asm.R6, asm.R1),
+
+		// r2 = ctx->op
+		asm.LoadMem(asm.R2, asm.R6, offOpsOp, asm.Word),
+		asm.JNE.Imm(asm.R2, unix.BPF_SOCK_OPS_TCP_CONNECT_CB, done),
+
+		// key = { cookie, 0, 0 }
+		asm.FnGetSocketCookie.Call(),
+		asm.StoreMem(asm.RFP, originKeyOff, asm.R0, asm.DWord),
+	}
+
+	for off := int16(8); off < originKeySize; off += 4 {
+		insns = append(insns,
+			asm.StoreImm(asm.RFP, originKeyOff+off, 0, asm.Word),
+		)
+	}
+
+	insns = append(insns,
+		asm.LoadMapPtr(asm.R1, origins.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, originKeyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, done),
+		// r7 = value
+		asm.Mov.Reg(asm.R7, asm.R0),
+
+		// key = { 0, ctx->local_ip, htons(ctx->local_port) }
+		asm.StoreImm(asm.RFP, originKeyOff, 0, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+4, 0, asm.Word),
+		// r2 = ctx->family
+		asm.LoadMem(asm.R2, asm.R6, offOpsFamily, asm.Word),
+		asm.JNE.Imm(asm.R2, unix.AF_INET, ipv6),
+		asm.LoadMem(asm.R2, asm.R6, offOpsLocalIP4, asm.Word),
+		asm.StoreMem(asm.RFP, originKeyOff+8, asm.R2, asm.Word),
+		asm.Ja.Label(port),
+		landing(ipv6),
+	)
+
+	for off := int16(0); off < net.IPv6len; off += 4 {
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R6, offOpsLocalIP6+off, asm.Word),
+			asm.StoreMem(asm.RFP, originKeyOff+8+off, asm.R2, asm.Word),
+		)
+	}
+
+	return append(insns,
+		// local_port is in host byte order.
+		asm.LoadMem(asm.R2, asm.R6, offOpsLocalPort, asm.Word).WithSymbol(port),
+		asm.HostTo(asm.BE, asm.R2, asm.Half),
+		asm.StoreMem(asm.RFP, originKeyOff+8+net.IPv6len, asm.R2, asm.Word),
+
+		asm.LoadMapPtr(asm.R1, origins.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, originKeyOff),
+		asm.Mov.Reg(asm.R3, asm.R7),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateAny)),
+		asm.FnMapUpdateElem.Call(),
+
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(done),
+		asm.Return(),
+	)
+}
+
+// getsockoptInstructions generates the program of the getsockopt root hook,
+// which answers SO_ORIGINAL_DST of SOL_IP and SOL_IPV6
+// with the destination remembered in origins
+// for the peer address of the socket,
+// as netfilter knows nothing about connections rewritten by programs.
+// Like netfilter, SOL_IP is answered for ipv4 connections only,
+// and SOL_IPV6 for ipv6 connections only.
+// Other options are left untouched.
+// Return value of getsockopt programs must be 1.
+func getsockoptInstructions(origins *ebpf.Map) asm.Instructions {
+	const (
+		done   = "done"
+		option = "option"
+		ipv6   = "ipv6"
+		port   = "port"
+		in6    = "in6"
+		answer = "answer"
+	)
+
+	// ::ffff:0:0/96 in network byte order.
+	mapped := int32(binary.NativeEndian.Uint32([]byte{0, 0, 0xff, 0xff}))
+
+	insns := asm.Instructions{
+		// r6 = ctx
+		asm.Mov.Reg(asm.R6, asm.R1),
+
+		// r2 = ctx->level
+		asm.LoadMem(asm.R2, asm.R6, offOptLevel, asm.Word),
+		asm.JEq.Imm(asm.R2, unix.SOL_IP, option),
+		asm.JNE.Imm(asm.R2, unix.SOL_IPV6, done),
+		// r2 = ctx->optname
+		asm.LoadMem(asm.R2, asm.R6, offOptName, asm.Word).WithSymbol(option),
+		asm.JNE.Imm(asm.R2, soOriginalDst, done),
+
+		// r7 = ctx->sk
+		asm.LoadMem(asm.R7, asm.R6, offOptSK, asm.DWord),
+
+		// key = { 0, ctx->sk->dst_ip, ctx->sk->dst_port },
+		// r8 = level of the family of key
+		asm.StoreImm(asm.RFP, originKeyOff, 0, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+4, 0, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+12+net.IPv6len, 0, asm.Word),
+		asm.Mov.Imm(asm.R8, unix.SOL_IP),
+		// r2 = ctx->sk->family
+		asm.LoadMem(asm.R2, asm.R7, offSockFamily, asm.Word),
+		asm.JNE.Imm(asm.R2, unix.AF_INET, ipv6),
+		asm.LoadMem(asm.R2, asm.R7, offSockDstIP4, asm.Word),
+		asm.StoreMem(asm.RFP, originKeyOff+8, asm.R2, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+12, 0, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+16, 0, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+20, 0, asm.Word),
+		asm.Ja.Label(port),
+		asm.Mov.Imm(asm.R8, unix.SOL_IPV6).WithSymbol(ipv6),
+	}
+
+	for off := int16(0); off < net.IPv6len; off += 4 {
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R7, offSockDstIP6+off, asm.Word),
+			asm.StoreMem(asm.RFP, originKeyOff+8+off, asm.R2, asm.Word),
+		)
+	}
+
+	insns = append(insns,
+		// Clients of ipv4 connected to servers listening on ipv6
+		// are seen with ipv4-mapped addresses,
+		// which are remembered as ipv4 addresses.
+		asm.LoadMem(asm.R2, asm.RFP, originKeyOff+8, asm.Word),
+		asm.JNE.Imm(asm.R2, 0, port),
+		asm.LoadMem(asm.R2, asm.RFP, originKeyOff+12, asm.Word),
+		asm.JNE.Imm(asm.R2, 0, port),
+		asm.LoadMem(asm.R2, asm.RFP, originKeyOff+16, asm.Word),
+		asm.JNE.Imm32(asm.R2, mapped, port),
+		asm.LoadMem(asm.R2, asm.RFP, originKeyOff+20, asm.Word),
+		asm.StoreMem(asm.RFP, originKeyOff+8, asm.R2, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+16, 0, asm.Word),
+		asm.StoreImm(asm.RFP, originKeyOff+20, 0, asm.Word),
+		asm.Mov.Imm(asm.R8, unix.SOL_IP),
+
+		// dst_port is in network byte order.
+		asm.LoadMem(asm.R2, asm.R7, offSockDstPort, asm.Word).WithSymbol(port),
+		asm.StoreMem(asm.RFP, originKeyOff+8+net.IPv6len, asm.R2, asm.Word),
+
+		asm.LoadMapPtr(asm.R1, origins.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, originKeyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, done),
+
+		// r2 = ctx->optval, r3 = ctx->optval_end
+		asm.LoadMem(asm.R2, asm.R6, offOptVal, asm.DWord),
+		asm.LoadMem(asm.R3, asm.R6, offOptValEnd, asm.DWord),
+		// r4 = ctx->level
+		asm.LoadMem(asm.R4, asm.R6, offOptLevel, asm.Word),
+		asm.JNE.Reg(asm.R4, asm.R8, done),
+		asm.JEq.Imm(asm.R4, unix.SOL_IPV6, in6),
+
+		// *optval = struct sockaddr_in { AF_INET, port, ip }
+		asm.Mov.Reg(asm.R4, asm.R2),
+		asm.Add.Imm(asm.R4, unix.SizeofSockaddrInet4),
+		asm.JGT.Reg(asm.R4, asm.R3, done),
+		asm.StoreImm(asm.R2, 0, unix.AF_INET, asm.Half),
+		asm.LoadMem(asm.R4, asm.R0, net.IPv6len, asm.Word),
+		asm.StoreMem(asm.R2, 2, asm.R4, asm.Half),
+		asm.LoadMem(asm.R4, asm.R0, 0, asm.Word),
+		asm.StoreMem(asm.R2, 4, asm.R4, asm.Word),
+		asm.StoreImm(asm.R2, 8, 0, asm.Word),
+		asm.StoreImm(asm.R2, 12, 0, asm.Word),
+		asm.Mov.Imm(asm.R4, unix.SizeofSockaddrInet4),
+		asm.Ja.Label(answer),
+
+		// *optval = struct sockaddr_in6 { AF_INET6, port, 0, ip, 0 }
+		asm.Mov.Reg(asm.R4, asm.R2).WithSymbol(in6),
+		asm.Add.Imm(asm.R4, unix.SizeofSockaddrInet6),
+		asm.JGT.Reg(asm.R4, asm.R3, done),
+		asm.StoreImm(asm.R2, 0, unix.AF_INET6, asm.Half),
+		asm.LoadMem(asm.R4, asm.R0, net.IPv6len, asm.Word),
+		asm.StoreMem(asm.R2, 2, asm.R4, asm.Half),
+		asm.StoreImm(asm.R2, 4, 0, asm.Word),
+	)
+
+	for off := int16(0); off < net.IPv6len; off += 4 {
+		insns = append(insns,
+			asm.LoadMem(asm.R4, asm.R0, off, asm.Word),
+			asm.StoreMem(asm.R2, 8+off, asm.R4, asm.Word),
+		)
+	}
+
+	return append(insns,
+		asm.StoreImm(asm.R2, 8+net.IPv6len, 0, asm.Word),
+		asm.Mov.Imm(asm.R4, unix.SizeofSockaddrInet6),
+
+		// ctx->optlen = r4, ctx->retval = 0
+		asm.StoreMem(asm.R6, offOptLen, asm.R4, asm.Word).WithSymbol(answer),
+		asm.Mov.Imm(asm.R4, 0),
+		asm.StoreMem(asm.R6, offOptRetval, asm.R4, asm.Word),
+
+		asm.Mov.Imm(asm.R0, 1).WithSymbol(done),
+		asm.Return(),
+	)
+}
+
+// loadRoot loads programs of rootHooks,
+// which pass original destinations of tcp sockets remembered in origins
+// to servers accepting them.
+func loadRoot(origins *ebpf.Map) (ret *rootPrograms, err error) {
+	defer Wrap(&err, "load bpf programs of cgroup root")
+
+	p := &rootPrograms{}
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		p.close()
+	}()
+
+	for i, h := range rootHooks {
+		insns := sockOpsInstructions(origins)
+		if h.attach == ebpf.AttachCGroupGetsockopt {
+			insns = getsockoptInstructions(origins)
+		}
+
+		p.progs[i], err = ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         h.name,
+			Type:         h.programType(),
+			AttachType:   h.attach,
+			Instructions: insns,
+			License:      "GPL",
+		})
+		if err != nil {
+			var verr *ebpf.VerifierError
+			if errors.As(err, &verr) {
+				Wrap(&err, "%+v", verr)
+			}
+			return
+		}
+	}
+
+	ret = p
+	return
+}
+
+// newOriginsMap creates the map
+// where original destinations of rewritten sockets are remembered,
+// see rememberInstructions.
+// Entries are evicted when the map is full,
+// as they are not removed when sockets are closed.
+func newOriginsMap() (ret *ebpf.Map, err error) {
+	defer Wrap(&err, "create origins map")
+
+	ret, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       ProgramNamePrefix + "o",
+		Type:       ebpf.LRUHash,
+		KeySize:    originKeySize,
+		ValueSize:  originValueSize,
+		MaxEntries: originsMaxEntries,
+	})
+	return
+}
+
+// bypassInstructions jumps to allow
+// if the destination is found in the lpm trie bypass.
+func bypassInstructions(h hook, bypass *ebpf.Map, allow string) asm.Instructions {
+	insns := asm.Instructions{}
+
+	// The key of lpm trie is struct { u32 prefixlen; u8 data[]; },
+	// which is put at the top of stack.
+	size := int16(4 + net.IPv4len)
+	if h.ipv6 {
+		size = 4 + net.IPv6len
+	}
+
+	insns = append(insns,
+		asm.Mov.Imm(asm.R2, int32(size-4)*8),
+		asm.StoreMem(asm.RFP, -size, asm.R2, asm.Word),
+	)
+
+	for off := int16(0); off < size-4; off += 4 {
+		src := int16(offUserIP4)
+		if h.ipv6 {
+			src = offUserIP6
+		}
+
+		insns = append(insns,
+			asm.LoadMem(asm.R2, asm.R6, src+off, asm.Word),
+			asm.StoreMem(asm.RFP, -size+4+off, asm.R2, asm.Word),
+		)
+	}
+
+	return append(insns,
+		asm.LoadMapPtr(asm.R1, bypass.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, int32(-size)),
+		asm.FnMapLookupElem.Call(),
+		asm.JNE.Imm(asm.R0, 0, allow),
+	)
+}
+
+// rewriteInstructions sets the destination to addr and port.
+func rewriteInstructions(h hook, addr net.IP, port uint16) asm.Instructions {
+	insns := asm.Instructions{}
+
+	if !h.ipv6 {
+		insns = append(insns,
+			asm.Mov.Imm32(asm.R2, int32(binary.NativeEndian.Uint32(addr.To4()))),
+			asm.StoreMem(asm.R6, offUserIP4, asm.R2, asm.Word),
+		)
+	} else {
+		ip := addr.To16()
+		for off := 0; off < net.IPv6len; off += 4 {
+			insns = append(insns,
+				asm.Mov.Imm32(asm.R2, int32(binary.NativeEndian.Uint32(ip[off:]))),
+				asm.StoreMem(asm.R6, offUserIP6+int16(off), asm.R2, asm.Word),
+			)
+		}
+	}
+
+	return append(insns,
+		asm.Mov.Imm32(asm.R2, int32(nport(port))),
+		asm.StoreMem(asm.R6, offUserPort, asm.R2, asm.Word),
+	)
+}
+
+// nport returns port in network byte order,
+// as how it is stored in user_port of struct bpf_sock_addr.
+func nport(port uint16) uint32 {
+	return uint32(binary.NativeEndian.Uint16(
+		binary.BigEndian.AppendUint16(nil, port),
+	))
+}
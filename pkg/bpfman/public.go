@@ -0,0 +1,451 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package bpfman
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/cilium/ebpf"
+)
+
+// InitStructure forgets tproxies, redirects and cgroups known before.
+// Nothing is loaded into kernel until programs are attached to cgroups.
+func (m *BPFManager) InitStructure() (err error) {
+	defer Wrap(&err, "initialize bpf manager")
+
+	if m.cgroupRoot == "" {
+		err = ErrCGroupRootMissing
+		return
+	}
+
+	m.tproxies = map[string]*config.TProxy{}
+	m.redirects = map[string]*config.Redirect{}
+	m.cgroups = map[string]string{}
+	m.closePrograms()
+
+	m.log.Debug("BPF manager initialized.")
+	return
+}
+
+func (m *BPFManager) AddChainAndRulesForTProxies(tps []*config.TProxy) (err error) {
+	for _, tp := range tps {
+		m.tproxies[tp.Name] = tp
+	}
+
+	return
+}
+
+func (m *BPFManager) AddChainAndRulesForRedirects(redirects []*config.Redirect) (err error) {
+	for _, redirect := range redirects {
+		m.redirects[redirect.Name] = redirect
+	}
+
+	return
+}
+
+// AddChainAndRulesForRoutes fails if there is any route,
+// as programs cannot make sockets go through other network interfaces.
+func (m *BPFManager) AddChainAndRulesForRoutes(routes []*config.Route) (err error) {
+	if len(routes) == 0 {
+		return
+	}
+
+	defer Wrap(&err, "add routes %#v", routes)
+
+	err = ErrRoutesNotSupported
+	return
+}
+
+// AddRoutes attaches programs of targets to cgroups of routes,
+// programs attached to these cgroups before are replaced.
+// If anything goes wrong, programs of all these cgroups are restored.
+func (m *BPFManager) AddRoutes(routes []types.Route) (err error) {
+	if len(routes) == 0 {
+		return
+	}
+
+	defer Wrap(&err, "attach bpf programs to %d cgroups", len(routes))
+	defer m.observeApply(metrics.OpAddRoutes, time.Now(), &err)
+	defer m.gc()
+
+	// old records keys of programs attached to touched cgroups before,
+	// "" means nothing was attached.
+	old := map[string]string{}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		m.restore(old)
+	}()
+
+	for i := range routes {
+		path := routes[i].Path
+
+		var key string
+		var p *programs
+		key, p, err = m.programsOf(routes[i].Target)
+		if err != nil {
+			return
+		}
+
+		if _, ok := old[path]; !ok {
+			old[path] = m.cgroups[path]
+		}
+
+		m.cgroups[path] = key
+
+		err = attach(path, p)
+		if err != nil {
+			return
+		}
+	}
+
+	m.log.Infow("BPF programs attached to new cgroups.",
+		"size", len(routes),
+	)
+
+	return
+}
+
+// ReplaceRoutes attaches programs of targets to cgroups of routes
+// and detaches programs from other cgroups at paths.
+// Attaching programs to a cgroup replaces programs attached before,
+// so cgroups in routes are never left with nothing attached.
+func (m *BPFManager) ReplaceRoutes(paths []string, routes []types.Route) (err error) {
+	err = m.AddRoutes(routes)
+	if err != nil {
+		return
+	}
+
+	routed := make(map[string]struct{}, len(routes))
+	for i := range routes {
+		routed[routes[i].Path] = struct{}{}
+	}
+
+	removed := []string{}
+	for _, path := range paths {
+		if _, ok := routed[path]; ok {
+			continue
+		}
+
+		removed = append(removed, path)
+	}
+
+	if len(removed) == 0 {
+		return
+	}
+
+	err = m.RemoveRoutes(removed)
+	return
+}
+
+// RemoveRoutes detaches programs from cgroups at paths.
+// Cgroups already removed are skipped,
+// as programs are detached by kernel when cgroups are removed.
+func (m *BPFManager) RemoveRoutes(paths []string) (err error) {
+	defer Wrap(
+		&err,
+		"detach bpf programs from %d cgroup(s)",
+		len(paths),
+	)
+	defer m.observeApply(metrics.OpRemoveRoutes, time.Now(), &err)
+	defer m.gc()
+
+	errs := []error{}
+
+	for _, path := range paths {
+		key, ok := m.cgroups[path]
+		if !ok {
+			m.log.Debugw("Nothing to do with this cgroup",
+				"cgroup", path,
+			)
+			continue
+		}
+
+		errs = append(errs, detach(path, m.programs[key]))
+		delete(m.cgroups, path)
+	}
+
+	err = errors.Join(errs...)
+	return
+}
+
+// Reload makes programs attached to cgroups
+// follow the new configuration and cgroup routes.
+// Programs of cgroups not in routes are detached.
+// If anything goes wrong, programs attached before are restored.
+func (m *BPFManager) Reload(cfg *config.Config, routes []types.Route) (err error) {
+	defer Wrap(&err, "reload bpf programs with %d routes", len(routes))
+	defer m.observeApply(metrics.OpReload, time.Now(), &err)
+
+	if len(cfg.Routes) != 0 {
+		err = ErrRoutesNotSupported
+		return
+	}
+
+	oldBypass := m.bypass
+	oldTProxies := m.tproxies
+	oldRedirects := m.redirects
+	oldPrograms := m.programs
+	oldCGroups := m.cgroups
+
+	m.bypass = cfg.Bypass
+	m.tproxies = make(map[string]*config.TProxy, len(cfg.TProxies))
+	for name, tp := range cfg.TProxies {
+		m.tproxies[name] = tp
+	}
+	m.redirects = make(map[string]*config.Redirect, len(cfg.Redirects))
+	for name, redirect := range cfg.Redirects {
+		m.redirects[name] = redirect
+	}
+	m.programs = map[string]*programs{}
+	m.cgroups = map[string]string{}
+
+	defer func() {
+		if err == nil {
+			for _, p := range oldPrograms {
+				p.close()
+			}
+
+			return
+		}
+
+		for path, key := range m.cgroups {
+			if _, ok := oldCGroups[path]; ok {
+				continue
+			}
+
+			_ = detach(path, m.programs[key])
+		}
+
+		for path, key := range oldCGroups {
+			m.log.Debugw("Restoring programs of cgroup.",
+				"cgroup", path,
+			)
+			_ = attach(path, oldPrograms[key])
+		}
+
+		m.closePrograms()
+
+		m.bypass = oldBypass
+		m.tproxies = oldTProxies
+		m.redirects = oldRedirects
+		m.programs = oldPrograms
+		m.cgroups = oldCGroups
+	}()
+
+	for i := range routes {
+		path := routes[i].Path
+
+		var key string
+		var p *programs
+		key, p, err = m.programsOf(routes[i].Target)
+		if err != nil {
+			return
+		}
+
+		m.cgroups[path] = key
+
+		err = attach(path, p)
+		if err != nil {
+			return
+		}
+	}
+
+	for path, key := range oldCGroups {
+		if _, ok := m.cgroups[path]; ok {
+			continue
+		}
+
+		err = detach(path, oldPrograms[key])
+		if err != nil {
+			return
+		}
+	}
+
+	m.log.Infow("BPF programs reloaded.",
+		"cgroups", len(m.cgroups),
+		"tproxies", len(m.tproxies),
+		"redirects", len(m.redirects),
+	)
+
+	return
+}
+
+// Clear detaches programs from all cgroups and the cgroup root.
+func (m *BPFManager) Clear() (err error) {
+	defer Wrap(&err, "detach all bpf programs")
+
+	errs := []error{}
+	for path, key := range m.cgroups {
+		errs = append(errs, detach(path, m.programs[key]))
+	}
+
+	m.cgroups = map[string]string{}
+	m.closePrograms()
+
+	errs = append(errs, m.closeOrigins(true))
+
+	err = errors.Join(errs...)
+	return
+}
+
+// Counters returns nothing,
+// as programs count no traffic.
+func (m *BPFManager) Counters() (ret []types.Counter, err error) {
+	ret = []types.Counter{}
+	return
+}
+
+// HasCGroup tells whether programs of cgtproxy are attached
+// to the cgroup at path.
+// Like RemoveLeftover, it asks kernel directly,
+// so it can be used from another process.
+func (m *BPFManager) HasCGroup(path string) (ret bool, err error) {
+	defer Wrap(&err, "lookup bpf programs of cgroup %s", path)
+
+	var progs []*ebpf.Program
+	progs, err = attachedPrograms(path, hooks[0])
+	if err != nil {
+		return
+	}
+
+	for i := range progs {
+		progs[i].Close()
+	}
+
+	ret = len(progs) != 0
+	return
+}
+
+// CGroupElements returns cgroups programs have been attached to,
+// with their current inode numbers.
+// Programs of a cgroup are missing
+// if the cgroup has been removed or created again.
+// Programs attached to cgroups but unknown are not reported,
+// they are found by RemoveLeftover.
+func (m *BPFManager) CGroupElements() (ret []types.CGroupElement, err error) {
+	defer Wrap(&err, "list cgroups with bpf programs")
+
+	elements := []types.CGroupElement{}
+	for path := range m.cgroups {
+		element := types.CGroupElement{Path: path, Missing: true}
+
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			elements = append(elements, element)
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		element.Inode = info.Sys().(*syscall.Stat_t).Ino
+
+		var progs []*ebpf.Program
+		progs, err = attachedPrograms(path, hooks[0])
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+
+		for i := range progs {
+			progs[i].Close()
+		}
+
+		element.Missing = len(progs) == 0
+		elements = append(elements, element)
+	}
+
+	sort.Slice(elements, func(i, j int) bool {
+		return elements[i].Path < elements[j].Path
+	})
+
+	ret = elements
+	return
+}
+
+// RemoveCGroupElements detaches programs from cgroups of elements,
+// the same as RemoveRoutes does.
+func (m *BPFManager) RemoveCGroupElements(elements []types.CGroupElement) (err error) {
+	paths := []string{}
+	for i := range elements {
+		if elements[i].Path == "" {
+			continue
+		}
+
+		paths = append(paths, elements[i].Path)
+	}
+
+	return m.RemoveRoutes(paths)
+}
+
+// RemoveLeftover detaches programs of cgtproxy from cgroups under cgroup root,
+// which are left by a previous cgtproxy which did not exit normally.
+// It can be used without InitStructure.
+// It reports whether there was any such program.
+func (m *BPFManager) RemoveLeftover() (ret bool, err error) {
+	defer Wrap(&err, "remove leftover bpf programs")
+
+	if m.cgroupRoot == "" {
+		err = ErrCGroupRootMissing
+		return
+	}
+
+	err = filepath.WalkDir(
+		string(m.cgroupRoot),
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+
+			if !d.IsDir() {
+				return nil
+			}
+
+			found, err := detachLeftover(path)
+			if err != nil {
+				return err
+			}
+
+			if found {
+				m.log.Debugw("Leftover bpf programs detached.",
+					"cgroup", path,
+				)
+			}
+
+			ret = ret || found
+			return nil
+		},
+	)
+	return
+}
+
+// Release closes programs and the origins map loaded,
+// programs still attached to cgroups are kept by kernel.
+func (m *BPFManager) Release() (err error) {
+	m.closePrograms()
+	err = m.closeOrigins(false)
+	return
+}
@@ -10,5 +10,7 @@ var (
 	ErrContextMissing         = errors.New("context is missing.")
 	ErrCGroupRootNotFound     = errors.New("cgroup v2 file system mount point is missing.")
 	ErrLoggerMissing          = errors.New("logger is missing.")
+	ErrMetricsMissing         = errors.New("metrics is missing.")
+	ErrBufferSizeInvalid      = errors.New("buffer size must not be negative.")
 	ErrUnderlingWatcherExited = errors.New("underling file system watcher has exited.")
 )
@@ -9,6 +9,8 @@ import (
 	"strconv"
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/rjeczalik/notify"
@@ -20,6 +22,11 @@ type CGroupFSMonitor struct {
 	eventsIn  chan notify.EventInfo
 	root      config.CGroupRoot
 	log       *zap.SugaredLogger
+	metrics   interfaces.Metrics
+
+	// bufferSize is the size of eventsIn,
+	// 0 means it is decided by environment variable.
+	bufferSize int
 }
 
 //go:generate go run github.com/rjeczalik/interfaces/cmd/interfacer@v0.3.0 -for github.com/black-desk/cgtproxy/pkg/cgfsmon.CGroupFSMonitor -as interfaces.CGroupMonitor -o ../interfaces/cgmon.go
@@ -42,6 +49,16 @@ func New(opts ...Opt) (ret *CGroupFSMonitor, err error) {
 		w.log = zap.NewNop().Sugar()
 	}
 
+	if w.metrics == nil {
+		var m *metrics.Metrics
+		m, err = metrics.New(metrics.WithLogger(w.log))
+		if err != nil {
+			return
+		}
+
+		w.metrics = m
+	}
+
 	if w.root == "" {
 		err = ErrCGroupRootNotFound
 		return
@@ -54,13 +71,17 @@ func New(opts ...Opt) (ret *CGroupFSMonitor, err error) {
 	// - https://github.com/rjeczalik/notify/issues/98
 	//
 	// To mitigate this issue, we use a buffered channel to receive events.
-	// The buffer size can be configured via CGTPROXY_MONITOR_BUFFER_SIZE environment variable.
+	// The buffer size can be configured via buffer-size of monitor in configuration,
+	// or CGTPROXY_MONITOR_BUFFER_SIZE environment variable
+	// if it is not set in configuration.
 	// A larger buffer can handle more events in a short period but consumes more memory.
 	// If you notice event loss, try increasing this value.
 
-	// Get buffer size from environment variable, default to 1024
-	bufferSize := 1024
-	if envSize := os.Getenv("CGTPROXY_MONITOR_BUFFER_SIZE"); envSize != "" {
+	// Get buffer size from configuration or environment variable, default to 1024
+	bufferSize := config.DefaultMonitorBufferSize
+	if w.bufferSize != 0 {
+		bufferSize = w.bufferSize
+	} else if envSize := os.Getenv("CGTPROXY_MONITOR_BUFFER_SIZE"); envSize != "" {
 		size, err := strconv.Atoi(envSize)
 		if err != nil {
 			w.log.Warnw("Invalid buffer size in CGTPROXY_MONITOR_BUFFER_SIZE, using default",
@@ -114,3 +135,31 @@ func WithLogger(log *zap.SugaredLogger) Opt {
 		return
 	}
 }
+
+func WithMetrics(m interfaces.Metrics) Opt {
+	return func(w *CGroupFSMonitor) (ret *CGroupFSMonitor, err error) {
+		if m == nil {
+			err = ErrMetricsMissing
+			return
+		}
+
+		w.metrics = m
+		ret = w
+		return
+	}
+}
+
+// WithBufferSize sets the number of events kept before being handled,
+// 0 means the default one.
+func WithBufferSize(size int) Opt {
+	return func(w *CGroupFSMonitor) (ret *CGroupFSMonitor, err error) {
+		if size < 0 {
+			err = ErrBufferSizeInvalid
+			return
+		}
+
+		w.bufferSize = size
+		ret = w
+		return
+	}
+}
@@ -68,6 +68,18 @@ LOOP:
 		case <-ctx.Done():
 			break LOOP
 		case eventInfo := <-w.eventsIn:
+			w.metrics.AddEventsReceived(1)
+
+			// NOTE:
+			// github.com/rjeczalik/notify drops events
+			// instead of blocking when the buffer is full,
+			// the number of events dropped is unknown.
+			if len(w.eventsIn) == cap(w.eventsIn)-1 {
+				w.log.Warnw("Event buffer was full, some events may be lost.",
+					"buffer_size", cap(w.eventsIn),
+				)
+				w.metrics.AddEventsDropped(1)
+			}
 
 			event := eventInfo.Event()
 			path := eventInfo.Path()
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cgpath_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgpath"
+	. "github.com/black-desk/lib/go/ginkgo-helper"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCGPath(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CGPath Suite")
+}
+
+const userService = "/user.slice/user-1000.slice/user@1000.service"
+
+var _ = Describe("Parse", func() {
+	ContextTable("application unit %s",
+		ContextTableEntry(userService+"/app.slice/app-gnome-org.mozilla.firefox-12345.scope",
+			"org.mozilla.firefox", "gnome").WithFmt("launched by GNOME"),
+		ContextTableEntry(userService+"/app.slice/app-DDE-org.mozilla.firefox-12345.scope",
+			"org.mozilla.firefox", "DDE").WithFmt("launched by DDE"),
+		ContextTableEntry(userService+"/app.slice/app-flatpak-org.mozilla.firefox-12345.scope",
+			"org.mozilla.firefox", "flatpak").WithFmt("launched by flatpak"),
+		ContextTableEntry(userService+"/app.slice/app-org.mozilla.firefox@a1b2c3.service",
+			"org.mozilla.firefox", "").WithFmt("launched by KDE"),
+		ContextTableEntry(userService+"/app.slice/app-org.mozilla.firefox.service",
+			"org.mozilla.firefox", "").WithFmt("without random string"),
+		ContextTableEntry(userService+`/app.slice/app-gnome-google\x2dchrome-12345.scope`,
+			"google-chrome", "gnome").WithFmt("with escaped application ID"),
+		func(path, appID, launcher string) {
+			It("should find the application ID", func() {
+				info := cgpath.Parse(path)
+				Expect(info.AppID).To(Equal(appID))
+				Expect(info.Launcher).To(Equal(launcher))
+				Expect(info.UID).ToNot(BeNil())
+				Expect(*info.UID).To(Equal(uint32(1000)))
+			})
+		})
+
+	ContextTable("non-application cgroup %s",
+		ContextTableEntry("/system.slice/clash-meta.service",
+			"clash-meta.service", []string{"system.slice"}).WithFmt("of a system service"),
+		ContextTableEntry("/system.slice/docker.service/sub",
+			"docker.service", []string{"system.slice"}).WithFmt("delegated by a service"),
+		ContextTableEntry(userService+"/cgtproxy.slice/cgtproxy-direct.slice/run-u22.service",
+			"run-u22.service",
+			[]string{"user.slice", "user-1000.slice", "cgtproxy.slice", "cgtproxy-direct.slice"},
+		).WithFmt("in user slices"),
+		ContextTableEntry("/init.scope",
+			"init.scope", []string(nil)).WithFmt("of a scope"),
+		func(path, unit string, slices []string) {
+			It("should find the unit and slices without application ID", func() {
+				info := cgpath.Parse(path)
+				Expect(info.Unit).To(Equal(unit))
+				Expect(info.Slices).To(Equal(slices))
+				Expect(info.AppID).To(BeEmpty())
+			})
+		})
+
+	It("should not find any UID for system services", func() {
+		Expect(cgpath.Parse("/system.slice/sshd.service").UID).To(BeNil())
+	})
+})
+
+var _ = Describe("OfPID", func() {
+	It("should find the cgroup of the current process", func() {
+		path, err := cgpath.OfPID(os.Getpid())
+		Expect(err).To(Succeed())
+		Expect(path).To(HavePrefix("/"))
+	})
+
+	It("should fail on processes not exist", func() {
+		_, err := cgpath.OfPID(-1)
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+})
@@ -0,0 +1,69 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package cgpath tells what a cgroup is from its path,
+// following the naming conventions of systemd.
+//
+// See https://systemd.io/DESKTOP_ENVIRONMENTS/ and systemd.slice(5).
+package cgpath
+
+import (
+	"strings"
+)
+
+// Info describes a cgroup created by systemd.
+type Info struct {
+	// UID is the user owning the cgroup,
+	// it is nil if the cgroup is not in any `user-UID.slice`.
+	UID *uint32
+	// Slices are the names of the slices containing the cgroup,
+	// from the outermost to the innermost.
+	// It includes the cgroup itself if it is a slice.
+	Slices []string
+	// Unit is the name of the innermost service or scope unit
+	// containing the cgroup.
+	Unit string
+	// AppID is the application ID
+	// parsed from the name of an application unit like
+	// `app[-<launcher>]-<ApplicationID>[@<random>].service`
+	// or `app[-<launcher>]-<ApplicationID>-<random>.scope`.
+	AppID string
+	// Launcher is the optional launcher part
+	// of the name of an application unit.
+	Launcher string
+}
+
+// Parse parses a cgroup path,
+// which is relative to the root of cgroupfs.
+func Parse(path string) (ret *Info) {
+	info := &Info{}
+
+	for _, name := range strings.Split(path, "/") {
+		switch {
+		case strings.HasSuffix(name, ".slice"):
+			info.Slices = append(info.Slices, name)
+			info.parseUserSlice(name)
+		case strings.HasSuffix(name, ".service"),
+			strings.HasSuffix(name, ".scope"):
+			info.Unit = name
+			info.parseUserService(name)
+		}
+	}
+
+	info.AppID, info.Launcher = parseAppUnit(info.Unit)
+
+	ret = info
+	return
+}
+
+// InSlice reports whether the cgroup is in the slice.
+func (info *Info) InSlice(slice string) bool {
+	for i := range info.Slices {
+		if info.Slices[i] == slice {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cgpath
+
+import (
+	"strconv"
+	"strings"
+)
+
+func (info *Info) parseUserSlice(name string) {
+	// user-1000.slice
+	uid, ok := strings.CutPrefix(strings.TrimSuffix(name, ".slice"), "user-")
+	if !ok {
+		return
+	}
+
+	info.setUID(uid)
+}
+
+func (info *Info) parseUserService(name string) {
+	// user@1000.service
+	uid, ok := strings.CutPrefix(strings.TrimSuffix(name, ".service"), "user@")
+	if !ok {
+		return
+	}
+
+	info.setUID(uid)
+}
+
+func (info *Info) setUID(str string) {
+	uid, err := strconv.ParseUint(str, 10, 32)
+	if err != nil {
+		return
+	}
+
+	value := uint32(uid)
+	info.UID = &value
+}
+
+// parseAppUnit parses unit names like
+// `app[-<launcher>]-<ApplicationID>[@<random>].service` or
+// `app[-<launcher>]-<ApplicationID>-<random>.scope`.
+//
+// Launchers escape "-" in application ID as "\x2d",
+// so "-" can be used to split the name.
+func parseAppUnit(unit string) (appID, launcher string) {
+	name, ok := strings.CutPrefix(unit, "app-")
+	if !ok {
+		return
+	}
+
+	if scope, ok := strings.CutSuffix(name, ".scope"); ok {
+		idx := strings.LastIndex(scope, "-")
+		if idx == -1 {
+			return
+		}
+
+		name = scope[:idx]
+	} else if service, ok := strings.CutSuffix(name, ".service"); ok {
+		name, _, _ = strings.Cut(service, "@")
+	} else {
+		return
+	}
+
+	if before, after, found := strings.Cut(name, "-"); found {
+		launcher = before
+		name = after
+	}
+
+	appID = unescape(name)
+	return
+}
+
+// unescape reverts the escaping done by systemd-escape(1).
+func unescape(str string) string {
+	if !strings.Contains(str, `\x`) {
+		return str
+	}
+
+	var builder strings.Builder
+
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+3 < len(str) && str[i+1] == 'x' {
+			b, err := strconv.ParseUint(str[i+2:i+4], 16, 8)
+			if err == nil {
+				builder.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+
+		builder.WriteByte(str[i])
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cgpath
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+var ErrCGroupV2Missing = errors.New("process is not in any cgroupv2.")
+
+// OfPID returns the path of the cgroupv2 the process is in,
+// which is relative to the root of cgroupfs.
+func OfPID(pid int) (ret string, err error) {
+	defer Wrap(&err, "get cgroup of process %d", pid)
+
+	var content []byte
+	content, err = os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		// The entry of cgroupv2 is always like "0::/path".
+		path, ok := strings.CutPrefix(scanner.Text(), "0::")
+		if !ok {
+			continue
+		}
+
+		ret = path
+		return
+	}
+
+	err = ErrCGroupV2Missing
+	return
+}
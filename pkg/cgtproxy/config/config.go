@@ -4,7 +4,11 @@
 
 package config
 
-import "go.uber.org/zap"
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
 
 type Config struct {
 	Version string `yaml:"version" validate:"required,eq=1"`
@@ -14,10 +18,48 @@ type Config struct {
 	// If the destination matched in Bypass, the traffic will not be touched.
 	Bypass   Bypass             `yaml:"bypass" validate:"dive,ipv4|cidrv4|ipv6|cidrv6"`
 	TProxies map[string]*TProxy `yaml:"tproxies" validate:"dive"`
-	Rules    []Rule             `yaml:"rules" validate:"dive"`
+	// Redirects are proxy servers
+	// which only support traffic redirected by NAT.
+	Redirects map[string]*Redirect `yaml:"redirects" validate:"dive"`
+	// Routes send traffic through other network interfaces
+	// by policy routing.
+	Routes map[string]*Route `yaml:"routes" validate:"dive"`
+	Rules  []Rule            `yaml:"rules" validate:"dive"`
 	// The route table number cgtproxy will create to route TPROXY traffic.
 	// This table will be removed when cgtproxy stopped.
 	RouteTable int `yaml:"route-table" validate:"required"`
+	// Metrics enables the listener exposing metrics
+	// in Prometheus text format.
+	// Changes of Metrics take effect after restarting.
+	Metrics *Metrics `yaml:"metrics"`
+	// OverridesFile is where overrides of cgroups are persisted,
+	// overrides in it are applied when cgtproxy starts.
+	// Overrides cannot be persisted if it is empty.
+	OverridesFile string `yaml:"overrides-file" validate:"omitempty,filepath"`
+	// Backend is how traffic of cgroups is handled,
+	// which is one of "nftables" and "bpf".
+	// "nftables" makes cgtproxy maintain a nftable looking up cgroups
+	// of each packet.
+	// "bpf" makes cgtproxy attach bpf programs to cgroups,
+	// which decide what to do with a socket
+	// when it connects or sends a datagram without connecting,
+	// by rewriting the destination to a tproxy, a redirect or a dns server
+	// on the loopback address, or refusing it.
+	// Servers of tproxies and redirects get original destinations
+	// of tcp connections by SO_ORIGINAL_DST.
+	// Routes, udp of tproxies and rules using route, mark or log
+	// are not supported by "bpf".
+	// Backend is "nftables" if omitted.
+	// Changes of Backend take effect after restarting.
+	Backend string `yaml:"backend" validate:"omitempty,oneof=nftables bpf"`
+	// Monitor describes how cgroups are watched.
+	// Changes of Monitor take effect after restarting.
+	Monitor Monitor `yaml:"monitor"`
+	// ReconcileInterval is how often cgtproxy goes through cgroupfs
+	// to find and fix cgroups whose events have been missed,
+	// e.g. "10m". "0s" disables periodic reconciliation.
+	// ReconcileInterval is 5m if omitted.
+	ReconcileInterval *time.Duration `yaml:"reconcile-interval" validate:"omitempty,gte=0"`
 
 	log *zap.SugaredLogger `yaml:"-"`
 	raw []byte
@@ -25,21 +67,129 @@ type Config struct {
 
 type Bypass []string
 
+// Metrics describes where metrics are exposed.
+// Exactly one of Address and Unix must be set.
+type Metrics struct {
+	// Address is the TCP address to listen on, e.g. "127.0.0.1:9091".
+	Address string `yaml:"address" validate:"required_without=Unix,excluded_with=Unix,omitempty,hostname_port"`
+	// Unix is the path of the unix socket to listen on,
+	// e.g. "/run/cgtproxy/metrics.sock".
+	Unix string `yaml:"unix" validate:"required_without=Address,excluded_with=Address,omitempty,filepath"`
+}
+
+// Monitor describes how cgroups are watched.
+type Monitor struct {
+	// Backend is what watches cgroups,
+	// which is one of "notify", "inotify" and "systemd".
+	// "notify" watches cgroupfs by github.com/rjeczalik/notify,
+	// which drops events silently if they come faster than handled.
+	// "inotify" watches cgroupfs by inotify directly,
+	// it goes through cgroupfs again
+	// if the kernel tells that events have been dropped,
+	// so creates and deletes of cgroups are never lost.
+	// "systemd" follows cgroups of units
+	// of the systemd system manager and user managers through D-Bus
+	// instead of watching cgroupfs,
+	// so cgroups created by programs themselves
+	// rather than by systemd are not seen.
+	// Backend is "notify" if omitted.
+	Backend string `yaml:"backend" validate:"omitempty,oneof=notify inotify systemd"`
+	// BufferSize is the number of events kept before being handled.
+	// For "notify" it is the size of the queue
+	// events are dropped from when it is full,
+	// for "inotify" it is how many events are read at once,
+	// while the size of the queue is decided by the kernel,
+	// see max_queued_events in inotify(7).
+	// For "systemd" it is the size of the queue of D-Bus signals,
+	// signals coming when it is full are kept but might be reordered.
+	// BufferSize is 1024 if omitted.
+	BufferSize int `yaml:"buffer-size" validate:"gte=0"`
+	// MaxBatchDelay is how long events wait for others
+	// to be handled together, e.g. "200ms",
+	// as every batch makes the nftable rebuilt.
+	// A create and a delete of the same cgroup in a batch cancel out,
+	// so cgroups living shorter than it cost nothing.
+	// "0s" makes events handled as soon as they come.
+	// MaxBatchDelay is 100ms if omitted.
+	MaxBatchDelay *time.Duration `yaml:"max-batch-delay" validate:"omitempty,gte=0"`
+	// MaxBatchSize is the number of events in a batch at most,
+	// a full batch is handled without waiting any more.
+	// MaxBatchSize is 1024 if omitted.
+	MaxBatchSize int `yaml:"max-batch-size" validate:"gte=0"`
+}
+
 type CGroupRoot string
 
 // Rule describes a rule about how to handle traffic comes from a cgroup.
 type Rule struct {
 	// Match is an regex expression
 	// to match an cgroup path relative to the root of cgroupfs.
-	Match string `yaml:"match" validate:"required"`
+	Match string `yaml:"match" validate:"required_without_all=AppID Unit Slice UID"`
+
+	// The following fields match cgroups by what they are,
+	// following the naming conventions of systemd.
+	// If more than one field including Match is set,
+	// the rule matches a cgroup only if all of them match.
+
+	// AppID matches cgroups of application launched by desktop environments,
+	// no matter which launcher is used.
+	// See https://systemd.io/DESKTOP_ENVIRONMENTS/.
+	AppID string `yaml:"app-id"`
+	// Unit matches cgroups in a systemd service or scope unit.
+	// ".service" is appended if the unit type is omitted.
+	Unit string `yaml:"unit"`
+	// Slice matches cgroups in a systemd slice unit.
+	// ".slice" is appended if omitted.
+	Slice string `yaml:"slice"`
+	// UID matches cgroups in slice of the user.
+	UID *uint32 `yaml:"uid"`
 
 	// TProxy means that the traffic comes from this cgroup
 	// should be redirected to a TPROXY server.
-	TProxy string `yaml:"tproxy" validate:"required_without_all=Drop Direct,excluded_with=Drop Direct"`
+	TProxy string `yaml:"tproxy" validate:"required_without_all=Drop Direct Redirect Route Mark Reject,excluded_with=Drop Direct Redirect Route Mark Reject"`
 	// Drop means that the traffic comes from this cgroup will be dropped.
-	Drop bool `yaml:"drop" validate:"required_without_all=TProxy Direct,excluded_with=TProxy Direct"`
+	Drop bool `yaml:"drop" validate:"required_without_all=TProxy Direct Redirect Route Mark Reject,excluded_with=TProxy Direct Redirect Route Mark Reject"`
 	// Direct means that the traffic comes from this cgroup will not be touched.
-	Direct bool `yaml:"direct" validate:"required_without_all=TProxy Drop,excluded_with=TProxy Drop"`
+	Direct bool `yaml:"direct" validate:"required_without_all=TProxy Drop Redirect Route Mark Reject,excluded_with=TProxy Drop Redirect Route Mark Reject"`
+	// Redirect means that the tcp traffic comes from this cgroup
+	// should be redirected to a proxy server by NAT.
+	Redirect string `yaml:"redirect" validate:"required_without_all=TProxy Drop Direct Route Mark Reject,excluded_with=TProxy Drop Direct Route Mark Reject"`
+	// Route means that the traffic comes from this cgroup
+	// should be sent through the network interface of a route.
+	Route string `yaml:"route" validate:"required_without_all=TProxy Drop Direct Redirect Mark Reject,excluded_with=TProxy Drop Direct Redirect Mark Reject"`
+	// Mark means that the traffic comes from this cgroup
+	// will be marked and then left untouched,
+	// so that it can be handled by policy routing or tc rules out of cgtproxy.
+	// The mark must not be one of marks of tproxies and routes.
+	Mark *Mark `yaml:"mark" validate:"required_without_all=TProxy Drop Direct Redirect Route Reject,excluded_with=TProxy Drop Direct Redirect Route Reject"`
+	// Reject means that the traffic comes from this cgroup will be rejected.
+	// TCP connections are reset,
+	// other traffic is rejected with the ICMP or ICMPv6 unreachable message
+	// described by Reject, which is one of
+	// "admin-prohibited", "port-unreachable", "host-unreachable" and "no-route".
+	Reject string `yaml:"reject" validate:"required_without_all=TProxy Drop Direct Redirect Route Mark,excluded_with=TProxy Drop Direct Redirect Route Mark,omitempty,oneof=admin-prohibited port-unreachable host-unreachable no-route"`
+
+	// DNS means that the dns request traffic comes from this cgroup
+	// should be sent to the dns server described in DNS,
+	// no matter whether the tproxy of this rule hijacks dns or not.
+	// It can only be used with Direct, TProxy and Route.
+	DNS *DNSHijack `yaml:"dns" validate:"omitempty,excluded_with=Drop Redirect Mark Reject"`
+
+	// Log means that the first packet of each connection
+	// comes from this cgroup will be logged before handled by the target.
+	Log *Log `yaml:"log"`
+}
+
+// Log describes how to log packets.
+type Log struct {
+	// Prefix is prepended to each log message.
+	Prefix string `yaml:"prefix" validate:"max=127"`
+	// Group is the nflog group packets are sent to.
+	// If Group is not set, packets are logged to the kernel log.
+	Group *uint16 `yaml:"group"`
+	// Rate is the max number of packets logged per minute.
+	// 0 means no limit.
+	Rate uint64 `yaml:"rate"`
 }
 
 // TProxy describes a TPROXY server.
@@ -48,6 +198,11 @@ type TProxy struct {
 	NoUDP  bool   `yaml:"no-udp"`
 	NoIPv6 bool   `yaml:"no-ipv6"`
 	Port   uint16 `yaml:"port" validate:"required"`
+	// Bypass describes the bypass rules only apply to this TPROXY server,
+	// in addition to the global one.
+	// If the destination matched in Bypass,
+	// the traffic will not be redirected to this TPROXY server.
+	Bypass Bypass `yaml:"bypass" validate:"dive,ipv4|cidrv4|ipv6|cidrv6"`
 	// Mark is the fire wall mark used to identify the TPROXY server
 	// and trigger reroute operation of netfliter
 	// from OUTPUT to PREROUTING internally.
@@ -66,11 +221,66 @@ type TProxy struct {
 
 type FireWallMark uint32
 
+// Mark describes the fire wall mark to set.
+type Mark struct {
+	Value FireWallMark `yaml:"value"`
+	// Mask is the bits of fire wall mark to change,
+	// other bits are kept.
+	// All bits are changed if Mask is omitted.
+	Mask FireWallMark `yaml:"mask"`
+}
+
+// Route describes how to send traffic through a network interface.
+// A rule selecting Table by Mark and a default route in Table
+// via Interface will be added.
+type Route struct {
+	Name string `yaml:"-"`
+	// Interface is the name of the network interface, e.g. "wg0".
+	Interface string `yaml:"interface" validate:"required"`
+	// Gateway is the address of the router on Interface
+	// ipv4 traffic is sent to, e.g. an upstream router on a LAN.
+	// If Gateway is not set,
+	// the default route sends ipv4 traffic out of Interface directly,
+	// which is what point-to-point interfaces like WireGuard need.
+	Gateway *string `yaml:"gateway" validate:"omitempty,ip4_addr"`
+	// Gateway6 is the same as Gateway but for ipv6 traffic.
+	Gateway6 *string `yaml:"gateway6" validate:"omitempty,ip6_addr"`
+	// Table is the route table number for the default route via Interface.
+	// It must be different from the route-table of the whole configuration.
+	Table int `yaml:"table" validate:"required"`
+	// Mark is the fire wall mark set to traffic should go through Interface.
+	Mark FireWallMark `yaml:"mark" validate:"required"`
+	// Masquerade means that the source address of traffic
+	// will be changed to the address of Interface.
+	// This is required if the source address has been chosen
+	// before the traffic gets rerouted, which is true in most cases.
+	Masquerade bool `yaml:"masquerade"`
+}
+
+// Redirect describes a proxy server
+// accepting tcp traffic redirected to it by NAT,
+// which is useful for servers not support TPROXY.
+type Redirect struct {
+	Name   string `yaml:"-"`
+	NoIPv6 bool   `yaml:"no-ipv6"`
+	Port   uint16 `yaml:"port" validate:"required"`
+}
+
 type DNSHijack struct {
-	IP   *string `yaml:"ip" validate:"ip4_addr"`
+	// IP is the address of dns server for ipv4 dns request traffic.
+	// If IP is not set, ipv4 dns request traffic will not be hijacked,
+	// except that dns-hijack of tproxies defaults it to 127.0.0.1.
+	IP *string `yaml:"ip" validate:"omitempty,ip4_addr"`
+	// IP6 is the address of dns server for ipv6 dns request traffic.
+	// If IP6 is not set, ipv6 dns request traffic will not be hijacked.
+	IP6  *string `yaml:"ip6" validate:"omitempty,ip6_addr"`
 	Port uint16  `yaml:"port"`
 	// If TCP is set to true,
 	// tcp traffic will be hijacked, too,
 	// when it's destination port is 53.
 	TCP bool `yaml:"tcp"`
+	// If DropDoT is set to true,
+	// tcp traffic to port 853 (DNS over TLS) will be dropped,
+	// so applications fall back to plain dns, which can be hijacked.
+	DropDoT bool `yaml:"drop-dot"`
 }
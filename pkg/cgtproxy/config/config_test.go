@@ -113,6 +113,22 @@ var _ = Describe("Rule.String", func() {
 			"rule [ match: /direct/.* | DIRECT ]").WithFmt("direct"),
 		ContextTableEntry(&config.Rule{Match: "/proxy/.*", TProxy: "clash"},
 			"rule [ match: /proxy/.* | TPROXY clash ]").WithFmt("tproxy"),
+		ContextTableEntry(&config.Rule{AppID: "org.mozilla.firefox", UID: &[]uint32{1000}[0], TProxy: "clash"},
+			"rule [ app-id: org.mozilla.firefox, uid: 1000 | TPROXY clash ]").WithFmt("structured"),
+		ContextTableEntry(&config.Rule{Match: "/redirect/.*", Redirect: "redsocks"},
+			"rule [ match: /redirect/.* | REDIRECT redsocks ]").WithFmt("redirect"),
+		ContextTableEntry(&config.Rule{Slice: "cgtproxy-vpn.slice", Route: "vpn"},
+			"rule [ slice: cgtproxy-vpn.slice | ROUTE vpn ]").WithFmt("route"),
+		ContextTableEntry(&config.Rule{Unit: "tc.service", Mark: &config.Mark{Value: 0x100}},
+			"rule [ unit: tc.service | MARK 0x100 ]").WithFmt("mark"),
+		ContextTableEntry(&config.Rule{Unit: "tc.service", Mark: &config.Mark{Value: 0x100, Mask: 0xff00}},
+			"rule [ unit: tc.service | MARK 0x100/0xff00 ]").WithFmt("mark with mask"),
+		ContextTableEntry(&config.Rule{Slice: "filtered.slice", Direct: true, DNS: &config.DNSHijack{IP: &[]string{"127.0.0.1"}[0], Port: 5353}},
+			"rule [ slice: filtered.slice | DIRECT | DNS 127.0.0.1:5353 ]").WithFmt("dns"),
+		ContextTableEntry(&config.Rule{Slice: "sandbox.slice", Reject: config.RejectWithAdminProhibited},
+			"rule [ slice: sandbox.slice | REJECT admin-prohibited ]").WithFmt("reject"),
+		ContextTableEntry(&config.Rule{Slice: "audit.slice", TProxy: "clash", Log: &config.Log{Prefix: "audit: "}},
+			"rule [ slice: audit.slice | TPROXY clash | LOG \"audit: \" ]").WithFmt("log"),
 		func(rule *config.Rule, expected string) {
 			It("should render the expected string", func() {
 				Expect(rule.String()).To(Equal(expected))
@@ -130,3 +146,571 @@ var _ = Describe("WithLogger", func() {
 		Expect(err).ToNot(HaveOccurred())
 	})
 })
+
+var _ = Describe("Rule referring to a tproxy", func() {
+	It("should fail when the tproxy is not defined", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    port: 7893
+    mark: 4000
+rules:
+  - match: \/.*
+    tproxy: v2ray
+`)))
+		Expect(err).To(MatchError(config.ErrTProxyNotFound))
+	})
+
+	It("should fail when the redirect is not defined", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+redirects:
+  redsocks:
+    port: 12345
+rules:
+  - match: \/.*
+    redirect: v2ray
+`)))
+		Expect(err).To(MatchError(config.ErrRedirectNotFound))
+	})
+
+	It("should fail when a rule has both tproxy and redirect", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    port: 7893
+    mark: 4000
+redirects:
+  redsocks:
+    port: 12345
+rules:
+  - match: \/.*
+    tproxy: clash
+    redirect: redsocks
+`)))
+		var validationErrs validator.ValidationErrors
+		Expect(errors.As(err, &validationErrs)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Rule with structured match fields", func() {
+	It("should fail when no match field is set", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - direct: true
+`)))
+		var validationErrs validator.ValidationErrors
+		Expect(errors.As(err, &validationErrs)).To(BeTrue())
+	})
+
+	It("should complete unit and slice names", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - unit: clash-meta
+    direct: true
+  - unit: run-u22.scope
+    direct: true
+  - slice: cgtproxy-direct
+    uid: 1000
+    direct: true
+`)))
+		Expect(err).To(BeNil())
+		Expect(cfg.Rules[0].Unit).To(Equal("clash-meta.service"))
+		Expect(cfg.Rules[1].Unit).To(Equal("run-u22.scope"))
+		Expect(cfg.Rules[2].Slice).To(Equal("cgtproxy-direct.slice"))
+		Expect(*cfg.Rules[2].UID).To(Equal(uint32(1000)))
+	})
+})
+
+var _ = Describe("Route", func() {
+	ContextTable("loading configuration %s",
+		ContextTableEntry(`
+routes:
+  vpn:
+    interface: wg0
+    table: 400
+    mark: 600
+rules:
+  - match: \/.*
+    route: wireguard
+`, config.ErrRouteNotFound).WithFmt("using an undefined route"),
+		ContextTableEntry(`
+tproxies:
+  clash:
+    port: 7893
+    mark: 600
+routes:
+  vpn:
+    interface: wg0
+    table: 400
+    mark: 600
+`, config.ErrMarkConflict).WithFmt("sharing mark with a tproxy"),
+		ContextTableEntry(`
+routes:
+  vpn:
+    interface: wg0
+    table: 300
+    mark: 600
+`, config.ErrRouteTableConflict).WithFmt("using the route table of tproxies"),
+		ContextTableEntry(`
+routes:
+  vpn:
+    interface: wg0
+    table: 400
+    mark: 600
+  vpn2:
+    interface: wg1
+    table: 400
+    mark: 601
+`, config.ErrRouteTableConflict).WithFmt("sharing route table with another route"),
+		func(content string, expected error) {
+			It("should fail", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+` + content)))
+				Expect(err).To(MatchError(expected))
+			})
+		})
+
+	It("should accept gateways of routes", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+routes:
+  lan:
+    interface: eth0
+    gateway: 192.168.1.1
+    gateway6: fe80::1
+    table: 400
+    mark: 600
+`)))
+		Expect(err).To(Succeed())
+		Expect(*cfg.Routes["lan"].Gateway).To(Equal("192.168.1.1"))
+		Expect(*cfg.Routes["lan"].Gateway6).To(Equal("fe80::1"))
+	})
+
+	It("should refuse gateways of another family", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+routes:
+  lan:
+    interface: eth0
+    gateway: fe80::1
+    table: 400
+    mark: 600
+`)))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Rule with mark target", func() {
+	ContextTable("loading configuration %s",
+		ContextTableEntry(`
+tproxies:
+  clash:
+    port: 7893
+    mark: 0x10
+rules:
+  - match: \/.*
+    mark:
+      value: 0x10
+`, config.ErrMarkConflict).WithFmt("setting the mark of a tproxy"),
+		ContextTableEntry(`
+routes:
+  vpn:
+    interface: wg0
+    table: 400
+    mark: 0x100
+rules:
+  - match: \/.*
+    mark:
+      value: 0x1ff
+      mask: 0xff00
+`, config.ErrMarkConflict).WithFmt("setting the mark of a route under the mask"),
+		func(content string, expected error) {
+			It("should fail", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+` + content)))
+				Expect(err).To(MatchError(expected))
+			})
+		})
+
+	It("should accept marks not used by tproxies", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    port: 7893
+    mark: 0x10
+rules:
+  - match: \/a
+    mark:
+      value: 0x20
+  - match: \/b
+    mark:
+      value: 0x20
+`)))
+		Expect(err).To(BeNil())
+	})
+
+	It("should accept hexadecimal marks", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: \/.*
+    mark:
+      value: 0x100
+      mask: 0xff00
+`)))
+		Expect(err).To(BeNil())
+		Expect(cfg.Rules[0].Mark).To(Equal(&config.Mark{Value: 0x100, Mask: 0xff00}))
+	})
+})
+
+var _ = Describe("DNS hijack", func() {
+	It("should accept an IPv6 address", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    mark: 3000
+    port: 7893
+    dns-hijack:
+      ip: 127.0.0.1
+      ip6: ::1
+      port: 53
+      drop-dot: true
+`)))
+		Expect(err).To(BeNil())
+
+		dnsHijack := cfg.TProxies["clash"].DNSHijack
+		Expect(*dnsHijack.IP6).To(Equal("::1"))
+		Expect(dnsHijack.DropDoT).To(BeTrue())
+	})
+
+	It("should default ip of tproxies to the loopback address", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    mark: 3000
+    port: 7893
+    dns-hijack:
+      port: 53
+`)))
+		Expect(err).To(BeNil())
+		Expect(*cfg.TProxies["clash"].DNSHijack.IP).To(Equal("127.0.0.1"))
+	})
+
+	It("should accept an IPv6 only dns server of rules", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: \/.*
+    direct: true
+    dns:
+      ip6: ::1
+      port: 53
+`)))
+		Expect(err).To(BeNil())
+		Expect(cfg.Rules[0].DNS.IP).To(BeNil())
+		Expect(cfg.Rules[0].DNS.String()).To(Equal("[::1]:53"))
+	})
+
+	It("should fail when ip6 is not an IPv6 address", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    mark: 3000
+    port: 7893
+    dns-hijack:
+      ip: 127.0.0.1
+      ip6: 127.0.0.1
+      port: 53
+`)))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Rule with dns", func() {
+	It("should fail when used with drop", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: \/.*
+    drop: true
+    dns:
+      ip: 127.0.0.1
+      port: 53
+`)))
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should be accepted with direct", func() {
+		cfg, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: \/.*
+    direct: true
+    dns:
+      ip: 127.0.0.1
+      ip6: ::1
+      port: 5353
+`)))
+		Expect(err).To(BeNil())
+		Expect(*cfg.Rules[0].DNS.IP6).To(Equal("::1"))
+	})
+})
+
+var _ = Describe("Rule with reject target", func() {
+	ContextTable("rejecting with %s",
+		ContextTableEntry("admin-prohibited", true).WithFmt("admin-prohibited"),
+		ContextTableEntry("no-route", true).WithFmt("no-route"),
+		ContextTableEntry("tcp-reset", false).WithFmt("an unknown reason"),
+		func(reason string, valid bool) {
+			It("should be validated", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: \/.*
+    reject: ` + reason)))
+				if valid {
+					Expect(err).To(BeNil())
+				} else {
+					Expect(err).ToNot(BeNil())
+				}
+			})
+		})
+})
+
+var _ = Describe("Metrics", func() {
+	ContextTable("listening on %s",
+		ContextTableEntry("address: 127.0.0.1:9091", true).WithFmt("a tcp address"),
+		ContextTableEntry("unix: /run/cgtproxy/metrics.sock", true).WithFmt("a unix socket"),
+		ContextTableEntry(`
+    address: 127.0.0.1:9091
+    unix: /run/cgtproxy/metrics.sock`, false).WithFmt("both"),
+		ContextTableEntry("address: 9091", false).WithFmt("an invalid address"),
+		func(listen string, valid bool) {
+			It("should be validated", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+metrics:
+    ` + listen)))
+				if valid {
+					Expect(err).To(BeNil())
+				} else {
+					Expect(err).ToNot(BeNil())
+				}
+			})
+		})
+
+	It("should fail without any listener", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+metrics: {}
+`)))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Backend", func() {
+	It("should be nftables if omitted", func() {
+		cfg, err := config.New(config.WithContent([]byte(config.DefaultConfig)))
+		Expect(err).To(Succeed())
+		Expect(cfg.Backend).To(Equal(config.BackendNFTables))
+	})
+
+	ContextTable("bpf with %s",
+		ContextTableEntry(`
+tproxies:
+  clash:
+    port: 7893
+    mark: 520
+rules:
+  - match: \/.*
+    tproxy: clash
+`, config.ErrNotSupportedByBackend).WithFmt("a tproxy with udp"),
+		ContextTableEntry(`
+tproxies:
+  clash:
+    port: 7893
+    mark: 520
+    no-udp: true
+rules:
+  - match: \/.*
+    tproxy: clash
+`, nil).WithFmt("a tproxy without udp"),
+		ContextTableEntry(`
+redirects:
+  redsocks:
+    port: 12345
+rules:
+  - match: \/.*
+    redirect: redsocks
+`, nil).WithFmt("a redirect"),
+		ContextTableEntry(`
+routes:
+  vpn:
+    interface: wg0
+    table: 400
+    mark: 600
+`, config.ErrNotSupportedByBackend).WithFmt("a route"),
+		ContextTableEntry(`
+rules:
+  - match: \/.*
+    mark:
+      value: 0x100
+`, config.ErrNotSupportedByBackend).WithFmt("a mark rule"),
+		ContextTableEntry(`
+rules:
+  - match: \/.*
+    direct: true
+    log: {}
+`, config.ErrNotSupportedByBackend).WithFmt("a log rule"),
+		func(content string, expected error) {
+			It("should be validated", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+backend: bpf
+` + content)))
+				if expected == nil {
+					Expect(err).To(Succeed())
+				} else {
+					Expect(err).To(MatchError(expected))
+				}
+			})
+		})
+
+	It("should fail with an unknown backend", func() {
+		_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+backend: iptables
+`)))
+		Expect(err).ToNot(BeNil())
+	})
+})
+
+var _ = Describe("Monitor", func() {
+	It("should be notify if omitted", func() {
+		cfg, err := config.New(config.WithContent([]byte(config.DefaultConfig)))
+		Expect(err).To(Succeed())
+		Expect(cfg.Monitor.Backend).To(Equal(config.MonitorNotify))
+	})
+
+	It("should batch events by default", func() {
+		cfg, err := config.New(config.WithContent([]byte(config.DefaultConfig)))
+		Expect(err).To(Succeed())
+		Expect(*cfg.Monitor.MaxBatchDelay).To(Equal(config.DefaultMaxBatchDelay))
+		Expect(cfg.Monitor.MaxBatchSize).To(Equal(config.DefaultMaxBatchSize))
+	})
+
+	ContextTable("with %s",
+		ContextTableEntry(`
+  backend: inotify
+  buffer-size: 4096`, true).WithFmt("inotify"),
+		ContextTableEntry(`
+  backend: systemd`, true).WithFmt("systemd"),
+		ContextTableEntry(`
+  backend: fanotify`, false).WithFmt("an unknown backend"),
+		ContextTableEntry(`
+  buffer-size: -1`, false).WithFmt("a negative buffer size"),
+		ContextTableEntry(`
+  max-batch-delay: 0s
+  max-batch-size: 64`, true).WithFmt("batching"),
+		ContextTableEntry(`
+  max-batch-delay: -1s`, false).WithFmt("a negative batch delay"),
+		ContextTableEntry(`
+  max-batch-size: -1`, false).WithFmt("a negative batch size"),
+		func(monitor string, valid bool) {
+			It("should be validated", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+monitor:` + monitor)))
+				if valid {
+					Expect(err).To(BeNil())
+				} else {
+					Expect(err).ToNot(BeNil())
+				}
+			})
+		})
+})
+
+var _ = Describe("ReconcileInterval", func() {
+	It("should be 5m if omitted", func() {
+		cfg, err := config.New(config.WithContent([]byte(config.DefaultConfig)))
+		Expect(err).To(Succeed())
+		Expect(*cfg.ReconcileInterval).To(Equal(config.DefaultReconcileInterval))
+	})
+
+	ContextTable("with %s",
+		ContextTableEntry("1h30m", true).WithFmt("a duration"),
+		ContextTableEntry("0s", true).WithFmt("0s"),
+		ContextTableEntry("-1m", false).WithFmt("a negative duration"),
+		ContextTableEntry("soon", false).WithFmt("an invalid duration"),
+		func(interval string, valid bool) {
+			It("should be validated", func() {
+				_, err := config.New(config.WithContent([]byte(`
+version: 1
+cgroup-root: AUTO
+route-table: 300
+reconcile-interval: ` + interval)))
+				if valid {
+					Expect(err).To(BeNil())
+				} else {
+					Expect(err).ToNot(BeNil())
+				}
+			})
+		})
+})
@@ -4,6 +4,8 @@
 
 package config
 
+import "time"
+
 const (
 	DefaultConfig = `
 version: 1
@@ -15,3 +17,33 @@ rules:
 `
 	IPv4LocalhostStr = "127.0.0.1"
 )
+
+// Reasons to reject traffic.
+const (
+	RejectWithAdminProhibited = "admin-prohibited"
+	RejectWithPortUnreachable = "port-unreachable"
+	RejectWithHostUnreachable = "host-unreachable"
+	RejectWithNoRoute         = "no-route"
+)
+
+// Backends handling traffic of cgroups.
+const (
+	BackendNFTables = "nftables"
+	BackendBPF      = "bpf"
+)
+
+// Backends watching cgroups.
+const (
+	MonitorNotify  = "notify"
+	MonitorINotify = "inotify"
+	MonitorSystemd = "systemd"
+)
+
+const DefaultMonitorBufferSize = 1024
+
+const (
+	DefaultMaxBatchDelay = 100 * time.Millisecond
+	DefaultMaxBatchSize  = 1024
+)
+
+const DefaultReconcileInterval = 5 * time.Minute
@@ -10,4 +10,10 @@ import (
 
 var (
 	ErrCannotFoundCgroupv2Root = errors.New("`cgroup2` mount point not found.")
+	ErrTProxyNotFound          = errors.New("tproxy used in rule is not defined.")
+	ErrRedirectNotFound        = errors.New("redirect used in rule is not defined.")
+	ErrRouteNotFound           = errors.New("route used in rule is not defined.")
+	ErrMarkConflict            = errors.New("fire wall mark is used more than once.")
+	ErrRouteTableConflict      = errors.New("route table is used more than once.")
+	ErrNotSupportedByBackend   = errors.New("not supported by backend.")
 )
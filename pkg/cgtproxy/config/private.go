@@ -7,9 +7,12 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/go-playground/validator/v10"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 func (c *Config) check() (err error) {
@@ -56,6 +59,206 @@ func (c *Config) check() (err error) {
 		}
 	}
 
+	if c.Redirects == nil {
+		c.Redirects = map[string]*Redirect{}
+	}
+
+	for name := range c.Redirects {
+		redirect := c.Redirects[name]
+		if redirect.Name == "" {
+			redirect.Name = name
+		}
+	}
+
+	if c.Routes == nil {
+		c.Routes = map[string]*Route{}
+	}
+
+	for name := range c.Routes {
+		route := c.Routes[name]
+		if route.Name == "" {
+			route.Name = name
+		}
+	}
+
+	err = c.checkConflicts()
+	if err != nil {
+		return
+	}
+
+	if c.Backend == "" {
+		c.Backend = BackendNFTables
+	}
+
+	err = c.checkBackend()
+	if err != nil {
+		return
+	}
+
+	if c.Monitor.Backend == "" {
+		c.Monitor.Backend = MonitorNotify
+	}
+
+	if c.Monitor.MaxBatchDelay == nil {
+		delay := DefaultMaxBatchDelay
+		c.Monitor.MaxBatchDelay = &delay
+	}
+
+	if c.Monitor.MaxBatchSize == 0 {
+		c.Monitor.MaxBatchSize = DefaultMaxBatchSize
+	}
+
+	if c.ReconcileInterval == nil {
+		interval := DefaultReconcileInterval
+		c.ReconcileInterval = &interval
+	}
+
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Unit != "" &&
+			!strings.HasSuffix(rule.Unit, ".service") &&
+			!strings.HasSuffix(rule.Unit, ".scope") {
+			rule.Unit += ".service"
+		}
+		if rule.Slice != "" && !strings.HasSuffix(rule.Slice, ".slice") {
+			rule.Slice += ".slice"
+		}
+
+		if rule.Redirect != "" {
+			if _, ok := c.Redirects[rule.Redirect]; !ok {
+				err = fmt.Errorf("%w: %s", ErrRedirectNotFound, rule.Redirect)
+				return
+			}
+		}
+
+		if rule.Route != "" {
+			if _, ok := c.Routes[rule.Route]; !ok {
+				err = fmt.Errorf("%w: %s", ErrRouteNotFound, rule.Route)
+				return
+			}
+		}
+
+		if rule.TProxy == "" {
+			continue
+		}
+
+		if _, ok := c.TProxies[rule.TProxy]; ok {
+			continue
+		}
+
+		err = fmt.Errorf("%w: %s", ErrTProxyNotFound, rule.TProxy)
+		return
+	}
+
+	return
+}
+
+// checkConflicts makes sure that
+// fire wall marks and route tables are not shared,
+// as cgtproxy removes rules and routes it added when exiting,
+// and that rules do not set marks of tproxies and routes.
+func (c *Config) checkConflicts() (err error) {
+	marks := map[FireWallMark]string{}
+	tables := map[int]string{c.RouteTable: "route-table"}
+
+	names := maps.Keys(c.TProxies)
+	slices.Sort(names)
+
+	for _, name := range names {
+		tp := c.TProxies[name]
+		if other, ok := marks[tp.Mark]; ok {
+			err = fmt.Errorf("%w: %d (%s, %s)", ErrMarkConflict, tp.Mark, other, name)
+			return
+		}
+
+		marks[tp.Mark] = name
+	}
+
+	names = maps.Keys(c.Routes)
+	slices.Sort(names)
+
+	for _, name := range names {
+		route := c.Routes[name]
+		if other, ok := marks[route.Mark]; ok {
+			err = fmt.Errorf("%w: %d (%s, %s)", ErrMarkConflict, route.Mark, other, name)
+			return
+		}
+
+		marks[route.Mark] = name
+
+		if other, ok := tables[route.Table]; ok {
+			err = fmt.Errorf("%w: %d (%s, %s)", ErrRouteTableConflict, route.Table, other, name)
+			return
+		}
+
+		tables[route.Table] = name
+	}
+
+	// NOTE:
+	// Traffic with a mark set by a rule would be sent
+	// into the route table of the tproxy or route using the same mark.
+	for i := range c.Rules {
+		if c.Rules[i].Mark == nil {
+			continue
+		}
+
+		mark := c.Rules[i].Mark.Value
+		if c.Rules[i].Mark.Mask != 0 {
+			mark &= c.Rules[i].Mark.Mask
+		}
+
+		if other, ok := marks[mark]; ok {
+			err = fmt.Errorf("%w: %d (%s, rule %d)", ErrMarkConflict, mark, other, i)
+			return
+		}
+	}
+
+	return
+}
+
+// checkBackend makes sure that
+// nothing the backend cannot do is configured.
+func (c *Config) checkBackend() (err error) {
+	if c.Backend != BackendBPF {
+		return
+	}
+
+	for name, tp := range c.TProxies {
+		if tp.NoUDP {
+			continue
+		}
+
+		err = fmt.Errorf(
+			"%w: udp of tproxy %s, set no-udp (%s)",
+			ErrNotSupportedByBackend, name, c.Backend,
+		)
+		return
+	}
+
+	if len(c.Routes) != 0 {
+		err = fmt.Errorf("%w: routes (%s)", ErrNotSupportedByBackend, c.Backend)
+		return
+	}
+
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+
+		var what string
+		if rule.Mark != nil {
+			what = "mark"
+		} else if rule.Log != nil {
+			what = "log"
+		} else {
+			continue
+		}
+
+		err = fmt.Errorf(
+			"%w: %s in rule %d (%s)",
+			ErrNotSupportedByBackend, what, i, c.Backend,
+		)
+		return
+	}
+
 	return
 }
 
@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Hash returns the hex encoded sha256 of the content configuration loaded from.
+func (c *Config) Hash() string {
+	sum := sha256.Sum256(c.raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -6,17 +6,79 @@ package config
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 func (r *Rule) String() string {
+	conditions := []string{}
+	if r.Match != "" {
+		conditions = append(conditions, "match: "+r.Match)
+	}
+	if r.AppID != "" {
+		conditions = append(conditions, "app-id: "+r.AppID)
+	}
+	if r.Unit != "" {
+		conditions = append(conditions, "unit: "+r.Unit)
+	}
+	if r.Slice != "" {
+		conditions = append(conditions, "slice: "+r.Slice)
+	}
+	if r.UID != nil {
+		conditions = append(conditions, fmt.Sprintf("uid: %d", *r.UID))
+	}
+
+	condition := strings.Join(conditions, ", ")
+
+	var target string
 	if r.Drop {
-		return fmt.Sprintf("rule [ match: %s | DROP ]", r.Match)
+		target = "DROP"
 	} else if r.Direct {
-		return fmt.Sprintf("rule [ match: %s | DIRECT ]", r.Match)
+		target = "DIRECT"
 	} else if r.TProxy != "" {
-		return fmt.Sprintf("rule [ match: %s | TPROXY %s ]",
-			r.Match, r.TProxy)
+		target = "TPROXY " + r.TProxy
+	} else if r.Redirect != "" {
+		target = "REDIRECT " + r.Redirect
+	} else if r.Route != "" {
+		target = "ROUTE " + r.Route
+	} else if r.Mark != nil {
+		target = "MARK " + r.Mark.String()
+	} else if r.Reject != "" {
+		target = "REJECT " + r.Reject
+	} else {
+		panic("this should never happened")
+	}
+
+	if r.DNS != nil {
+		target += " | DNS " + r.DNS.String()
+	}
+
+	if r.Log != nil {
+		target += " | LOG"
+		if r.Log.Prefix != "" {
+			target += " " + strconv.Quote(r.Log.Prefix)
+		}
+	}
+
+	return fmt.Sprintf("rule [ %s | %s ]", condition, target)
+}
+
+func (d *DNSHijack) String() string {
+	addrs := []string{}
+	if d.IP != nil {
+		addrs = append(addrs, fmt.Sprintf("%s:%d", *d.IP, d.Port))
+	}
+	if d.IP6 != nil {
+		addrs = append(addrs, fmt.Sprintf("[%s]:%d", *d.IP6, d.Port))
+	}
+
+	return strings.Join(addrs, ", ")
+}
+
+func (m *Mark) String() string {
+	if m.Mask == 0 {
+		return fmt.Sprintf("%#x", uint32(m.Value))
 	}
 
-	panic("this should never happened")
+	return fmt.Sprintf("%#x/%#x", uint32(m.Value), uint32(m.Mask))
 }
@@ -13,4 +13,6 @@ var (
 	ErrLoggerMissing        = errors.New("logger is missing.")
 	ErrCGroupMonitorMissing = errors.New("cgroup monitor is missing.")
 	ErrRouteManagerMissing  = errors.New("route manager is missing.")
+	ErrMetricsMissing       = errors.New("metrics is missing.")
+	ErrControlServerMissing = errors.New("control server is missing.")
 )
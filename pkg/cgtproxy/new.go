@@ -20,6 +20,10 @@ type CGTProxy struct {
 
 	cgMonitor interfaces.CGroupMonitor
 	rtManager interfaces.RouteManager
+	// metrics is nil if metrics server should not be run.
+	metrics interfaces.Metrics
+	// ctlServer is nil if control server should not be run.
+	ctlServer interfaces.ControlServer
 }
 
 type Opt = (func(*CGTProxy) (*CGTProxy, error))
@@ -117,3 +121,29 @@ func WithRouteManager(rman interfaces.RouteManager) Opt {
 		return
 	}
 }
+
+func WithMetrics(m interfaces.Metrics) Opt {
+	return func(core *CGTProxy) (ret *CGTProxy, err error) {
+		if m == nil {
+			err = ErrMetricsMissing
+			return
+		}
+
+		core.metrics = m
+		ret = core
+		return
+	}
+}
+
+func WithControlServer(s interfaces.ControlServer) Opt {
+	return func(core *CGTProxy) (ret *CGTProxy, err error) {
+		if s == nil {
+			err = ErrControlServerMissing
+			return
+		}
+
+		core.ctlServer = s
+		ret = core
+		return
+	}
+}
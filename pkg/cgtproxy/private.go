@@ -33,3 +33,19 @@ func (c *CGTProxy) runCGroupMonitor(ctx context.Context) (err error) {
 
 	return ctx.Err()
 }
+
+func (c *CGTProxy) runMetricsServer(ctx context.Context) (err error) {
+	defer c.log.Debug("Metrics server exited.")
+
+	c.log.Debug("Start metrics server.")
+
+	return c.metrics.RunMetricsServer(ctx)
+}
+
+func (c *CGTProxy) runControlServer(ctx context.Context) (err error) {
+	defer c.log.Debug("Control server exited.")
+
+	c.log.Debug("Start control server.")
+
+	return c.ctlServer.RunControlServer(ctx)
+}
@@ -7,6 +7,8 @@ package cgtproxy
 import (
 	"context"
 
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/sourcegraph/conc/pool"
 )
@@ -23,5 +25,45 @@ func (c *CGTProxy) RunCGTProxy(ctx context.Context) (err error) {
 	pool.Go(c.runCGroupMonitor)
 	pool.Go(c.runRouteManager)
 
+	if c.metrics != nil {
+		pool.Go(c.runMetricsServer)
+	}
+
+	if c.ctlServer != nil {
+		pool.Go(c.runControlServer)
+	}
+
 	return pool.Wait()
 }
+
+// Reload makes cgtproxy use a new configuration without restarting.
+// The old configuration is kept if the new one cannot be applied.
+func (c *CGTProxy) Reload(cfg *config.Config) (err error) {
+	defer Wrap(&err, "reload cgtproxy core")
+
+	if cfg == nil {
+		err = ErrConfigMissing
+		return
+	}
+
+	err = c.rtManager.Reload(cfg)
+	if err != nil {
+		return
+	}
+
+	c.cfg = cfg
+
+	c.log.Debugw("Core reloaded.",
+		"configuration", c.cfg,
+	)
+
+	return
+}
+
+// Reconcile fixes differences between cgroupfs and the cgroup map
+// left by cgroup events missed.
+func (c *CGTProxy) Reconcile() (ret types.Drift, err error) {
+	defer Wrap(&err, "reconcile cgtproxy core")
+
+	return c.rtManager.Reconcile()
+}
@@ -0,0 +1,9 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cgtrace
+
+// maxLineSize is the size limit of a line in a trace,
+// a batch of the first walk through a busy cgroupfs can be large.
+const maxLineSize = 64 * 1024 * 1024
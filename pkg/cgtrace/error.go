@@ -0,0 +1,11 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package cgtrace
+
+import "errors"
+
+var (
+	ErrOutsideRoot = errors.New("cgroup is not under cgroup root.")
+)
@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package recorder
+
+import "errors"
+
+var (
+	ErrCGroupMonitorMissing = errors.New("cgroup monitor is missing.")
+	ErrCGroupRootMissing    = errors.New("cgroup v2 file system mount point is missing.")
+	ErrPathMissing          = errors.New("path of trace file is missing.")
+	ErrLoggerMissing        = errors.New("logger is missing.")
+)
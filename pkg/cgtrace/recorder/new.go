@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package recorder
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"go.uber.org/zap"
+)
+
+// Recorder is an interfaces.CGroupMonitor wrapping another one,
+// it writes every batch of events sent by the wrapped monitor
+// to a trace file before passing it on.
+type Recorder struct {
+	monitor interfaces.CGroupMonitor
+	root    config.CGroupRoot
+	path    string
+	log     *zap.SugaredLogger
+
+	eventsOut chan types.CGroupEvents
+}
+
+type Opt = (func(*Recorder) (*Recorder, error))
+
+func New(opts ...Opt) (ret *Recorder, err error) {
+	defer Wrap(&err, "create cgroup events recorder")
+
+	r := &Recorder{}
+
+	for i := range opts {
+		r, err = opts[i](r)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.log == nil {
+		r.log = zap.NewNop().Sugar()
+	}
+
+	if r.monitor == nil {
+		err = ErrCGroupMonitorMissing
+		return
+	}
+
+	if r.root == "" {
+		err = ErrCGroupRootMissing
+		return
+	}
+
+	if r.path == "" {
+		err = ErrPathMissing
+		return
+	}
+
+	r.eventsOut = make(chan types.CGroupEvents)
+
+	ret = r
+
+	r.log.Debugw("Create a cgroup events recorder.",
+		"file", r.path,
+	)
+
+	return
+}
+
+func WithCGroupMonitor(mon interfaces.CGroupMonitor) Opt {
+	return func(r *Recorder) (ret *Recorder, err error) {
+		if mon == nil {
+			err = ErrCGroupMonitorMissing
+			return
+		}
+
+		r.monitor = mon
+		ret = r
+		return
+	}
+}
+
+func WithCgroupRoot(root config.CGroupRoot) Opt {
+	return func(r *Recorder) (ret *Recorder, err error) {
+		if root == "" {
+			err = ErrCGroupRootMissing
+			return
+		}
+
+		r.root = root
+		ret = r
+		return
+	}
+}
+
+// WithPath sets the trace file to write,
+// it is truncated when the recorder starts.
+func WithPath(path string) Opt {
+	return func(r *Recorder) (ret *Recorder, err error) {
+		if path == "" {
+			err = ErrPathMissing
+			return
+		}
+
+		r.path = path
+		ret = r
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(r *Recorder) (ret *Recorder, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		r.log = log
+		ret = r
+		return
+	}
+}
@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package recorder
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtrace"
+)
+
+// forward records and passes on events of the wrapped monitor,
+// until the wrapped monitor stops sending events or ctx is done.
+func (r *Recorder) forward(ctx context.Context, w io.Writer) {
+	for events := range r.monitor.Events() {
+		record, err := cgtrace.NewRecord(string(r.root), time.Now(), events.Events)
+		if err == nil {
+			err = cgtrace.Write(w, record)
+		}
+		if err != nil {
+			r.log.Errorw("Failed to record cgroup events.",
+				"size", len(events.Events),
+				"error", err,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case r.eventsOut <- events:
+		}
+	}
+}
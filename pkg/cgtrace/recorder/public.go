@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package recorder
+
+import (
+	"context"
+	"os"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+func (r *Recorder) Events() <-chan types.CGroupEvents {
+	return r.eventsOut
+}
+
+// RunCGroupMonitor runs the wrapped monitor
+// and records events it sends until it exits.
+// Failing to record a batch is logged
+// but never stops events from being passed on.
+func (r *Recorder) RunCGroupMonitor(ctx context.Context) (err error) {
+	defer Wrap(&err, "run cgroup events recorder")
+	defer close(r.eventsOut)
+
+	var file *os.File
+	file, err = os.OpenFile(r.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	r.log.Infow("Recording cgroup events.",
+		"file", r.path,
+	)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.monitor.RunCGroupMonitor(ctx)
+	}()
+
+	r.forward(ctx, file)
+
+	err = <-done
+	return
+}
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package recorder_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace/recorder"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace/replayer"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRecorder(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Recorder Suite")
+}
+
+// fakeMonitor sends batches given to it,
+// then exits or waits for ctx to be done if wait is set.
+type fakeMonitor struct {
+	batches [][]types.CGroupEvent
+	wait    bool
+	out     chan types.CGroupEvents
+}
+
+func (m *fakeMonitor) Events() <-chan types.CGroupEvents {
+	return m.out
+}
+
+func (m *fakeMonitor) RunCGroupMonitor(ctx context.Context) error {
+	defer close(m.out)
+
+	for _, events := range m.batches {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m.out <- types.CGroupEvents{Events: events}:
+		}
+	}
+
+	if m.wait {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+var _ = Describe("Recorder", func() {
+	const recorded = "/sys/fs/cgroup"
+
+	var (
+		trace   string
+		batches [][]types.CGroupEvent
+		mon     *fakeMonitor
+	)
+
+	BeforeEach(func() {
+		trace = filepath.Join(GinkgoT().TempDir(), "trace.jsonl")
+		batches = [][]types.CGroupEvent{
+			{
+				{Path: recorded + "/user.slice", EventType: types.CgroupEventTypeNew},
+				{Path: recorded + "/user.slice/a.service", EventType: types.CgroupEventTypeNew},
+			},
+			{
+				{Path: recorded + "/user.slice/b.service", EventType: types.CgroupEventTypeNew},
+			},
+			{
+				{Path: recorded + "/user.slice/a.service", EventType: types.CgroupEventTypeDelete},
+			},
+		}
+		mon = &fakeMonitor{
+			batches: batches,
+			out:     make(chan types.CGroupEvents),
+		}
+	})
+
+	newRecorder := func() *recorder.Recorder {
+		r, err := recorder.New(
+			recorder.WithCGroupMonitor(mon),
+			recorder.WithCgroupRoot(config.CGroupRoot(recorded)),
+			recorder.WithPath(trace),
+		)
+		Expect(err).To(Succeed())
+		return r
+	}
+
+	It("should pass batches on unchanged", func() {
+		r := newRecorder()
+
+		done := make(chan error, 1)
+		go func() { done <- r.RunCGroupMonitor(context.Background()) }()
+
+		received := [][]types.CGroupEvent{}
+		for events := range r.Events() {
+			received = append(received, events.Events)
+		}
+
+		Expect(<-done).To(Succeed())
+		Expect(received).To(Equal(batches))
+	})
+
+	It("should record batches which replay the same", func() {
+		r := newRecorder()
+
+		done := make(chan error, 1)
+		go func() { done <- r.RunCGroupMonitor(context.Background()) }()
+		for range r.Events() {
+		}
+		Expect(<-done).To(Succeed())
+
+		root := GinkgoT().TempDir()
+		p, err := replayer.New(
+			replayer.WithTrace(trace),
+			replayer.WithCgroupRoot(config.CGroupRoot(root)),
+		)
+		Expect(err).To(Succeed())
+
+		go func() { done <- p.RunCGroupMonitor(context.Background()) }()
+
+		replayed := [][]types.CGroupEvent{}
+		for events := range p.Events() {
+			replayed = append(replayed, events.Events)
+			events.Result <- nil
+		}
+		Expect(<-done).To(Succeed())
+
+		expected := [][]types.CGroupEvent{}
+		for _, events := range batches {
+			moved := []types.CGroupEvent{}
+			for _, event := range events {
+				event.Path = root + strings.TrimPrefix(event.Path, recorded)
+				moved = append(moved, event)
+			}
+			expected = append(expected, moved)
+		}
+
+		Expect(replayed).To(Equal(expected))
+	})
+
+	It("should stop when the context is done", func() {
+		mon.wait = true
+		r := newRecorder()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- r.RunCGroupMonitor(ctx) }()
+
+		for range batches {
+			Eventually(r.Events()).Should(Receive())
+		}
+
+		cancel()
+		Eventually(done).Should(Receive(MatchError(context.Canceled)))
+		Eventually(r.Events()).Should(BeClosed())
+
+		content, err := os.ReadFile(trace)
+		Expect(err).To(Succeed())
+		Expect(strings.Count(string(content), "\n")).To(Equal(len(batches)))
+	})
+
+	It("should fail if the trace file cannot be created", func() {
+		trace = filepath.Join(GinkgoT().TempDir(), "missing", "trace.jsonl")
+		r := newRecorder()
+
+		Expect(r.RunCGroupMonitor(context.Background())).
+			To(MatchError(os.ErrNotExist))
+		Eventually(r.Events()).Should(BeClosed())
+	})
+
+	It("should refuse to be created without a monitor", func() {
+		_, err := recorder.New(
+			recorder.WithCgroupRoot(config.CGroupRoot(recorded)),
+			recorder.WithPath(trace),
+		)
+		Expect(err).To(MatchError(recorder.ErrCGroupMonitorMissing))
+	})
+})
@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package replayer
+
+import "errors"
+
+var (
+	ErrTraceMissing      = errors.New("trace to replay is missing.")
+	ErrCGroupRootMissing = errors.New("cgroup root to replay trace in is missing.")
+	ErrSpeedInvalid      = errors.New("speed of replaying must not be negative.")
+	ErrLoggerMissing     = errors.New("logger is missing.")
+)
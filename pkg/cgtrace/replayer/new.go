@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package replayer
+
+import (
+	"os"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"go.uber.org/zap"
+)
+
+// Replayer is an interfaces.CGroupMonitor sending events in a trace
+// instead of watching a cgroupfs.
+// Cgroups in the trace are created and removed
+// as directories under the cgroup root it replays the trace in,
+// which is usually a temporary directory.
+type Replayer struct {
+	records []*cgtrace.Record
+	root    config.CGroupRoot
+	// speed is how many times faster than recorded the trace is replayed,
+	// 0 means batches are sent one by one without waiting.
+	speed float64
+	log   *zap.SugaredLogger
+
+	eventsOut chan types.CGroupEvents
+}
+
+type Opt = (func(*Replayer) (*Replayer, error))
+
+func New(opts ...Opt) (ret *Replayer, err error) {
+	defer Wrap(&err, "create cgroup events replayer")
+
+	r := &Replayer{}
+
+	for i := range opts {
+		r, err = opts[i](r)
+		if err != nil {
+			return
+		}
+	}
+
+	if r.log == nil {
+		r.log = zap.NewNop().Sugar()
+	}
+
+	if r.records == nil {
+		err = ErrTraceMissing
+		return
+	}
+
+	if r.root == "" {
+		err = ErrCGroupRootMissing
+		return
+	}
+
+	r.eventsOut = make(chan types.CGroupEvents)
+
+	ret = r
+
+	r.log.Debugw("Create a cgroup events replayer.",
+		"records", len(r.records),
+		"root", r.root,
+	)
+
+	return
+}
+
+// WithTrace reads the trace file at path to replay.
+func WithTrace(path string) Opt {
+	return func(r *Replayer) (ret *Replayer, err error) {
+		var file *os.File
+		file, err = os.Open(path)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		r.records, err = cgtrace.Read(file)
+		if err != nil {
+			return
+		}
+
+		ret = r
+		return
+	}
+}
+
+func WithCgroupRoot(root config.CGroupRoot) Opt {
+	return func(r *Replayer) (ret *Replayer, err error) {
+		if root == "" {
+			err = ErrCGroupRootMissing
+			return
+		}
+
+		r.root = root
+		ret = r
+		return
+	}
+}
+
+// WithSpeed makes the replayer wait between batches
+// as long as they were recorded divided by speed.
+func WithSpeed(speed float64) Opt {
+	return func(r *Replayer) (ret *Replayer, err error) {
+		if speed < 0 {
+			err = ErrSpeedInvalid
+			return
+		}
+
+		r.speed = speed
+		ret = r
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(r *Replayer) (ret *Replayer, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		r.log = log
+		ret = r
+		return
+	}
+}
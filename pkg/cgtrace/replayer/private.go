@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package replayer
+
+import (
+	"os"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+// apply makes directories of cgroups the way events say.
+//
+// NOTE:
+// A deleted cgroup is removed with everything under it,
+// as cgroups under it must have been deleted in the recorded system,
+// even if their events were lost.
+// Events of a cgroup which does not exist any more
+// or exists already are kept, as monitors may send them as well.
+func apply(events []types.CGroupEvent) (err error) {
+	for i := range events {
+		path := events[i].Path
+
+		switch events[i].EventType {
+		case types.CgroupEventTypeNew:
+			err = os.MkdirAll(path, 0755)
+		case types.CgroupEventTypeDelete:
+			err = os.RemoveAll(path)
+		}
+
+		if err != nil {
+			Wrap(&err, "apply %s event of %s", events[i].EventType, path)
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package replayer
+
+import (
+	"context"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+func (r *Replayer) Events() <-chan types.CGroupEvents {
+	return r.eventsOut
+}
+
+// RunCGroupMonitor replays the trace and returns when it is done.
+// A batch is sent after cgroups in it are created or removed,
+// and the next one is not sent until the receiver has handled it,
+// so the receiver sees the same thing whenever the trace is replayed.
+// Errors of the receiver handling batches are logged only,
+// as they may be exactly what the trace is recorded for.
+func (r *Replayer) RunCGroupMonitor(ctx context.Context) (err error) {
+	defer Wrap(&err, "replay cgroup events")
+	defer close(r.eventsOut)
+
+	for i, record := range r.records {
+		if i != 0 {
+			err = r.wait(ctx, record.Time.Sub(r.records[i-1].Time))
+			if err != nil {
+				return
+			}
+		}
+
+		var events []types.CGroupEvent
+		events, err = record.CGroupEvents(string(r.root))
+		if err != nil {
+			return
+		}
+
+		err = apply(events)
+		if err != nil {
+			return
+		}
+
+		result := make(chan error, 1)
+
+		select {
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+			return
+		case r.eventsOut <- types.CGroupEvents{Events: events, Result: result}:
+		}
+
+		select {
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+			return
+		case handleErr := <-result:
+			if handleErr == nil {
+				break
+			}
+
+			r.log.Warnw("Failed to handle replayed cgroup events.",
+				"record", i,
+				"time", record.Time,
+				"error", handleErr,
+			)
+		}
+	}
+
+	r.log.Infow("Trace replayed.",
+		"records", len(r.records),
+	)
+
+	return
+}
+
+func (r *Replayer) wait(ctx context.Context, d time.Duration) (err error) {
+	if r.speed == 0 || d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(float64(d) / r.speed))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	case <-timer.C:
+	}
+
+	return
+}
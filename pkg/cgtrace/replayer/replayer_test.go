@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package replayer_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace/recorder"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace/replayer"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestReplayer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Replayer Suite")
+}
+
+// fakeMonitor sends batches given to it and exits.
+type fakeMonitor struct {
+	batches [][]types.CGroupEvent
+	out     chan types.CGroupEvents
+}
+
+func (m *fakeMonitor) Events() <-chan types.CGroupEvents {
+	return m.out
+}
+
+func (m *fakeMonitor) RunCGroupMonitor(ctx context.Context) error {
+	defer close(m.out)
+
+	for _, events := range m.batches {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m.out <- types.CGroupEvents{Events: events}:
+		}
+	}
+
+	return nil
+}
+
+var _ = Describe("Replayer", func() {
+	var (
+		recorded string
+		trace    string
+	)
+
+	BeforeEach(func() {
+		recorded = "/sys/fs/cgroup"
+		trace = filepath.Join(GinkgoT().TempDir(), "trace.jsonl")
+
+		mon := &fakeMonitor{
+			out: make(chan types.CGroupEvents),
+			batches: [][]types.CGroupEvent{
+				{
+					{Path: recorded + "/user.slice", EventType: types.CgroupEventTypeNew},
+					{Path: recorded + "/user.slice/a.service", EventType: types.CgroupEventTypeNew},
+				},
+				{
+					{Path: recorded + "/user.slice/b.service", EventType: types.CgroupEventTypeNew},
+				},
+				{
+					{Path: recorded + "/user.slice/a.service", EventType: types.CgroupEventTypeDelete},
+				},
+			},
+		}
+
+		r, err := recorder.New(
+			recorder.WithCGroupMonitor(mon),
+			recorder.WithCgroupRoot(config.CGroupRoot(recorded)),
+			recorder.WithPath(trace),
+		)
+		Expect(err).To(Succeed())
+
+		received := 0
+		done := make(chan error, 1)
+		go func() { done <- r.RunCGroupMonitor(context.Background()) }()
+		for range r.Events() {
+			received++
+		}
+
+		Expect(<-done).To(Succeed())
+		Expect(received).To(Equal(3))
+	})
+
+	It("should write a line with relative paths for each batch", func() {
+		content, err := os.ReadFile(trace)
+		Expect(err).To(Succeed())
+		Expect(strings.Count(string(content), "\n")).To(Equal(3))
+		Expect(string(content)).To(ContainSubstring(
+			`"events":[{"path":"user.slice/a.service","type":"Delete"}]`,
+		))
+	})
+
+	It("should create cgroups under another root before sending them", func() {
+		root := GinkgoT().TempDir()
+
+		r, err := replayer.New(
+			replayer.WithTrace(trace),
+			replayer.WithCgroupRoot(config.CGroupRoot(root)),
+		)
+		Expect(err).To(Succeed())
+
+		done := make(chan error, 1)
+		go func() { done <- r.RunCGroupMonitor(context.Background()) }()
+
+		batches := [][]types.CGroupEvent{}
+		for events := range r.Events() {
+			for i := range events.Events {
+				if events.Events[i].EventType != types.CgroupEventTypeNew {
+					continue
+				}
+
+				Expect(events.Events[i].Path).To(BeADirectory())
+			}
+
+			batches = append(batches, events.Events)
+			events.Result <- nil
+		}
+
+		Expect(<-done).To(Succeed())
+		Expect(batches).To(HaveLen(3))
+		Expect(batches[2]).To(Equal([]types.CGroupEvent{{
+			Path:      root + "/user.slice/a.service",
+			EventType: types.CgroupEventTypeDelete,
+		}}))
+		Expect(filepath.Join(root, "user.slice/a.service")).ToNot(BeADirectory())
+		Expect(filepath.Join(root, "user.slice/b.service")).To(BeADirectory())
+	})
+
+	It("should refuse traces with cgroups outside the root", func() {
+		Expect(os.WriteFile(trace, []byte(
+			`{"time":"2025-01-01T00:00:00Z","events":[{"path":"../etc","type":"New"}]}`+"\n",
+		), 0644)).To(Succeed())
+
+		r, err := replayer.New(
+			replayer.WithTrace(trace),
+			replayer.WithCgroupRoot(config.CGroupRoot(GinkgoT().TempDir())),
+		)
+		Expect(err).To(Succeed())
+
+		go func() {
+			for range r.Events() {
+			}
+		}()
+
+		Expect(r.RunCGroupMonitor(context.Background())).
+			To(MatchError(cgtrace.ErrOutsideRoot))
+	})
+})
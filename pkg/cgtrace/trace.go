@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package cgtrace defines traces of cgroup events,
+// which are written by recorder and fed to route manager by replayer,
+// so that bugs depending on order of events can be reproduced.
+//
+// A trace is a file of JSON lines,
+// each line is a Record of a batch of events sent by a cgroup monitor.
+// Paths of cgroups are relative to the cgroup root,
+// so a trace can be replayed under any directory.
+package cgtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+// Record is a batch of cgroup events in a trace.
+type Record struct {
+	// Time is when the batch was sent by the cgroup monitor.
+	Time   time.Time `json:"time"`
+	Events []Event   `json:"events"`
+}
+
+type Event struct {
+	// Path is the path of the cgroup relative to the cgroup root.
+	Path string                `json:"path"`
+	Type types.CgroupEventType `json:"type"`
+}
+
+// NewRecord makes a record of events under root sent at t.
+func NewRecord(root string, t time.Time, events []types.CGroupEvent) (ret *Record, err error) {
+	defer Wrap(&err, "make record of cgroup events")
+
+	r := &Record{Time: t, Events: make([]Event, 0, len(events))}
+
+	for i := range events {
+		var path string
+		path, err = filepath.Rel(root, events[i].Path)
+		if err != nil {
+			return
+		}
+
+		if outside(path) {
+			err = ErrOutsideRoot
+			return
+		}
+
+		r.Events = append(r.Events, Event{
+			Path: path,
+			Type: events[i].EventType,
+		})
+	}
+
+	ret = r
+	return
+}
+
+// CGroupEvents returns events in the record as if they happened under root.
+func (r *Record) CGroupEvents(root string) (ret []types.CGroupEvent, err error) {
+	defer Wrap(&err, "get cgroup events of record at %s", r.Time)
+
+	events := make([]types.CGroupEvent, 0, len(r.Events))
+
+	for i := range r.Events {
+		path := filepath.Clean(r.Events[i].Path)
+		if outside(path) {
+			err = ErrOutsideRoot
+			return
+		}
+
+		events = append(events, types.CGroupEvent{
+			Path:      filepath.Join(root, path),
+			EventType: r.Events[i].Type,
+		})
+	}
+
+	ret = events
+	return
+}
+
+// Read reads all records of a trace from reader.
+func Read(reader io.Reader) (ret []*Record, err error) {
+	defer Wrap(&err, "read trace")
+
+	records := []*Record{}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, maxLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		r := &Record{}
+		err = json.Unmarshal(scanner.Bytes(), r)
+		if err != nil {
+			err = fmt.Errorf("line %d: %w", line, err)
+			return
+		}
+
+		records = append(records, r)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+
+	ret = records
+	return
+}
+
+// Write writes record to writer as a line of a trace.
+func Write(writer io.Writer, record *Record) (err error) {
+	defer Wrap(&err, "write record")
+
+	var data []byte
+	data, err = json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	// NOTE:
+	// A record is written by a single write,
+	// so a trace is readable even if cgtproxy gets killed.
+	_, err = writer.Write(append(data, '\n'))
+	return
+}
+
+// outside tells whether a cleaned path relative to a directory
+// points to somewhere outside the directory.
+func outside(path string) bool {
+	return filepath.IsAbs(path) ||
+		path == ".." || strings.HasPrefix(path, "../")
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/black-desk/cgtproxy/pkg/control"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+var ErrSocketPathMissing = errors.New("socket path is missing.")
+
+// Client talks to the control server of a running cgtproxy.
+type Client struct {
+	path string
+	http *http.Client
+}
+
+type Opt = (func(*Client) (*Client, error))
+
+func New(opts ...Opt) (ret *Client, err error) {
+	defer Wrap(&err, "create control client")
+
+	c := &Client{}
+	for i := range opts {
+		c, err = opts[i](c)
+		if err != nil {
+			return
+		}
+	}
+
+	if c.path == "" {
+		c.path = control.DefaultSocketPath
+	}
+
+	c.http = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", c.path)
+		},
+	}}
+
+	ret = c
+	return
+}
+
+func WithSocketPath(path string) Opt {
+	return func(c *Client) (ret *Client, err error) {
+		if path == "" {
+			err = ErrSocketPathMissing
+			return
+		}
+
+		c.path = path
+		ret = c
+		return
+	}
+}
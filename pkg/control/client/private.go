@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/black-desk/cgtproxy/pkg/control"
+)
+
+func (c *Client) do(method, path string, result any) (err error) {
+	return c.doContext(context.Background(), method, path, nil, result)
+}
+
+// doContext sends a request with body encoded in JSON if it is not nil,
+// then decodes the response into result if it is not nil.
+func (c *Client) doContext(
+	ctx context.Context, method, path string, body, result any,
+) (
+	err error,
+) {
+	var reqBody io.Reader
+	if body != nil {
+		var content []byte
+		content, err = json.Marshal(body)
+		if err != nil {
+			return
+		}
+
+		reqBody = bytes.NewReader(content)
+	}
+
+	var req *http.Request
+	req, err = http.NewRequestWithContext(ctx, method, "http://cgtproxy"+path, reqBody)
+	if err != nil {
+		return
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	var resp *http.Response
+	resp, err = c.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respErr := control.Error{}
+		err = json.NewDecoder(resp.Body).Decode(&respErr)
+		if err != nil || respErr.Error == "" {
+			err = fmt.Errorf("unexpected status %q", resp.Status)
+			return
+		}
+
+		err = errors.New(respErr.Error)
+		return
+	}
+
+	if result == nil {
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(result)
+	return
+}
@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/control"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+// CGroups returns routes of cgroups tracked by cgtproxy.
+func (c *Client) CGroups() (ret []types.Route, err error) {
+	defer Wrap(&err, "list cgroups")
+
+	err = c.do(http.MethodGet, control.PathCGroups, &ret)
+	return
+}
+
+// TProxies returns tproxies cgtproxy is using.
+func (c *Client) TProxies() (ret []*config.TProxy, err error) {
+	defer Wrap(&err, "list tproxies")
+
+	err = c.do(http.MethodGet, control.PathTProxies, &ret)
+	return
+}
+
+// Resync makes cgtproxy go through cgroupfs again.
+func (c *Client) Resync() (err error) {
+	defer Wrap(&err, "resync")
+
+	err = c.do(http.MethodPost, control.PathResync, nil)
+	return
+}
+
+// Reconcile makes cgtproxy fix differences
+// between cgroupfs and the cgroup map,
+// and returns how many of them have been fixed.
+func (c *Client) Reconcile() (ret *types.Drift, err error) {
+	defer Wrap(&err, "reconcile")
+
+	ret = &types.Drift{}
+	err = c.do(http.MethodPost, control.PathReconcile, ret)
+	if err != nil {
+		ret = nil
+	}
+	return
+}
+
+// Version returns version and configuration hash of cgtproxy.
+func (c *Client) Version() (ret *control.Version, err error) {
+	defer Wrap(&err, "get version")
+
+	ret = &control.Version{}
+	err = c.do(http.MethodGet, control.PathVersion, ret)
+	if err != nil {
+		ret = nil
+	}
+	return
+}
+
+// Overrides returns overrides in use.
+func (c *Client) Overrides() (ret []types.Override, err error) {
+	defer Wrap(&err, "list overrides")
+
+	err = c.do(http.MethodGet, control.PathOverrides, &ret)
+	return
+}
+
+// SetOverride pins a cgroup, and its descendants if o.Subtree is set,
+// to the target of o.
+func (c *Client) SetOverride(o types.Override) (err error) {
+	defer Wrap(&err, "set override of %s", o.Path)
+
+	err = c.doContext(
+		context.Background(),
+		http.MethodPost, control.PathOverrides,
+		o, nil,
+	)
+	return
+}
+
+// RemoveOverride removes the override of the cgroup at path.
+func (c *Client) RemoveOverride(path string) (err error) {
+	defer Wrap(&err, "remove override of %s", path)
+
+	err = c.do(
+		http.MethodDelete,
+		control.PathOverrides+"?"+url.Values{"path": {path}}.Encode(),
+		nil,
+	)
+	return
+}
+
+// SelfRoute waits until cgtproxy has handled
+// the cgroup of the current process,
+// then returns the route of that cgroup.
+func (c *Client) SelfRoute(ctx context.Context) (ret *types.Route, err error) {
+	defer Wrap(&err, "wait for route of current cgroup")
+
+	ret = &types.Route{}
+	err = c.doContext(ctx, http.MethodGet, control.PathSelfRoute, nil, ret)
+	if err != nil {
+		ret = nil
+	}
+	return
+}
@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control
+
+const (
+	// DefaultSocketPath is where the control server listens on by default.
+	DefaultSocketPath = "/run/cgtproxy/control.sock"
+)
+
+// Paths of the control API.
+// Responses are JSON encoded.
+const (
+	// PathCGroups responds with []types.Route of all routed cgroups.
+	PathCGroups = "/v1/cgroups"
+	// PathTProxies responds with []*config.TProxy in use, sorted by name.
+	PathTProxies = "/v1/tproxies"
+	// PathResync makes cgtproxy go through cgroupfs again
+	// and update routes of all cgroups, it only accepts POST.
+	PathResync = "/v1/resync"
+	// PathReconcile makes cgtproxy fix differences
+	// between cgroupfs and the cgroup map,
+	// it only accepts POST and responds with types.Drift fixed.
+	PathReconcile = "/v1/reconcile"
+	// PathVersion responds with Version.
+	PathVersion = "/v1/version"
+	// PathOverrides responds with []types.Override in use on GET,
+	// sets the types.Override in request body on POST,
+	// removes the override of cgroup in query parameter "path" on DELETE.
+	PathOverrides = "/v1/overrides"
+	// PathSelfRoute waits until cgtproxy has handled
+	// the cgroup of the process connected to the control server,
+	// then responds with types.Route of that cgroup.
+	// Everyone is allowed to use it.
+	PathSelfRoute = "/v1/self/route"
+)
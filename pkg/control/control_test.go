@@ -0,0 +1,255 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgpath"
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/control"
+	"github.com/black-desk/cgtproxy/pkg/control/client"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/routeman"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestControl(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Control Suite")
+}
+
+type fakeRouteManager struct {
+	interfaces.RouteManager
+
+	cfg       *config.Config
+	routes    []types.Route
+	resynced  int
+	resyncErr error
+	drift     types.Drift
+	waited    []string
+	overrides map[string]types.Override
+}
+
+func (f *fakeRouteManager) Config() (*config.Config, error) {
+	return f.cfg, nil
+}
+
+func (f *fakeRouteManager) Routes() ([]types.Route, error) {
+	return f.routes, nil
+}
+
+func (f *fakeRouteManager) WaitCGroup(ctx context.Context, path string) (types.Route, error) {
+	f.waited = append(f.waited, path)
+	return types.Route{Path: path, Target: types.Target{Op: types.TargetDirect}}, nil
+}
+
+func (f *fakeRouteManager) Overrides() ([]types.Override, error) {
+	ret := []types.Override{}
+	for _, o := range f.overrides {
+		ret = append(ret, o)
+	}
+	return ret, nil
+}
+
+func (f *fakeRouteManager) SetOverride(o types.Override) error {
+	if o.Target == "bad" {
+		return routeman.ErrOverrideTargetInvalid
+	}
+	f.overrides[o.Path] = o
+	return nil
+}
+
+func (f *fakeRouteManager) RemoveOverride(path string) error {
+	if _, ok := f.overrides[path]; !ok {
+		return routeman.ErrOverrideNotFound
+	}
+	delete(f.overrides, path)
+	return nil
+}
+
+func (f *fakeRouteManager) Resync() error {
+	f.resynced++
+	return f.resyncErr
+}
+
+func (f *fakeRouteManager) Reconcile() (types.Drift, error) {
+	return f.drift, nil
+}
+
+const testConfigYAML = `
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  mihomo:
+    port: 7894
+    mark: 521
+  clash:
+    port: 7893
+    mark: 520
+rules:
+  - match: .*proxy.*
+    tproxy: clash
+`
+
+var _ = Describe("Control server", func() {
+	It("should require a route manager", func() {
+		_, err := control.New()
+		Expect(err).To(MatchError(control.ErrRouteManagerMissing))
+	})
+
+	Context("listening on a unix socket", func() {
+		var (
+			rtManager *fakeRouteManager
+			socket    string
+			cancel    context.CancelFunc
+			done      chan error
+			c         *client.Client
+		)
+
+		BeforeEach(func() {
+			cfg, err := config.New(config.WithContent([]byte(testConfigYAML)))
+			Expect(err).To(Succeed())
+
+			rtManager = &fakeRouteManager{
+				cfg:       cfg,
+				overrides: map[string]types.Override{},
+				routes: []types.Route{{
+					Path:   "/user/proxy/app.service",
+					Target: types.Target{Op: types.TargetTProxy, Chain: "clash-MARK"},
+				}},
+			}
+
+			socket = filepath.Join(GinkgoT().TempDir(), "run", "control.sock")
+
+			var s *control.Server
+			s, err = control.New(
+				control.WithSocketPath(socket),
+				control.WithVersion("v1.2.3"),
+				control.WithRouteManager(rtManager),
+			)
+			Expect(err).To(Succeed())
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+
+			done = make(chan error)
+			go func() {
+				done <- s.RunControlServer(ctx)
+			}()
+
+			c, err = client.New(client.WithSocketPath(socket))
+			Expect(err).To(Succeed())
+
+			Eventually(func() error {
+				_, err := c.Version()
+				return err
+			}).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			cancel()
+			Eventually(done).Should(Receive(MatchError(context.Canceled)))
+			Expect(socket).ToNot(BeAnExistingFile())
+		})
+
+		It("should let everyone connect", func() {
+			info, err := os.Stat(socket)
+			Expect(err).To(Succeed())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0666)))
+		})
+
+		It("should list tracked cgroups", func() {
+			routes, err := c.CGroups()
+			Expect(err).To(Succeed())
+			Expect(routes).To(Equal(rtManager.routes))
+		})
+
+		It("should list tproxies sorted by name", func() {
+			tproxies, err := c.TProxies()
+			Expect(err).To(Succeed())
+			Expect(tproxies).To(HaveLen(2))
+			Expect(tproxies[0].Name).To(Equal("clash"))
+			Expect(tproxies[0].Port).To(Equal(uint16(7893)))
+			Expect(tproxies[1].Name).To(Equal("mihomo"))
+		})
+
+		It("should report version and config hash", func() {
+			v, err := c.Version()
+			Expect(err).To(Succeed())
+			Expect(v.Version).To(Equal("v1.2.3"))
+			Expect(v.ConfigHash).To(Equal(rtManager.cfg.Hash()))
+			Expect(v.ConfigHash).To(HaveLen(64))
+		})
+
+		It("should trigger a resync", func() {
+			Expect(c.Resync()).To(Succeed())
+			Expect(rtManager.resynced).To(Equal(1))
+		})
+
+		It("should report drift fixed by reconciliation", func() {
+			rtManager.drift = types.Drift{Created: 1, Orphans: 2}
+
+			drift, err := c.Reconcile()
+			Expect(err).To(Succeed())
+			Expect(*drift).To(Equal(rtManager.drift))
+		})
+
+		It("should wait for the cgroup of the peer", func() {
+			self, err := cgpath.OfPID(os.Getpid())
+			Expect(err).To(Succeed())
+			path := filepath.Join(string(rtManager.cfg.CgroupRoot), self)
+
+			route, err := c.SelfRoute(context.Background())
+			Expect(err).To(Succeed())
+			Expect(route.Path).To(Equal(path))
+			Expect(route.Target.Op).To(Equal(types.TargetDirect))
+			Expect(rtManager.waited).To(Equal([]string{path}))
+		})
+
+		It("should set, list and remove overrides", func() {
+			o := types.Override{
+				Path:    "/user/app.slice",
+				Subtree: true,
+				Target:  "tproxy:mihomo",
+			}
+			Expect(c.SetOverride(o)).To(Succeed())
+
+			overrides, err := c.Overrides()
+			Expect(err).To(Succeed())
+			Expect(overrides).To(Equal([]types.Override{o}))
+
+			Expect(c.RemoveOverride(o.Path)).To(Succeed())
+
+			overrides, err = c.Overrides()
+			Expect(err).To(Succeed())
+			Expect(overrides).To(BeEmpty())
+
+			err = c.RemoveOverride(o.Path)
+			Expect(err).To(MatchError(ContainSubstring(
+				routeman.ErrOverrideNotFound.Error(),
+			)))
+
+			err = c.SetOverride(types.Override{Path: o.Path, Target: "bad"})
+			Expect(err).To(MatchError(ContainSubstring(
+				routeman.ErrOverrideTargetInvalid.Error(),
+			)))
+		})
+
+		It("should report errors of the route manager", func() {
+			rtManager.resyncErr = errors.New("injected resync failure")
+
+			err := c.Resync()
+			Expect(err).To(MatchError(ContainSubstring("injected resync failure")))
+		})
+	})
+})
@@ -0,0 +1,15 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control
+
+import "errors"
+
+var (
+	ErrLoggerMissing       = errors.New("logger is missing.")
+	ErrRouteManagerMissing = errors.New("route manager is missing.")
+	ErrSocketPathMissing   = errors.New("socket path is missing.")
+	ErrPermissionDenied    = errors.New("peer is not allowed to use control API.")
+	ErrOverridePathMissing = errors.New("path of override is missing.")
+)
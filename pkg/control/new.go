@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	. "github.com/black-desk/lib/go/errwrap"
+	"go.uber.org/zap"
+)
+
+// Server serves the control API over a unix socket.
+// Only root and the user running cgtproxy are allowed to use it,
+// which is checked by SO_PEERCRED.
+type Server struct {
+	path    string
+	version string
+
+	rtManager interfaces.RouteManager
+	log       *zap.SugaredLogger
+}
+
+type Opt = (func(*Server) (*Server, error))
+
+//go:generate go run github.com/rjeczalik/interfaces/cmd/interfacer@v0.3.0 -for github.com/black-desk/cgtproxy/pkg/control.Server -as interfaces.ControlServer -o ../interfaces/control.go
+
+func New(opts ...Opt) (ret *Server, err error) {
+	defer Wrap(&err, "create control server")
+
+	s := &Server{}
+	for i := range opts {
+		s, err = opts[i](s)
+		if err != nil {
+			return
+		}
+	}
+
+	if s.log == nil {
+		s.log = zap.NewNop().Sugar()
+	}
+
+	if s.path == "" {
+		s.path = DefaultSocketPath
+	}
+
+	if s.rtManager == nil {
+		err = ErrRouteManagerMissing
+		return
+	}
+
+	ret = s
+
+	s.log.Debugw("Control server created.",
+		"path", s.path,
+	)
+
+	return
+}
+
+func WithSocketPath(path string) Opt {
+	return func(s *Server) (ret *Server, err error) {
+		if path == "" {
+			err = ErrSocketPathMissing
+			return
+		}
+
+		s.path = path
+		ret = s
+		return
+	}
+}
+
+// WithVersion sets the version reported by the control API.
+func WithVersion(version string) Opt {
+	return func(s *Server) (ret *Server, err error) {
+		s.version = version
+		ret = s
+		return
+	}
+}
+
+func WithRouteManager(m interfaces.RouteManager) Opt {
+	return func(s *Server) (ret *Server, err error) {
+		if m == nil {
+			err = ErrRouteManagerMissing
+			return
+		}
+
+		s.rtManager = m
+		ret = s
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(s *Server) (ret *Server, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		s.log = log
+		ret = s
+		return
+	}
+}
@@ -0,0 +1,317 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/black-desk/cgtproxy/pkg/cgpath"
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/routeman"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+)
+
+func (s *Server) listen() (ret net.Listener, err error) {
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return
+	}
+
+	// Socket left by the last run which was not exited normally.
+	err = os.Remove(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	var l *net.UnixListener
+	l, err = net.ListenUnix("unix", &net.UnixAddr{Name: s.path, Net: "unix"})
+	if err != nil {
+		return
+	}
+	l.SetUnlinkOnClose(true)
+
+	// Everyone can connect,
+	// peers are checked by SO_PEERCRED in authorize.
+	err = os.Chmod(s.path, 0666)
+	if err != nil {
+		l.Close()
+		return
+	}
+
+	ret = l
+	return
+}
+
+type peerCredKey struct{}
+
+func withPeerCred(ctx context.Context, c net.Conn) context.Context {
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(
+			int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED,
+		)
+	})
+	if err != nil || credErr != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+func peerCred(r *http.Request) (*unix.Ucred, bool) {
+	cred, ok := r.Context().Value(peerCredKey{}).(*unix.Ucred)
+	return cred, ok
+}
+
+// authorize only lets root and the user running cgtproxy in.
+func (s *Server) authorize(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := peerCred(r)
+		if !ok || (cred.Uid != 0 && int(cred.Uid) != os.Geteuid()) {
+			s.log.Warnw("Reject control request.",
+				"path", r.URL.Path,
+				"cred", cred,
+			)
+			s.writeError(w, http.StatusForbidden, ErrPermissionDenied)
+			return
+		}
+
+		s.log.Debugw("Handle control request.",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"pid", cred.Pid,
+			"uid", cred.Uid,
+		)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET "+PathCGroups, s.authorize(s.handleCGroups))
+	mux.Handle("GET "+PathTProxies, s.authorize(s.handleTProxies))
+	mux.Handle("POST "+PathResync, s.authorize(s.handleResync))
+	mux.Handle("POST "+PathReconcile, s.authorize(s.handleReconcile))
+	mux.Handle("GET "+PathVersion, s.authorize(s.handleVersion))
+	mux.Handle("GET "+PathOverrides, s.authorize(s.handleOverrides))
+	mux.Handle("POST "+PathOverrides, s.authorize(s.handleSetOverride))
+	mux.Handle("DELETE "+PathOverrides, s.authorize(s.handleRemoveOverride))
+	mux.HandleFunc("GET "+PathSelfRoute, s.handleSelfRoute)
+	return mux
+}
+
+func (s *Server) handleCGroups(w http.ResponseWriter, r *http.Request) {
+	routes, err := s.rtManager.Routes()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if routes == nil {
+		routes = []types.Route{}
+	}
+
+	s.writeJSON(w, routes)
+}
+
+func (s *Server) handleTProxies(w http.ResponseWriter, r *http.Request) {
+	cfg, err := s.rtManager.Config()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tproxies := []*config.TProxy{}
+	if cfg != nil {
+		tproxies = maps.Values(cfg.TProxies)
+	}
+
+	sort.Slice(tproxies, func(i, j int) bool {
+		return tproxies[i].Name < tproxies[j].Name
+	})
+
+	s.writeJSON(w, tproxies)
+}
+
+func (s *Server) handleResync(w http.ResponseWriter, r *http.Request) {
+	err := s.rtManager.Resync()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	drift, err := s.rtManager.Reconcile()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.writeJSON(w, drift)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	cfg, err := s.rtManager.Config()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	v := Version{Version: s.version}
+	if cfg != nil {
+		v.ConfigHash = cfg.Hash()
+	}
+
+	s.writeJSON(w, v)
+}
+
+func (s *Server) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	overrides, err := s.rtManager.Overrides()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if overrides == nil {
+		overrides = []types.Override{}
+	}
+
+	s.writeJSON(w, overrides)
+}
+
+func (s *Server) handleSetOverride(w http.ResponseWriter, r *http.Request) {
+	var o types.Override
+	err := json.NewDecoder(r.Body).Decode(&o)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if o.Path == "" {
+		s.writeError(w, http.StatusBadRequest, ErrOverridePathMissing)
+		return
+	}
+
+	err = s.rtManager.SetOverride(o)
+	if errors.Is(err, routeman.ErrOverrideTargetInvalid) ||
+		errors.Is(err, routeman.ErrOverridesFileMissing) {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRemoveOverride(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		s.writeError(w, http.StatusBadRequest, ErrOverridePathMissing)
+		return
+	}
+
+	err := s.rtManager.RemoveOverride(path)
+	if errors.Is(err, routeman.ErrOverrideNotFound) {
+		s.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSelfRoute only tells the peer about the cgroup it is in,
+// so it needs no authorization.
+func (s *Server) handleSelfRoute(w http.ResponseWriter, r *http.Request) {
+	cred, ok := peerCred(r)
+	if !ok {
+		s.writeError(w, http.StatusForbidden, ErrPermissionDenied)
+		return
+	}
+
+	cfg, err := s.rtManager.Config()
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	path, err := cgpath.OfPID(int(cred.Pid))
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	path = filepath.Join(string(cfg.CgroupRoot), path)
+
+	s.log.Debugw("Wait for cgroup of peer.",
+		"pid", cred.Pid,
+		"cgroup", path,
+	)
+
+	route, err := s.rtManager.WaitCGroup(r.Context(), path)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.writeJSON(w, route)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		s.log.Errorw("Failed to write control response.",
+			"error", err,
+		)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err = json.NewEncoder(w).Encode(Error{Error: err.Error()})
+	if err != nil {
+		s.log.Errorw("Failed to write control response.",
+			"error", err,
+		)
+	}
+}
@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+// RunControlServer serves the control API until ctx is done.
+func (s *Server) RunControlServer(ctx context.Context) (err error) {
+	defer Wrap(&err, "running control server")
+
+	var l net.Listener
+	l, err = s.listen()
+	if err != nil {
+		return
+	}
+
+	server := &http.Server{
+		Handler:           s.handler(),
+		ConnContext:       withPeerCred,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(
+			context.Background(), 5*time.Second,
+		)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	s.log.Infow("Control server started.",
+		"path", s.path,
+	)
+
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	return ctx.Err()
+}
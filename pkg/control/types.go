@@ -0,0 +1,17 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package control
+
+// Version describes the running cgtproxy.
+type Version struct {
+	Version string `json:"version"`
+	// ConfigHash is the hex encoded sha256 of the configuration in use.
+	ConfigHash string `json:"config_hash"`
+}
+
+// Error is the response when a request failed.
+type Error struct {
+	Error string `json:"error"`
+}
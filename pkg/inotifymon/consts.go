@@ -0,0 +1,18 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package inotifymon
+
+import "golang.org/x/sys/unix"
+
+// watchMask is the events watched on directories in cgroupfs.
+// Cgroups cannot be moved,
+// moves are watched for directories other than cgroupfs.
+const watchMask = unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// maxEventSize is the max size of an inotify event,
+// which is followed by a name of a file.
+const maxEventSize = unix.SizeofInotifyEvent + unix.NAME_MAX + 1
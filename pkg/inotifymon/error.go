@@ -0,0 +1,15 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package inotifymon
+
+import "errors"
+
+var (
+	ErrCGroupRootNotFound = errors.New("cgroup v2 file system mount point is missing.")
+	ErrBufferSizeInvalid  = errors.New("buffer size must not be negative.")
+	ErrLoggerMissing      = errors.New("logger is missing.")
+	ErrMetricsMissing     = errors.New("metrics is missing.")
+	ErrCGroupRootRemoved  = errors.New("cgroup root is not watched any more.")
+)
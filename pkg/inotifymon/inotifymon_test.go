@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package inotifymon
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+)
+
+func TestINotifyMonitor(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "INotifyMonitor Suite")
+}
+
+func event(path string, typ types.CgroupEventType) types.CGroupEvent {
+	return types.CGroupEvent{Path: path, EventType: typ}
+}
+
+var _ = Describe("New", func() {
+	It("should fail when no cgroup root is provided", func() {
+		_, err := New()
+		Expect(err).To(MatchError(ErrCGroupRootNotFound))
+	})
+
+	It("should fail on negative buffer size", func() {
+		_, err := New(WithCgroupRoot("/tmp"), WithBufferSize(-1))
+		Expect(err).To(MatchError(ErrBufferSizeInvalid))
+	})
+
+	It("should use the default buffer size if it is 0", func() {
+		m, err := New(WithCgroupRoot("/tmp"), WithBufferSize(0))
+		Expect(err).To(Succeed())
+		Expect(m.bufferSize).To(Equal(config.DefaultMonitorBufferSize))
+	})
+})
+
+// Inotify works on plain directories as well,
+// so tests run against a temp directory without privileges.
+var _ = Describe("INotifyMonitor", func() {
+	var (
+		root string
+		m    *INotifyMonitor
+	)
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(root, "a", "b"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(root, "file"), nil, 0o644)).To(Succeed())
+
+		var err error
+		m, err = New(WithCgroupRoot(config.CGroupRoot(root)))
+		Expect(err).To(Succeed())
+	})
+
+	Context("watching directories", func() {
+		BeforeEach(func() {
+			var err error
+			m.fd, err = unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+			Expect(err).To(Succeed())
+			DeferCleanup(unix.Close, m.fd)
+
+			m.dirs = map[string]int{}
+			m.watches = map[int]string{}
+
+			events, err := m.add(root)
+			Expect(err).To(Succeed())
+			Expect(events).To(Equal([]types.CGroupEvent{
+				event(filepath.Join(root, "a"), types.CgroupEventTypeNew),
+				event(filepath.Join(root, "a", "b"), types.CgroupEventTypeNew),
+			}))
+		})
+
+		It("should skip directories removed before being watched", func() {
+			events, err := m.add(filepath.Join(root, "gone"))
+			Expect(err).To(Succeed())
+			Expect(events).To(BeEmpty())
+		})
+
+		It("should not send events of directories known again", func() {
+			events, err := m.add(filepath.Join(root, "a"))
+			Expect(err).To(Succeed())
+			Expect(events).To(BeEmpty())
+		})
+
+		It("should make up events dropped when the queue overflowed", func() {
+			Expect(os.RemoveAll(filepath.Join(root, "a"))).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(root, "c", "d"), 0o755)).To(Succeed())
+
+			buf := make([]byte, unix.SizeofInotifyEvent)
+			binary.NativeEndian.PutUint32(buf[0:], uint32(0xffffffff))
+			binary.NativeEndian.PutUint32(buf[4:], unix.IN_Q_OVERFLOW)
+
+			events, err := m.handle(buf)
+			Expect(err).To(Succeed())
+			Expect(events).To(Equal([]types.CGroupEvent{
+				event(filepath.Join(root, "a", "b"), types.CgroupEventTypeDelete),
+				event(filepath.Join(root, "a"), types.CgroupEventTypeDelete),
+				event(filepath.Join(root, "c"), types.CgroupEventTypeNew),
+				event(filepath.Join(root, "c", "d"), types.CgroupEventTypeNew),
+			}))
+		})
+
+		It("should find directories created again when the queue overflowed", func() {
+			Expect(os.RemoveAll(filepath.Join(root, "a"))).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(root, "a"), 0o755)).To(Succeed())
+
+			events, err := m.rescan()
+			Expect(err).To(Succeed())
+			Expect(events).To(Equal([]types.CGroupEvent{
+				event(filepath.Join(root, "a", "b"), types.CgroupEventTypeDelete),
+				event(filepath.Join(root, "a"), types.CgroupEventTypeDelete),
+				event(filepath.Join(root, "a"), types.CgroupEventTypeNew),
+			}))
+		})
+
+		It("should fail if the cgroup root is removed", func() {
+			Expect(os.RemoveAll(root)).To(Succeed())
+
+			_, err := m.rescan()
+			Expect(err).To(MatchError(ErrCGroupRootRemoved))
+		})
+	})
+
+	It("should split events of the same cgroup into batches", func() {
+		a := filepath.Join(root, "a")
+		b := filepath.Join(root, "b")
+		Expect(split([]types.CGroupEvent{
+			event(a, types.CgroupEventTypeNew),
+			event(b, types.CgroupEventTypeNew),
+			event(a, types.CgroupEventTypeDelete),
+		})).To(Equal([][]types.CGroupEvent{
+			{
+				event(a, types.CgroupEventTypeNew),
+				event(b, types.CgroupEventTypeNew),
+			},
+			{
+				event(a, types.CgroupEventTypeDelete),
+			},
+		}))
+	})
+
+	It("should send the first pass and changes until cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() { done <- m.RunCGroupMonitor(ctx) }()
+
+		By("sending cgroups existing at first")
+		Eventually(m.Events()).Should(Receive(Equal(types.CGroupEvents{
+			Events: []types.CGroupEvent{
+				event(filepath.Join(root, "a"), types.CgroupEventTypeNew),
+				event(filepath.Join(root, "a", "b"), types.CgroupEventTypeNew),
+			},
+		})))
+
+		By("sending nested cgroups created at once")
+		received := []types.CGroupEvent{}
+		collect := func() []types.CGroupEvent {
+			select {
+			case events := <-m.Events():
+				received = append(received, events.Events...)
+			default:
+			}
+			return received
+		}
+
+		Expect(os.MkdirAll(filepath.Join(root, "c", "d", "e"), 0o755)).To(Succeed())
+		Eventually(collect, "3s").Should(ConsistOf(
+			event(filepath.Join(root, "c"), types.CgroupEventTypeNew),
+			event(filepath.Join(root, "c", "d"), types.CgroupEventTypeNew),
+			event(filepath.Join(root, "c", "d", "e"), types.CgroupEventTypeNew),
+		))
+
+		By("sending cgroups removed")
+		received = nil
+		Expect(os.RemoveAll(filepath.Join(root, "a"))).To(Succeed())
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event(filepath.Join(root, "a", "b"), types.CgroupEventTypeDelete),
+			event(filepath.Join(root, "a"), types.CgroupEventTypeDelete),
+		}))
+
+		By("stopping when the context is cancelled")
+		cancel()
+		Eventually(done, "3s").Should(Receive(MatchError(context.Canceled)))
+	})
+})
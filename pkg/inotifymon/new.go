@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package inotifymon
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"go.uber.org/zap"
+)
+
+// INotifyMonitor is the other implementation of interfaces.CGroupMonitor,
+// which watches every directory in cgroupfs by inotify directly.
+// It knows which cgroups exist and sends events of changes only,
+// and it goes through cgroupfs again
+// to find out what has changed
+// if the kernel tells that events have been dropped.
+type INotifyMonitor struct {
+	eventsOut  chan types.CGroupEvents
+	root       config.CGroupRoot
+	bufferSize int
+	log        *zap.SugaredLogger
+	metrics    interfaces.Metrics
+
+	// fd is the inotify instance, valid while the monitor is running.
+	fd int
+	// dirs records watch descriptors of directories watched,
+	// keyed by their paths, the cgroup root is one of them.
+	dirs map[string]int
+	// watches maps watch descriptors to paths of directories.
+	watches map[int]string
+}
+
+type Opt = (func(*INotifyMonitor) (*INotifyMonitor, error))
+
+func New(opts ...Opt) (ret *INotifyMonitor, err error) {
+	defer Wrap(&err, "create inotify cgroup monitor")
+
+	m := &INotifyMonitor{}
+
+	for i := range opts {
+		m, err = opts[i](m)
+		if err != nil {
+			return
+		}
+	}
+
+	if m.log == nil {
+		m.log = zap.NewNop().Sugar()
+	}
+
+	if m.metrics == nil {
+		var mt *metrics.Metrics
+		mt, err = metrics.New(metrics.WithLogger(m.log))
+		if err != nil {
+			return
+		}
+
+		m.metrics = mt
+	}
+
+	if m.root == "" {
+		err = ErrCGroupRootNotFound
+		return
+	}
+
+	if m.bufferSize == 0 {
+		m.bufferSize = config.DefaultMonitorBufferSize
+	}
+
+	m.eventsOut = make(chan types.CGroupEvents)
+
+	ret = m
+
+	m.log.Debugw("Create an inotify cgroup monitor.",
+		"buffer_size", m.bufferSize,
+	)
+
+	return
+}
+
+func WithCgroupRoot(root config.CGroupRoot) Opt {
+	return func(m *INotifyMonitor) (ret *INotifyMonitor, err error) {
+		if root == "" {
+			err = ErrCGroupRootNotFound
+			return
+		}
+
+		m.root = root
+		ret = m
+		return
+	}
+}
+
+// WithBufferSize sets how many events are read from inotify at once,
+// 0 means the default one.
+func WithBufferSize(size int) Opt {
+	return func(m *INotifyMonitor) (ret *INotifyMonitor, err error) {
+		if size < 0 {
+			err = ErrBufferSizeInvalid
+			return
+		}
+
+		m.bufferSize = size
+		ret = m
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(m *INotifyMonitor) (ret *INotifyMonitor, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		m.log = log
+		ret = m
+		return
+	}
+}
+
+func WithMetrics(mt interfaces.Metrics) Opt {
+	return func(m *INotifyMonitor) (ret *INotifyMonitor, err error) {
+		if mt == nil {
+			err = ErrMetricsMissing
+			return
+		}
+
+		m.metrics = mt
+		ret = m
+		return
+	}
+}
@@ -0,0 +1,293 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package inotifymon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// add watches the directory at path and directories in it,
+// and returns events of cgroups not known before.
+// Directories removed while going through them are skipped,
+// as events of their removal are going to arrive or have been handled.
+func (m *INotifyMonitor) add(path string) (ret []types.CGroupEvent, err error) {
+	var wd int
+	wd, err = unix.InotifyAddWatch(m.fd, path, watchMask)
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+		m.log.Debugw("Cgroup had been removed.",
+			"path", path,
+		)
+		err = nil
+		return
+	}
+	if err != nil {
+		err = &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		return
+	}
+
+	events := []types.CGroupEvent{}
+
+	// NOTE:
+	// Watches of the same directory share a watch descriptor,
+	// a different one means the directory has been removed
+	// and created again while events were dropped.
+	if known, ok := m.dirs[path]; ok && known != wd {
+		events = append(events, m.forget(path)...)
+	}
+
+	if _, ok := m.dirs[path]; !ok {
+		m.dirs[path] = wd
+		m.watches[wd] = path
+
+		if path != string(m.root) {
+			events = append(events, types.CGroupEvent{
+				Path:      path,
+				EventType: types.CgroupEventTypeNew,
+			})
+		}
+	}
+
+	// NOTE:
+	// Directories are read after the watch added,
+	// so that directories created in the meantime
+	// are found either here or by events.
+	// Directories known already get no events.
+	var entries []os.DirEntry
+	entries, err = os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		m.log.Errorw("Errors occurred while going through cgroupfs.",
+			"path", path,
+			"error", err,
+		)
+		err = nil
+	}
+
+	for i := range entries {
+		if !entries[i].IsDir() {
+			continue
+		}
+
+		var sub []types.CGroupEvent
+		sub, err = m.add(filepath.Join(path, entries[i].Name()))
+		if err != nil {
+			return
+		}
+
+		events = append(events, sub...)
+	}
+
+	ret = events
+	return
+}
+
+// forget stops watching the directory at path and directories in it,
+// and returns events of their removal, deepest ones first.
+func (m *INotifyMonitor) forget(path string) (ret []types.CGroupEvent) {
+	paths := []string{}
+	for p := range m.dirs {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			paths = append(paths, p)
+		}
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/")
+	})
+
+	events := []types.CGroupEvent{}
+	for _, p := range paths {
+		wd := m.dirs[p]
+		delete(m.dirs, p)
+		delete(m.watches, wd)
+
+		// NOTE:
+		// Watches of removed directories have been removed by the kernel.
+		_, _ = unix.InotifyRmWatch(m.fd, uint32(wd))
+
+		if p == string(m.root) {
+			continue
+		}
+
+		events = append(events, types.CGroupEvent{
+			Path:      p,
+			EventType: types.CgroupEventTypeDelete,
+		})
+	}
+
+	ret = events
+	return
+}
+
+// rescan goes through cgroupfs again
+// and returns events of differences from cgroups known,
+// which is how events dropped by the kernel are made up.
+func (m *INotifyMonitor) rescan() (ret []types.CGroupEvent, err error) {
+	stale := []string{}
+	for path, known := range m.dirs {
+		wd, addErr := unix.InotifyAddWatch(m.fd, path, watchMask)
+		if addErr == nil && wd == known {
+			continue
+		}
+
+		stale = append(stale, path)
+	}
+
+	events := []types.CGroupEvent{}
+	for _, path := range stale {
+		if path == string(m.root) {
+			err = ErrCGroupRootRemoved
+			return
+		}
+
+		events = append(events, m.forget(path)...)
+	}
+
+	var added []types.CGroupEvent
+	added, err = m.add(string(m.root))
+	if err != nil {
+		return
+	}
+
+	ret = append(events, added...)
+	return
+}
+
+// handle returns events of cgroups from inotify events in buf.
+func (m *INotifyMonitor) handle(buf []byte) (ret []types.CGroupEvent, err error) {
+	events := []types.CGroupEvent{}
+
+	for len(buf) >= unix.SizeofInotifyEvent {
+		wd := int(int32(binary.NativeEndian.Uint32(buf[0:])))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		size := int(binary.NativeEndian.Uint32(buf[12:]))
+
+		end := min(unix.SizeofInotifyEvent+size, len(buf))
+		name := string(bytes.TrimRight(buf[unix.SizeofInotifyEvent:end], "\x00"))
+		buf = buf[end:]
+
+		m.metrics.AddEventsReceived(1)
+
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			m.log.Warnw("Inotify queue overflowed, going through cgroupfs again.",
+				"buffer_size", m.bufferSize,
+			)
+			m.metrics.AddEventsDropped(1)
+
+			var rescanned []types.CGroupEvent
+			rescanned, err = m.rescan()
+			if err != nil {
+				return
+			}
+
+			events = append(events, rescanned...)
+			continue
+		}
+
+		parent, ok := m.watches[wd]
+		if !ok {
+			// Events of directories forgotten.
+			continue
+		}
+
+		if mask&unix.IN_IGNORED != 0 {
+			if parent == string(m.root) {
+				err = ErrCGroupRootRemoved
+				return
+			}
+
+			events = append(events, m.forget(parent)...)
+			continue
+		}
+
+		if mask&unix.IN_ISDIR == 0 {
+			continue
+		}
+
+		path := filepath.Join(parent, name)
+
+		m.log.Debugw("New inotify event arrived.",
+			"mask", mask,
+			"path", path,
+		)
+
+		if mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0 {
+			events = append(events, m.forget(path)...)
+			continue
+		}
+
+		if mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			var added []types.CGroupEvent
+			added, err = m.add(path)
+			if err != nil {
+				return
+			}
+
+			events = append(events, added...)
+		}
+	}
+
+	ret = events
+	return
+}
+
+// split splits events into batches
+// in which every cgroup has one event at most,
+// as events in a batch are not handled in order.
+func split(events []types.CGroupEvent) (ret [][]types.CGroupEvent) {
+	batches := [][]types.CGroupEvent{}
+
+	var batch []types.CGroupEvent
+	seen := map[string]struct{}{}
+	for i := range events {
+		if _, ok := seen[events[i].Path]; ok {
+			batches = append(batches, batch)
+			batch = nil
+			seen = map[string]struct{}{}
+		}
+
+		batch = append(batch, events[i])
+		seen[events[i].Path] = struct{}{}
+	}
+
+	if len(batch) != 0 {
+		batches = append(batches, batch)
+	}
+
+	ret = batches
+	return
+}
+
+func (m *INotifyMonitor) send(ctx context.Context, cgEvents types.CGroupEvents) (err error) {
+	m.log.Debugw("New cgroup envents.",
+		"size", len(cgEvents.Events),
+	)
+
+	cnt := len(cgEvents.Events)
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case m.eventsOut <- cgEvents:
+		m.log.Debugw("Cgroup events sent.",
+			"size", cnt,
+		)
+	}
+
+	return
+}
@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package inotifymon
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"golang.org/x/sys/unix"
+)
+
+func (m *INotifyMonitor) Events() <-chan types.CGroupEvents {
+	return m.eventsOut
+}
+
+// RunCGroupMonitor sends events of all cgroups existing at first,
+// and then events of changes until ctx is done.
+func (m *INotifyMonitor) RunCGroupMonitor(ctx context.Context) (err error) {
+	defer Wrap(&err, "running inotify cgroup monitor")
+	defer close(m.eventsOut)
+
+	m.fd, err = unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return
+	}
+
+	// NOTE:
+	// The non-blocking fd is read through the runtime poller,
+	// so that a read in progress can be stopped by a deadline
+	// without closing the fd still used to add watches.
+	file := os.NewFile(uintptr(m.fd), "inotify")
+	defer file.Close()
+	stop := context.AfterFunc(ctx, func() { file.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	m.dirs = map[string]int{}
+	m.watches = map[int]string{}
+
+	m.log.Info("Going through cgroupfs first time...")
+	var events []types.CGroupEvent
+	events, err = m.add(string(m.root))
+	m.log.Info("Going through cgroupfs first time...Done.")
+	if err != nil {
+		return
+	}
+
+	if _, ok := m.dirs[string(m.root)]; !ok {
+		err = ErrCGroupRootNotFound
+		return
+	}
+
+	// NOTE:
+	// The first batch is sent even if it is empty,
+	// the same as the cgroupfs monitor does.
+	err = m.send(ctx, types.CGroupEvents{Events: events})
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, m.bufferSize*maxEventSize)
+
+	for {
+		var n int
+		n, err = file.Read(buf)
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		events, err = m.handle(buf[:n])
+		if err != nil {
+			return
+		}
+
+		for _, batch := range split(events) {
+			err = m.send(ctx, types.CGroupEvents{Events: batch})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -4,9 +4,13 @@ package interfaces
 
 import (
 	"context"
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/types"
 )
 
 // CGTProxy is an interface generated for "github.com/black-desk/cgtproxy/pkg/cgtproxy.CGTProxy".
 type CGTProxy interface {
+	Reconcile() (types.Drift, error)
+	Reload(*config.Config) error
 	RunCGTProxy(context.Context) error
 }
@@ -9,10 +9,19 @@ import (
 
 // NFTManager is an interface generated for "github.com/black-desk/cgtproxy/pkg/nftman.NFTManager".
 type NFTManager interface {
+	AddChainAndRulesForRedirects([]*config.Redirect) error
+	AddChainAndRulesForRoutes([]*config.Route) error
 	AddChainAndRulesForTProxies([]*config.TProxy) error
 	AddRoutes([]types.Route) error
+	CGroupElements() ([]types.CGroupElement, error)
 	Clear() error
+	Counters() ([]types.Counter, error)
+	HasCGroup(string) (bool, error)
 	InitStructure() error
 	Release() error
+	Reload(*config.Config, []types.Route) error
+	RemoveCGroupElements([]types.CGroupElement) error
+	RemoveLeftover() (bool, error)
 	RemoveRoutes([]string) error
+	ReplaceRoutes([]string, []types.Route) error
 }
@@ -4,9 +4,22 @@ package interfaces
 
 import (
 	"context"
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/types"
 )
 
 // RouteManager is an interface generated for "github.com/black-desk/cgtproxy/pkg/routeman.RouteManager".
 type RouteManager interface {
+	Cleanup() error
+	Config() (*config.Config, error)
+	FillNftable() error
+	Overrides() ([]types.Override, error)
+	Reconcile() (types.Drift, error)
+	Reload(*config.Config) error
+	RemoveOverride(string) error
+	Resync() error
+	Routes() ([]types.Route, error)
 	RunRouteManager(context.Context) error
+	SetOverride(types.Override) error
+	WaitCGroup(context.Context, string) (types.Route, error)
 }
@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package metrics
+
+// Operations applying changes to nftable,
+// used as the operation label of metrics.
+const (
+	OpAddRoutes     = "add_routes"
+	OpRemoveRoutes  = "remove_routes"
+	OpReplaceRoutes = "replace_routes"
+	OpReload        = "reload"
+)
+
+const namespace = "cgtproxy"
@@ -0,0 +1,13 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package metrics
+
+import "errors"
+
+var (
+	ErrConfigMissing     = errors.New("config is missing.")
+	ErrLoggerMissing     = errors.New("logger is missing.")
+	ErrNFTManagerMissing = errors.New("nft manager is missing.")
+)
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Metrics Suite")
+}
+
+// fakeNFTManager only implements Counters,
+// which is the only method used by metrics.
+type fakeNFTManager struct {
+	interfaces.NFTManager
+	counters []types.Counter
+}
+
+func (f *fakeNFTManager) Counters() ([]types.Counter, error) {
+	return f.counters, nil
+}
+
+var _ = Describe("Metrics", func() {
+	It("should run nothing without configuration", func() {
+		m, err := metrics.New()
+		Expect(err).To(Succeed())
+
+		Expect(m.RunMetricsServer(context.Background())).To(Succeed())
+	})
+
+	Context("listening on a unix socket", func() {
+		var (
+			m      *metrics.Metrics
+			socket string
+			cancel context.CancelFunc
+			done   chan error
+			client *http.Client
+		)
+
+		BeforeEach(func() {
+			socket = filepath.Join(GinkgoT().TempDir(), "run", "metrics.sock")
+
+			var err error
+			m, err = metrics.New(
+				metrics.WithConfig(&config.Metrics{Unix: socket}),
+				metrics.WithNFTManager(&fakeNFTManager{counters: []types.Counter{
+					{Target: "tproxy-clash", Proto: "tcp", Family: "ipv4", Packets: 3, Bytes: 180},
+					{Target: "direct", Proto: "tcp", Family: "ipv4", Packets: 5, Bytes: 300},
+				}}),
+			)
+			Expect(err).To(Succeed())
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+
+			done = make(chan error)
+			go func() {
+				done <- m.RunMetricsServer(ctx)
+			}()
+
+			client = &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}}
+
+			Eventually(func() error {
+				_, err := client.Get("http://unix/metrics")
+				return err
+			}).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			cancel()
+			Eventually(done).Should(Receive(MatchError(context.Canceled)))
+			Expect(socket).ToNot(BeAnExistingFile())
+		})
+
+		scrape := func() string {
+			resp, err := client.Get("http://unix/metrics")
+			Expect(err).To(Succeed())
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).To(Succeed())
+
+			return string(body)
+		}
+
+		It("should expose recorded values", func() {
+			m.SetCGroups(42)
+			m.AddEventsReceived(3)
+			m.AddEventsDropped(1)
+			m.ObserveApply(metrics.OpAddRoutes, time.Millisecond, nil)
+			m.ObserveApply(metrics.OpRemoveRoutes, time.Millisecond, errors.New("test"))
+
+			body := scrape()
+			Expect(body).To(ContainSubstring("cgtproxy_cgroups 42"))
+			Expect(body).To(ContainSubstring("cgtproxy_monitor_events_received_total 3"))
+			Expect(body).To(ContainSubstring("cgtproxy_monitor_events_dropped_total 1"))
+			Expect(body).To(ContainSubstring(`cgtproxy_nft_apply_duration_seconds_count{operation="add_routes"} 1`))
+			Expect(body).To(ContainSubstring(`cgtproxy_nft_apply_errors_total{operation="remove_routes"} 1`))
+			Expect(body).ToNot(ContainSubstring(`cgtproxy_nft_apply_errors_total{operation="add_routes"}`))
+			Expect(body).To(MatchRegexp(`cgtproxy_nft_last_apply_timestamp_seconds [1-9]`))
+		})
+
+		It("should expose nft counters of tproxies only", func() {
+			body := scrape()
+			Expect(body).To(ContainSubstring(`cgtproxy_tproxy_packets_total{family="ipv4",proto="tcp",tproxy="clash"} 3`))
+			Expect(body).To(ContainSubstring(`cgtproxy_tproxy_bytes_total{family="ipv4",proto="tcp",tproxy="clash"} 180`))
+			Expect(body).ToNot(ContainSubstring(`tproxy="direct"`))
+		})
+	})
+})
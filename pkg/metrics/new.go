@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package metrics
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+type Metrics struct {
+	// cfg is nil if metrics should not be exposed.
+	cfg *config.Metrics
+	log *zap.SugaredLogger
+
+	// nft is used to read nft counters of tproxies when scraped.
+	// It must not share netlink connection with the nft manager
+	// maintaining the table, as scrapes happen in other goroutines.
+	nft interfaces.NFTManager
+
+	registry *prometheus.Registry
+
+	cgroups        prometheus.Gauge
+	eventsReceived prometheus.Counter
+	eventsDropped  prometheus.Counter
+	applyDuration  *prometheus.HistogramVec
+	applyErrors    *prometheus.CounterVec
+	lastApply      prometheus.Gauge
+}
+
+type Opt = (func(*Metrics) (*Metrics, error))
+
+//go:generate go run github.com/rjeczalik/interfaces/cmd/interfacer@v0.3.0 -for github.com/black-desk/cgtproxy/pkg/metrics.Metrics -as interfaces.Metrics -o ../interfaces/metrics.go
+
+func New(opts ...Opt) (ret *Metrics, err error) {
+	defer Wrap(&err, "create metrics")
+
+	m := &Metrics{}
+	for i := range opts {
+		m, err = opts[i](m)
+		if err != nil {
+			return
+		}
+	}
+
+	if m.log == nil {
+		m.log = zap.NewNop().Sugar()
+	}
+
+	m.cgroups = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cgroups",
+		Help:      "Number of cgroups tracked in the cgroup map.",
+	})
+	m.eventsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "monitor",
+		Name:      "events_received_total",
+		Help:      "Number of cgroup events received by the cgroup monitor.",
+	})
+	m.eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "monitor",
+		Name:      "events_dropped_total",
+		Help:      "Number of times cgroup events may have been dropped by the cgroup monitor.",
+	})
+	m.applyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "nft",
+		Name:      "apply_duration_seconds",
+		Help:      "Time taken to apply changes to nftable.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+	m.applyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nft",
+		Name:      "apply_errors_total",
+		Help:      "Number of failed attempts to apply changes to nftable.",
+	}, []string{"operation"})
+	m.lastApply = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "nft",
+		Name:      "last_apply_timestamp_seconds",
+		Help:      "Unix time of the last successful change to nftable.",
+	})
+
+	m.registry = prometheus.NewRegistry()
+	m.registry.MustRegister(
+		m.cgroups,
+		m.eventsReceived,
+		m.eventsDropped,
+		m.applyDuration,
+		m.applyErrors,
+		m.lastApply,
+	)
+
+	if m.nft != nil {
+		m.registry.MustRegister(&tproxyCollector{nft: m.nft, log: m.log})
+	}
+
+	ret = m
+
+	m.log.Debugw("Metrics created.",
+		"config", m.cfg,
+	)
+
+	return
+}
+
+// WithConfig makes metrics exposed as described in cfg.
+func WithConfig(cfg *config.Metrics) Opt {
+	return func(m *Metrics) (ret *Metrics, err error) {
+		if cfg == nil {
+			err = ErrConfigMissing
+			return
+		}
+
+		m.cfg = cfg
+		ret = m
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(m *Metrics) (ret *Metrics, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		m.log = log
+		ret = m
+		return
+	}
+}
+
+// WithNFTManager makes metrics include nft counters of tproxies
+// read by nft.
+func WithNFTManager(nft interfaces.NFTManager) Opt {
+	return func(m *Metrics) (ret *Metrics, err error) {
+		if nft == nil {
+			err = ErrNFTManagerMissing
+			return
+		}
+
+		m.nft = nft
+		ret = m
+		return
+	}
+}
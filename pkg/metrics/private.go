@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package metrics
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func (m *Metrics) listen() (ret net.Listener, err error) {
+	if m.cfg.Address != "" {
+		return net.Listen("tcp", m.cfg.Address)
+	}
+
+	err = os.MkdirAll(filepath.Dir(m.cfg.Unix), 0755)
+	if err != nil {
+		return
+	}
+
+	// Socket left by the last run which was not exited normally.
+	err = os.Remove(m.cfg.Unix)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	var l *net.UnixListener
+	l, err = net.ListenUnix("unix", &net.UnixAddr{Name: m.cfg.Unix, Net: "unix"})
+	if err != nil {
+		return
+	}
+	l.SetUnlinkOnClose(true)
+
+	ret = l
+	return
+}
+
+var (
+	tproxyPacketsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tproxy", "packets_total"),
+		"Number of packets sent to the tproxy.",
+		[]string{"tproxy", "proto", "family"}, nil,
+	)
+	tproxyBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tproxy", "bytes_total"),
+		"Number of bytes sent to the tproxy.",
+		[]string{"tproxy", "proto", "family"}, nil,
+	)
+)
+
+// tproxyCollector reads nft counters of tproxies when scraped.
+type tproxyCollector struct {
+	nft interfaces.NFTManager
+	log *zap.SugaredLogger
+}
+
+func (c *tproxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tproxyPacketsDesc
+	ch <- tproxyBytesDesc
+}
+
+func (c *tproxyCollector) Collect(ch chan<- prometheus.Metric) {
+	counters, err := c.nft.Counters()
+	if err != nil {
+		c.log.Errorw("Failed to read nft counters.",
+			"error", err,
+		)
+		ch <- prometheus.NewInvalidMetric(tproxyPacketsDesc, err)
+		return
+	}
+
+	for i := range counters {
+		name, ok := strings.CutPrefix(counters[i].Target, "tproxy-")
+		if !ok {
+			continue
+		}
+
+		labels := []string{name, counters[i].Proto, counters[i].Family}
+
+		ch <- prometheus.MustNewConstMetric(
+			tproxyPacketsDesc, prometheus.CounterValue,
+			float64(counters[i].Packets), labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			tproxyBytesDesc, prometheus.CounterValue,
+			float64(counters[i].Bytes), labels...,
+		)
+	}
+}
+
+// zapErrorLog makes errors of promhttp logged by zap.
+type zapErrorLog struct {
+	log *zap.SugaredLogger
+}
+
+func (l zapErrorLog) Println(v ...any) {
+	l.log.Errorln(v...)
+}
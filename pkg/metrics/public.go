@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// SetCGroups records the number of cgroups in the cgroup map.
+func (m *Metrics) SetCGroups(n int) {
+	m.cgroups.Set(float64(n))
+}
+
+// AddEventsReceived records n cgroup events received by the monitor.
+func (m *Metrics) AddEventsReceived(n int) {
+	m.eventsReceived.Add(float64(n))
+}
+
+// AddEventsDropped records n times that the monitor
+// may have dropped cgroup events.
+func (m *Metrics) AddEventsDropped(n int) {
+	m.eventsDropped.Add(float64(n))
+}
+
+// ObserveApply records an attempt to apply changes to nftable,
+// op is one of the Op constants.
+func (m *Metrics) ObserveApply(op string, duration time.Duration, err error) {
+	m.applyDuration.WithLabelValues(op).Observe(duration.Seconds())
+
+	if err != nil {
+		m.applyErrors.WithLabelValues(op).Inc()
+		return
+	}
+
+	m.lastApply.SetToCurrentTime()
+}
+
+// RunMetricsServer exposes metrics in Prometheus text format
+// until ctx is done.
+// It returns immediately if metrics is not configured.
+func (m *Metrics) RunMetricsServer(ctx context.Context) (err error) {
+	defer Wrap(&err, "running metrics server")
+
+	if m.cfg == nil {
+		m.log.Debug("Metrics server is not configured.")
+		return
+	}
+
+	var l net.Listener
+	l, err = m.listen()
+	if err != nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorLog: zapErrorLog{m.log},
+	}))
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(
+			context.Background(), 5*time.Second,
+		)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	m.log.Infow("Metrics server started.",
+		"address", l.Addr().String(),
+	)
+
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	return ctx.Err()
+}
@@ -12,4 +12,5 @@ var (
 	ErrLoggerMissing      = errors.New("logger is missing.")
 	ErrCGroupRootMissing  = errors.New("cgroupv2 file system mount point is missing.")
 	ErrConnFactoryMissing = errors.New("netlink conn factory is missing.")
+	ErrMetricsMissing     = errors.New("metrics is missing.")
 )
@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package memconnector_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/nftman"
+	"github.com/black-desk/cgtproxy/pkg/nftman/memconnector"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMemConnector(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "MemConnector Suite")
+}
+
+func pstr(s string) *string { return &s }
+
+var _ = Describe("In-memory ruleset", func() {
+	var (
+		mem  *memconnector.Connector
+		conn *nftables.Conn
+		err  error
+
+		table = &nftables.Table{
+			Name:   "test",
+			Family: nftables.TableFamilyINet,
+		}
+	)
+
+	BeforeEach(func() {
+		mem, err = memconnector.New()
+		Expect(err).To(Succeed())
+
+		conn, err = mem.Connect()
+		Expect(err).To(Succeed())
+
+		conn.AddTable(table)
+		conn.AddChain(&nftables.Chain{Table: table, Name: "target"})
+		Expect(conn.Flush()).To(Succeed())
+	})
+
+	It("should list what has been added", func() {
+		chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+		Expect(err).To(Succeed())
+		Expect(chains).To(HaveLen(1))
+		Expect(chains[0].Name).To(Equal("target"))
+	})
+
+	It("should refuse rules jumping to chains not exist", func() {
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: &nftables.Chain{Table: table, Name: "target"},
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictGoto, Chain: "missing"}},
+		})
+		Expect(conn.Flush()).To(MatchError(syscall.ENOENT))
+	})
+
+	It("should refuse to delete chains in use", func() {
+		conn.AddChain(&nftables.Chain{Table: table, Name: "source"})
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: &nftables.Chain{Table: table, Name: "source"},
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictGoto, Chain: "target"}},
+		})
+		Expect(conn.Flush()).To(Succeed())
+
+		conn.DelChain(&nftables.Chain{Table: table, Name: "target"})
+		Expect(conn.Flush()).To(MatchError(syscall.EBUSY))
+	})
+
+	It("should apply nothing in a batch if any message fails", func() {
+		conn.AddChain(&nftables.Chain{Table: table, Name: "new"})
+		conn.DelChain(&nftables.Chain{Table: table, Name: "missing"})
+		Expect(conn.Flush()).ToNot(Succeed())
+
+		chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyINet)
+		Expect(err).To(Succeed())
+		Expect(chains).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Render", func() {
+	var (
+		mem    *memconnector.Connector
+		nft    *nftman.NFTManager
+		root   string
+		result string
+		err    error
+	)
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+
+		cgroups := map[uint64]string{}
+		for _, path := range []string{"a", "a/b", "c"} {
+			Expect(os.MkdirAll(filepath.Join(root, path), 0755)).To(Succeed())
+
+			info, err := os.Stat(filepath.Join(root, path))
+			Expect(err).To(Succeed())
+
+			cgroups[info.Sys().(*syscall.Stat_t).Ino] = "/" + path
+		}
+
+		mem, err = memconnector.New()
+		Expect(err).To(Succeed())
+
+		nft, err = nftman.New(
+			nftman.WithCgroupRoot(config.CGroupRoot(root)),
+			nftman.WithBypass(config.Bypass{"10.0.0.0/8", "192.168.1.1"}),
+			nftman.WithConnFactory(mem),
+		)
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForTProxies([]*config.TProxy{{
+			Name: "clash",
+			Port: 7893,
+			Mark: 100,
+			DNSHijack: &config.DNSHijack{
+				IP:   pstr("127.0.0.1"),
+				Port: 53,
+			},
+		}})).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{
+				Path:   filepath.Join(root, "a"),
+				Target: types.Target{Op: types.TargetDirect},
+			},
+			{
+				Path:   filepath.Join(root, "a/b"),
+				Target: types.Target{Op: types.TargetTProxy, Chain: "clash"},
+			},
+			{
+				Path: filepath.Join(root, "c"),
+				Target: types.Target{
+					Op: types.TargetMark, Mark: 0x1200, MarkMask: 0xff00,
+				},
+			},
+		})).To(Succeed())
+
+		buf := &strings.Builder{}
+		Expect(mem.Render(buf, cgroups)).To(Succeed())
+		result = buf.String()
+	})
+
+	It("should print the table in syntax of nft", func() {
+		for _, expect := range []string{
+			"table inet cgtproxy {",
+			"elements = { 10.0.0.0/8,\n\t\t\t     192.168.1.1 }",
+			`elements = { "a" : goto DIRECT,` + "\n" +
+				`			     "a/b" : goto clash,` + "\n" +
+				`			     "c" : goto MARK-0x1200-0xff00 }`,
+			"type route hook output priority mangle; policy accept;",
+			"meta nfproto ipv4 ip daddr @bypass return",
+			"meta l4proto != { tcp, udp } return",
+			"socket cgroupv2 level 2 vmap @cgroup-vmap",
+			"meta l4proto { tcp, udp } tproxy to :7893",
+			"meta l4proto udp th dport 53 dnat ip to 127.0.0.1:53",
+			`meta nfproto ipv4 meta l4proto tcp counter name "tproxy-clash-tcp4"`,
+			"meta mark set meta mark & 0xffff00ff | 0x00001200",
+		} {
+			Expect(result).To(ContainSubstring(expect))
+		}
+	})
+
+	It("should print keys of unknown cgroups as inodes and follow changes", func() {
+		buf := &strings.Builder{}
+		Expect(mem.Render(buf, nil)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring("goto DIRECT"))
+		Expect(buf.String()).ToNot(ContainSubstring(`"a"`))
+
+		Expect(nft.RemoveRoutes([]string{filepath.Join(root, "c")})).To(Succeed())
+
+		buf.Reset()
+		Expect(mem.Render(buf, nil)).To(Succeed())
+		Expect(buf.String()).ToNot(ContainSubstring("goto MARK-0x1200-0xff00"))
+	})
+})
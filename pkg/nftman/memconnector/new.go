@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package memconnector
+
+import "sync"
+
+// Connector connects to a ruleset kept in memory instead of the kernel.
+// Batches sent through its connections are checked and applied
+// to the in-memory ruleset the way the kernel does,
+// and the ruleset can be listed through the same connections,
+// so everything NFTManager does works without touching netlink.
+type Connector struct {
+	mu sync.Mutex
+
+	tables []*table
+	// handle is the last handle assigned to a rule.
+	handle uint64
+}
+
+type Opt = (func(*Connector) (*Connector, error))
+
+func New(opts ...Opt) (ret *Connector, err error) {
+	c := &Connector{}
+
+	for i := range opts {
+		c, err = opts[i](c)
+		if err != nil {
+			return
+		}
+	}
+
+	ret = c
+	return
+}
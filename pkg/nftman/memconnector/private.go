@@ -0,0 +1,1355 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package memconnector
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+type table struct {
+	family byte
+	name   string
+
+	chains []*chain
+	sets   []*set
+	objs   []*obj
+}
+
+type chain struct {
+	name  string
+	attrs []netlink.Attribute
+	rules []*rule
+}
+
+type rule struct {
+	handle uint64
+	// exprs is the payload of NFTA_RULE_EXPRESSIONS.
+	exprs    []byte
+	userData []byte
+}
+
+type set struct {
+	name string
+	// attrs are attributes of the set except its name.
+	attrs     []netlink.Attribute
+	anonymous bool
+	elems     []*elem
+}
+
+type elem struct {
+	key []byte
+	end bool
+	// data is the payload of NFTA_SET_ELEM_DATA, nil for elements of sets.
+	data []byte
+	// attrs is the element as it was sent.
+	attrs []byte
+}
+
+type obj struct {
+	name  string
+	typ   uint32
+	attrs []netlink.Attribute
+}
+
+// session is a netlink connection to the in-memory ruleset,
+// it holds replies which have not been received yet.
+type session struct {
+	connector *Connector
+	pending   [][]netlink.Message
+}
+
+func (s *session) handle(req []netlink.Message) (ret []netlink.Message, err error) {
+	if req == nil {
+		if len(s.pending) == 0 {
+			return
+		}
+
+		ret = s.pending[0]
+		s.pending = s.pending[1:]
+		return
+	}
+
+	c := s.connector
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if req[0].Header.Type == netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN) {
+		s.pending = append(s.pending, c.commit(req)...)
+		return
+	}
+
+	for i := range req {
+		replies, errno := c.get(req[i])
+		if errno != 0 {
+			replies = reply(nltest.Error(int(errno), req[i:i+1]))
+		} else if req[i].Header.Flags&netlink.Acknowledge != 0 &&
+			req[i].Header.Flags&netlink.Dump != netlink.Dump {
+			s.pending = append(s.pending, ack(req[i]))
+		}
+
+		ret = append(ret, replies...)
+	}
+
+	return
+}
+
+// batch is a copy of the ruleset which messages in a batch are applied to.
+// The copy replaces the ruleset only if all messages are applied.
+type batch struct {
+	tables []*table
+	handle uint64
+
+	// sets are sets added in this batch, keyed by their IDs.
+	sets map[uint32]*set
+	// anonymous are messages adding anonymous sets in this batch.
+	anonymous map[*set]netlink.Message
+}
+
+// commit applies messages in a batch to the ruleset,
+// it returns replies of messages requiring acknowledgement.
+func (c *Connector) commit(req []netlink.Message) (ret [][]netlink.Message) {
+	b := &batch{
+		tables:    cloneTables(c.tables),
+		handle:    c.handle,
+		sets:      map[uint32]*set{},
+		anonymous: map[*set]netlink.Message{},
+	}
+
+	failed := false
+
+	for i := range req {
+		switch req[i].Header.Type {
+		case netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN),
+			netlink.HeaderType(unix.NFNL_MSG_BATCH_END):
+			continue
+		}
+
+		err := b.apply(req[i])
+		if err != nil {
+			failed = true
+			ret = append(ret, reply(nltest.Error(int(errno(err)), req[i:i+1])))
+			continue
+		}
+
+		if req[i].Header.Flags&netlink.Acknowledge != 0 {
+			ret = append(ret, ack(req[i]))
+		}
+	}
+
+	if failed {
+		return
+	}
+
+	// NOTE:
+	// Kernel refuses anonymous sets not used by any rule of the batch
+	// adding them, and removes anonymous sets
+	// once rules using them are removed.
+	for s, msg := range b.anonymous {
+		if b.setUsed(s) {
+			continue
+		}
+
+		failed = true
+		ret = append(ret, reply(nltest.Error(int(unix.EINVAL), []netlink.Message{msg})))
+	}
+
+	if failed {
+		return
+	}
+
+	for _, t := range b.tables {
+		t.sets = slices.DeleteFunc(t.sets, func(s *set) bool {
+			return s.anonymous && !b.setUsed(s)
+		})
+	}
+
+	c.tables = b.tables
+	c.handle = b.handle
+	return
+}
+
+func (b *batch) apply(msg netlink.Message) (err error) {
+	if msg.Header.Type>>8 != unix.NFNL_SUBSYS_NFTABLES || len(msg.Data) < 4 {
+		return unix.EOPNOTSUPP
+	}
+
+	family := msg.Data[0]
+
+	var attrs []netlink.Attribute
+	attrs, err = netlink.UnmarshalAttributes(msg.Data[4:])
+	if err != nil {
+		return
+	}
+
+	flags := msg.Header.Flags
+
+	switch msg.Header.Type & 0xff {
+	case unix.NFT_MSG_NEWTABLE:
+		return b.newTable(family, attrs, flags)
+	case unix.NFT_MSG_DELTABLE:
+		return b.delTable(family, attrs)
+	case unix.NFT_MSG_NEWCHAIN:
+		return b.newChain(family, attrs, flags)
+	case unix.NFT_MSG_DELCHAIN:
+		return b.delChain(family, attrs)
+	case unix.NFT_MSG_NEWRULE:
+		return b.newRule(family, attrs, flags)
+	case unix.NFT_MSG_DELRULE:
+		return b.delRule(family, attrs)
+	case unix.NFT_MSG_NEWSET:
+		return b.newSet(family, attrs, flags, msg)
+	case unix.NFT_MSG_DELSET:
+		return b.delSet(family, attrs)
+	case unix.NFT_MSG_NEWSETELEM:
+		return b.newSetElem(family, attrs, flags)
+	case unix.NFT_MSG_DELSETELEM:
+		return b.delSetElem(family, attrs)
+	case unix.NFT_MSG_NEWOBJ:
+		return b.newObj(family, attrs, flags)
+	case unix.NFT_MSG_DELOBJ:
+		return b.delObj(family, attrs)
+	}
+
+	return unix.EOPNOTSUPP
+}
+
+func (b *batch) table(family byte, name string) (ret *table, err error) {
+	for _, t := range b.tables {
+		if t.family == family && t.name == name {
+			ret = t
+			return
+		}
+	}
+
+	err = unix.ENOENT
+	return
+}
+
+func (b *batch) newTable(
+	family byte, attrs []netlink.Attribute, flags netlink.HeaderFlags,
+) (
+	err error,
+) {
+	name := findString(attrs, unix.NFTA_TABLE_NAME)
+
+	if _, err = b.table(family, name); err == nil {
+		if flags&netlink.Excl != 0 {
+			err = unix.EEXIST
+		}
+		return
+	}
+
+	err = nil
+	b.tables = append(b.tables, &table{family: family, name: name})
+	return
+}
+
+func (b *batch) delTable(family byte, attrs []netlink.Attribute) (err error) {
+	if _, ok := find(attrs, unix.NFTA_TABLE_NAME); !ok {
+		// Flush the whole ruleset.
+		b.tables = slices.DeleteFunc(b.tables, func(t *table) bool {
+			return family == unix.NFPROTO_UNSPEC || t.family == family
+		})
+		return
+	}
+
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_TABLE_NAME))
+	if err != nil {
+		return
+	}
+
+	b.tables = slices.DeleteFunc(b.tables, func(x *table) bool {
+		return x == t
+	})
+	return
+}
+
+func (b *batch) newChain(
+	family byte, attrs []netlink.Attribute, flags netlink.HeaderFlags,
+) (
+	err error,
+) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_CHAIN_TABLE))
+	if err != nil {
+		return
+	}
+
+	name := findString(attrs, unix.NFTA_CHAIN_NAME)
+	if t.chain(name) != nil {
+		if flags&netlink.Excl != 0 {
+			err = unix.EEXIST
+		}
+		return
+	}
+
+	t.chains = append(t.chains, &chain{name: name, attrs: attrs})
+	return
+}
+
+func (b *batch) delChain(family byte, attrs []netlink.Attribute) (err error) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_CHAIN_TABLE))
+	if err != nil {
+		return
+	}
+
+	ch := t.chain(findString(attrs, unix.NFTA_CHAIN_NAME))
+	if ch == nil {
+		err = unix.ENOENT
+		return
+	}
+
+	// Rules of the chain are removed with it,
+	// but it cannot be removed while others jump to it.
+	var used bool
+	used, err = t.chainUsed(ch)
+	if err != nil {
+		return
+	}
+	if used {
+		err = unix.EBUSY
+		return
+	}
+
+	t.chains = slices.DeleteFunc(t.chains, func(x *chain) bool {
+		return x == ch
+	})
+	return
+}
+
+func (b *batch) newRule(
+	family byte, attrs []netlink.Attribute, flags netlink.HeaderFlags,
+) (
+	err error,
+) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_RULE_TABLE))
+	if err != nil {
+		return
+	}
+
+	ch := t.chain(findString(attrs, unix.NFTA_RULE_CHAIN))
+	if ch == nil {
+		err = unix.ENOENT
+		return
+	}
+
+	r := &rule{}
+	r.userData, _ = find(attrs, unix.NFTA_RULE_USERDATA)
+
+	exprs, _ := find(attrs, unix.NFTA_RULE_EXPRESSIONS)
+	r.exprs, err = b.bindExprs(t, exprs)
+	if err != nil {
+		return
+	}
+
+	if handle, ok := findUint64(attrs, unix.NFTA_RULE_HANDLE); ok &&
+		flags&netlink.Replace != 0 {
+		index := ch.ruleIndex(handle)
+		if index < 0 {
+			err = unix.ENOENT
+			return
+		}
+
+		r.handle = handle
+		ch.rules[index] = r
+		return
+	}
+
+	b.handle++
+	r.handle = b.handle
+
+	if position, ok := findUint64(attrs, unix.NFTA_RULE_POSITION); ok &&
+		position != 0 {
+		index := ch.ruleIndex(position)
+		if index < 0 {
+			err = unix.ENOENT
+			return
+		}
+
+		if flags&netlink.Append != 0 {
+			index++
+		}
+
+		ch.rules = slices.Insert(ch.rules, index, r)
+		return
+	}
+
+	if flags&netlink.Append != 0 {
+		ch.rules = append(ch.rules, r)
+		return
+	}
+
+	ch.rules = slices.Insert(ch.rules, 0, r)
+	return
+}
+
+func (b *batch) delRule(family byte, attrs []netlink.Attribute) (err error) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_RULE_TABLE))
+	if err != nil {
+		return
+	}
+
+	chains := t.chains
+	if _, ok := find(attrs, unix.NFTA_RULE_CHAIN); ok {
+		ch := t.chain(findString(attrs, unix.NFTA_RULE_CHAIN))
+		if ch == nil {
+			err = unix.ENOENT
+			return
+		}
+
+		chains = []*chain{ch}
+	}
+
+	handle, ok := findUint64(attrs, unix.NFTA_RULE_HANDLE)
+	if !ok {
+		for _, ch := range chains {
+			ch.rules = nil
+		}
+		return
+	}
+
+	ch := chains[0]
+	index := ch.ruleIndex(handle)
+	if len(chains) != 1 || index < 0 {
+		err = unix.ENOENT
+		return
+	}
+
+	ch.rules = slices.Delete(ch.rules, index, index+1)
+	return
+}
+
+func (b *batch) newSet(
+	family byte,
+	attrs []netlink.Attribute,
+	flags netlink.HeaderFlags,
+	msg netlink.Message,
+) (
+	err error,
+) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_SET_TABLE))
+	if err != nil {
+		return
+	}
+
+	name := findString(attrs, unix.NFTA_SET_NAME)
+	id, _ := findUint32(attrs, unix.NFTA_SET_ID)
+	setFlags, _ := findUint32(attrs, unix.NFTA_SET_FLAGS)
+
+	if strings.Contains(name, "%d") {
+		name = t.freeSetName(name)
+	} else if s := t.set(name); s != nil {
+		if flags&netlink.Excl != 0 {
+			err = unix.EEXIST
+			return
+		}
+
+		b.sets[id] = s
+		return
+	}
+
+	s := &set{
+		name:      name,
+		attrs:     without(attrs, unix.NFTA_SET_NAME),
+		anonymous: setFlags&unix.NFT_SET_ANONYMOUS != 0,
+	}
+
+	t.sets = append(t.sets, s)
+	b.sets[id] = s
+
+	if s.anonymous {
+		b.anonymous[s] = msg
+	}
+
+	return
+}
+
+func (b *batch) delSet(family byte, attrs []netlink.Attribute) (err error) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_SET_TABLE))
+	if err != nil {
+		return
+	}
+
+	s := t.set(findString(attrs, unix.NFTA_SET_NAME))
+	if s == nil {
+		err = unix.ENOENT
+		return
+	}
+
+	if b.setUsed(s) {
+		err = unix.EBUSY
+		return
+	}
+
+	t.sets = slices.DeleteFunc(t.sets, func(x *set) bool {
+		return x == s
+	})
+	return
+}
+
+// setOf returns the set elements in attrs belong to.
+func (b *batch) setOf(
+	family byte, attrs []netlink.Attribute,
+) (
+	t *table, s *set, err error,
+) {
+	t, err = b.table(family, findString(attrs, unix.NFTA_SET_ELEM_LIST_TABLE))
+	if err != nil {
+		return
+	}
+
+	name := findString(attrs, unix.NFTA_SET_ELEM_LIST_SET)
+	if strings.Contains(name, "%d") {
+		id, _ := findUint32(attrs, unix.NFTA_SET_ELEM_LIST_SET_ID)
+		s = b.sets[id]
+	} else {
+		s = t.set(name)
+	}
+
+	if s == nil {
+		err = unix.ENOENT
+		return
+	}
+
+	return
+}
+
+func (b *batch) newSetElem(
+	family byte, attrs []netlink.Attribute, flags netlink.HeaderFlags,
+) (
+	err error,
+) {
+	var (
+		t *table
+		s *set
+	)
+	t, s, err = b.setOf(family, attrs)
+	if err != nil {
+		return
+	}
+
+	var elems []*elem
+	elems, err = parseElems(attrs)
+	if err != nil {
+		return
+	}
+
+	for _, e := range elems {
+		var target string
+		target, err = verdictChain(e.data)
+		if err != nil {
+			return
+		}
+		if target != "" && t.chain(target) == nil {
+			err = unix.ENOENT
+			return
+		}
+
+		index := s.elemIndex(e)
+		if index < 0 {
+			s.elems = append(s.elems, e)
+			continue
+		}
+
+		// NOTE:
+		// Kernel refuses to change data of an existing element.
+		if !bytes.Equal(s.elems[index].data, e.data) {
+			err = unix.EBUSY
+			return
+		}
+
+		if flags&netlink.Excl != 0 {
+			err = unix.EEXIST
+			return
+		}
+	}
+
+	return
+}
+
+func (b *batch) delSetElem(family byte, attrs []netlink.Attribute) (err error) {
+	var s *set
+	_, s, err = b.setOf(family, attrs)
+	if err != nil {
+		return
+	}
+
+	if _, ok := find(attrs, unix.NFTA_SET_ELEM_LIST_ELEMENTS); !ok {
+		// Flush the set.
+		s.elems = nil
+		return
+	}
+
+	var elems []*elem
+	elems, err = parseElems(attrs)
+	if err != nil {
+		return
+	}
+
+	for _, e := range elems {
+		index := s.elemIndex(e)
+		if index < 0 {
+			err = unix.ENOENT
+			return
+		}
+
+		s.elems = slices.Delete(s.elems, index, index+1)
+	}
+
+	return
+}
+
+func (b *batch) newObj(
+	family byte, attrs []netlink.Attribute, flags netlink.HeaderFlags,
+) (
+	err error,
+) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_OBJ_TABLE))
+	if err != nil {
+		return
+	}
+
+	name := findString(attrs, unix.NFTA_OBJ_NAME)
+	typ, _ := findUint32(attrs, unix.NFTA_OBJ_TYPE)
+
+	if t.obj(name, typ) != nil {
+		if flags&netlink.Excl != 0 {
+			err = unix.EEXIST
+		}
+		return
+	}
+
+	t.objs = append(t.objs, &obj{name: name, typ: typ, attrs: attrs})
+	return
+}
+
+func (b *batch) delObj(family byte, attrs []netlink.Attribute) (err error) {
+	var t *table
+	t, err = b.table(family, findString(attrs, unix.NFTA_OBJ_TABLE))
+	if err != nil {
+		return
+	}
+
+	typ, _ := findUint32(attrs, unix.NFTA_OBJ_TYPE)
+	o := t.obj(findString(attrs, unix.NFTA_OBJ_NAME), typ)
+	if o == nil {
+		err = unix.ENOENT
+		return
+	}
+
+	var used bool
+	used, err = t.objUsed(o)
+	if err != nil {
+		return
+	}
+	if used {
+		err = unix.EBUSY
+		return
+	}
+
+	t.objs = slices.DeleteFunc(t.objs, func(x *obj) bool {
+		return x == o
+	})
+	return
+}
+
+// bindExprs checks that sets, chains and objects
+// expressions of a rule refer to exist,
+// and replaces names of anonymous sets added in this batch
+// with the names they actually get.
+func (b *batch) bindExprs(t *table, data []byte) (ret []byte, err error) {
+	var exprs []expression
+	exprs, err = parseExprs(data)
+	if err != nil {
+		return
+	}
+
+	for i := range exprs {
+		e := &exprs[i]
+
+		switch e.name {
+		case "lookup":
+			name := findString(e.attrs, unix.NFTA_LOOKUP_SET)
+			if !strings.Contains(name, "%d") {
+				if t.set(name) == nil {
+					err = unix.ENOENT
+					return
+				}
+				continue
+			}
+
+			id, _ := findUint32(e.attrs, unix.NFTA_LOOKUP_SET_ID)
+			s := b.sets[id]
+			if s == nil {
+				err = unix.ENOENT
+				return
+			}
+
+			e.attrs = replace(e.attrs, unix.NFTA_LOOKUP_SET, []byte(s.name+"\x00"))
+		case "immediate":
+			value, _ := find(e.attrs, unix.NFTA_IMMEDIATE_DATA)
+
+			var target string
+			target, err = verdictChain(value)
+			if err != nil {
+				return
+			}
+			if target != "" && t.chain(target) == nil {
+				err = unix.ENOENT
+				return
+			}
+		case "objref":
+			typ, _ := findUint32(e.attrs, unix.NFTA_OBJREF_IMM_TYPE)
+			if t.obj(findString(e.attrs, unix.NFTA_OBJREF_IMM_NAME), typ) == nil {
+				err = unix.ENOENT
+				return
+			}
+		}
+	}
+
+	return marshalExprs(exprs)
+}
+
+// setUsed tells whether any rule looks up s.
+func (b *batch) setUsed(s *set) bool {
+	for _, t := range b.tables {
+		if !slices.Contains(t.sets, s) {
+			continue
+		}
+
+		for _, ch := range t.chains {
+			for _, r := range ch.rules {
+				exprs, err := parseExprs(r.exprs)
+				if err != nil {
+					continue
+				}
+
+				for i := range exprs {
+					if exprs[i].name == "lookup" &&
+						findString(exprs[i].attrs, unix.NFTA_LOOKUP_SET) == s.name {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *table) chain(name string) *chain {
+	for _, ch := range t.chains {
+		if ch.name == name {
+			return ch
+		}
+	}
+
+	return nil
+}
+
+func (t *table) set(name string) *set {
+	for _, s := range t.sets {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (t *table) obj(name string, typ uint32) *obj {
+	for _, o := range t.objs {
+		if o.name == name && o.typ == typ {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// freeSetName returns the first name not used by any set
+// formatted from pattern like "__set%d".
+func (t *table) freeSetName(pattern string) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf(pattern, i)
+		if t.set(name) == nil {
+			return name
+		}
+	}
+}
+
+// chainUsed tells whether rules of other chains
+// or elements of verdict maps jump to or goto ch.
+func (t *table) chainUsed(ch *chain) (ret bool, err error) {
+	for _, other := range t.chains {
+		if other == ch {
+			continue
+		}
+
+		for _, r := range other.rules {
+			var exprs []expression
+			exprs, err = parseExprs(r.exprs)
+			if err != nil {
+				return
+			}
+
+			for i := range exprs {
+				if exprs[i].name != "immediate" {
+					continue
+				}
+
+				value, _ := find(exprs[i].attrs, unix.NFTA_IMMEDIATE_DATA)
+
+				var target string
+				target, err = verdictChain(value)
+				if err != nil {
+					return
+				}
+
+				if target == ch.name {
+					ret = true
+					return
+				}
+			}
+		}
+	}
+
+	for _, s := range t.sets {
+		for _, e := range s.elems {
+			var target string
+			target, err = verdictChain(e.data)
+			if err != nil {
+				return
+			}
+
+			if target == ch.name {
+				ret = true
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// objUsed tells whether any rule refers to o.
+func (t *table) objUsed(o *obj) (ret bool, err error) {
+	for _, ch := range t.chains {
+		for _, r := range ch.rules {
+			var exprs []expression
+			exprs, err = parseExprs(r.exprs)
+			if err != nil {
+				return
+			}
+
+			for i := range exprs {
+				if exprs[i].name != "objref" {
+					continue
+				}
+
+				typ, _ := findUint32(exprs[i].attrs, unix.NFTA_OBJREF_IMM_TYPE)
+				name := findString(exprs[i].attrs, unix.NFTA_OBJREF_IMM_NAME)
+				if typ == o.typ && name == o.name {
+					ret = true
+					return
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func (ch *chain) ruleIndex(handle uint64) int {
+	return slices.IndexFunc(ch.rules, func(r *rule) bool {
+		return r.handle == handle
+	})
+}
+
+func (s *set) elemIndex(e *elem) int {
+	return slices.IndexFunc(s.elems, func(x *elem) bool {
+		return x.end == e.end && bytes.Equal(x.key, e.key)
+	})
+}
+
+func cloneTables(tables []*table) []*table {
+	ret := make([]*table, len(tables))
+
+	for i, t := range tables {
+		nt := *t
+
+		nt.chains = make([]*chain, len(t.chains))
+		for j, ch := range t.chains {
+			nch := *ch
+			nch.rules = slices.Clone(ch.rules)
+			nt.chains[j] = &nch
+		}
+
+		nt.sets = make([]*set, len(t.sets))
+		for j, s := range t.sets {
+			ns := *s
+			ns.elems = slices.Clone(s.elems)
+			nt.sets[j] = &ns
+		}
+
+		nt.objs = slices.Clone(t.objs)
+
+		ret[i] = &nt
+	}
+
+	return ret
+}
+
+// get answers a request listing the ruleset.
+func (c *Connector) get(req netlink.Message) (ret []netlink.Message, err syscall.Errno) {
+	if req.Header.Type>>8 != unix.NFNL_SUBSYS_NFTABLES || len(req.Data) < 4 {
+		err = unix.EOPNOTSUPP
+		return
+	}
+
+	family := req.Data[0]
+
+	attrs, unmarshalErr := netlink.UnmarshalAttributes(req.Data[4:])
+	if unmarshalErr != nil {
+		err = unix.EINVAL
+		return
+	}
+
+	dump := req.Header.Flags&netlink.Dump == netlink.Dump
+
+	msgs := []netlink.Message{}
+
+	tables := []*table{}
+	for _, t := range c.tables {
+		if family != unix.NFPROTO_UNSPEC && t.family != family {
+			continue
+		}
+
+		tables = append(tables, t)
+	}
+
+	// NOTE:
+	// The attribute holding name of table
+	// is the first one in all kinds of requests.
+	if _, ok := find(attrs, unix.NFTA_TABLE_NAME); ok {
+		name := findString(attrs, unix.NFTA_TABLE_NAME)
+		tables = slices.DeleteFunc(tables, func(t *table) bool {
+			return t.name != name
+		})
+
+		if len(tables) == 0 {
+			err = unix.ENOENT
+			return
+		}
+	}
+
+	switch req.Header.Type & 0xff {
+	case unix.NFT_MSG_GETTABLE:
+		for _, t := range tables {
+			msgs = append(msgs, message(unix.NFT_MSG_NEWTABLE, t.family, []netlink.Attribute{
+				{Type: unix.NFTA_TABLE_NAME, Data: []byte(t.name + "\x00")},
+				{Type: unix.NFTA_TABLE_FLAGS, Data: binaryutil.BigEndian.PutUint32(0)},
+			}))
+		}
+	case unix.NFT_MSG_GETCHAIN:
+		name, filter := find(attrs, unix.NFTA_CHAIN_NAME)
+		for _, t := range tables {
+			for _, ch := range t.chains {
+				if filter && ch.name != trim(name) {
+					continue
+				}
+
+				msgs = append(msgs, message(unix.NFT_MSG_NEWCHAIN, t.family, ch.attrs))
+			}
+		}
+	case unix.NFT_MSG_GETRULE:
+		name, filter := find(attrs, unix.NFTA_RULE_CHAIN)
+		for _, t := range tables {
+			for _, ch := range t.chains {
+				if filter && ch.name != trim(name) {
+					continue
+				}
+
+				for _, r := range ch.rules {
+					msgs = append(msgs, message(unix.NFT_MSG_NEWRULE, t.family, r.marshal(t, ch)))
+				}
+			}
+		}
+	case unix.NFT_MSG_GETSET:
+		name, filter := find(attrs, unix.NFTA_SET_NAME)
+		for _, t := range tables {
+			for _, s := range t.sets {
+				if filter && s.name != trim(name) {
+					continue
+				}
+
+				msgs = append(msgs, message(unix.NFT_MSG_NEWSET, t.family, s.marshal()))
+			}
+		}
+	case unix.NFT_MSG_GETSETELEM:
+		name := findString(attrs, unix.NFTA_SET_ELEM_LIST_SET)
+		for _, t := range tables {
+			s := t.set(name)
+			if s == nil {
+				continue
+			}
+
+			if len(s.elems) == 0 {
+				break
+			}
+
+			msgs = append(msgs, message(unix.NFT_MSG_NEWSETELEM, t.family, s.marshalElems(t)))
+		}
+	case unix.NFT_MSG_GETOBJ, unix.NFT_MSG_GETOBJ_RESET:
+		name, filter := find(attrs, unix.NFTA_OBJ_NAME)
+		typ, filterType := findUint32(attrs, unix.NFTA_OBJ_TYPE)
+		for _, t := range tables {
+			for _, o := range t.objs {
+				if filter && o.name != trim(name) {
+					continue
+				}
+
+				if filterType && o.typ != typ {
+					continue
+				}
+
+				msgs = append(msgs, message(unix.NFT_MSG_NEWOBJ, t.family, o.attrs))
+			}
+		}
+	default:
+		err = unix.EOPNOTSUPP
+		return
+	}
+
+	for i := range msgs {
+		msgs[i].Header.Sequence = req.Header.Sequence
+		msgs[i].Header.PID = req.Header.PID
+	}
+
+	if !dump {
+		if len(msgs) == 0 {
+			err = unix.ENOENT
+			return
+		}
+
+		ret = msgs[:1]
+		return
+	}
+
+	for i := range msgs {
+		msgs[i].Header.Flags |= netlink.Multi
+	}
+
+	ret = append(msgs, netlink.Message{
+		Header: netlink.Header{
+			Type:     netlink.Done,
+			Flags:    netlink.Multi,
+			Sequence: req.Header.Sequence,
+			PID:      req.Header.PID,
+		},
+	})
+	return
+}
+
+func (r *rule) marshal(t *table, ch *chain) []netlink.Attribute {
+	attrs := []netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: []byte(t.name + "\x00")},
+		{Type: unix.NFTA_RULE_CHAIN, Data: []byte(ch.name + "\x00")},
+		{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(r.handle)},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_RULE_EXPRESSIONS, Data: r.exprs},
+	}
+
+	if r.userData != nil {
+		attrs = append(attrs, netlink.Attribute{
+			Type: unix.NFTA_RULE_USERDATA, Data: r.userData,
+		})
+	}
+
+	return attrs
+}
+
+func (s *set) marshal() []netlink.Attribute {
+	// NOTE:
+	// setsFromMsg of github.com/google/nftables
+	// takes the verdict data type of a verdict map as its key type,
+	// so attributes describing data are put before those describing keys,
+	// which makes the key type win.
+	attrs := []netlink.Attribute{}
+	rest := []netlink.Attribute{}
+
+	for _, a := range s.attrs {
+		switch a.Type & attrTypeMask {
+		case unix.NFTA_SET_TABLE:
+			attrs = append(attrs, a, netlink.Attribute{
+				Type: unix.NFTA_SET_NAME, Data: []byte(s.name + "\x00"),
+			})
+		case unix.NFTA_SET_DATA_TYPE, unix.NFTA_SET_DATA_LEN:
+			attrs = append(attrs, a)
+		default:
+			rest = append(rest, a)
+		}
+	}
+
+	return append(attrs, rest...)
+}
+
+func (s *set) marshalElems(t *table) []netlink.Attribute {
+	elems := make([]netlink.Attribute, 0, len(s.elems))
+	for _, e := range s.elems {
+		elems = append(elems, netlink.Attribute{
+			Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: e.attrs,
+		})
+	}
+
+	data, err := netlink.MarshalAttributes(elems)
+	if err != nil {
+		// Elements have been marshaled once when they were added.
+		panic(err)
+	}
+
+	return []netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(t.name + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(s.name + "\x00")},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_LIST_ELEMENTS, Data: data},
+	}
+}
+
+// expression is an element in NFTA_RULE_EXPRESSIONS.
+type expression struct {
+	name  string
+	attrs []netlink.Attribute
+}
+
+func parseExprs(data []byte) (ret []expression, err error) {
+	var list []netlink.Attribute
+	list, err = netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return
+	}
+
+	for i := range list {
+		var attrs []netlink.Attribute
+		attrs, err = netlink.UnmarshalAttributes(list[i].Data)
+		if err != nil {
+			return
+		}
+
+		e := expression{name: findString(attrs, unix.NFTA_EXPR_NAME)}
+
+		if data, ok := find(attrs, unix.NFTA_EXPR_DATA); ok {
+			e.attrs, err = netlink.UnmarshalAttributes(data)
+			if err != nil {
+				return
+			}
+		}
+
+		ret = append(ret, e)
+	}
+
+	return
+}
+
+func marshalExprs(exprs []expression) (ret []byte, err error) {
+	list := make([]netlink.Attribute, 0, len(exprs))
+
+	for i := range exprs {
+		var data []byte
+		data, err = netlink.MarshalAttributes(exprs[i].attrs)
+		if err != nil {
+			return
+		}
+
+		var e []byte
+		e, err = netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: unix.NFTA_EXPR_NAME, Data: []byte(exprs[i].name + "\x00")},
+			{Type: unix.NLA_F_NESTED | unix.NFTA_EXPR_DATA, Data: data},
+		})
+		if err != nil {
+			return
+		}
+
+		list = append(list, netlink.Attribute{
+			Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: e,
+		})
+	}
+
+	return netlink.MarshalAttributes(list)
+}
+
+func parseElems(attrs []netlink.Attribute) (ret []*elem, err error) {
+	data, _ := find(attrs, unix.NFTA_SET_ELEM_LIST_ELEMENTS)
+
+	var list []netlink.Attribute
+	list, err = netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return
+	}
+
+	for i := range list {
+		var elemAttrs []netlink.Attribute
+		elemAttrs, err = netlink.UnmarshalAttributes(list[i].Data)
+		if err != nil {
+			return
+		}
+
+		e := &elem{attrs: list[i].Data}
+
+		key, _ := find(elemAttrs, unix.NFTA_SET_ELEM_KEY)
+
+		var keyAttrs []netlink.Attribute
+		keyAttrs, err = netlink.UnmarshalAttributes(key)
+		if err != nil {
+			return
+		}
+
+		e.key, _ = find(keyAttrs, unix.NFTA_DATA_VALUE)
+
+		flags, _ := findUint32(elemAttrs, unix.NFTA_SET_ELEM_FLAGS)
+		e.end = flags&unix.NFT_SET_ELEM_INTERVAL_END != 0
+
+		e.data, _ = find(elemAttrs, unix.NFTA_SET_ELEM_DATA)
+
+		ret = append(ret, e)
+	}
+
+	return
+}
+
+// verdictChain returns the chain a verdict in data jumps to or goes to,
+// data is the payload of attributes holding struct nft_data,
+// e.g. NFTA_SET_ELEM_DATA and NFTA_IMMEDIATE_DATA.
+func verdictChain(data []byte) (ret string, err error) {
+	if data == nil {
+		return
+	}
+
+	var attrs []netlink.Attribute
+	attrs, err = netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return
+	}
+
+	verdict, ok := find(attrs, unix.NFTA_DATA_VERDICT)
+	if !ok {
+		return
+	}
+
+	attrs, err = netlink.UnmarshalAttributes(verdict)
+	if err != nil {
+		return
+	}
+
+	ret = findString(attrs, unix.NFTA_VERDICT_CHAIN)
+	return
+}
+
+const attrTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+
+func find(attrs []netlink.Attribute, typ uint16) ([]byte, bool) {
+	for i := range attrs {
+		if attrs[i].Type&attrTypeMask == typ {
+			return attrs[i].Data, true
+		}
+	}
+
+	return nil, false
+}
+
+func findString(attrs []netlink.Attribute, typ uint16) string {
+	data, _ := find(attrs, typ)
+	return trim(data)
+}
+
+func findUint32(attrs []netlink.Attribute, typ uint16) (uint32, bool) {
+	data, ok := find(attrs, typ)
+	if !ok || len(data) != 4 {
+		return 0, false
+	}
+
+	return binaryutil.BigEndian.Uint32(data), true
+}
+
+func findUint64(attrs []netlink.Attribute, typ uint16) (uint64, bool) {
+	data, ok := find(attrs, typ)
+	if !ok || len(data) != 8 {
+		return 0, false
+	}
+
+	return binaryutil.BigEndian.Uint64(data), true
+}
+
+func trim(data []byte) string {
+	return string(bytes.TrimRight(data, "\x00"))
+}
+
+func without(attrs []netlink.Attribute, typ uint16) []netlink.Attribute {
+	return slices.DeleteFunc(slices.Clone(attrs), func(a netlink.Attribute) bool {
+		return a.Type&attrTypeMask == typ
+	})
+}
+
+func replace(
+	attrs []netlink.Attribute, typ uint16, data []byte,
+) []netlink.Attribute {
+	ret := slices.Clone(attrs)
+	for i := range ret {
+		if ret[i].Type&attrTypeMask == typ {
+			ret[i].Data = data
+		}
+	}
+
+	return ret
+}
+
+func message(
+	typ uint16, family byte, attrs []netlink.Attribute,
+) netlink.Message {
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		// Attributes have been unmarshaled from messages sent before.
+		panic(err)
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | typ),
+		},
+		Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+}
+
+func ack(req netlink.Message) []netlink.Message {
+	return reply(nltest.Error(0, []netlink.Message{req}))
+}
+
+func reply(msgs []netlink.Message, _ error) []netlink.Message {
+	return msgs
+}
+
+func errno(err error) syscall.Errno {
+	var ret syscall.Errno
+	if errors.As(err, &ret) {
+		return ret
+	}
+
+	return unix.EINVAL
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package memconnector
+
+import (
+	"bytes"
+	"io"
+
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink/nltest"
+)
+
+func (c *Connector) Connect() (ret *nftables.Conn, err error) {
+	defer Wrap(&err, "new in-memory netlink connection")
+
+	return nftables.New(nftables.WithTestDial(c.Dial()))
+}
+
+// Dial returns a function handling netlink messages
+// the way a new connection to the in-memory ruleset does,
+// requests listing the ruleset get their replies returned at once.
+func (c *Connector) Dial() nltest.Func {
+	s := &session{connector: c}
+	return s.handle
+}
+
+func (c *Connector) Release() error {
+	return nil
+}
+
+// Render writes tables in the in-memory ruleset to w
+// in the syntax `nft -f` takes.
+// Keys of cgroupsv2 maps are printed as paths found in cgroups,
+// which maps inodes of cgroups to their paths relative to cgroup root.
+// Counters are printed with nothing counted.
+func (c *Connector) Render(w io.Writer, cgroups map[uint64]string) (err error) {
+	defer Wrap(&err, "render in-memory ruleset")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	for i, t := range c.tables {
+		if i != 0 {
+			buf.WriteString("\n")
+		}
+
+		r := &renderer{w: buf, t: t, cgroups: cgroups}
+		r.table()
+		if r.err != nil {
+			err = r.err
+			return
+		}
+	}
+
+	_, err = buf.WriteTo(w)
+	return
+}
+
+// DecodeExprs decodes NFTA_RULE_EXPRESSIONS of a rule in a table of family.
+// Unlike github.com/google/nftables,
+// which skips expressions it cannot decode,
+// it decodes socket and tproxy expressions as well
+// and fails on expressions it does not know.
+func DecodeExprs(family byte, data []byte) (ret []expr.Any, err error) {
+	defer Wrap(&err, "decode expressions")
+
+	return decodeExprs(family, data)
+}
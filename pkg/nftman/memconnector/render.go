@@ -0,0 +1,950 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package memconnector
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sys/unix"
+)
+
+// kind tells how to print values loaded into a register.
+type kind int
+
+const (
+	kindInteger kind = iota
+	kindNFProto
+	kindL4Proto
+	kindMark
+	kindIfname
+	kindCtDirection
+	kindCtState
+	kindIPv4
+	kindIPv6
+	kindPort
+	kindCGroup
+)
+
+// register is what a rule has loaded into a register.
+type register struct {
+	// text is how nft refers to the value, e.g. "meta mark".
+	text string
+	kind kind
+	// mask is set if the value has been masked by bitwise with no xor.
+	mask []byte
+	// data is set if the value is an immediate.
+	data []byte
+}
+
+// renderer prints a table in the syntax `nft -f` takes.
+type renderer struct {
+	w   *bytes.Buffer
+	t   *table
+	err error
+
+	// cgroups maps inodes of cgroups to their paths.
+	cgroups map[uint64]string
+}
+
+func (r *renderer) printf(format string, a ...any) {
+	fmt.Fprintf(r.w, format, a...)
+}
+
+func (r *renderer) table() {
+	r.printf("table %s %s {\n", familyName(r.t.family), r.t.name)
+
+	blocks := []func(){}
+
+	for _, o := range r.t.objs {
+		if o.typ != unix.NFT_OBJECT_COUNTER {
+			r.err = fmt.Errorf("object %s: %w", o.name, ErrUnsupported)
+			return
+		}
+
+		o := o
+		blocks = append(blocks, func() { r.counter(o) })
+	}
+
+	for _, s := range r.t.sets {
+		if s.anonymous {
+			continue
+		}
+
+		s := s
+		blocks = append(blocks, func() { r.set(s) })
+	}
+
+	for _, ch := range r.t.chains {
+		ch := ch
+		blocks = append(blocks, func() { r.chain(ch) })
+	}
+
+	for i, block := range blocks {
+		if i != 0 {
+			r.printf("\n")
+		}
+
+		block()
+		if r.err != nil {
+			return
+		}
+	}
+
+	r.printf("}\n")
+}
+
+func (r *renderer) counter(o *obj) {
+	r.printf("\tcounter %s {\n", o.name)
+	r.printf("\t\tpackets 0 bytes 0\n")
+	r.printf("\t}\n")
+}
+
+func (r *renderer) set(s *set) {
+	keyType, _ := findUint32(s.attrs, unix.NFTA_SET_KEY_TYPE)
+	flags, _ := findUint32(s.attrs, unix.NFTA_SET_FLAGS)
+	dataType, _ := findUint32(s.attrs, unix.NFTA_SET_DATA_TYPE)
+
+	keyKind, keyName, ok := datatype(keyType)
+	if !ok {
+		r.err = fmt.Errorf("key type %d of set %s: %w", keyType, s.name, ErrUnsupported)
+		return
+	}
+
+	isMap := flags&unix.NFT_SET_MAP != 0
+	if isMap && dataType != unix.NFT_DATA_VERDICT {
+		r.err = fmt.Errorf("data type %d of map %s: %w", dataType, s.name, ErrUnsupported)
+		return
+	}
+
+	if isMap {
+		r.printf("\tmap %s {\n", s.name)
+		r.printf("\t\ttype %s : verdict\n", keyName)
+	} else {
+		r.printf("\tset %s {\n", s.name)
+		r.printf("\t\ttype %s\n", keyName)
+	}
+
+	if flags&unix.NFT_SET_INTERVAL != 0 {
+		r.printf("\t\tflags interval\n")
+	}
+
+	var elems []string
+	elems, r.err = r.elems(s, keyKind)
+	if r.err != nil {
+		return
+	}
+
+	if len(elems) != 0 {
+		r.printf("\t\telements = { %s }\n", strings.Join(elems, ",\n\t\t\t     "))
+	}
+
+	r.printf("\t}\n")
+}
+
+// elems returns elements of s in the syntax of nft,
+// intervals are merged back into prefixes or ranges.
+func (r *renderer) elems(s *set, keyKind kind) (ret []string, err error) {
+	flags, _ := findUint32(s.attrs, unix.NFTA_SET_FLAGS)
+
+	if flags&unix.NFT_SET_INTERVAL == 0 {
+		for _, e := range s.elems {
+			text := r.value(keyKind, e.key)
+
+			if e.data != nil {
+				var verdict string
+				verdict, err = elemVerdict(e.data)
+				if err != nil {
+					return
+				}
+
+				text += " : " + verdict
+			}
+
+			ret = append(ret, text)
+		}
+
+		sort.Strings(ret)
+		return
+	}
+
+	elems := slices.Clone(s.elems)
+	sort.SliceStable(elems, func(i, j int) bool {
+		c := bytes.Compare(elems[i].key, elems[j].key)
+		if c != 0 {
+			return c < 0
+		}
+
+		// An interval ends where the next one starts.
+		return elems[i].end && !elems[j].end
+	})
+
+	var start []byte
+	for _, e := range elems {
+		if !e.end {
+			if start != nil {
+				ret = append(ret, r.interval(keyKind, start, nil))
+			}
+
+			start = e.key
+			continue
+		}
+
+		if start == nil {
+			// The end of the interval starting from zero,
+			// which marks zero not in the set.
+			continue
+		}
+
+		ret = append(ret, r.interval(keyKind, start, e.key))
+		start = nil
+	}
+
+	if start != nil {
+		ret = append(ret, r.interval(keyKind, start, nil))
+	}
+
+	return
+}
+
+// interval prints addresses from start to the one before end,
+// or to the last address if end is nil.
+func (r *renderer) interval(keyKind kind, start, end []byte) string {
+	first := new(big.Int).SetBytes(start)
+
+	var last *big.Int
+	if end == nil {
+		last = new(big.Int).Lsh(big.NewInt(1), uint(len(start)*8))
+	} else {
+		last = new(big.Int).SetBytes(end)
+	}
+	last.Sub(last, big.NewInt(1))
+
+	lastBytes := make([]byte, len(start))
+	last.FillBytes(lastBytes)
+
+	if first.Cmp(last) == 0 {
+		return r.value(keyKind, start)
+	}
+
+	// It is a prefix if first and last differ only in trailing bits,
+	// which are all zero in first and all one in last.
+	size := new(big.Int).Sub(last, first)
+	size.Add(size, big.NewInt(1))
+
+	if size.BitLen() > 0 &&
+		new(big.Int).And(size, new(big.Int).Sub(size, big.NewInt(1))).Sign() == 0 &&
+		new(big.Int).Mod(first, size).Sign() == 0 {
+		ones := len(start)*8 - (size.BitLen() - 1)
+		return fmt.Sprintf("%s/%d", r.value(keyKind, start), ones)
+	}
+
+	return r.value(keyKind, start) + "-" + r.value(keyKind, lastBytes)
+}
+
+func (r *renderer) chain(ch *chain) {
+	r.printf("\tchain %s {\n", ch.name)
+
+	if hook, ok := find(ch.attrs, unix.NFTA_CHAIN_HOOK); ok {
+		hookAttrs, err := netlink.UnmarshalAttributes(hook)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		hooknum, _ := findUint32(hookAttrs, unix.NFTA_HOOK_HOOKNUM)
+		priority, _ := findUint32(hookAttrs, unix.NFTA_HOOK_PRIORITY)
+		policy, ok := findUint32(ch.attrs, unix.NFTA_CHAIN_POLICY)
+
+		policyName := "accept"
+		if ok && policy == uint32(nftables.ChainPolicyDrop) {
+			policyName = "drop"
+		}
+
+		r.printf("\t\ttype %s hook %s priority %s; policy %s;\n",
+			findString(ch.attrs, unix.NFTA_CHAIN_TYPE),
+			hookName(hooknum),
+			priorityName(int32(priority)),
+			policyName,
+		)
+	}
+
+	for _, rule := range ch.rules {
+		var text string
+		text, r.err = r.rule(rule)
+		if r.err != nil {
+			r.err = fmt.Errorf("rule in chain %s: %w", ch.name, r.err)
+			return
+		}
+
+		r.printf("\t\t%s\n", text)
+	}
+
+	r.printf("\t}\n")
+}
+
+// rule decompiles expressions of rule into statements of nft.
+func (r *renderer) rule(rule *rule) (ret string, err error) {
+	var exprs []expr.Any
+	exprs, err = decodeExprs(r.t.family, rule.exprs)
+	if err != nil {
+		return
+	}
+
+	regs := map[uint32]*register{}
+	stmts := []string{}
+
+	load := func(reg uint32, text string, k kind) {
+		regs[reg] = &register{text: text, kind: k}
+	}
+
+	get := func(reg uint32) (*register, error) {
+		ret, ok := regs[reg]
+		if !ok {
+			return nil, fmt.Errorf("register %d: %w", reg, ErrUnsupported)
+		}
+
+		return ret, nil
+	}
+
+	for _, e := range exprs {
+		var reg *register
+
+		switch e := e.(type) {
+		case *expr.Meta:
+			text, k, ok := metaKey(e.Key)
+			if !ok {
+				err = fmt.Errorf("meta key %d: %w", e.Key, ErrUnsupported)
+				return
+			}
+
+			if !e.SourceRegister {
+				load(e.Register, text, k)
+				continue
+			}
+
+			reg, err = get(e.Register)
+			if err != nil {
+				return
+			}
+
+			stmts = append(stmts, text+" set "+r.operand(reg, k))
+		case *expr.Ct:
+			switch e.Key {
+			case expr.CtKeyDIRECTION:
+				load(e.Register, "ct direction", kindCtDirection)
+			case expr.CtKeySTATE:
+				load(e.Register, "ct state", kindCtState)
+			default:
+				err = fmt.Errorf("ct key %d: %w", e.Key, ErrUnsupported)
+				return
+			}
+		case *expr.Payload:
+			if e.OperationType != expr.PayloadLoad {
+				err = fmt.Errorf("payload write: %w", ErrUnsupported)
+				return
+			}
+
+			switch {
+			case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 16 && e.Len == 4:
+				load(e.DestRegister, "ip daddr", kindIPv4)
+			case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 24 && e.Len == 16:
+				load(e.DestRegister, "ip6 daddr", kindIPv6)
+			case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 2 && e.Len == 2:
+				load(e.DestRegister, "th dport", kindPort)
+			default:
+				err = fmt.Errorf("payload %d+%d/%d: %w", e.Base, e.Offset, e.Len, ErrUnsupported)
+				return
+			}
+		case *expr.Socket:
+			if e.Key != expr.SocketKeyCgroupv2 {
+				err = fmt.Errorf("socket key %d: %w", e.Key, ErrUnsupported)
+				return
+			}
+
+			load(e.Register, fmt.Sprintf("socket cgroupv2 level %d", e.Level), kindCGroup)
+		case *expr.Immediate:
+			regs[e.Register] = &register{data: e.Data}
+		case *expr.Bitwise:
+			reg, err = get(e.SourceRegister)
+			if err != nil {
+				return
+			}
+
+			next := *reg
+			if bytes.Count(e.Xor, []byte{0}) == len(e.Xor) {
+				next.mask = e.Mask
+			} else {
+				// meta mark & mask ^ xor,
+				// xor is always a part of the inverse of mask here,
+				// so it is the same as meta mark & mask | xor.
+				next.text = fmt.Sprintf("%s & %s | %s",
+					reg.text, r.value(reg.kind, e.Mask), r.value(reg.kind, e.Xor))
+			}
+			regs[e.DestRegister] = &next
+		case *expr.Cmp:
+			reg, err = get(e.Register)
+			if err != nil {
+				return
+			}
+
+			stmts = append(stmts, r.cmp(reg, e))
+		case *expr.Lookup:
+			reg, err = get(e.SourceRegister)
+			if err != nil {
+				return
+			}
+
+			var text string
+			text, err = r.lookup(reg, e)
+			if err != nil {
+				return
+			}
+
+			stmts = append(stmts, text)
+		case *expr.Objref:
+			if e.Type != unix.NFT_OBJECT_COUNTER {
+				err = fmt.Errorf("object type %d: %w", e.Type, ErrUnsupported)
+				return
+			}
+
+			stmts = append(stmts, "counter name "+strconv.Quote(e.Name))
+		case *expr.Counter:
+			stmts = append(stmts, "counter")
+		case *expr.Limit:
+			if e.Type != expr.LimitTypePkts {
+				err = fmt.Errorf("limit of bytes: %w", ErrUnsupported)
+				return
+			}
+
+			text := fmt.Sprintf("limit rate %d/%s", e.Rate, limitUnit(e.Unit))
+			if e.Burst != 0 {
+				text += fmt.Sprintf(" burst %d packets", e.Burst)
+			}
+			stmts = append(stmts, text)
+		case *expr.Log:
+			text := "log"
+			if e.Key&(1<<unix.NFTA_LOG_PREFIX) != 0 {
+				text += " prefix " + strconv.Quote(strings.TrimRight(string(e.Data), "\x00"))
+			}
+			if e.Key&(1<<unix.NFTA_LOG_GROUP) != 0 {
+				text += fmt.Sprintf(" group %d", e.Group)
+			}
+			stmts = append(stmts, text)
+		case *expr.TProxy:
+			reg, err = get(e.RegPort)
+			if err != nil {
+				return
+			}
+
+			family := ""
+			switch e.Family {
+			case unix.NFPROTO_IPV4:
+				family = " ip"
+			case unix.NFPROTO_IPV6:
+				family = " ip6"
+			}
+
+			stmts = append(stmts, fmt.Sprintf("tproxy%s to :%s", family, r.operand(reg, kindPort)))
+		case *expr.Redir:
+			reg, err = get(e.RegisterProtoMin)
+			if err != nil {
+				return
+			}
+
+			stmts = append(stmts, "redirect to :"+r.operand(reg, kindPort))
+		case *expr.NAT:
+			var text string
+			text, err = r.nat(e, get)
+			if err != nil {
+				return
+			}
+
+			stmts = append(stmts, text)
+		case *expr.Masq:
+			stmts = append(stmts, "masquerade")
+		case *expr.Reject:
+			var text string
+			text, err = reject(e)
+			if err != nil {
+				return
+			}
+
+			stmts = append(stmts, text)
+		case *expr.Verdict:
+			stmts = append(stmts, verdict(e))
+		default:
+			err = fmt.Errorf("expression %T: %w", e, ErrUnsupported)
+			return
+		}
+	}
+
+	ret = strings.Join(stmts, " ")
+	return
+}
+
+func (r *renderer) cmp(reg *register, e *expr.Cmp) string {
+	op := ""
+	switch e.Op {
+	case expr.CmpOpNeq:
+		op = "!= "
+	case expr.CmpOpLt:
+		op = "< "
+	case expr.CmpOpLte:
+		op = "<= "
+	case expr.CmpOpGt:
+		op = "> "
+	case expr.CmpOpGte:
+		op = ">= "
+	}
+
+	if reg.mask == nil {
+		return reg.text + " " + op + r.value(reg.kind, e.Data)
+	}
+
+	// Flags are tested by ct state & new != 0,
+	// which nft writes as ct state new.
+	zero := bytes.Count(e.Data, []byte{0}) == len(e.Data)
+	if reg.kind == kindCtState && zero && e.Op == expr.CmpOpNeq {
+		return reg.text + " " + r.value(reg.kind, reg.mask)
+	}
+
+	return fmt.Sprintf("%s & %s %s%s",
+		reg.text, r.value(reg.kind, reg.mask), op, r.value(reg.kind, e.Data))
+}
+
+func (r *renderer) lookup(reg *register, e *expr.Lookup) (ret string, err error) {
+	s := r.t.set(e.SetName)
+	if s == nil {
+		err = fmt.Errorf("set %s: %w", e.SetName, unix.ENOENT)
+		return
+	}
+
+	target := "@" + s.name
+	if s.anonymous {
+		var elems []string
+		elems, err = r.elems(s, reg.kind)
+		if err != nil {
+			return
+		}
+
+		target = "{ " + strings.Join(elems, ", ") + " }"
+	}
+
+	if e.IsDestRegSet {
+		ret = reg.text + " vmap " + target
+		return
+	}
+
+	if e.Invert {
+		ret = reg.text + " != " + target
+		return
+	}
+
+	ret = reg.text + " " + target
+	return
+}
+
+func (r *renderer) nat(
+	e *expr.NAT, get func(uint32) (*register, error),
+) (
+	ret string, err error,
+) {
+	if e.Type != expr.NATTypeDestNAT {
+		err = fmt.Errorf("nat type %d: %w", e.Type, ErrUnsupported)
+		return
+	}
+
+	var addr, port *register
+	addr, err = get(e.RegAddrMin)
+	if err != nil {
+		return
+	}
+
+	port, err = get(e.RegProtoMin)
+	if err != nil {
+		return
+	}
+
+	switch e.Family {
+	case unix.NFPROTO_IPV4:
+		ret = fmt.Sprintf("dnat ip to %s:%s",
+			r.operand(addr, kindIPv4), r.operand(port, kindPort))
+	case unix.NFPROTO_IPV6:
+		ret = fmt.Sprintf("dnat ip6 to [%s]:%s",
+			r.operand(addr, kindIPv6), r.operand(port, kindPort))
+	default:
+		err = fmt.Errorf("nat family %d: %w", e.Family, ErrUnsupported)
+	}
+
+	return
+}
+
+// operand prints what reg holds as a value of kind k.
+func (r *renderer) operand(reg *register, k kind) string {
+	if reg.data != nil {
+		return r.value(k, reg.data)
+	}
+
+	return reg.text
+}
+
+// value prints data as a value of kind k.
+func (r *renderer) value(k kind, data []byte) string {
+	switch k {
+	case kindNFProto:
+		switch data[0] {
+		case unix.NFPROTO_IPV4:
+			return "ipv4"
+		case unix.NFPROTO_IPV6:
+			return "ipv6"
+		}
+	case kindL4Proto:
+		switch data[0] {
+		case unix.IPPROTO_TCP:
+			return "tcp"
+		case unix.IPPROTO_UDP:
+			return "udp"
+		}
+	case kindMark:
+		if len(data) == 4 {
+			return fmt.Sprintf("0x%08x", binaryutil.NativeEndian.Uint32(data))
+		}
+	case kindIfname:
+		return strconv.Quote(string(bytes.TrimRight(data, "\x00")))
+	case kindCtDirection:
+		switch data[0] {
+		case 0:
+			return "original"
+		case 1:
+			return "reply"
+		}
+	case kindCtState:
+		if len(data) == 4 {
+			return ctState(binaryutil.NativeEndian.Uint32(data))
+		}
+	case kindIPv4, kindIPv6:
+		return net.IP(data).String()
+	case kindPort:
+		if len(data) == 2 {
+			return strconv.Itoa(int(binaryutil.BigEndian.Uint16(data)))
+		}
+	case kindCGroup:
+		if len(data) == 8 {
+			inode := binaryutil.NativeEndian.Uint64(data)
+			if path, ok := r.cgroups[inode]; ok {
+				return strconv.Quote(strings.TrimPrefix(path, "/"))
+			}
+
+			return strconv.FormatUint(inode, 10)
+		}
+	}
+
+	return "0x" + fmt.Sprintf("%x", data)
+}
+
+func decodeExprs(family byte, data []byte) (ret []expr.Any, err error) {
+	var list []netlink.Attribute
+	list, err = netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return
+	}
+
+	for i := range list {
+		var attrs []netlink.Attribute
+		attrs, err = netlink.UnmarshalAttributes(list[i].Data)
+		if err != nil {
+			return
+		}
+
+		name := findString(attrs, unix.NFTA_EXPR_NAME)
+		exprData, _ := find(attrs, unix.NFTA_EXPR_DATA)
+
+		var e expr.Any
+		switch name {
+		case "meta":
+			e = &expr.Meta{}
+		case "ct":
+			e = &expr.Ct{}
+		case "cmp":
+			e = &expr.Cmp{}
+		case "payload":
+			e = &expr.Payload{}
+		case "lookup":
+			e = &expr.Lookup{}
+		case "immediate":
+			e = &expr.Immediate{}
+		case "bitwise":
+			e = &expr.Bitwise{}
+		case "socket":
+			e = &expr.Socket{}
+		case "objref":
+			e = &expr.Objref{}
+		case "counter":
+			e = &expr.Counter{}
+		case "limit":
+			e = &expr.Limit{}
+		case "log":
+			e = &expr.Log{}
+		case "tproxy":
+			// NOTE:
+			// github.com/google/nftables sends family of tproxy as uint32
+			// but fails to parse it back as uint8.
+			var tproxyAttrs []netlink.Attribute
+			tproxyAttrs, err = netlink.UnmarshalAttributes(exprData)
+			if err != nil {
+				return
+			}
+
+			family, _ := findUint32(tproxyAttrs, expr.NFTA_TPROXY_FAMILY)
+			port, _ := findUint32(tproxyAttrs, expr.NFTA_TPROXY_REG_PORT)
+			ret = append(ret, &expr.TProxy{Family: byte(family), RegPort: port})
+			continue
+		case "redir":
+			e = &expr.Redir{}
+		case "nat":
+			e = &expr.NAT{}
+		case "masq":
+			e = &expr.Masq{}
+		case "reject":
+			e = &expr.Reject{}
+		default:
+			err = fmt.Errorf("expression %s: %w", name, ErrUnsupported)
+			return
+		}
+
+		err = expr.Unmarshal(family, exprData, e)
+		if err != nil {
+			return
+		}
+
+		// NOTE:
+		// Verdicts are immediates loading nothing into the verdict register.
+		if imm, ok := e.(*expr.Immediate); ok &&
+			imm.Register == unix.NFT_REG_VERDICT && len(imm.Data) == 0 {
+			e = &expr.Verdict{}
+			err = expr.Unmarshal(family, exprData, e)
+			if err != nil {
+				return
+			}
+		}
+
+		ret = append(ret, e)
+	}
+
+	return
+}
+
+// elemVerdict prints the verdict in data of an element of a verdict map.
+func elemVerdict(data []byte) (ret string, err error) {
+	var attrs []netlink.Attribute
+	attrs, err = netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return
+	}
+
+	value, _ := find(attrs, unix.NFTA_DATA_VERDICT)
+	attrs, err = netlink.UnmarshalAttributes(value)
+	if err != nil {
+		return
+	}
+
+	code, _ := findUint32(attrs, unix.NFTA_VERDICT_CODE)
+
+	ret = verdict(&expr.Verdict{
+		Kind:  expr.VerdictKind(int32(code)),
+		Chain: findString(attrs, unix.NFTA_VERDICT_CHAIN),
+	})
+	return
+}
+
+func verdict(v *expr.Verdict) string {
+	switch v.Kind {
+	case expr.VerdictReturn:
+		return "return"
+	case expr.VerdictGoto:
+		return "goto " + v.Chain
+	case expr.VerdictJump:
+		return "jump " + v.Chain
+	case expr.VerdictBreak:
+		return "break"
+	case expr.VerdictContinue:
+		return "continue"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictStolen:
+		return "stolen"
+	case expr.VerdictQueue:
+		return "queue"
+	}
+
+	return "return"
+}
+
+var rejectICMPXCodes = map[uint8]string{
+	unix.NFT_REJECT_ICMPX_NO_ROUTE:         "no-route",
+	unix.NFT_REJECT_ICMPX_PORT_UNREACH:     "port-unreachable",
+	unix.NFT_REJECT_ICMPX_HOST_UNREACH:     "host-unreachable",
+	unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED: "admin-prohibited",
+}
+
+func reject(e *expr.Reject) (ret string, err error) {
+	switch e.Type {
+	case unix.NFT_REJECT_TCP_RST:
+		ret = "reject with tcp reset"
+		return
+	case unix.NFT_REJECT_ICMPX_UNREACH:
+		code, ok := rejectICMPXCodes[e.Code]
+		if !ok {
+			break
+		}
+
+		ret = "reject with icmpx " + code
+		return
+	}
+
+	err = fmt.Errorf("reject type %d code %d: %w", e.Type, e.Code, ErrUnsupported)
+	return
+}
+
+func metaKey(key expr.MetaKey) (text string, k kind, ok bool) {
+	ok = true
+
+	switch key {
+	case expr.MetaKeyNFPROTO:
+		text, k = "meta nfproto", kindNFProto
+	case expr.MetaKeyL4PROTO:
+		text, k = "meta l4proto", kindL4Proto
+	case expr.MetaKeyMARK:
+		text, k = "meta mark", kindMark
+	case expr.MetaKeyOIFNAME:
+		text, k = "meta oifname", kindIfname
+	default:
+		ok = false
+	}
+
+	return
+}
+
+func datatype(magic uint32) (k kind, name string, ok bool) {
+	ok = true
+
+	switch magic {
+	case nftables.TypeIPAddr.GetNFTMagic():
+		k, name = kindIPv4, nftables.TypeIPAddr.Name
+	case nftables.TypeIP6Addr.GetNFTMagic():
+		k, name = kindIPv6, nftables.TypeIP6Addr.Name
+	case nftables.TypeInetProto.GetNFTMagic():
+		k, name = kindL4Proto, nftables.TypeInetProto.Name
+	case nftables.TypeMark.GetNFTMagic():
+		k, name = kindMark, nftables.TypeMark.Name
+	case nftables.TypeCGroupV2.GetNFTMagic():
+		k, name = kindCGroup, nftables.TypeCGroupV2.Name
+	default:
+		ok = false
+	}
+
+	return
+}
+
+func ctState(state uint32) string {
+	names := []string{}
+	for _, bit := range []struct {
+		bit  uint32
+		name string
+	}{
+		{expr.CtStateBitINVALID, "invalid"},
+		{expr.CtStateBitESTABLISHED, "established"},
+		{expr.CtStateBitRELATED, "related"},
+		{expr.CtStateBitNEW, "new"},
+		{expr.CtStateBitUNTRACKED, "untracked"},
+	} {
+		if state&bit.bit != 0 {
+			names = append(names, bit.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+func limitUnit(unit expr.LimitTime) string {
+	switch unit {
+	case expr.LimitTimeSecond:
+		return "second"
+	case expr.LimitTimeMinute:
+		return "minute"
+	case expr.LimitTimeHour:
+		return "hour"
+	case expr.LimitTimeDay:
+		return "day"
+	}
+
+	return "week"
+}
+
+func familyName(family byte) string {
+	switch family {
+	case unix.NFPROTO_IPV4:
+		return "ip"
+	case unix.NFPROTO_IPV6:
+		return "ip6"
+	case unix.NFPROTO_ARP:
+		return "arp"
+	case unix.NFPROTO_BRIDGE:
+		return "bridge"
+	case unix.NFPROTO_NETDEV:
+		return "netdev"
+	}
+
+	return "inet"
+}
+
+func hookName(hook uint32) string {
+	switch hook {
+	case unix.NF_INET_PRE_ROUTING:
+		return "prerouting"
+	case unix.NF_INET_LOCAL_IN:
+		return "input"
+	case unix.NF_INET_FORWARD:
+		return "forward"
+	case unix.NF_INET_LOCAL_OUT:
+		return "output"
+	case unix.NF_INET_POST_ROUTING:
+		return "postrouting"
+	}
+
+	return strconv.FormatUint(uint64(hook), 10)
+}
+
+func priorityName(priority int32) string {
+	switch priority {
+	case int32(*nftables.ChainPriorityRaw):
+		return "raw"
+	case int32(*nftables.ChainPriorityMangle):
+		return "mangle"
+	case int32(*nftables.ChainPriorityNATDest):
+		return "dstnat"
+	case int32(*nftables.ChainPriorityFilter):
+		return "filter"
+	case int32(*nftables.ChainPrioritySecurity):
+		return "security"
+	case int32(*nftables.ChainPriorityNATSource):
+		return "srcnat"
+	}
+
+	return strconv.Itoa(int(priority))
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
 	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
 	"github.com/black-desk/cgtproxy/pkg/nftman/connector"
 	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/google/nftables"
@@ -22,6 +23,7 @@ type NFTManager struct {
 	log        *zap.SugaredLogger
 
 	connector interfaces.NetlinkConnector
+	metrics   interfaces.Metrics
 
 	table *nftables.Table
 
@@ -40,12 +42,31 @@ type NFTManager struct {
 	cgroupMap        *nftables.Set
 	cgroupMapElement map[string]nftables.SetElement
 
+	// cgroupNATMap has the same keys as cgroupMap,
+	// its verdicts are used in output-nat chain.
+	cgroupNATMap        *nftables.Set
+	cgroupNATMapElement map[string]nftables.SetElement
+
+	// tproxies records the tproxies whose chains are in the table,
+	// so that Reload can tell which of them are added, changed or removed.
+	tproxies map[string]*config.TProxy
+	// redirects is the same as tproxies but for redirects.
+	redirects map[string]*config.Redirect
+	// routes is the same as tproxies but for routes.
+	routes map[string]*config.Route
+	// targetChains records chains created for targets of cgroup routes,
+	// e.g. chains setting fire wall mark for mark targets,
+	// mapped to names of counters in them.
+	targetChains map[string]string
+
 	markTproxyMap *nftables.Set
 	markDNSMap    *nftables.Set
 
 	outputMangleChain *nftables.Chain
 	outputNATChain    *nftables.Chain
+	markDNSChain      *nftables.Chain
 	preroutingChain   *nftables.Chain
+	postroutingChain  *nftables.Chain
 }
 
 type Opt = (func(*NFTManager) (*NFTManager, error))
@@ -78,6 +99,16 @@ func New(opts ...Opt) (ret *NFTManager, err error) {
 		t.log = zap.NewNop().Sugar()
 	}
 
+	if t.metrics == nil {
+		var m *metrics.Metrics
+		m, err = metrics.New(metrics.WithLogger(t.log))
+		if err != nil {
+			return
+		}
+
+		t.metrics = m
+	}
+
 	ret = t
 	t.log.Debugw("NFTManager created.")
 
@@ -91,27 +122,36 @@ func WithBypass(bypass config.Bypass) Opt {
 			return
 		}
 
-		for i := range bypass {
-			ip := net.ParseIP(bypass[i])
+		table.bypassIPv4, table.bypassIPv6, err = splitBypass(bypass)
+		if err != nil {
+			return
+		}
 
-			if ip == nil {
-				ip, _, err = net.ParseCIDR(bypass[i])
-				if err != nil {
-					return
-				}
-			}
+		return table, nil
+	}
+}
 
-			if ip.To4() != nil {
-				table.bypassIPv4 = append(table.bypassIPv4, bypass[i])
-			} else if ip.To16() != nil {
-				table.bypassIPv6 = append(table.bypassIPv6, bypass[i])
-			} else {
-				panic("this should never happened, check validator.")
+func splitBypass(bypass config.Bypass) (ipv4, ipv6 []string, err error) {
+	for i := range bypass {
+		ip := net.ParseIP(bypass[i])
+
+		if ip == nil {
+			ip, _, err = net.ParseCIDR(bypass[i])
+			if err != nil {
+				return
 			}
 		}
 
-		return table, nil
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, bypass[i])
+		} else if ip.To16() != nil {
+			ipv6 = append(ipv6, bypass[i])
+		} else {
+			panic("this should never happened, check validator.")
+		}
 	}
+
+	return
 }
 
 func WithCgroupRoot(root config.CGroupRoot) Opt {
@@ -150,3 +190,16 @@ func WithConnFactory(f interfaces.NetlinkConnector) Opt {
 		return
 	}
 }
+
+func WithMetrics(m interfaces.Metrics) Opt {
+	return func(nft *NFTManager) (ret *NFTManager, err error) {
+		if m == nil {
+			err = ErrMetricsMissing
+			return
+		}
+
+		nft.metrics = m
+		ret = nft
+		return
+	}
+}
@@ -5,17 +5,25 @@
 package nftman
 
 import (
+	"io/fs"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/nftman/nfttest"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/ginkgo-helper"
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
 )
 
 // pstr returns a pointer to the given string, for fields like DNSHijack.IP.
@@ -26,6 +34,82 @@ const needSandboxMessage = "" +
 	"If you really want to run tests of this package, " +
 	"try run `make test` at the root directory of this repository."
 
+// newNFTManager creates a NFTManager to test,
+// cgroups are created under cgroupRoot,
+// rules returns the ruleset in the syntax of nft.
+type newNFTManager func() (nft *NFTManager, cgroupRoot string, rules func() string)
+
+// newNFTManagerInMemory creates a NFTManager on an in-memory ruleset
+// with a temporary directory as cgroup root,
+// which needs no privilege.
+func newNFTManagerInMemory() (nft *NFTManager, cgroupRoot string, rules func() string) {
+	conn, err := nfttest.New()
+	Expect(err).To(Succeed())
+
+	cgroupRoot = GinkgoT().TempDir()
+	nft = newNFTManagerOn(conn, cgroupRoot)
+	rules = func() string {
+		return renderRules(conn, cgroupRoot)
+	}
+	return
+}
+
+// newNFTManagerInSandbox returns a newNFTManager
+// creating a NFTManager by inject on the ruleset of kernel,
+// which is skipped out of the sandbox.
+func newNFTManagerInSandbox(
+	inject func(config.CGroupRoot) (*NFTManager, error),
+) newNFTManager {
+	return func() (nft *NFTManager, cgroupRoot string, rules func() string) {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+
+		var err error
+		nft, err = inject(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		rules = getNFTableRules
+		return
+	}
+}
+
+func newNFTManagerOn(conn interfaces.NetlinkConnector, cgroupRoot string) *NFTManager {
+	nft, err := New(
+		WithCgroupRoot(config.CGroupRoot(cgroupRoot)),
+		WithConnFactory(conn),
+	)
+	Expect(err).To(Succeed())
+
+	return nft
+}
+
+// renderRules renders the in-memory ruleset of conn,
+// keys of cgroup maps are printed as paths relative to cgroupRoot.
+func renderRules(conn *nfttest.Connector, cgroupRoot string) string {
+	cgroups := map[uint64]string{}
+	Expect(filepath.WalkDir(cgroupRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		cgroups[info.Sys().(*syscall.Stat_t).Ino] = strings.TrimPrefix(path, cgroupRoot)
+		return nil
+	})).To(Succeed())
+
+	buf := &strings.Builder{}
+	Expect(conn.Render(buf, cgroups)).To(Succeed())
+
+	return buf.String()
+}
+
 var _ = Describe("Netfliter table", Ordered, func() {
 	var (
 		err error
@@ -242,7 +326,7 @@ var _ = Describe("Netfliter table", Ordered, func() {
 										)
 
 										Expect(result).To(
-											ContainSubstring(`test/c" : drop`),
+											ContainSubstring(`test/c" : goto DROP`),
 										)
 
 										Expect(result).To(
@@ -263,7 +347,7 @@ var _ = Describe("Netfliter table", Ordered, func() {
 
 									It("should produce expected nftable rules", func() {
 										result = getNFTableRules()
-										Expect(result).ToNot(ContainSubstring("drop"))
+										Expect(result).ToNot(ContainSubstring("goto DROP"))
 									})
 
 									Context("then add some of them back", func() {
@@ -276,7 +360,7 @@ var _ = Describe("Netfliter table", Ordered, func() {
 										It("should produce expected nftable rules", func() {
 											result = getNFTableRules()
 											Expect(result).To(ContainSubstring("goto"))
-											Expect(result).ToNot(ContainSubstring("drop"))
+											Expect(result).ToNot(ContainSubstring("goto DROP"))
 										})
 									})
 								})
@@ -327,6 +411,12 @@ var _ = Describe("DNS hijack", Ordered, func() {
 				IP: pstr("192.168.0.1"), Port: 5354, TCP: true,
 			}},
 		}).WithFmt("UDP + TCP"),
+		ContextTableEntry([]*config.TProxy{
+			{Name: "dnsv6", Port: 7899, Mark: 107, DNSHijack: &config.DNSHijack{
+				IP: pstr("127.0.0.1"), IP6: pstr("::1"), Port: 5355, TCP: true,
+				DropDoT: true,
+			}},
+		}).WithFmt("IPv6 + DoT drop"),
 		func(tps []*config.TProxy) {
 			var result string
 
@@ -358,7 +448,886 @@ var _ = Describe("DNS hijack", Ordered, func() {
 					Expect(result).ToNot(ContainSubstring(tcpRule))
 				}
 			})
+
+			It("should emit an ip6 dnat rule only when IPv6 hijack is requested", func() {
+				ip6Rule := "udp dport 53 dnat ip6 to [::1]:" +
+					strconv.Itoa(int(tps[0].DNSHijack.Port))
+				if tps[0].DNSHijack.IP6 != nil {
+					Expect(result).To(ContainSubstring(ip6Rule))
+				} else {
+					Expect(result).ToNot(ContainSubstring(ip6Rule))
+				}
+			})
+
+			It("should drop DoT traffic only when requested", func() {
+				if tps[0].DNSHijack.DropDoT {
+					Expect(result).To(ContainSubstring("tcp dport 853 drop"))
+				} else {
+					Expect(result).ToNot(ContainSubstring("tcp dport 853 drop"))
+				}
+			})
+		})
+})
+
+var _ = Describe("TProxy bypass", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForTProxies([]*config.TProxy{
+			{Name: "corp", Port: 7901, Mark: 201, Bypass: config.Bypass{"8.8.8.0/24", "fd00::/8"}},
+			{Name: "home", Port: 7902, Mark: 202},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+	})
+
+	It("should create bypass sets for each tproxy", func() {
+		Expect(result).To(ContainSubstring("set corp-bypass "))
+		Expect(result).To(ContainSubstring("set corp-bypass6 "))
+		Expect(result).To(ContainSubstring("set home-bypass "))
+		Expect(result).To(ContainSubstring("set home-bypass6 "))
+	})
+
+	It("should fill the bypass sets", func() {
+		Expect(result).To(ContainSubstring("8.8.8.0/24"))
+		Expect(result).To(ContainSubstring("fd00::/8"))
+	})
+
+	It("should check the bypass sets in chains of the tproxy", func() {
+		Expect(result).To(ContainSubstring("ip daddr @corp-bypass return"))
+		Expect(result).To(ContainSubstring("ip6 daddr @corp-bypass6 return"))
+	})
+})
+
+var _ = Describe("Redirect", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForRedirects([]*config.Redirect{
+			{Name: "redsocks", Port: 12345},
+		})).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/redirect", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/redirect",
+				Target: types.Target{Op: types.TargetRedirect, Chain: "redsocks-REDIRECT"}},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/redirect")).To(Succeed())
+	})
+
+	It("should create the redirect chain", func() {
+		Expect(result).To(ContainSubstring("chain redsocks-REDIRECT"))
+		Expect(result).To(ContainSubstring("tcp redirect to :12345"))
+	})
+
+	It("should look up the cgroup nat map in output-nat chain", func() {
+		Expect(result).To(ContainSubstring("vmap @cgroup-nat-vmap"))
+		Expect(result).To(ContainSubstring("goto redsocks-REDIRECT"))
+	})
+})
+
+var _ = Describe("Route", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForRoutes([]*config.Route{
+			{Name: "vpn", Interface: "wg0", Table: 400, Mark: 600, Masquerade: true},
+			{Name: "lan", Interface: "eth1", Table: 401, Mark: 601},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+	})
+
+	It("should create chains setting the mark of routes", func() {
+		Expect(result).To(ContainSubstring("chain vpn-ROUTE"))
+		Expect(result).To(ContainSubstring("meta mark set 0x00000258"))
+		Expect(result).To(ContainSubstring("chain lan-ROUTE"))
+		Expect(result).To(ContainSubstring("meta mark set 0x00000259"))
+	})
+
+	It("should masquerade traffic only for routes asking for it", func() {
+		Expect(result).To(ContainSubstring(
+			`meta mark 0x00000258 oifname "wg0" masquerade`))
+		Expect(result).ToNot(ContainSubstring(`oifname "eth1"`))
+	})
+})
+
+var _ = Describe("Mark", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/mark/a", 0755)).To(Succeed())
+		Expect(os.MkdirAll(cgroupRoot+"/mark/b", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/mark/a",
+				Target: types.Target{Op: types.TargetMark, Mark: 0x100}},
+			{Path: cgroupRoot + "/mark/b",
+				Target: types.Target{Op: types.TargetMark, Mark: 0x100, MarkMask: 0xff00}},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/mark/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/mark/b")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/mark")).To(Succeed())
+	})
+
+	It("should create a chain for each mark", func() {
+		Expect(result).To(ContainSubstring("chain MARK-0x100 "))
+		Expect(result).To(ContainSubstring("chain MARK-0x100-0xff00 "))
+		Expect(result).To(ContainSubstring("goto MARK-0x100"))
+	})
+
+	It("should keep bits out of the mask", func() {
+		Expect(result).To(ContainSubstring("meta mark set 0x00000100"))
+		Expect(result).To(ContainSubstring(
+			"meta mark set meta mark & 0xffff00ff | 0x00000100"))
+	})
+})
+
+var _ = Describe("Reject", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/reject/a", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/reject/a",
+				Target: types.Target{Op: types.TargetReject,
+					RejectWith: config.RejectWithAdminProhibited}},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/reject/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/reject")).To(Succeed())
+	})
+
+	It("should create a chain for the reason", func() {
+		Expect(result).To(ContainSubstring("chain REJECT-admin-prohibited "))
+		Expect(result).To(ContainSubstring("goto REJECT-admin-prohibited"))
+	})
+
+	It("should reset tcp connections", func() {
+		Expect(result).To(ContainSubstring("meta l4proto tcp reject with tcp reset"))
+	})
+
+	It("should reject other traffic with the reason", func() {
+		Expect(result).To(ContainSubstring("reject with icmpx admin-prohibited"))
+	})
+})
+
+var _ = Describe("Log", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+
+		group := uint16(3)
+
+		Expect(os.MkdirAll(cgroupRoot+"/log/a", 0755)).To(Succeed())
+		Expect(os.MkdirAll(cgroupRoot+"/log/b", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/log/a",
+				Target: types.Target{Op: types.TargetDrop,
+					Log: &config.Log{Prefix: "dropped: ", Rate: 10}}},
+			{Path: cgroupRoot + "/log/b",
+				Target: types.Target{Op: types.TargetDirect,
+					Log: &config.Log{Group: &group}}},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/log/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/log/b")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/log")).To(Succeed())
+	})
+
+	It("should log new connections before the verdict", func() {
+		Expect(result).To(ContainSubstring(
+			`ct state new limit rate 10/minute log prefix "dropped: "`))
+		Expect(result).To(ContainSubstring("ct state new log group 3"))
+		Expect(result).To(ContainSubstring("goto LOG-"))
+	})
+})
+
+var _ = Describe("DNS of rules", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/dns/a", 0755)).To(Succeed())
+		Expect(os.MkdirAll(cgroupRoot+"/dns/b", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/dns/a",
+				Target: types.Target{Op: types.TargetDirect, DNS: &config.DNSHijack{
+					IP: pstr("127.0.0.1"), Port: 5353, DropDoT: true,
+				}}},
+			{Path: cgroupRoot + "/dns/b",
+				Target: types.Target{Op: types.TargetDirect, DNS: &config.DNSHijack{
+					IP6: pstr("::1"), Port: 5353,
+				}}},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/dns/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/dns/b")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/dns")).To(Succeed())
+	})
+
+	It("should create a chain for the dns", func() {
+		Expect(result).To(ContainSubstring("chain DNS-127.0.0.1-5353-drop-dot "))
+		Expect(result).To(ContainSubstring("goto DNS-127.0.0.1-5353-drop-dot"))
+		Expect(result).To(ContainSubstring("udp dport 53 dnat ip to 127.0.0.1:5353"))
+		Expect(result).To(ContainSubstring("tcp dport 853 drop"))
+	})
+
+	It("should hijack ipv6 only if the dns has no ipv4 address", func() {
+		Expect(result).To(ContainSubstring(`"dns/b" : goto DNS-5353-__1`))
+		Expect(result).To(ContainSubstring("chain DNS-5353-__1 "))
+		Expect(result).To(ContainSubstring("udp dport 53 dnat ip6 to [::1]:5353"))
+	})
+
+	It("should fall back to dns hijack of tproxies", func() {
+		Expect(result).To(ContainSubstring("goto mark-dns"))
+	})
+})
+
+var _ = Describe("Counters", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+		counters   []types.Counter
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForTProxies([]*config.TProxy{
+			{Name: "clash", Port: 7893, Mark: 7893},
+		})).To(Succeed())
+		Expect(nft.AddChainAndRulesForRedirects([]*config.Redirect{
+			{Name: "redsocks", Port: 12345},
+		})).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/counter/a", 0755)).To(Succeed())
+		Expect(os.MkdirAll(cgroupRoot+"/counter/b", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/counter/a",
+				Target: types.Target{Op: types.TargetRedirect, Chain: "redsocks-REDIRECT"}},
+			{Path: cgroupRoot + "/counter/b",
+				Target: types.Target{Op: types.TargetDirect, Rule: "rule-0"}},
+		})).To(Succeed())
+
+		result = getNFTableRules()
+
+		counters, err = nft.Counters()
+		Expect(err).To(Succeed())
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/counter/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/counter/b")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/counter")).To(Succeed())
+	})
+
+	It("should always have counters for direct and drop", func() {
+		Expect(result).To(ContainSubstring(`meta nfproto ipv4 meta l4proto tcp counter name "direct-tcp4"`))
+		Expect(result).To(ContainSubstring(`meta nfproto ipv6 meta l4proto udp counter name "drop-udp6"`))
+	})
+
+	It("should count traffic to be redirected out of output-nat chain", func() {
+		Expect(result).To(ContainSubstring("goto redsocks-REDIRECT-COUNT"))
+		Expect(result).To(ContainSubstring(`counter name "redirect-redsocks-tcp4"`))
+		Expect(result).ToNot(ContainSubstring(`counter name "redirect-redsocks-udp4"`))
+	})
+
+	It("should read counters of each target", func() {
+		targets := map[string]int{}
+		for i := range counters {
+			targets[counters[i].Target]++
+		}
+
+		Expect(targets).To(Equal(map[string]int{
+			"direct":            4,
+			"drop":              4,
+			"tproxy-clash":      4,
+			"redirect-redsocks": 2,
+			"rule-0":            4,
+		}))
+	})
+
+	It("should count traffic of each rule before its target", func() {
+		Expect(result).To(ContainSubstring(`"counter/b" : goto RULE-0-DIRECT`))
+		Expect(result).To(ContainSubstring(`counter name "rule-0-tcp4"`))
+		Expect(result).To(ContainSubstring("goto DIRECT"))
+	})
+
+	It("should keep counters of a rule whose target has changed", func() {
+		cfg := &config.Config{
+			TProxies: map[string]*config.TProxy{
+				"clash": {Name: "clash", Port: 7893, Mark: 7893},
+			},
+			Redirects: map[string]*config.Redirect{
+				"redsocks": {Name: "redsocks", Port: 12345},
+			},
+		}
+
+		Expect(nft.Reload(cfg, []types.Route{
+			{Path: cgroupRoot + "/counter/b",
+				Target: types.Target{Op: types.TargetDrop, Rule: "rule-0"}},
+		})).To(Succeed())
+
+		result := getNFTableRules()
+		Expect(result).To(ContainSubstring(`"counter/b" : goto RULE-0-DROP`))
+		Expect(result).ToNot(ContainSubstring("chain RULE-0-DIRECT"))
+		Expect(result).To(ContainSubstring(`counter name "rule-0-tcp4"`))
+
+		Expect(nft.Reload(cfg, []types.Route{
+			{Path: cgroupRoot + "/counter/b",
+				Target: types.Target{Op: types.TargetDrop, Rule: "rule-1"}},
+		})).To(Succeed())
+
+		counters, err := nft.Counters()
+		Expect(err).To(Succeed())
+
+		targets := map[string]int{}
+		for i := range counters {
+			targets[counters[i].Target]++
+		}
+
+		Expect(targets).To(HaveKeyWithValue("rule-1", 4))
+		Expect(targets).ToNot(HaveKey("rule-0"))
+	})
+})
+
+var _ = Describe("HasCGroup", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/lookup/a", 0755)).To(Succeed())
+		Expect(os.MkdirAll(cgroupRoot+"/lookup/b", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/lookup/a",
+				Target: types.Target{Op: types.TargetDirect}},
+		})).To(Succeed())
+	})
+
+	AfterAll(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/lookup/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/lookup/b")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/lookup")).To(Succeed())
+	})
+
+	It("should find cgroups in the cgroup map", func() {
+		Expect(nft.HasCGroup(cgroupRoot + "/lookup/a")).To(BeTrue())
+	})
+
+	It("should not find cgroups without route", func() {
+		Expect(nft.HasCGroup(cgroupRoot + "/lookup/b")).To(BeFalse())
+	})
+
+	It("should fail on cgroups not exist", func() {
+		_, err := nft.HasCGroup(cgroupRoot + "/lookup/c")
+		Expect(err).To(MatchError(os.ErrNotExist))
+	})
+})
+
+var _ = Describe("RemoveLeftover", func() {
+	BeforeEach(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+	})
+
+	It("should remove the table left by another NFTManager", func() {
+		cgroupRoot := config.CGroupRoot(os.Getenv("CGTPROXY_TEST_CGROUP_ROOT"))
+
+		killed, err := injectedNFTManagerWithLastingConnector(cgroupRoot)
+		Expect(err).To(Succeed())
+		Expect(killed.InitStructure()).To(Succeed())
+
+		nft, err := injectedNFTManagerWithLastingConnector(cgroupRoot)
+		Expect(err).To(Succeed())
+
+		Expect(nft.RemoveLeftover()).To(BeTrue())
+		Expect(nft.RemoveLeftover()).To(BeFalse())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.Clear()).To(Succeed())
+	})
+})
+
+// batchRecorder connects to an in-memory ruleset like nfttest.Connector,
+// and calls committed after each batch sent through its connections.
+type batchRecorder struct {
+	*nfttest.Connector
+	committed func()
+}
+
+func (c *batchRecorder) Connect() (*nftables.Conn, error) {
+	dial := c.Dial()
+	return nftables.New(nftables.WithTestDial(
+		func(req []netlink.Message) ([]netlink.Message, error) {
+			ret, err := dial(req)
+			if len(req) != 0 && req[0].Header.Type ==
+				netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN) {
+				c.committed()
+			}
+			return ret, err
+		},
+	))
+}
+
+var _ = Describe("ReplaceRoutes", func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot string
+		rules      func() string
+		committed  []string
+	)
+
+	BeforeEach(func() {
+		conn, err := nfttest.New()
+		Expect(err).To(Succeed())
+
+		cgroupRoot = GinkgoT().TempDir()
+		rules = func() string {
+			return renderRules(conn, cgroupRoot)
+		}
+
+		committed = nil
+		recorder := &batchRecorder{Connector: conn, committed: func() {
+			committed = append(committed, rules())
+		}}
+		nft = newNFTManagerOn(recorder, cgroupRoot)
+
+		Expect(nft.InitStructure()).To(Succeed())
+
+		for _, dir := range []string{"replace/a", "replace/a/sub", "replace/b"} {
+			Expect(os.MkdirAll(filepath.Join(cgroupRoot, dir), 0755)).To(Succeed())
+		}
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/replace/a",
+				Target: types.Target{Op: types.TargetDirect}},
+			{Path: cgroupRoot + "/replace/a/sub",
+				Target: types.Target{Op: types.TargetDirect}},
+			{Path: cgroupRoot + "/replace/b",
+				Target: types.Target{Op: types.TargetDirect}},
+		})).To(Succeed())
+
+		committed = nil
+	})
+
+	AfterEach(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+	})
+
+	It("should replace elements without removing them first", func() {
+		Expect(nft.ReplaceRoutes([]string{
+			cgroupRoot + "/replace/a",
+			cgroupRoot + "/replace/a/sub",
+			cgroupRoot + "/replace/b",
+		}, []types.Route{
+			{Path: cgroupRoot + "/replace/a",
+				Target: types.Target{Op: types.TargetDrop}},
+			{Path: cgroupRoot + "/replace/a/sub",
+				Target: types.Target{Op: types.TargetDirect}},
+		})).To(Succeed())
+
+		// NOTE:
+		// The only batch sent is the one replacing the elements,
+		// so there is no moment the cgroups have no element.
+		Expect(committed).To(HaveLen(1))
+		Expect(committed[0]).To(ContainSubstring(`"replace/a" : goto DROP`))
+		Expect(committed[0]).To(ContainSubstring(`"replace/a/sub" : goto DIRECT`))
+		Expect(committed[0]).ToNot(ContainSubstring(`"replace/b"`))
+	})
+
+	It("should leave the table untouched on failure", func() {
+		before := rules()
+
+		Expect(nft.ReplaceRoutes([]string{
+			cgroupRoot + "/replace/a",
+		}, []types.Route{
+			{Path: cgroupRoot + "/replace/a",
+				Target: types.Target{Op: types.TargetTProxy, Chain: "unknown-MARK"}},
+		})).ToNot(Succeed())
+
+		Expect(rules()).To(Equal(before))
+	})
+})
+
+var _ = Describe("Reload", Ordered, func() {
+	var (
+		nft        *NFTManager
+		cgroupRoot = os.Getenv("CGTPROXY_TEST_CGROUP_ROOT")
+		result     string
+	)
+
+	BeforeAll(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip(needSandboxMessage)
+		}
+	})
+
+	BeforeEach(func() {
+		var err error
+		nft, err = injectedNFTManagerWithLastingConnector(config.CGroupRoot(cgroupRoot))
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForTProxies([]*config.TProxy{
+			{Name: "kept", Port: 7901, Mark: 201},
+			{Name: "changed", Port: 7902, Mark: 202, DNSHijack: &config.DNSHijack{
+				IP: pstr("127.0.0.1"), Port: 5353,
+			}},
+			{Name: "removed", Port: 7903, Mark: 203},
+		})).To(Succeed())
+
+		Expect(os.MkdirAll(cgroupRoot+"/reload/a", 0755)).To(Succeed())
+		Expect(os.MkdirAll(cgroupRoot+"/reload/b", 0755)).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{
+			{Path: cgroupRoot + "/reload/a",
+				Target: types.Target{Op: types.TargetTProxy, Chain: "removed-MARK"}},
+			{Path: cgroupRoot + "/reload/b",
+				Target: types.Target{Op: types.TargetTProxy, Chain: "kept-MARK"}},
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		if nft != nil {
+			Expect(nft.Clear()).To(Succeed())
+		}
+
+		Expect(syscall.Rmdir(cgroupRoot + "/reload/a")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/reload/b")).To(Succeed())
+		Expect(syscall.Rmdir(cgroupRoot + "/reload")).To(Succeed())
+	})
+
+	Context("with a valid configuration", func() {
+		BeforeEach(func() {
+			cfg := &config.Config{
+				Bypass: config.Bypass{"10.0.0.0/8"},
+				TProxies: map[string]*config.TProxy{
+					"kept":    {Name: "kept", Port: 7901, Mark: 201},
+					"changed": {Name: "changed", Port: 7912, Mark: 212},
+					"added":   {Name: "added", Port: 7904, Mark: 204},
+				},
+			}
+
+			Expect(nft.Reload(cfg, []types.Route{
+				{Path: cgroupRoot + "/reload/a",
+					Target: types.Target{Op: types.TargetTProxy, Chain: "added-MARK"}},
+				{Path: cgroupRoot + "/reload/b",
+					Target: types.Target{Op: types.TargetDrop}},
+			})).To(Succeed(), "nft:\n%s", getNFTableRules())
+
+			result = getNFTableRules()
+		})
+
+		It("should update chains of tproxies", func() {
+			Expect(result).To(ContainSubstring("chain added"))
+			Expect(result).To(ContainSubstring("tproxy to :7912"))
+			Expect(result).ToNot(ContainSubstring("tproxy to :7902"))
+			Expect(result).ToNot(ContainSubstring("chain changed-DNS"))
+			Expect(result).ToNot(ContainSubstring("chain removed"))
+		})
+
+		It("should update the bypass set", func() {
+			Expect(result).To(ContainSubstring("10.0.0.0/8"))
+		})
+
+		It("should update targets of known cgroups", func() {
+			Expect(result).To(ContainSubstring(`reload/a" : goto added-MARK`))
+			Expect(result).To(ContainSubstring(`reload/b" : goto DROP`))
+		})
+	})
+
+	Context("with a route to an unknown chain", func() {
+		var (
+			before string
+			err    error
+		)
+
+		BeforeEach(func() {
+			before = getNFTableRules()
+
+			err = nft.Reload(&config.Config{}, []types.Route{
+				{Path: cgroupRoot + "/reload/a",
+					Target: types.Target{Op: types.TargetTProxy, Chain: "unknown-MARK"}},
+			})
 		})
+
+		It("should leave the table untouched", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(getNFTableRules()).To(Equal(before))
+		})
+	})
+})
+
+// Specs of this table run on both the in-memory ruleset and the kernel,
+// so that they keep the in-memory connector
+// telling the same as the kernel.
+var _ = Describe("Ruleset", func() {
+	ContextTable("on %s",
+		ContextTableEntry(newNFTManager(newNFTManagerInMemory)).WithFmt("in-memory connector"),
+		ContextTableEntry(newNFTManagerInSandbox(injectedNFTManagerWithLastingConnector)).WithFmt("lasting connector"),
+		func(newNFTManager newNFTManager) {
+			var (
+				nft        *NFTManager
+				cgroupRoot string
+				rules      func() string
+			)
+
+			BeforeEach(func() {
+				nft, cgroupRoot, rules = newNFTManager()
+
+				Expect(nft.InitStructure()).To(Succeed())
+				DeferCleanup(func() {
+					Expect(nft.Clear()).To(Succeed())
+				})
+
+				Expect(nft.AddChainAndRulesForTProxies([]*config.TProxy{{
+					Name: "clash", Port: 7893, Mark: 7893,
+					Bypass: config.Bypass{"192.168.0.0/16"},
+				}})).To(Succeed())
+				Expect(nft.AddChainAndRulesForRedirects([]*config.Redirect{{
+					Name: "redsocks", Port: 12345,
+				}})).To(Succeed())
+
+				// Cleanups run in reverse order,
+				// so cgroups are removed before their parent.
+				DeferCleanup(syscall.Rmdir, cgroupRoot+"/ruleset")
+				for _, path := range []string{"a", "b", "c", "d"} {
+					path = cgroupRoot + "/ruleset/" + path
+					Expect(os.MkdirAll(path, 0755)).To(Succeed())
+					DeferCleanup(syscall.Rmdir, path)
+				}
+
+				Expect(nft.AddRoutes([]types.Route{
+					{Path: cgroupRoot + "/ruleset/a",
+						Target: types.Target{Op: types.TargetTProxy, Chain: "clash-MARK", Rule: "rule-0"}},
+					{Path: cgroupRoot + "/ruleset/b",
+						Target: types.Target{Op: types.TargetRedirect, Chain: "redsocks-REDIRECT"}},
+					{Path: cgroupRoot + "/ruleset/c",
+						Target: types.Target{Op: types.TargetDirect, DNS: &config.DNSHijack{
+							IP: pstr("127.0.0.1"), Port: 5353,
+						}}},
+					{Path: cgroupRoot + "/ruleset/d",
+						Target: types.Target{Op: types.TargetDrop}},
+				})).To(Succeed())
+			})
+
+			It("should send cgroups to chains of their targets", func() {
+				result := rules()
+
+				Expect(result).To(ContainSubstring(`"ruleset/a" : goto RULE-0-clash-MARK`))
+				Expect(result).To(ContainSubstring(`"ruleset/b" : goto redsocks-REDIRECT-COUNT`))
+				Expect(result).To(ContainSubstring(`"ruleset/c" : goto DNS-127.0.0.1-5353`))
+				Expect(result).To(ContainSubstring(`"ruleset/d" : goto DROP`))
+				Expect(result).To(ContainSubstring("192.168.0.0/16"))
+			})
+
+			It("should read counters of targets and rules", func() {
+				counters, err := nft.Counters()
+				Expect(err).To(Succeed())
+
+				targets := map[string]int{}
+				for i := range counters {
+					targets[counters[i].Target]++
+				}
+
+				Expect(targets).To(HaveKeyWithValue("rule-0", 4))
+				Expect(targets).To(HaveKeyWithValue("tproxy-clash", 4))
+				Expect(targets).To(HaveKeyWithValue("redirect-redsocks", 2))
+			})
+
+			It("should forget cgroups removed", func() {
+				Expect(nft.RemoveRoutes([]string{
+					cgroupRoot + "/ruleset/a", cgroupRoot + "/ruleset/d",
+				})).To(Succeed())
+
+				result := rules()
+				Expect(result).ToNot(ContainSubstring(`"ruleset/a"`))
+				Expect(result).ToNot(ContainSubstring(`"ruleset/d"`))
+				Expect(result).To(ContainSubstring(`"ruleset/b" : goto redsocks-REDIRECT-COUNT`))
+			})
+
+			It("should leave nothing after cleared", func() {
+				Expect(nft.Clear()).To(Succeed())
+				Expect(rules()).To(BeEmpty())
+			})
+		},
+	)
 })
 
 func TestTable(t *testing.T) {
@@ -0,0 +1,42 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package nfttest provides a test double of interfaces.NetlinkConnector,
+// which makes code using NFTManager testable without CAP_NET_ADMIN.
+package nfttest
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/nftman/memconnector"
+	. "github.com/black-desk/lib/go/errwrap"
+)
+
+// Connector connects to an in-memory ruleset like memconnector.Connector,
+// and decodes what has been sent through its connections
+// into a Ruleset which tests can inspect.
+type Connector struct {
+	*memconnector.Connector
+}
+
+type Opt = (func(*Connector) (*Connector, error))
+
+func New(opts ...Opt) (ret *Connector, err error) {
+	defer Wrap(&err, "create netlink connector for tests")
+
+	c := &Connector{}
+
+	c.Connector, err = memconnector.New()
+	if err != nil {
+		return
+	}
+
+	for i := range opts {
+		c, err = opts[i](c)
+		if err != nil {
+			return
+		}
+	}
+
+	ret = c
+	return
+}
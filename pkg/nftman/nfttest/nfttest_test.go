@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nfttest_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/nftman"
+	"github.com/black-desk/cgtproxy/pkg/nftman/nfttest"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestNFTTest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "NFTTest Suite")
+}
+
+var _ = Describe("Ruleset of NFTManager", func() {
+	var (
+		conn *nfttest.Connector
+		nft  *nftman.NFTManager
+		root string
+		key  []byte
+	)
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		Expect(os.Mkdir(filepath.Join(root, "app"), 0755)).To(Succeed())
+
+		info, err := os.Stat(filepath.Join(root, "app"))
+		Expect(err).To(Succeed())
+		key = binaryutil.NativeEndian.PutUint64(info.Sys().(*syscall.Stat_t).Ino)
+
+		conn, err = nfttest.New()
+		Expect(err).To(Succeed())
+
+		nft, err = nftman.New(
+			nftman.WithCgroupRoot(config.CGroupRoot(root)),
+			nftman.WithBypass(config.Bypass{"10.0.0.0/8"}),
+			nftman.WithConnFactory(conn),
+		)
+		Expect(err).To(Succeed())
+
+		Expect(nft.InitStructure()).To(Succeed())
+		Expect(nft.AddChainAndRulesForTProxies([]*config.TProxy{{
+			Name: "clash", Port: 7893, Mark: 100,
+		}})).To(Succeed())
+		Expect(nft.AddRoutes([]types.Route{{
+			Path:   filepath.Join(root, "app"),
+			Target: types.Target{Op: types.TargetTProxy, Chain: "clash"},
+		}})).To(Succeed())
+	})
+
+	It("should have the table with bypass", func() {
+		t := tableOf(conn)
+
+		bypass := t.Set("bypass")
+		Expect(bypass).ToNot(BeNil())
+		Expect(bypass.Interval).To(BeTrue())
+		Expect(bypass.Element([]byte{10, 0, 0, 0})).ToNot(BeNil())
+	})
+
+	It("should route cgroups to chains of their targets", func() {
+		t := tableOf(conn)
+
+		e := t.Set("cgroup-vmap").Element(key)
+		Expect(e).ToNot(BeNil())
+		Expect(e.VerdictData.Kind).To(Equal(expr.VerdictGoto))
+		Expect(e.VerdictData.Chain).To(Equal("clash"))
+
+		Expect(nft.RemoveRoutes([]string{filepath.Join(root, "app")})).To(Succeed())
+		Expect(tableOf(conn).Set("cgroup-vmap").Element(key)).To(BeNil())
+	})
+
+	It("should decode tproxy expressions of rules", func() {
+		found := false
+		for _, ch := range tableOf(conn).Chains {
+			for _, r := range ch.Rules {
+				Expect(r.Handle).ToNot(BeZero())
+
+				for _, e := range r.Exprs {
+					if _, ok := e.(*expr.TProxy); ok {
+						found = true
+					}
+				}
+			}
+		}
+
+		Expect(found).To(BeTrue())
+	})
+
+	It("should show nothing after clear", func() {
+		Expect(nft.Clear()).To(Succeed())
+
+		r, err := conn.Ruleset()
+		Expect(err).To(Succeed())
+		Expect(r.Table(nftables.TableFamilyINet, nftman.NftTableName)).To(BeNil())
+	})
+})
+
+func tableOf(c *nfttest.Connector) *nfttest.Table {
+	r, err := c.Ruleset()
+	Expect(err).To(Succeed())
+
+	t := r.Table(nftables.TableFamilyINet, nftman.NftTableName)
+	Expect(t).ToNot(BeNil())
+
+	return t
+}
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nfttest
+
+import (
+	"strings"
+
+	"github.com/black-desk/cgtproxy/pkg/nftman/memconnector"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// verdictDataType is NFTA_SET_DATA_TYPE of verdict maps.
+const verdictDataType = 0xffffff00
+
+// dump sends a request of typ dumping objects in a table of family,
+// and returns attributes of objects in replies.
+func (c *Connector) dump(
+	family nftables.TableFamily, typ uint16, attrs []netlink.Attribute,
+) (
+	ret [][]netlink.Attribute, err error,
+) {
+	var data []byte
+	data, err = netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return
+	}
+
+	var replies []netlink.Message
+	replies, err = c.Dial()([]netlink.Message{{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | typ),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: append([]byte{byte(family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}})
+	if err != nil {
+		return
+	}
+
+	result := [][]netlink.Attribute{}
+
+	for _, msg := range replies {
+		if msg.Header.Type == netlink.Done {
+			break
+		}
+
+		if msg.Header.Type == netlink.Error {
+			errno := int32(binaryutil.NativeEndian.Uint32(msg.Data[:4]))
+			err = unix.Errno(-errno)
+			return
+		}
+
+		var msgAttrs []netlink.Attribute
+		msgAttrs, err = netlink.UnmarshalAttributes(msg.Data[4:])
+		if err != nil {
+			return
+		}
+
+		result = append(result, msgAttrs)
+	}
+
+	ret = result
+	return
+}
+
+// rules lists rules of chain in table.
+//
+// NOTE:
+// Rules are listed by a raw NFT_MSG_GETRULE request
+// instead of (*nftables.Conn).GetRules,
+// as github.com/google/nftables skips expressions it cannot decode,
+// such as socket and tproxy used by NFTManager.
+func (c *Connector) rules(
+	table *nftables.Table, chain *nftables.Chain,
+) (
+	ret []*nftables.Rule, err error,
+) {
+	defer Wrap(&err, "list rules of chain %s", chain.Name)
+
+	var list [][]netlink.Attribute
+	list, err = c.dump(table.Family, unix.NFT_MSG_GETRULE, []netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: []byte(table.Name + "\x00")},
+		{Type: unix.NFTA_RULE_CHAIN, Data: []byte(chain.Name + "\x00")},
+	})
+	if err != nil {
+		return
+	}
+
+	rules := []*nftables.Rule{}
+
+	for _, attrs := range list {
+		r := &nftables.Rule{Table: table, Chain: chain}
+
+		for _, attr := range attrs {
+			switch attr.Type &^ unix.NLA_F_NESTED {
+			case unix.NFTA_RULE_HANDLE:
+				r.Handle = binaryutil.BigEndian.Uint64(attr.Data)
+			case unix.NFTA_RULE_EXPRESSIONS:
+				r.Exprs, err = memconnector.DecodeExprs(byte(table.Family), attr.Data)
+				if err != nil {
+					return
+				}
+			case unix.NFTA_RULE_USERDATA:
+				r.UserData = attr.Data
+			}
+		}
+
+		rules = append(rules, r)
+	}
+
+	ret = rules
+	return
+}
+
+// decodeVerdicts fills DataType of a verdict map
+// and VerdictData of its elements.
+//
+// NOTE:
+// github.com/google/nftables takes the verdict data type of a map
+// as its key type, and leaves verdicts of elements encoded in Val.
+func (c *Connector) decodeVerdicts(s *Set) (err error) {
+	defer Wrap(&err, "decode verdicts of map %s", s.Name)
+
+	if !s.IsMap {
+		return
+	}
+
+	var list [][]netlink.Attribute
+	list, err = c.dump(s.Table.Family, unix.NFT_MSG_GETSET, []netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: []byte(s.Table.Name + "\x00")},
+		{Type: unix.NFTA_SET_NAME, Data: []byte(s.Name + "\x00")},
+	})
+	if err != nil {
+		return
+	}
+
+	isVerdictMap := false
+	for _, attrs := range list {
+		for _, attr := range attrs {
+			if attr.Type == unix.NFTA_SET_DATA_TYPE &&
+				binaryutil.BigEndian.Uint32(attr.Data) == verdictDataType {
+				isVerdictMap = true
+			}
+		}
+	}
+
+	if !isVerdictMap {
+		return
+	}
+
+	s.DataType = nftables.TypeVerdict
+
+	for i := range s.Elements {
+		e := &s.Elements[i]
+		if e.IntervalEnd {
+			continue
+		}
+
+		var attrs []netlink.Attribute
+		attrs, err = netlink.UnmarshalAttributes(e.Val)
+		if err != nil {
+			return
+		}
+
+		v := &expr.Verdict{}
+		for _, attr := range attrs {
+			switch attr.Type &^ unix.NLA_F_NESTED {
+			case unix.NFTA_VERDICT_CODE:
+				v.Kind = expr.VerdictKind(int32(binaryutil.BigEndian.Uint32(attr.Data)))
+			case unix.NFTA_VERDICT_CHAIN:
+				v.Chain = strings.TrimSuffix(string(attr.Data), "\x00")
+			}
+		}
+
+		e.Val = nil
+		e.VerdictData = v
+	}
+
+	return
+}
@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nfttest
+
+import (
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/google/nftables"
+)
+
+// Ruleset lists the in-memory ruleset
+// through a new connection and decodes it.
+func (c *Connector) Ruleset() (ret *Ruleset, err error) {
+	defer Wrap(&err, "list in-memory ruleset")
+
+	var conn *nftables.Conn
+	conn, err = c.Connect()
+	if err != nil {
+		return
+	}
+
+	var tables []*nftables.Table
+	tables, err = conn.ListTables()
+	if err != nil {
+		return
+	}
+
+	var chains []*nftables.Chain
+	chains, err = conn.ListChains()
+	if err != nil {
+		return
+	}
+
+	r := &Ruleset{}
+
+	for _, table := range tables {
+		t := &Table{Table: table}
+
+		for _, chain := range chains {
+			if chain.Table.Family != table.Family ||
+				chain.Table.Name != table.Name {
+				continue
+			}
+
+			ch := &Chain{Chain: chain}
+			ch.Rules, err = c.rules(table, chain)
+			if err != nil {
+				return
+			}
+
+			t.Chains = append(t.Chains, ch)
+		}
+
+		var sets []*nftables.Set
+		sets, err = conn.GetSets(table)
+		if err != nil {
+			return
+		}
+
+		for _, set := range sets {
+			s := &Set{Set: set}
+			s.Elements, err = conn.GetSetElements(set)
+			if err != nil {
+				return
+			}
+
+			err = c.decodeVerdicts(s)
+			if err != nil {
+				return
+			}
+
+			t.Sets = append(t.Sets, s)
+		}
+
+		r.Tables = append(r.Tables, t)
+	}
+
+	ret = r
+	return
+}
@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nfttest
+
+import (
+	"bytes"
+
+	"github.com/google/nftables"
+)
+
+// Ruleset is a snapshot of tables in the in-memory ruleset.
+type Ruleset struct {
+	Tables []*Table
+}
+
+type Table struct {
+	*nftables.Table
+
+	Chains []*Chain
+	Sets   []*Set
+}
+
+// Chain is a chain with its rules in order.
+// Expressions of rules are decoded completely,
+// including those github.com/google/nftables fails to decode.
+type Chain struct {
+	*nftables.Chain
+
+	Rules []*nftables.Rule
+}
+
+// Set is a set or map with its elements,
+// anonymous sets used by rules are included.
+type Set struct {
+	*nftables.Set
+
+	Elements []nftables.SetElement
+}
+
+// Table returns the table named name of family,
+// or nil if there is no such table.
+func (r *Ruleset) Table(family nftables.TableFamily, name string) *Table {
+	for _, t := range r.Tables {
+		if t.Family == family && t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Chain returns the chain named name, or nil if there is no such chain.
+func (t *Table) Chain(name string) *Chain {
+	for _, ch := range t.Chains {
+		if ch.Name == name {
+			return ch
+		}
+	}
+
+	return nil
+}
+
+// Set returns the set named name, or nil if there is no such set.
+func (t *Table) Set(name string) *Set {
+	for _, s := range t.Sets {
+		if s.Name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// Element returns the element of key, or nil if there is no such element.
+// Ends of intervals are not elements here.
+func (s *Set) Element(key []byte) *nftables.SetElement {
+	for i := range s.Elements {
+		if s.Elements[i].IntervalEnd {
+			continue
+		}
+
+		if bytes.Equal(s.Elements[i].Key, key) {
+			return &s.Elements[i]
+		}
+	}
+
+	return nil
+}
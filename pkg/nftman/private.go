@@ -5,12 +5,17 @@
 package nftman
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
 	"github.com/black-desk/cgtproxy/pkg/types"
@@ -18,6 +23,8 @@ import (
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
@@ -32,13 +39,22 @@ func (nft *NFTManager) initIPV4BypassSet(conn *nftables.Conn) (err error) {
 		Interval:     true,
 	}
 
+	err = conn.AddSet(nft.ipv4BypassSet, nft.genIPV4BypassSetElements(nft.bypassIPv4))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (nft *NFTManager) genIPV4BypassSetElements(bypassIPv4 []string) []nftables.SetElement {
 	elements := []nftables.SetElement{{
 		Key:         net.ParseIP("0.0.0.0").To4(),
 		IntervalEnd: true,
 	}}
 
-	for i := range nft.bypassIPv4 {
-		bypass := nft.bypassIPv4[i]
+	for i := range bypassIPv4 {
+		bypass := bypassIPv4[i]
 		ip := net.ParseIP(bypass)
 
 		if ip != nil {
@@ -72,12 +88,7 @@ func (nft *NFTManager) initIPV4BypassSet(conn *nftables.Conn) (err error) {
 		)
 	}
 
-	err = conn.AddSet(nft.ipv4BypassSet, elements)
-	if err != nil {
-		return
-	}
-
-	return
+	return elements
 }
 
 func (nft *NFTManager) initIPV6BypassSet(conn *nftables.Conn) (err error) {
@@ -89,13 +100,22 @@ func (nft *NFTManager) initIPV6BypassSet(conn *nftables.Conn) (err error) {
 		Interval:     true,
 	}
 
+	err = conn.AddSet(nft.ipv6BypassSet, nft.genIPV6BypassSetElements(nft.bypassIPv6))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (nft *NFTManager) genIPV6BypassSetElements(bypassIPv6 []string) []nftables.SetElement {
 	elements := []nftables.SetElement{{
 		Key:         net.ParseIP("::").To16(),
 		IntervalEnd: true,
 	}}
 
-	for i := range nft.bypassIPv6 {
-		bypass := nft.bypassIPv6[i]
+	for i := range bypassIPv6 {
+		bypass := bypassIPv6[i]
 		ip := net.ParseIP(bypass)
 		if ip != nil {
 			elements = append(elements,
@@ -128,12 +148,7 @@ func (nft *NFTManager) initIPV6BypassSet(conn *nftables.Conn) (err error) {
 		)
 	}
 
-	err = conn.AddSet(nft.ipv6BypassSet, elements)
-	if err != nil {
-		return
-	}
-
-	return
+	return elements
 }
 
 func (nft *NFTManager) initProtoSet() {
@@ -153,7 +168,7 @@ func (nft *NFTManager) initProtoSet() {
 func (nft *NFTManager) initCgroupMap(conn *nftables.Conn) (err error) {
 	nft.cgroupMap = &nftables.Set{
 		Table:        nft.table,
-		Name:         "cgroup-vmap",
+		Name:         cgroupMapName,
 		KeyType:      nftables.TypeCGroupV2,
 		DataType:     nftables.TypeVerdict,
 		IsMap:        true,
@@ -170,6 +185,26 @@ func (nft *NFTManager) initCgroupMap(conn *nftables.Conn) (err error) {
 	return
 }
 
+func (nft *NFTManager) initCgroupNATMap(conn *nftables.Conn) (err error) {
+	nft.cgroupNATMap = &nftables.Set{
+		Table:        nft.table,
+		Name:         "cgroup-nat-vmap",
+		KeyType:      nftables.TypeCGroupV2,
+		DataType:     nftables.TypeVerdict,
+		IsMap:        true,
+		KeyByteOrder: binaryutil.NativeEndian,
+	}
+
+	nft.cgroupNATMapElement = make(map[string]nftables.SetElement)
+
+	err = conn.AddSet(nft.cgroupNATMap, []nftables.SetElement{})
+	if err != nil {
+		return
+	}
+
+	return
+}
+
 func (nft *NFTManager) initMarkMap(conn *nftables.Conn) (err error) {
 	nft.markTproxyMap = &nftables.Set{
 		Table:        nft.table,
@@ -255,28 +290,26 @@ func (nft *NFTManager) fillOutputMangleChain(
 		Exprs: exprs,
 	})
 
-	// ip daddr @bypass return
+	nft.addBypassRules(conn, chain, nft.ipv4BypassSet, nft.ipv6BypassSet)
+
+	// meta l4proto != { tcp, udp } return
+
+	nft.protoSet.ID = 0
+	err = conn.AddSet(nft.protoSet, nft.protoSetElement)
+	if err != nil {
+		return
+	}
+
 	exprs = []expr.Any{
-		&expr.Meta{ // meta load nfproto => reg 1
-			Key:      expr.MetaKeyNFPROTO,
-			Register: 1,
-		},
-		&expr.Cmp{ // cmp eq reg 1 0x00000002
-			Op:       expr.CmpOpEq,
+		&expr.Meta{ // meta load l4proto => reg 1
+			Key:      expr.MetaKeyL4PROTO,
 			Register: 1,
-			Data:     []byte{0x00000002},
-		},
-		&expr.Payload{ // payload load 4b @ network header + 16 => reg 1
-			OperationType: expr.PayloadLoad,
-			DestRegister:  1,
-			Base:          expr.PayloadBaseNetworkHeader,
-			Offset:        16,
-			Len:           4,
 		},
-		&expr.Lookup{ // lookup reg 1 set bypass
+		&expr.Lookup{ // lookup reg 1 set __set%d
 			SourceRegister: 1,
-			SetID:          nft.ipv4BypassSet.ID,
-			SetName:        nft.ipv4BypassSet.Name,
+			SetID:          nft.protoSet.ID,
+			SetName:        nft.protoSet.Name,
+			Invert:         true,
 		},
 		&expr.Verdict{ // immediate reg 0 return
 			Kind: expr.VerdictReturn,
@@ -291,74 +324,194 @@ func (nft *NFTManager) fillOutputMangleChain(
 		Exprs: exprs,
 	})
 
-	// ip6 daddr @bypass6 return
+	return
+}
 
-	exprs = []expr.Any{
-		&expr.Meta{ // meta load nfproto => reg 1
-			Key:      expr.MetaKeyNFPROTO,
-			Register: 1,
-		},
-		&expr.Cmp{ // cmp eq reg 1 0x0000000a
-			Op:       expr.CmpOpEq,
+// initMarkDNSChain adds the chain sending dns request traffic
+// to dns chains of tproxies by fire wall mark.
+// It is the default verdict of cgroup nat map,
+// so dns of rules can take precedence over dns hijack of tproxies.
+func (nft *NFTManager) initMarkDNSChain(conn *nftables.Conn) {
+	nft.markDNSChain = conn.AddChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  "mark-dns",
+	})
+
+	// meta mark vmap @mark-dns-vmap
+	exprs := []expr.Any{
+		&expr.Meta{
+			Key:      expr.MetaKeyMARK,
 			Register: 1,
-			Data:     []byte{0x0000000a},
-		},
-		&expr.Payload{ // payload load 4b @ network header + 16 => reg 1
-			OperationType: expr.PayloadLoad,
-			DestRegister:  1,
-			Base:          expr.PayloadBaseNetworkHeader,
-			Offset:        24,
-			Len:           16,
 		},
-		&expr.Lookup{ // lookup reg 1 set bypass
+		&expr.Lookup{ // lookup reg 1 set mark-dns-vmap dreg 0
 			SourceRegister: 1,
-			SetID:          nft.ipv6BypassSet.ID,
-			SetName:        nft.ipv6BypassSet.Name,
-		},
-		&expr.Verdict{ // immediate reg 0 return
-			Kind: expr.VerdictReturn,
+			IsDestRegSet:   true,
+			SetName:        nft.markDNSMap.Name,
+			SetID:          nft.markDNSMap.ID,
 		},
 	}
-
 	exprs = addDebugCounter(exprs)
 
 	conn.AddRule(&nftables.Rule{
 		Table: nft.table,
-		Chain: chain,
+		Chain: nft.markDNSChain,
 		Exprs: exprs,
 	})
+}
 
-	// meta l4proto != { tcp, udp } return
+// initDirectAndDropChains adds the chains for direct and drop targets,
+// which count traffic before return or drop it.
+// They are created at the beginning,
+// so counters of these targets are always present.
+func (nft *NFTManager) initDirectAndDropChains(conn *nftables.Conn) {
+	for _, target := range []struct {
+		name    string
+		verdict expr.VerdictKind
+	}{
+		{directChainName, expr.VerdictReturn},
+		{dropChainName, expr.VerdictDrop},
+	} {
+		chain := conn.AddChain(&nftables.Chain{
+			Table: nft.table,
+			Name:  target.name,
+		})
+
+		nft.addCounterRules(conn, chain, strings.ToLower(target.name), counterProtos)
+
+		conn.AddRule(&nftables.Rule{
+			Table: nft.table,
+			Chain: chain,
+			Exprs: []expr.Any{&expr.Verdict{Kind: target.verdict}},
+		})
+	}
+}
 
-	nft.protoSet.ID = 0
-	err = conn.AddSet(nft.protoSet, nft.protoSetElement)
-	if err != nil {
-		return
+const (
+	directChainName = "DIRECT"
+	dropChainName   = "DROP"
+)
+
+const cgroupMapName = "cgroup-vmap"
+
+// counterKinds are the kinds of traffic counted separately for a target,
+// name of a counter is name of its target followed by the suffix.
+var counterKinds = []struct {
+	suffix string
+	proto  string
+	family string
+	l4     byte
+	nf     byte
+}{
+	{"tcp4", "tcp", "ipv4", unix.IPPROTO_TCP, unix.NFPROTO_IPV4},
+	{"udp4", "udp", "ipv4", unix.IPPROTO_UDP, unix.NFPROTO_IPV4},
+	{"tcp6", "tcp", "ipv6", unix.IPPROTO_TCP, unix.NFPROTO_IPV6},
+	{"udp6", "udp", "ipv6", unix.IPPROTO_UDP, unix.NFPROTO_IPV6},
+}
+
+// counterProtos are l4 protocols of traffic counted for most targets.
+var counterProtos = []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP}
+
+// redirectCounterProtos are l4 protocols of traffic counted for redirects,
+// which only redirect tcp traffic.
+var redirectCounterProtos = []byte{unix.IPPROTO_TCP}
+
+// addCounterRules adds named counters for target
+// and rules updating them to chain,
+// only traffic of l4 protocols in protos is counted.
+func (nft *NFTManager) addCounterRules(
+	conn *nftables.Conn, chain *nftables.Chain, target string, protos []byte,
+) {
+	for _, kind := range counterKinds {
+		if !slices.Contains(protos, kind.l4) {
+			continue
+		}
+
+		conn.AddObj(&nftables.CounterObj{
+			Table: nft.table,
+			Name:  target + "-" + kind.suffix,
+		})
 	}
 
-	exprs = []expr.Any{
-		&expr.Meta{ // meta load l4proto => reg 1
-			Key:      expr.MetaKeyL4PROTO,
-			Register: 1,
-		},
-		&expr.Lookup{ // lookup reg 1 set __set%d
-			SourceRegister: 1,
-			SetID:          nft.protoSet.ID,
-			SetName:        nft.protoSet.Name,
-			Invert:         true,
-		},
-		&expr.Verdict{ // immediate reg 0 return
-			Kind: expr.VerdictReturn,
-		},
+	nft.addCountingRules(conn, chain, target, protos)
+}
+
+// addCountingRules adds rules updating named counters for target
+// added by addCounterRules with protos to chain.
+func (nft *NFTManager) addCountingRules(
+	conn *nftables.Conn, chain *nftables.Chain, target string, protos []byte,
+) {
+	for _, kind := range counterKinds {
+		if !slices.Contains(protos, kind.l4) {
+			continue
+		}
+
+		// meta nfproto ... meta l4proto ... counter name ...
+		conn.AddRule(&nftables.Rule{
+			Table: nft.table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Meta{ // meta load nfproto => reg 1
+					Key:      expr.MetaKeyNFPROTO,
+					Register: 1,
+				},
+				&expr.Cmp{ // cmp eq reg 1 ...
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte{kind.nf},
+				},
+				&expr.Meta{ // meta load l4proto => reg 1
+					Key:      expr.MetaKeyL4PROTO,
+					Register: 1,
+				},
+				&expr.Cmp{ // cmp eq reg 1 ...
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte{kind.l4},
+				},
+				&expr.Objref{ // objref type 1 name ...
+					Type: unix.NFT_OBJECT_COUNTER,
+					Name: target + "-" + kind.suffix,
+				},
+			},
+		})
 	}
+}
 
-	exprs = addDebugCounter(exprs)
+// removeCounters removes named counters for target
+// added by addCounterRules with protos.
+// It must be called after rules refer to them have been removed.
+func (nft *NFTManager) removeCounters(conn *nftables.Conn, target string, protos []byte) {
+	for _, kind := range counterKinds {
+		if !slices.Contains(protos, kind.l4) {
+			continue
+		}
 
-	conn.AddRule(&nftables.Rule{
-		Table: nft.table,
-		Chain: chain,
-		Exprs: exprs,
-	})
+		conn.DeleteObject(&nftables.CounterObj{
+			Table: nft.table,
+			Name:  target + "-" + kind.suffix,
+		})
+	}
+}
+
+// parseCounter converts a named counter to types.Counter.
+// It returns false if the counter is not created by addCounterRules.
+func parseCounter(obj *nftables.CounterObj) (ret types.Counter, ok bool) {
+	for _, kind := range counterKinds {
+		target, found := strings.CutSuffix(obj.Name, "-"+kind.suffix)
+		if !found {
+			continue
+		}
+
+		ret = types.Counter{
+			Target:  target,
+			Proto:   kind.proto,
+			Family:  kind.family,
+			Packets: obj.Packets,
+			Bytes:   obj.Bytes,
+		}
+		ok = true
+		return
+	}
 
 	return
 }
@@ -374,28 +527,30 @@ func (nft *NFTManager) initOutputNATChain(conn *nftables.Conn) (err error) {
 		Policy:   &nft.policy,
 	})
 
-	// meta mark vmap @
+	nft.fillOutputNATChain(conn, nft.outputNATChain)
+
+	return
+}
+
+// fillOutputNATChain adds rules should be evaluated
+// after cgroup rules to the output nat chain.
+func (nft *NFTManager) fillOutputNATChain(
+	conn *nftables.Conn, chain *nftables.Chain,
+) {
+	// goto mark-dns
 	exprs := []expr.Any{
-		&expr.Meta{
-			Key:      expr.MetaKeyMARK,
-			Register: 1,
-		},
-		&expr.Lookup{ // lookup reg 1 set mark-vmap dreg 0
-			SourceRegister: 1,
-			IsDestRegSet:   true,
-			SetName:        nft.markDNSMap.Name,
-			SetID:          nft.markDNSMap.ID,
+		&expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: nft.markDNSChain.Name,
 		},
 	}
 	exprs = addDebugCounter(exprs)
 
 	conn.AddRule(&nftables.Rule{
 		Table: nft.table,
-		Chain: nft.outputNATChain,
+		Chain: chain,
 		Exprs: exprs,
 	})
-
-	return
 }
 
 func (nft *NFTManager) initPreroutingChain(conn *nftables.Conn) (err error) {
@@ -409,6 +564,39 @@ func (nft *NFTManager) initPreroutingChain(conn *nftables.Conn) (err error) {
 		Policy:   &nft.policy,
 	})
 
+	nft.addBypassRules(
+		conn, nft.preroutingChain, nft.ipv4BypassSet, nft.ipv6BypassSet,
+	)
+
+	// meta mark vmap @mark-vmap
+	exprs := []expr.Any{
+		&expr.Meta{
+			Key:      expr.MetaKeyMARK,
+			Register: 1,
+		},
+		&expr.Lookup{ // lookup reg 1 set mark-vmap dreg 0
+			SourceRegister: 1,
+			IsDestRegSet:   true,
+			SetName:        nft.markTproxyMap.Name,
+			SetID:          nft.markTproxyMap.ID,
+		},
+	}
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: nft.preroutingChain,
+		Exprs: exprs,
+	})
+
+	return
+}
+
+// addBypassRules adds rules to chain
+// that return if destination of the packet is in ipv4Set or ipv6Set.
+func (nft *NFTManager) addBypassRules(
+	conn *nftables.Conn, chain *nftables.Chain, ipv4Set, ipv6Set *nftables.Set,
+) {
 	// ip daddr @bypass return
 	exprs := []expr.Any{
 		&expr.Meta{ // meta load nfproto => reg 1
@@ -429,8 +617,8 @@ func (nft *NFTManager) initPreroutingChain(conn *nftables.Conn) (err error) {
 		},
 		&expr.Lookup{ // lookup reg 1 set bypass
 			SourceRegister: 1,
-			SetID:          nft.ipv4BypassSet.ID,
-			SetName:        nft.ipv4BypassSet.Name,
+			SetID:          ipv4Set.ID,
+			SetName:        ipv4Set.Name,
 		},
 		&expr.Verdict{ // immediate reg 0 return
 			Kind: expr.VerdictReturn,
@@ -441,7 +629,7 @@ func (nft *NFTManager) initPreroutingChain(conn *nftables.Conn) (err error) {
 
 	conn.AddRule(&nftables.Rule{
 		Table: nft.table,
-		Chain: nft.preroutingChain,
+		Chain: chain,
 		Exprs: exprs,
 	})
 
@@ -456,17 +644,17 @@ func (nft *NFTManager) initPreroutingChain(conn *nftables.Conn) (err error) {
 			Register: 1,
 			Data:     []byte{0x0000000a},
 		},
-		&expr.Payload{ // payload load 4b @ network header + 16 => reg 1
+		&expr.Payload{ // payload load 16b @ network header + 24 => reg 1
 			OperationType: expr.PayloadLoad,
 			DestRegister:  1,
 			Base:          expr.PayloadBaseNetworkHeader,
 			Offset:        24,
 			Len:           16,
 		},
-		&expr.Lookup{ // lookup reg 1 set bypass
+		&expr.Lookup{ // lookup reg 1 set bypass6
 			SourceRegister: 1,
-			SetID:          nft.ipv6BypassSet.ID,
-			SetName:        nft.ipv6BypassSet.Name,
+			SetID:          ipv6Set.ID,
+			SetName:        ipv6Set.Name,
 		},
 		&expr.Verdict{ // immediate reg 0 return
 			Kind: expr.VerdictReturn,
@@ -477,46 +665,93 @@ func (nft *NFTManager) initPreroutingChain(conn *nftables.Conn) (err error) {
 
 	conn.AddRule(&nftables.Rule{
 		Table: nft.table,
-		Chain: nft.preroutingChain,
+		Chain: chain,
 		Exprs: exprs,
 	})
+}
 
-	// meta mark vmap @mark-vmap
-	exprs = []expr.Any{
-		&expr.Meta{
-			Key:      expr.MetaKeyMARK,
-			Register: 1,
-		},
-		&expr.Lookup{ // lookup reg 1 set mark-vmap dreg 0
-			SourceRegister: 1,
-			IsDestRegSet:   true,
-			SetName:        nft.markTproxyMap.Name,
-			SetID:          nft.markTproxyMap.ID,
-		},
-	}
-	exprs = addDebugCounter(exprs)
-
-	conn.AddRule(&nftables.Rule{
-		Table: nft.table,
-		Chain: nft.preroutingChain,
-		Exprs: exprs,
+func (nft *NFTManager) initPostroutingChain(conn *nftables.Conn) {
+	// type nat hook postrouting priority srcnat; policy accept;
+	nft.postroutingChain = conn.AddChain(&nftables.Chain{
+		Table:    nft.table,
+		Name:     "postrouting",
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+		Policy:   &nft.policy,
 	})
-
-	return
 }
 
-func (nft *NFTManager) nextIP(ip net.IP) (ret net.IP) {
-	next := make(net.IP, len(ip))
-	copy(next, ip)
+// refillPostroutingChain adds masquerade rules for routes need them.
+func (nft *NFTManager) refillPostroutingChain(
+	conn *nftables.Conn, routes map[string]*config.Route,
+) {
+	conn.FlushChain(nft.postroutingChain)
 
-	for i := range next {
-		i = len(next) - i - 1
-		old := next[i]
-		next[i] += 1
-		if next[i] >= old {
-			break
-		}
-	}
+	names := maps.Keys(routes)
+	slices.Sort(names)
+
+	for _, name := range names {
+		route := routes[name]
+		if !route.Masquerade {
+			continue
+		}
+
+		// meta mark ... oifname "..." masquerade
+		exprs := []expr.Any{
+			&expr.Meta{ // meta load mark => reg 1
+				Key:      expr.MetaKeyMARK,
+				Register: 1,
+			},
+			&expr.Cmp{ // cmp eq reg 1 ...
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data: binaryutil.NativeEndian.PutUint32(
+					uint32(route.Mark),
+				),
+			},
+			&expr.Meta{ // meta load oifname => reg 1
+				Key:      expr.MetaKeyOIFNAME,
+				Register: 1,
+			},
+			&expr.Cmp{ // cmp eq reg 1 ...
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     ifname(route.Interface),
+			},
+			&expr.Masq{},
+		}
+
+		exprs = addDebugCounter(exprs)
+
+		conn.AddRule(&nftables.Rule{
+			Table: nft.table,
+			Chain: nft.postroutingChain,
+			Exprs: exprs,
+		})
+	}
+}
+
+// ifname pads name of network interface to IFNAMSIZ bytes,
+// which is how kernel compares it.
+func ifname(name string) []byte {
+	ret := make([]byte, unix.IFNAMSIZ)
+	copy(ret, name)
+	return ret
+}
+
+func (nft *NFTManager) nextIP(ip net.IP) (ret net.IP) {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	for i := range next {
+		i = len(next) - i - 1
+		old := next[i]
+		next[i] += 1
+		if next[i] >= old {
+			break
+		}
+	}
 
 	nft.log.Debugf("Next IP of %s is %s", ip.String(), next.String())
 
@@ -538,8 +773,58 @@ func (nft *NFTManager) lastIP(ipnet *net.IPNet) (ret net.IP) {
 	return
 }
 
-func (t *NFTManager) addMarkChainForTProxy(
+// addBypassSetsForTProxy adds the interval sets
+// holding destinations which should not be sent to the tproxy.
+// These sets are created even if the tproxy has no bypass,
+// so chains of the tproxy always have the same structure.
+func (t *NFTManager) addBypassSetsForTProxy(
 	conn *nftables.Conn, tp *config.TProxy,
+) (
+	ipv4Set, ipv6Set *nftables.Set, err error,
+) {
+	defer Wrap(&err, "add bypass sets for tproxy %s", tp.Name)
+
+	var bypassIPv4, bypassIPv6 []string
+	bypassIPv4, bypassIPv6, err = splitBypass(tp.Bypass)
+	if err != nil {
+		return
+	}
+
+	ipv4Set = &nftables.Set{
+		Table:        t.table,
+		Name:         tp.Name + "-bypass",
+		KeyType:      nftables.TypeIPAddr,
+		KeyByteOrder: binaryutil.BigEndian,
+		Interval:     true,
+	}
+
+	err = conn.AddSet(ipv4Set, t.genIPV4BypassSetElements(bypassIPv4))
+	if err != nil {
+		return
+	}
+
+	ipv6Set = &nftables.Set{
+		Table:        t.table,
+		Name:         tp.Name + "-bypass6",
+		KeyType:      nftables.TypeIP6Addr,
+		KeyByteOrder: binaryutil.BigEndian,
+		Interval:     true,
+	}
+
+	err = conn.AddSet(ipv6Set, t.genIPV6BypassSetElements(bypassIPv6))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func tproxyCounterName(tp *config.TProxy) string {
+	return "tproxy-" + tp.Name
+}
+
+func (t *NFTManager) addMarkChainForTProxy(
+	conn *nftables.Conn, tp *config.TProxy, ipv4Set, ipv6Set *nftables.Set,
 ) (
 	ret *nftables.Chain, err error,
 ) {
@@ -550,6 +835,14 @@ func (t *NFTManager) addMarkChainForTProxy(
 
 	conn.AddChain(chain)
 
+	t.addBypassRules(conn, chain, ipv4Set, ipv6Set)
+
+	t.addCounterRules(conn, chain, tproxyCounterName(tp), counterProtos)
+
+	if tp.DNSHijack != nil && tp.DNSHijack.DropDoT {
+		t.addDropDoTRule(conn, chain)
+	}
+
 	// meta mark set ...
 
 	exprs := []expr.Any{
@@ -579,8 +872,50 @@ func (t *NFTManager) addMarkChainForTProxy(
 	return
 }
 
+// addDropDoTRule adds `tcp dport 853 drop` to chain,
+// so applications fall back from DNS over TLS
+// to plain DNS, which can be hijacked.
+func (t *NFTManager) addDropDoTRule(
+	conn *nftables.Conn, chain *nftables.Chain,
+) {
+	exprs := []expr.Any{
+		&expr.Meta{ // meta load l4proto => reg 1
+			Key:      expr.MetaKeyL4PROTO,
+			Register: 1,
+		},
+		&expr.Cmp{ // cmp eq reg 1 0x00000006
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{unix.IPPROTO_TCP},
+		},
+		&expr.Payload{ // payload load 2b @ transport header + 2 => reg 1
+			OperationType: expr.PayloadLoad,
+			DestRegister:  1,
+			Base:          expr.PayloadBaseTransportHeader,
+			Offset:        2,
+			Len:           2,
+		},
+		&expr.Cmp{ // cmp eq reg 1 0x00005503
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(853),
+		},
+		&expr.Verdict{ // drop
+			Kind: expr.VerdictDrop,
+		},
+	}
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: t.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
 func (t *NFTManager) addTproxyChainForTProxy(
-	conn *nftables.Conn, tp *config.TProxy,
+	conn *nftables.Conn, tp *config.TProxy, ipv4Set, ipv6Set *nftables.Set,
 ) (
 	ret *nftables.Chain, err error,
 ) {
@@ -591,6 +926,8 @@ func (t *NFTManager) addTproxyChainForTProxy(
 
 	conn.AddChain(chain)
 
+	t.addBypassRules(conn, chain, ipv4Set, ipv6Set)
+
 	tproxy := &expr.TProxy{ // tproxy port reg 1
 		Family:  byte(nftables.TableFamilyUnspecified),
 		RegPort: 1,
@@ -718,7 +1055,61 @@ func (t *NFTManager) addDNSChainForTproxy(
 		ret = chain
 	}()
 
-	exprs := []expr.Any{
+	t.addDNSHijackRules(conn, chain, tp.DNSHijack)
+
+	return
+}
+
+// addDNSHijackRules adds dnat rules to chain
+// sending dns request traffic to the dns server described in dns.
+func (t *NFTManager) addDNSHijackRules(
+	conn *nftables.Conn, chain *nftables.Chain, dns *config.DNSHijack,
+) {
+	protos := []byte{unix.IPPROTO_UDP}
+	if dns.TCP {
+		protos = append(protos, unix.IPPROTO_TCP)
+	}
+
+	type destination struct {
+		family byte
+		addr   net.IP
+	}
+
+	destinations := []destination{}
+	if dns.IP != nil {
+		destinations = append(destinations, destination{
+			unix.NFPROTO_IPV4, net.ParseIP(*dns.IP).To4(),
+		})
+	}
+	if dns.IP6 != nil {
+		destinations = append(destinations, destination{
+			unix.NFPROTO_IPV6, net.ParseIP(*dns.IP6).To16(),
+		})
+	}
+
+	// NOTE:
+	// In an inet table, nat expression only works on packets
+	// of the same family, so ipv4 and ipv6 rules can live together.
+
+	for _, dst := range destinations {
+		for _, proto := range protos {
+			conn.AddRule(&nftables.Rule{
+				Table: t.table,
+				Chain: chain,
+				Exprs: t.genDNSHijackExprs(
+					proto, dst.family, dst.addr, dns.Port,
+				),
+			})
+		}
+	}
+}
+
+// genDNSHijackExprs generates expressions like
+// `meta l4proto udp udp dport 53 dnat ip to 127.0.0.1:53`.
+func (t *NFTManager) genDNSHijackExprs(
+	proto byte, family byte, addr net.IP, port uint16,
+) []expr.Any {
+	return []expr.Any{
 		&expr.Meta{ // meta load l4proto => reg 1
 			Key:      expr.MetaKeyL4PROTO,
 			Register: 1,
@@ -726,7 +1117,7 @@ func (t *NFTManager) addDNSChainForTproxy(
 		&expr.Cmp{ // cmp eq reg 1 0x00000011
 			Op:       expr.CmpOpEq,
 			Register: 1,
-			Data:     []byte{unix.IPPROTO_UDP},
+			Data:     []byte{proto},
 		},
 		&expr.Payload{ // payload load 2b @ transport header + 2 => reg 1
 			OperationType: expr.PayloadLoad,
@@ -742,191 +1133,1223 @@ func (t *NFTManager) addDNSChainForTproxy(
 		},
 		&expr.Immediate{ // immediate reg 1 xxx
 			Register: 1,
-			Data:     net.ParseIP(*tp.DNSHijack.IP).To4(),
+			Data:     addr,
 		},
 		&expr.Immediate{ // immediate reg 2 xxx
 			Register: 2,
-			Data:     binaryutil.BigEndian.PutUint16(tp.DNSHijack.Port),
+			Data:     binaryutil.BigEndian.PutUint16(port),
 		},
 		&expr.NAT{ // nat dnat ip addr_min reg 1
 			Type:        expr.NATTypeDestNAT,
-			Family:      unix.NFPROTO_IPV4,
+			Family:      uint32(family),
 			RegAddrMin:  1,
 			RegProtoMin: 2,
 		},
 	}
-	rule := &nftables.Rule{
-		Table: t.table,
-		Chain: chain,
-		Exprs: exprs,
-	}
+}
 
-	conn.AddRule(rule)
+func (nft *NFTManager) addChainAndRulesForTProxy(
+	conn *nftables.Conn, tp *config.TProxy,
+) (
+	err error,
+) {
+	nft.log.Debugw("Generating chain and rules for tproxy.",
+		"tproxy", tp,
+	)
 
-	if !tp.DNSHijack.TCP {
+	var ipv4Set, ipv6Set *nftables.Set
+	ipv4Set, ipv6Set, err = nft.addBypassSetsForTProxy(conn, tp)
+	if err != nil {
 		return
 	}
 
-	exprs = []expr.Any{
-		&expr.Meta{ // meta load l4proto => reg 1
-			Key:      expr.MetaKeyL4PROTO,
-			Register: 1,
-		},
-		&expr.Cmp{ // cmp eq reg 1 0x00000006
-			Op:       expr.CmpOpEq,
-			Register: 1,
-			Data:     []byte{unix.IPPROTO_TCP},
-		},
-		&expr.Payload{ // payload load 2b @ transport header + 2 => reg 1
-			OperationType:  expr.PayloadLoad,
-			DestRegister:   1,
-			SourceRegister: 0,
-			Base:           expr.PayloadBaseTransportHeader,
-			Offset:         2,
-			Len:            2,
-		},
-		&expr.Cmp{ // cmp eq reg 1 0x00003500
-			Op:       expr.CmpOpEq,
-			Register: 1,
-			Data:     binaryutil.BigEndian.PutUint16(53),
-		},
-		&expr.Immediate{ // immediate reg 1 xxx
-			Register: 1,
-			Data:     net.ParseIP(*tp.DNSHijack.IP).To4(),
-		},
-		&expr.Immediate{ // immediate reg 2 xxx
-			Register: 2,
-			Data:     binaryutil.BigEndian.PutUint16(tp.DNSHijack.Port),
-		},
-		&expr.NAT{ // nat dnat ip addr_min reg 1
-			Type:        expr.NATTypeDestNAT,
-			Family:      unix.NFPROTO_IPV4,
-			RegAddrMin:  1,
-			RegProtoMin: 2,
-		},
-	}
-	rule = &nftables.Rule{
-		Table: t.table,
-		Chain: chain,
-		Exprs: exprs,
+	_, err = nft.addMarkChainForTProxy(conn, tp, ipv4Set, ipv6Set)
+	if err != nil {
+		return
 	}
 
-	conn.AddRule(rule)
+	var chain *nftables.Chain
 
-	return
-}
+	chain, err = nft.addTproxyChainForTProxy(conn, tp, ipv4Set, ipv6Set)
+	if err != nil {
+		return
+	}
 
-func (t *NFTManager) removeCgroupRootFromPath(path string) string {
-	path = filepath.Clean(path)
-	if strings.HasPrefix(path, string(t.cgroupRoot)) {
-		path = path[len(t.cgroupRoot):]
+	err = nft.updateMarkTproxyMap(conn, tp.Mark, chain.Name)
+	if err != nil {
+		return
 	}
 
-	if !strings.HasPrefix(path, "/") {
-		path = "/" + path
+	if tp.DNSHijack != nil {
+		chain, err = nft.addDNSChainForTproxy(conn, tp)
+		if err != nil {
+			return
+		}
+
+		err = nft.updateMarkDNSMap(conn, tp.Mark, chain.Name)
+		if err != nil {
+			return
+		}
 	}
 
-	return path
+	nft.log.Debug("Chain and rules generated for this tproxy.",
+		"tproxy", tp,
+	)
+
+	return
 }
 
-func (t *NFTManager) addCgroupRuleForLevel(
-	conn *nftables.Conn, level int,
+// updateChainAndRulesForTProxy refills chains of a tproxy in place,
+// so elements in cgroup map goto these chains need not to be touched.
+func (nft *NFTManager) updateChainAndRulesForTProxy(
+	conn *nftables.Conn, old, tp *config.TProxy,
 ) (
 	err error,
 ) {
-	defer Wrap(&err,
-		"update output chain for level %d cgroup", level)
+	nft.log.Debugw("Updating chain and rules for tproxy.",
+		"old", old,
+		"new", tp,
+	)
 
-	exprs := []expr.Any{
-		&expr.Socket{ // socket load cgroupv2 => reg 1
-			Key:      expr.SocketKeyCgroupv2,
-			Level:    uint32(level),
-			Register: 1,
-		},
-		&expr.Lookup{ // lookup reg 1 set cgroup-map dreg 0
-			SourceRegister: 1,
-			IsDestRegSet:   true,
-			SetName:        t.cgroupMap.Name,
-			SetID:          t.cgroupMap.ID,
-		},
+	err = nft.deleteMarkMapElement(conn, nft.markTproxyMap, old.Mark)
+	if err != nil {
+		return
 	}
 
-	exprs = addDebugCounter(exprs)
+	if old.DNSHijack != nil {
+		err = nft.deleteMarkMapElement(conn, nft.markDNSMap, old.Mark)
+		if err != nil {
+			return
+		}
 
-	rule := &nftables.Rule{
-		Table: t.table,
-		Chain: t.outputMangleChain,
-		Exprs: exprs,
+		dnsChain := &nftables.Chain{Table: nft.table, Name: old.Name + "-DNS"}
+		if tp.DNSHijack == nil {
+			conn.DelChain(dnsChain)
+		} else {
+			conn.FlushChain(dnsChain)
+		}
 	}
 
-	conn.AddRule(rule)
-	return
-}
+	conn.FlushChain(&nftables.Chain{Table: nft.table, Name: tp.Name + "-MARK"})
+	conn.FlushChain(&nftables.Chain{Table: nft.table, Name: tp.Name})
 
-func getNFTableRules() string {
-	out, err := exec.Command("nft", "list", "ruleset").Output()
+	conn.FlushSet(&nftables.Set{Table: nft.table, Name: tp.Name + "-bypass"})
+	conn.FlushSet(&nftables.Set{Table: nft.table, Name: tp.Name + "-bypass6"})
+
+	// NOTE:
+	// Adding an existing chain or set without NLM_F_EXCL is a no-op,
+	// so the functions used to create them can be reused here
+	// to fill the flushed chains and sets.
+	err = nft.addChainAndRulesForTProxy(conn, tp)
 	if err != nil {
-		panic(err)
+		return
 	}
 
-	return string(out)
+	return
 }
 
-func (nft *NFTManager) genSetElement(route *types.Route) (ret nftables.SetElement, err error) {
-	defer Wrap(&err, "generating set element for route %v", route)
-
-	nft.log.Debugw("Generating set element for new cgroup route.",
-		"Path", route.Path,
-		"Target", route.Target,
+func (nft *NFTManager) removeChainAndRulesForTProxy(
+	conn *nftables.Conn, tp *config.TProxy,
+) (
+	err error,
+) {
+	nft.log.Debugw("Removing chain and rules for tproxy.",
+		"tproxy", tp,
 	)
 
-	path := route.Path
-	target := route.Target
-
-	if _, ok := nft.cgroupMapElement[path]; ok {
-		err = os.ErrExist
+	err = nft.deleteMarkMapElement(conn, nft.markTproxyMap, tp.Mark)
+	if err != nil {
 		return
 	}
 
-	var fileInfo os.FileInfo
-	fileInfo, err = os.Stat(path)
-	if err != nil {
-		return
+	if tp.DNSHijack != nil {
+		err = nft.deleteMarkMapElement(conn, nft.markDNSMap, tp.Mark)
+		if err != nil {
+			return
+		}
+
+		conn.DelChain(&nftables.Chain{Table: nft.table, Name: tp.Name + "-DNS"})
 	}
 
-	inode := fileInfo.Sys().(*syscall.Stat_t).Ino
+	conn.DelChain(&nftables.Chain{Table: nft.table, Name: tp.Name})
+	conn.DelChain(&nftables.Chain{Table: nft.table, Name: tp.Name + "-MARK"})
+	nft.removeCounters(conn, tproxyCounterName(tp), counterProtos)
 
-	route.Path = nft.removeCgroupRootFromPath(path)
-	path = route.Path
+	conn.DelSet(&nftables.Set{Table: nft.table, Name: tp.Name + "-bypass"})
+	conn.DelSet(&nftables.Set{Table: nft.table, Name: tp.Name + "-bypass6"})
 
-	nft.log.Debugw("Get inode of cgroup file using stat(2).",
-		"path", path,
-		"inode", inode,
-	)
+	return
+}
+
+func redirectCounterName(redirect *config.Redirect) string {
+	return "redirect-" + redirect.Name
+}
+
+// redirectCountChainName returns name of the chain
+// counting traffic to be redirected by the redirect chain.
+func redirectCountChainName(chain string) string {
+	return chain + "-COUNT"
+}
+
+func (nft *NFTManager) addChainAndRulesForRedirect(
+	conn *nftables.Conn, redirect *config.Redirect,
+) (
+	err error,
+) {
+	nft.log.Debugw("Generating chain and rules for redirect.",
+		"redirect", redirect,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  redirect.Name + "-REDIRECT",
+	}
+
+	conn.AddChain(chain)
+
+	nft.addBypassRules(conn, chain, nft.ipv4BypassSet, nft.ipv6BypassSet)
+
+	exprs := []expr.Any{}
+
+	if redirect.NoIPv6 {
+		exprs = append(exprs,
+			&expr.Meta{ // meta load nfproto => reg 1
+				Key:      expr.MetaKeyNFPROTO,
+				Register: 1,
+			},
+			&expr.Cmp{ // cmp eq reg 1 0x00000002
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{unix.NFPROTO_IPV4},
+			},
+		)
+	}
+
+	exprs = append(exprs,
+		&expr.Meta{ // meta load l4proto => reg 1
+			Key:      expr.MetaKeyL4PROTO,
+			Register: 1,
+		},
+		&expr.Cmp{ // cmp eq reg 1 0x00000006
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{unix.IPPROTO_TCP},
+		},
+		&expr.Immediate{ // immediate reg 1 ...
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(redirect.Port),
+		},
+		&expr.Redir{ // redir proto_min reg 1
+			RegisterProtoMin: 1,
+		},
+	)
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		// meta l4proto tcp redirect to :port
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+
+	// NOTE:
+	// Rules in the chain above only see the first packet of connections,
+	// traffic to be redirected is counted in output-mangle chain instead.
+	countChain := &nftables.Chain{
+		Table: nft.table,
+		Name:  redirectCountChainName(redirect.Name + "-REDIRECT"),
+	}
+
+	conn.AddChain(countChain)
+
+	nft.addCounterRules(conn, countChain, redirectCounterName(redirect), redirectCounterProtos)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: countChain,
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}},
+	})
+
+	nft.log.Debugw("Chain and rules generated for this redirect.",
+		"redirect", redirect,
+	)
+
+	return
+}
+
+// updateChainAndRulesForRedirect refills the chain of a redirect in place,
+// the same as updateChainAndRulesForTProxy.
+func (nft *NFTManager) updateChainAndRulesForRedirect(
+	conn *nftables.Conn, redirect *config.Redirect,
+) (
+	err error,
+) {
+	conn.FlushChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  redirect.Name + "-REDIRECT",
+	})
+	conn.FlushChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  redirectCountChainName(redirect.Name + "-REDIRECT"),
+	})
+
+	err = nft.addChainAndRulesForRedirect(conn, redirect)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (nft *NFTManager) removeChainAndRulesForRedirect(
+	conn *nftables.Conn, redirect *config.Redirect,
+) {
+	nft.log.Debugw("Removing chain and rules for redirect.",
+		"redirect", redirect,
+	)
+
+	conn.DelChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  redirect.Name + "-REDIRECT",
+	})
+	conn.DelChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  redirectCountChainName(redirect.Name + "-REDIRECT"),
+	})
+	nft.removeCounters(conn, redirectCounterName(redirect), redirectCounterProtos)
+}
+
+func routeCounterName(route *config.Route) string {
+	return "route-" + route.Name
+}
+
+func (nft *NFTManager) addChainAndRulesForRoute(
+	conn *nftables.Conn, route *config.Route,
+) {
+	nft.log.Debugw("Generating chain and rules for route.",
+		"route", route,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  route.Name + "-ROUTE",
+	}
+
+	conn.AddChain(chain)
+
+	nft.addCounterRules(conn, chain, routeCounterName(route), counterProtos)
+
+	// meta mark set ...
+	exprs := []expr.Any{
+		&expr.Immediate{ // immediate reg 1 ...
+			Register: 1,
+			Data: binaryutil.NativeEndian.PutUint32(
+				uint32(route.Mark),
+			),
+		},
+		&expr.Meta{
+			Key:            expr.MetaKeyMARK,
+			SourceRegister: true,
+			Register:       1,
+		},
+	}
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
+// updateChainAndRulesForRoute refills the chain of a route in place,
+// the same as updateChainAndRulesForTProxy.
+func (nft *NFTManager) updateChainAndRulesForRoute(
+	conn *nftables.Conn, route *config.Route,
+) {
+	conn.FlushChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  route.Name + "-ROUTE",
+	})
+
+	nft.addChainAndRulesForRoute(conn, route)
+}
+
+func (nft *NFTManager) removeChainAndRulesForRoute(
+	conn *nftables.Conn, route *config.Route,
+) {
+	nft.log.Debugw("Removing chain and rules for route.",
+		"route", route,
+	)
+
+	conn.DelChain(&nftables.Chain{
+		Table: nft.table,
+		Name:  route.Name + "-ROUTE",
+	})
+	nft.removeCounters(conn, routeCounterName(route), counterProtos)
+}
+
+func markChainName(target types.Target) string {
+	if target.MarkMask == 0 {
+		return fmt.Sprintf("MARK-%#x", target.Mark)
+	}
+
+	return fmt.Sprintf("MARK-%#x-%#x", target.Mark, target.MarkMask)
+}
+
+// addChainsForTargets adds chains for targets of routes,
+// e.g. chains setting fire wall mark for mark targets,
+// which are not in targetChains.
+// It returns all the chains targets of routes need,
+// mapped to names of counters in them, or "" if there is no counter.
+func (nft *NFTManager) addChainsForTargets(
+	conn *nftables.Conn, routes []types.Route, targetChains map[string]string,
+) (
+	ret map[string]string,
+) {
+	ret = map[string]string{}
+
+	add := func(name, counter string, addChain func()) {
+		if _, ok := ret[name]; ok {
+			return
+		}
+
+		ret[name] = counter
+
+		if _, ok := targetChains[name]; ok {
+			return
+		}
+
+		addChain()
+	}
+
+	for i := range routes {
+		target := routes[i].Target
+
+		switch target.Op {
+		case types.TargetMark:
+			name := markChainName(target)
+			add(name, strings.ToLower(name), func() {
+				nft.addChainForMark(conn, name, target)
+			})
+		case types.TargetReject:
+			name := rejectChainName(target)
+			add(name, strings.ToLower(name), func() {
+				nft.addChainForReject(conn, name, target)
+			})
+		}
+
+		if target.Log != nil {
+			name := nft.logChainName(target)
+			add(name, "", func() { nft.addChainForLog(conn, name, target) })
+		}
+
+		if target.DNS != nil && target.Op != types.TargetRedirect {
+			name := dnsChainName(target.DNS)
+			add(name, "", func() { nft.addChainForDNS(conn, name, target.DNS) })
+		}
+
+		// NOTE:
+		// Chains of a rule share its counters,
+		// e.g. after the target of the rule has been changed by Reload,
+		// so the counters are only added with the first one of them.
+		if target.Rule != "" {
+			name := nft.ruleChainName(target)
+			exist := hasCounter(targetChains, target.Rule) ||
+				hasCounter(ret, target.Rule)
+			add(name, target.Rule, func() {
+				nft.addChainForRule(conn, name, target, exist)
+			})
+		}
+	}
+
+	return
+}
+
+// hasCounter tells whether any chain in targetChains has counter.
+func hasCounter(targetChains map[string]string, counter string) bool {
+	for _, name := range targetChains {
+		if name == counter {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ruleChainName returns name of the chain
+// counting traffic of the rule target comes from
+// and then handling it as target.
+func (nft *NFTManager) ruleChainName(target types.Target) string {
+	rule := target.Rule
+	target.Rule = ""
+
+	return strings.ToUpper(rule) + "-" + nft.genVerdict(target).Chain
+}
+
+func isRuleChain(name string) bool {
+	return strings.HasPrefix(name, "RULE-")
+}
+
+func (nft *NFTManager) addChainForRule(
+	conn *nftables.Conn, name string, target types.Target, counterExist bool,
+) {
+	nft.log.Debugw("Generating chain for rule.",
+		"chain", name,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  name,
+	}
+
+	conn.AddChain(chain)
+
+	if counterExist {
+		nft.addCountingRules(conn, chain, target.Rule, counterProtos)
+	} else {
+		nft.addCounterRules(conn, chain, target.Rule, counterProtos)
+	}
+
+	target.Rule = ""
+
+	exprs := []expr.Any{nft.genVerdict(target)}
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
+func (nft *NFTManager) addChainForMark(
+	conn *nftables.Conn, name string, target types.Target,
+) {
+	nft.log.Debugw("Generating chain for mark.",
+		"chain", name,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  name,
+	}
+
+	conn.AddChain(chain)
+
+	nft.addCounterRules(conn, chain, strings.ToLower(name), counterProtos)
+
+	// meta mark set ...
+	exprs := []expr.Any{
+		&expr.Immediate{ // immediate reg 1 ...
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(target.Mark),
+		},
+	}
+
+	if target.MarkMask != 0 {
+		// meta mark set meta mark & ~mask | value & mask
+		exprs = []expr.Any{
+			&expr.Meta{ // meta load mark => reg 1
+				Key:      expr.MetaKeyMARK,
+				Register: 1,
+			},
+			&expr.Bitwise{ // bitwise reg 1 = (reg 1 & ~mask) ^ value
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask: binaryutil.NativeEndian.PutUint32(
+					^target.MarkMask,
+				),
+				Xor: binaryutil.NativeEndian.PutUint32(
+					target.Mark & target.MarkMask,
+				),
+			},
+		}
+	}
+
+	exprs = append(exprs,
+		&expr.Meta{
+			Key:            expr.MetaKeyMARK,
+			SourceRegister: true,
+			Register:       1,
+		},
+	)
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
+// logChainName returns name of the chain
+// logging packets and then handling them as target.
+// Targets share the chain if they log packets
+// in the same way and have the same verdict.
+func (nft *NFTManager) logChainName(target types.Target) string {
+	log := target.Log
+	target.Log = nil
+	target.Rule = ""
+	verdict := nft.genVerdict(target)
+
+	group := -1
+	if log.Group != nil {
+		group = int(*log.Group)
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d %s %q %d %d",
+		verdict.Kind, verdict.Chain, log.Prefix, group, log.Rate)
+
+	return fmt.Sprintf("LOG-%08x", h.Sum32())
+}
+
+func isLogChain(name string) bool {
+	return strings.HasPrefix(name, "LOG-")
+}
+
+func (nft *NFTManager) addChainForLog(
+	conn *nftables.Conn, name string, target types.Target,
+) {
+	nft.log.Debugw("Generating chain for log.",
+		"chain", name,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  name,
+	}
+
+	conn.AddChain(chain)
+
+	log := target.Log
+
+	// ct state new [limit rate ...] log [prefix ...] [group ...]
+	exprs := []expr.Any{
+		&expr.Ct{ // ct load state => reg 1
+			Register: 1,
+			Key:      expr.CtKeySTATE,
+		},
+		&expr.Bitwise{ // bitwise reg 1 = (reg 1 & 0x00000008) ^ 0x00000000
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask: binaryutil.NativeEndian.PutUint32(
+				expr.CtStateBitNEW,
+			),
+			Xor: binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{ // cmp neq reg 1 0x00000000
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint32(0),
+		},
+	}
+
+	if log.Rate != 0 {
+		exprs = append(exprs, &expr.Limit{ // limit rate ...
+			Type: expr.LimitTypePkts,
+			Rate: log.Rate,
+			Unit: expr.LimitTimeMinute,
+		})
+	}
+
+	logExpr := &expr.Log{}
+	if log.Prefix != "" {
+		logExpr.Key |= 1 << unix.NFTA_LOG_PREFIX
+		logExpr.Data = []byte(log.Prefix)
+	}
+	if log.Group != nil {
+		logExpr.Key |= 1 << unix.NFTA_LOG_GROUP
+		logExpr.Group = *log.Group
+	}
+
+	exprs = append(exprs, logExpr)
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+
+	target.Log = nil
+	target.Rule = ""
+
+	exprs = []expr.Any{nft.genVerdict(target)}
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
+func rejectChainName(target types.Target) string {
+	return "REJECT-" + target.RejectWith
+}
+
+var rejectICMPXCodes = map[string]uint8{
+	config.RejectWithAdminProhibited: unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED,
+	config.RejectWithPortUnreachable: unix.NFT_REJECT_ICMPX_PORT_UNREACH,
+	config.RejectWithHostUnreachable: unix.NFT_REJECT_ICMPX_HOST_UNREACH,
+	config.RejectWithNoRoute:         unix.NFT_REJECT_ICMPX_NO_ROUTE,
+}
+
+func (nft *NFTManager) addChainForReject(
+	conn *nftables.Conn, name string, target types.Target,
+) {
+	nft.log.Debugw("Generating chain for reject.",
+		"chain", name,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  name,
+	}
+
+	conn.AddChain(chain)
+
+	nft.addCounterRules(conn, chain, strings.ToLower(name), counterProtos)
+
+	// meta l4proto tcp reject with tcp reset
+	exprs := []expr.Any{
+		&expr.Meta{ // meta load l4proto => reg 1
+			Key:      expr.MetaKeyL4PROTO,
+			Register: 1,
+		},
+		&expr.Cmp{ // cmp eq reg 1 0x00000006
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{unix.IPPROTO_TCP},
+		},
+		&expr.Reject{ // reject type 1
+			Type: unix.NFT_REJECT_TCP_RST,
+		},
+	}
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+
+	// reject with icmpx ...
+	exprs = []expr.Any{
+		&expr.Reject{ // reject type 2 code ...
+			Type: unix.NFT_REJECT_ICMPX_UNREACH,
+			Code: rejectICMPXCodes[target.RejectWith],
+		},
+	}
+
+	exprs = addDebugCounter(exprs)
+
+	conn.AddRule(&nftables.Rule{
+		Table: nft.table,
+		Chain: chain,
+		Exprs: exprs,
+	})
+}
+
+func dnsChainName(dns *config.DNSHijack) string {
+	name := "DNS"
+	if dns.IP != nil {
+		name += "-" + *dns.IP
+	}
+	name += fmt.Sprintf("-%d", dns.Port)
+	if dns.IP6 != nil {
+		name += "-" + strings.ReplaceAll(*dns.IP6, ":", "_")
+	}
+	if dns.TCP {
+		name += "-tcp"
+	}
+	if dns.DropDoT {
+		name += "-drop-dot"
+	}
+
+	return name
+}
+
+func (nft *NFTManager) addChainForDNS(
+	conn *nftables.Conn, name string, dns *config.DNSHijack,
+) {
+	nft.log.Debugw("Generating chain for dns.",
+		"chain", name,
+	)
+
+	chain := &nftables.Chain{
+		Table: nft.table,
+		Name:  name,
+	}
+
+	conn.AddChain(chain)
+
+	if dns.DropDoT {
+		nft.addDropDoTRule(conn, chain)
+	}
+
+	nft.addDNSHijackRules(conn, chain, dns)
+}
+
+func (nft *NFTManager) deleteMarkMapElement(
+	conn *nftables.Conn, set *nftables.Set, mark config.FireWallMark,
+) (
+	err error,
+) {
+	err = conn.SetDeleteElements(set, []nftables.SetElement{{
+		Key: binaryutil.NativeEndian.PutUint32(uint32(mark)),
+	}})
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (t *NFTManager) removeCgroupRootFromPath(path string) string {
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, string(t.cgroupRoot)) {
+		path = path[len(t.cgroupRoot):]
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
+
+func (t *NFTManager) addCgroupRuleForLevel(
+	conn *nftables.Conn, chain *nftables.Chain, set *nftables.Set, level int,
+) (
+	err error,
+) {
+	defer Wrap(&err,
+		"update %s chain for level %d cgroup", chain.Name, level)
+
+	exprs := []expr.Any{
+		&expr.Socket{ // socket load cgroupv2 => reg 1
+			Key:      expr.SocketKeyCgroupv2,
+			Level:    uint32(level),
+			Register: 1,
+		},
+		&expr.Lookup{ // lookup reg 1 set cgroup-vmap dreg 0
+			SourceRegister: 1,
+			IsDestRegSet:   true,
+			SetName:        set.Name,
+			SetID:          set.ID,
+		},
+	}
+
+	exprs = addDebugCounter(exprs)
+
+	rule := &nftables.Rule{
+		Table: t.table,
+		Chain: chain,
+		Exprs: exprs,
+	}
+
+	conn.AddRule(rule)
+	return
+}
+
+// cgroupLevels returns levels of cgroups in the map in ascending order.
+func (nft *NFTManager) cgroupLevels(
+	cgroupMapElement map[string]nftables.SetElement,
+) []int {
+	tmp := map[int]struct{}{}
+
+	for path := range cgroupMapElement {
+		level := strings.Count(path, "/")
+		tmp[level] = struct{}{}
+	}
+
+	levels := make([]int, 0, len(tmp))
+	for level := range tmp {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+
+	nft.log.Debugw("Existing levels.",
+		"levels", levels,
+	)
+
+	return levels
+}
+
+func (nft *NFTManager) refillOutputMangleChain(
+	conn *nftables.Conn, cgroupMapElement map[string]nftables.SetElement,
+) (
+	err error,
+) {
+	levels := nft.cgroupLevels(cgroupMapElement)
+
+	conn.FlushChain(nft.outputMangleChain)
+
+	err = nft.fillOutputMangleChain(conn, nft.outputMangleChain)
+	if err != nil {
+		return
+	}
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		err = nft.addCgroupRuleForLevel(
+			conn, nft.outputMangleChain, nft.cgroupMap, levels[i],
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (nft *NFTManager) refillOutputNATChain(
+	conn *nftables.Conn, cgroupNATMapElement map[string]nftables.SetElement,
+) (
+	err error,
+) {
+	levels := nft.cgroupLevels(cgroupNATMapElement)
+
+	conn.FlushChain(nft.outputNATChain)
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		err = nft.addCgroupRuleForLevel(
+			conn, nft.outputNATChain, nft.cgroupNATMap, levels[i],
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	nft.fillOutputNATChain(conn, nft.outputNATChain)
+
+	return
+}
+
+// observeApply records an attempt to apply changes to nftable
+// started at start, and the number of cgroups in cgroup map if succeeded.
+func (nft *NFTManager) observeApply(op string, start time.Time, err *error) {
+	nft.metrics.ObserveApply(op, time.Since(start), *err)
+
+	if *err != nil {
+		return
+	}
+
+	nft.metrics.SetCGroups(len(nft.cgroupMapElement))
+}
+
+func getNFTableRules() string {
+	out, err := exec.Command("nft", "list", "ruleset").Output()
+	if err != nil {
+		panic(err)
+	}
+
+	return string(out)
+}
+
+func (nft *NFTManager) genSetElement(route *types.Route) (ret nftables.SetElement, err error) {
+	defer Wrap(&err, "generating set element for route %v", route)
+
+	nft.log.Debugw("Generating set element for new cgroup route.",
+		"Path", route.Path,
+		"Target", route.Target,
+	)
+
+	path := route.Path
+	target := route.Target
+
+	if _, ok := nft.cgroupMapElement[path]; ok {
+		err = os.ErrExist
+		return
+	}
+
+	var fileInfo os.FileInfo
+	fileInfo, err = os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	inode := fileInfo.Sys().(*syscall.Stat_t).Ino
+
+	route.Path = nft.removeCgroupRootFromPath(path)
+	path = route.Path
+
+	nft.log.Debugw("Get inode of cgroup file using stat(2).",
+		"path", path,
+		"inode", inode,
+	)
 
 	setElement := nftables.SetElement{
 		Key:         binaryutil.NativeEndian.PutUint64(inode),
 		VerdictData: nil,
 	}
 
+	setElement.VerdictData = nft.genVerdict(target)
+
+	ret = setElement
+	return
+}
+
+func (nft *NFTManager) genVerdict(target types.Target) (ret *expr.Verdict) {
+	if target.Rule != "" {
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: nft.ruleChainName(target),
+		}
+		return
+	}
+
+	if target.Log != nil {
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: nft.logChainName(target),
+		}
+		return
+	}
+
 	switch target.Op {
 	case types.TargetDirect:
-		setElement.VerdictData = &expr.Verdict{
-			Kind: expr.VerdictReturn,
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: directChainName,
 		}
 
-	case types.TargetTProxy:
-		setElement.VerdictData = &expr.Verdict{
+	case types.TargetTProxy, types.TargetRoute:
+		ret = &expr.Verdict{
 			Kind:  expr.VerdictGoto,
 			Chain: target.Chain,
 		}
 
+	case types.TargetMark:
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: markChainName(target),
+		}
+
+	case types.TargetReject:
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: rejectChainName(target),
+		}
+
 	case types.TargetDrop:
-		setElement.VerdictData = &expr.Verdict{
-			Kind: expr.VerdictDrop,
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: dropChainName,
+		}
+
+	case types.TargetRedirect:
+		// NOTE:
+		// Traffic to be redirected is handled in output-nat chain,
+		// it must not be touched by any rule of its parent cgroups here,
+		// so the chain this goto only counts it and then returns.
+		ret = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: redirectCountChainName(target.Chain),
 		}
 	}
 
-	ret = setElement
+	return
+}
+
+// genNATSetElement generates the element in cgroup nat map
+// for the cgroup which element in cgroup map is element.
+func (nft *NFTManager) genNATSetElement(
+	element nftables.SetElement, target types.Target,
+) (
+	ret nftables.SetElement,
+) {
+	ret = nftables.SetElement{
+		Key: element.Key,
+		VerdictData: &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: nft.markDNSChain.Name,
+		},
+	}
+
+	if target.Op == types.TargetRedirect {
+		ret.VerdictData = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: target.Chain,
+		}
+	} else if target.DNS != nil {
+		ret.VerdictData = &expr.Verdict{
+			Kind:  expr.VerdictGoto,
+			Chain: dnsChainName(target.DNS),
+		}
+	}
+
+	return
+}
+
+// diffSetElements returns elements need to be deleted from and added to
+// a verdict map to change its content from old to new.
+func diffSetElements(
+	old, new map[string]nftables.SetElement,
+) (
+	deleted, added []nftables.SetElement,
+) {
+	deleted = []nftables.SetElement{}
+	added = []nftables.SetElement{}
+
+	for path, element := range old {
+		newElement, ok := new[path]
+		if ok && sameVerdict(element.VerdictData, newElement.VerdictData) {
+			continue
+		}
+
+		deleted = append(deleted, element)
+	}
+
+	for path, element := range new {
+		oldElement, ok := old[path]
+		if ok && sameVerdict(oldElement.VerdictData, element.VerdictData) {
+			continue
+		}
+
+		added = append(added, element)
+	}
+
+	return
+}
+
+// updateCgroupMaps queues messages changing content of cgroup map
+// and cgroup nat map to the given elements,
+// elements not changed are left untouched,
+// so cgroups whose targets are not changed never lose their elements.
+func (nft *NFTManager) updateCgroupMaps(
+	conn *nftables.Conn,
+	cgroupMapElement, cgroupNATMapElement map[string]nftables.SetElement,
+) (
+	err error,
+) {
+	deleted, added := diffSetElements(nft.cgroupMapElement, cgroupMapElement)
+
+	nft.log.Debugw("Cgroup map elements to update.",
+		"deleted", len(deleted),
+		"added", len(added),
+	)
+
+	err = conn.SetDeleteElements(nft.cgroupMap, deleted)
+	if err != nil {
+		return
+	}
+
+	err = conn.SetAddElements(nft.cgroupMap, added)
+	if err != nil {
+		return
+	}
+
+	deleted, added = diffSetElements(nft.cgroupNATMapElement, cgroupNATMapElement)
+
+	nft.log.Debugw("Cgroup nat map elements to update.",
+		"deleted", len(deleted),
+		"added", len(added),
+	)
+
+	err = conn.SetDeleteElements(nft.cgroupNATMap, deleted)
+	if err != nil {
+		return
+	}
+
+	err = conn.SetAddElements(nft.cgroupNATMap, added)
+	if err != nil {
+		return
+	}
+
+	err = nft.refillOutputMangleChain(conn, cgroupMapElement)
+	if err != nil {
+		return
+	}
+
+	err = nft.refillOutputNATChain(conn, cgroupNATMapElement)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func sameVerdict(a, b *expr.Verdict) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Kind == b.Kind && a.Chain == b.Chain
+}
+
+// genCgroupMapElements generates the whole content
+// of cgroup map and cgroup nat map for routes.
+// Elements of cgroups already in the map reuse their keys,
+// cgroups which have been removed are skipped.
+func (nft *NFTManager) genCgroupMapElements(
+	routes []types.Route,
+) (
+	ret, retNAT map[string]nftables.SetElement, err error,
+) {
+	elements := make(map[string]nftables.SetElement, len(routes))
+	natElements := make(map[string]nftables.SetElement, len(routes))
+
+	for i := range routes {
+		route := routes[i]
+		path := nft.removeCgroupRootFromPath(route.Path)
+
+		element, ok := nft.cgroupMapElement[path]
+		if ok {
+			element = nftables.SetElement{
+				Key:         element.Key,
+				VerdictData: nft.genVerdict(route.Target),
+			}
+		} else {
+			element, err = nft.genSetElement(&route)
+			if errors.Is(err, os.ErrNotExist) {
+				nft.log.Debugw("Cgroup had been removed, skip it.",
+					"cgroup", path,
+				)
+				err = nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		elements[path] = element
+		natElements[path] = nft.genNATSetElement(element, route.Target)
+	}
+
+	ret = elements
+	retNAT = natElements
+	return
+}
+
+// kernelKeys returns keys of elements of set in kernel,
+// which are inode numbers of cgroups.
+func kernelKeys(conn *nftables.Conn, set *nftables.Set) (ret map[uint64]struct{}, err error) {
+	defer Wrap(&err, "list elements of set %s in kernel", set.Name)
+
+	var elements []nftables.SetElement
+	elements, err = conn.GetSetElements(set)
+	if err != nil {
+		return
+	}
+
+	keys := make(map[uint64]struct{}, len(elements))
+	for i := range elements {
+		keys[binaryutil.NativeEndian.Uint64(elements[i].Key)] = struct{}{}
+	}
+
+	ret = keys
 	return
 }
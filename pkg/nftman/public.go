@@ -5,15 +5,21 @@
 package nftman
 
 import (
+	"bytes"
 	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
-	"strings"
+	"syscall"
+	"time"
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 )
 
 func (nft *NFTManager) AddRoutes(routes []types.Route) (err error) {
@@ -22,6 +28,7 @@ func (nft *NFTManager) AddRoutes(routes []types.Route) (err error) {
 	}
 
 	defer Wrap(&err, "add %d routes to nftable", len(routes))
+	defer nft.observeApply(metrics.OpAddRoutes, time.Now(), &err)
 
 	var conn *nftables.Conn
 	conn, err = nft.connector.Connect()
@@ -29,12 +36,18 @@ func (nft *NFTManager) AddRoutes(routes []types.Route) (err error) {
 		return
 	}
 	elements := []nftables.SetElement{}
+	natElements := []nftables.SetElement{}
 
 	tmpCGroupMapElement := make(map[string]nftables.SetElement, len(nft.cgroupMapElement))
 	for k, v := range nft.cgroupMapElement {
 		tmpCGroupMapElement[k] = v
 	}
 
+	tmpCGroupNATMapElement := make(map[string]nftables.SetElement, len(nft.cgroupNATMapElement))
+	for k, v := range nft.cgroupNATMapElement {
+		tmpCGroupNATMapElement[k] = v
+	}
+
 	nft.log.Debugw("old cgroup map elements", "value", tmpCGroupMapElement)
 
 	for i := range routes {
@@ -43,46 +56,39 @@ func (nft *NFTManager) AddRoutes(routes []types.Route) (err error) {
 		if err != nil {
 			return
 		}
+		natElement := nft.genNATSetElement(element, routes[i].Target)
+
 		elements = append(elements, element)
+		natElements = append(natElements, natElement)
 		tmpCGroupMapElement[routes[i].Path] = element
+		tmpCGroupNATMapElement[routes[i].Path] = natElement
 	}
 
 	nft.log.Debugw("new cgroup map elements", "value", tmpCGroupMapElement)
 
+	targetChains := nft.addChainsForTargets(conn, routes, nft.targetChains)
+	for name, counter := range nft.targetChains {
+		targetChains[name] = counter
+	}
+
 	err = conn.SetAddElements(nft.cgroupMap, elements)
 	if err != nil {
 		return
 	}
 
-	tmp := map[int]struct{}{}
-
-	for path := range tmpCGroupMapElement {
-		level := strings.Count(path, "/")
-		tmp[level] = struct{}{}
-	}
-
-	levels := make([]int, 0, len(tmp))
-	for level := range tmp {
-		levels = append(levels, level)
+	err = conn.SetAddElements(nft.cgroupNATMap, natElements)
+	if err != nil {
+		return
 	}
-	sort.Ints(levels)
-
-	nft.log.Debugw("Existing levels.",
-		"levels", levels,
-	)
-
-	conn.FlushChain(nft.outputMangleChain)
 
-	err = nft.fillOutputMangleChain(conn, nft.outputMangleChain)
+	err = nft.refillOutputMangleChain(conn, tmpCGroupMapElement)
 	if err != nil {
 		return
 	}
 
-	for i := len(levels) - 1; i >= 0; i-- {
-		err = nft.addCgroupRuleForLevel(conn, levels[i])
-		if err != nil {
-			return
-		}
+	err = nft.refillOutputNATChain(conn, tmpCGroupNATMapElement)
+	if err != nil {
+		return
 	}
 
 	err = conn.Flush()
@@ -91,6 +97,8 @@ func (nft *NFTManager) AddRoutes(routes []types.Route) (err error) {
 	}
 
 	nft.cgroupMapElement = tmpCGroupMapElement
+	nft.cgroupNATMapElement = tmpCGroupNATMapElement
+	nft.targetChains = targetChains
 
 	nft.log.Infow("New cgroup routes added to nft.",
 		"size", len(routes),
@@ -107,6 +115,7 @@ func (nft *NFTManager) RemoveRoutes(paths []string) (err error) {
 		"remove %d cgroup(s) from nftable",
 		len(paths),
 	)
+	defer nft.observeApply(metrics.OpRemoveRoutes, time.Now(), &err)
 
 	var conn *nftables.Conn
 	conn, err = nft.connector.Connect()
@@ -114,6 +123,7 @@ func (nft *NFTManager) RemoveRoutes(paths []string) (err error) {
 		return
 	}
 	elements := []nftables.SetElement{}
+	natElements := []nftables.SetElement{}
 
 	for i := range paths {
 		path := nft.removeCgroupRootFromPath(paths[i])
@@ -130,7 +140,7 @@ func (nft *NFTManager) RemoveRoutes(paths []string) (err error) {
 		}
 
 		elements = append(elements, nft.cgroupMapElement[path])
-
+		natElements = append(natElements, nft.cgroupNATMapElement[path])
 	}
 
 	err = conn.SetDeleteElements(nft.cgroupMap, elements)
@@ -138,13 +148,20 @@ func (nft *NFTManager) RemoveRoutes(paths []string) (err error) {
 		return
 	}
 
+	err = conn.SetDeleteElements(nft.cgroupNATMap, natElements)
+	if err != nil {
+		return
+	}
+
 	err = conn.Flush()
 	if err != nil {
 		return
 	}
 
 	for i := range paths {
-		delete(nft.cgroupMapElement, paths[i])
+		path := nft.removeCgroupRootFromPath(paths[i])
+		delete(nft.cgroupMapElement, path)
+		delete(nft.cgroupNATMapElement, path)
 	}
 
 	nft.dumpNFTableRules()
@@ -170,42 +187,358 @@ func (nft *NFTManager) AddChainAndRulesForTProxies(tps []*config.TProxy) (err er
 	}
 
 	for _, tp := range tps {
-		nft.log.Debugw("Generating chain and rules for tproxy.",
-			"tproxy", tp,
-		)
+		err = nft.addChainAndRulesForTProxy(conn, tp)
+		if err != nil {
+			return
+		}
+	}
 
-		_, err = nft.addMarkChainForTProxy(conn, tp)
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	for _, tp := range tps {
+		nft.tproxies[tp.Name] = tp
+	}
+
+	nft.log.Debug("Chain and rules added for these tproxies.",
+		"tproxies", tps,
+	)
+
+	nft.dumpNFTableRules()
+
+	return
+}
+
+func (nft *NFTManager) AddChainAndRulesForRedirects(redirects []*config.Redirect) (err error) {
+	if len(redirects) == 0 {
+		return
+	}
+
+	defer Wrap(
+		&err,
+		"add chain and rules to nft table for redirects %#v",
+		redirects,
+	)
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	for _, redirect := range redirects {
+		err = nft.addChainAndRulesForRedirect(conn, redirect)
 		if err != nil {
 			return
 		}
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	for _, redirect := range redirects {
+		nft.redirects[redirect.Name] = redirect
+	}
+
+	nft.log.Debugw("Chain and rules added for these redirects.",
+		"redirects", redirects,
+	)
+
+	nft.dumpNFTableRules()
+
+	return
+}
+
+func (nft *NFTManager) AddChainAndRulesForRoutes(routes []*config.Route) (err error) {
+	if len(routes) == 0 {
+		return
+	}
+
+	defer Wrap(
+		&err,
+		"add chain and rules to nft table for routes %#v",
+		routes,
+	)
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	tmpRoutes := make(map[string]*config.Route, len(nft.routes)+len(routes))
+	for name, route := range nft.routes {
+		tmpRoutes[name] = route
+	}
+
+	for _, route := range routes {
+		nft.addChainAndRulesForRoute(conn, route)
+		tmpRoutes[route.Name] = route
+	}
+
+	nft.refillPostroutingChain(conn, tmpRoutes)
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	nft.routes = tmpRoutes
 
-		var chain *nftables.Chain
+	nft.log.Debugw("Chain and rules added for these routes.",
+		"routes", routes,
+	)
+
+	nft.dumpNFTableRules()
+
+	return
+}
+
+// ReplaceRoutes replaces elements of cgroups at paths in the cgroup maps
+// with elements of routes,
+// cgroups at paths without a route in routes are removed from the maps.
+// All changes are sent to kernel in a single transaction,
+// so cgroups in routes never lose their elements during replacing.
+func (nft *NFTManager) ReplaceRoutes(paths []string, routes []types.Route) (err error) {
+	if len(paths) == 0 && len(routes) == 0 {
+		return
+	}
+
+	defer Wrap(&err, "replace %d cgroup(s) with %d routes in nftable",
+		len(paths), len(routes))
+	defer nft.observeApply(metrics.OpReplaceRoutes, time.Now(), &err)
+
+	// NOTE:
+	// Elements must be generated before any message is queued,
+	// same as Reload.
+	var elements, natElements map[string]nftables.SetElement
+	elements, natElements, err = nft.genCgroupMapElements(routes)
+	if err != nil {
+		return
+	}
+
+	cgroupMapElement := make(map[string]nftables.SetElement, len(nft.cgroupMapElement))
+	for k, v := range nft.cgroupMapElement {
+		cgroupMapElement[k] = v
+	}
+
+	cgroupNATMapElement := make(map[string]nftables.SetElement, len(nft.cgroupNATMapElement))
+	for k, v := range nft.cgroupNATMapElement {
+		cgroupNATMapElement[k] = v
+	}
+
+	for i := range paths {
+		path := nft.removeCgroupRootFromPath(paths[i])
+		delete(cgroupMapElement, path)
+		delete(cgroupNATMapElement, path)
+	}
+
+	for k, v := range elements {
+		cgroupMapElement[k] = v
+	}
+	for k, v := range natElements {
+		cgroupNATMapElement[k] = v
+	}
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	targetChains := nft.addChainsForTargets(conn, routes, nft.targetChains)
+	for name, counter := range nft.targetChains {
+		targetChains[name] = counter
+	}
+
+	err = nft.updateCgroupMaps(conn, cgroupMapElement, cgroupNATMapElement)
+	if err != nil {
+		return
+	}
 
-		chain, err = nft.addTproxyChainForTProxy(conn, tp)
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	nft.cgroupMapElement = cgroupMapElement
+	nft.cgroupNATMapElement = cgroupNATMapElement
+	nft.targetChains = targetChains
+
+	nft.log.Infow("Cgroup routes replaced in nft.",
+		"cgroups", len(paths),
+		"routes", len(routes),
+	)
+
+	nft.dumpNFTableRules()
+
+	return
+}
+
+// Reload updates the bypass sets, the chains of tproxies, redirects and routes
+// and the cgroup maps to match the new configuration and cgroup routes.
+// All changes are sent to kernel in a single transaction,
+// so the table never disappears during reloading.
+// If the transaction is rejected, nothing is changed.
+func (nft *NFTManager) Reload(cfg *config.Config, routes []types.Route) (err error) {
+	defer Wrap(&err, "reload nftable with %d routes", len(routes))
+	defer nft.observeApply(metrics.OpReload, time.Now(), &err)
+
+	var bypassIPv4, bypassIPv6 []string
+	bypassIPv4, bypassIPv6, err = splitBypass(cfg.Bypass)
+	if err != nil {
+		return
+	}
+
+	// NOTE:
+	// Elements must be generated before any message is queued,
+	// as a lasting connection keeps queued messages
+	// until next time it get flushed.
+	var cgroupMapElement, cgroupNATMapElement map[string]nftables.SetElement
+	cgroupMapElement, cgroupNATMapElement, err = nft.genCgroupMapElements(routes)
+	if err != nil {
+		return
+	}
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	conn.FlushSet(nft.ipv4BypassSet)
+	err = conn.SetAddElements(
+		nft.ipv4BypassSet, nft.genIPV4BypassSetElements(bypassIPv4),
+	)
+	if err != nil {
+		return
+	}
+
+	conn.FlushSet(nft.ipv6BypassSet)
+	err = conn.SetAddElements(
+		nft.ipv6BypassSet, nft.genIPV6BypassSetElements(bypassIPv6),
+	)
+	if err != nil {
+		return
+	}
+
+	for name, tp := range cfg.TProxies {
+		old, ok := nft.tproxies[name]
+		if !ok {
+			err = nft.addChainAndRulesForTProxy(conn, tp)
+		} else if !reflect.DeepEqual(old, tp) {
+			err = nft.updateChainAndRulesForTProxy(conn, old, tp)
+		}
 		if err != nil {
 			return
 		}
+	}
 
-		err = nft.updateMarkTproxyMap(conn, tp.Mark, chain.Name)
+	for name, redirect := range cfg.Redirects {
+		old, ok := nft.redirects[name]
+		if !ok {
+			err = nft.addChainAndRulesForRedirect(conn, redirect)
+		} else if !reflect.DeepEqual(old, redirect) {
+			err = nft.updateChainAndRulesForRedirect(conn, redirect)
+		}
 		if err != nil {
 			return
 		}
+	}
+
+	for name, route := range cfg.Routes {
+		old, ok := nft.routes[name]
+		if !ok {
+			nft.addChainAndRulesForRoute(conn, route)
+		} else if !reflect.DeepEqual(old, route) {
+			nft.updateChainAndRulesForRoute(conn, route)
+		}
+	}
+
+	nft.refillPostroutingChain(conn, cfg.Routes)
+
+	targetChains := nft.addChainsForTargets(conn, routes, nft.targetChains)
+
+	err = nft.updateCgroupMaps(conn, cgroupMapElement, cgroupNATMapElement)
+	if err != nil {
+		return
+	}
+
+	// Chains of removed tproxies can only be deleted
+	// after all elements refer to them have been deleted.
+	for name, tp := range nft.tproxies {
+		if _, ok := cfg.TProxies[name]; ok {
+			continue
+		}
 
-		if tp.DNSHijack != nil {
-			chain, err = nft.addDNSChainForTproxy(conn, tp)
-			if err != nil {
-				return
-			}
+		err = nft.removeChainAndRulesForTProxy(conn, tp)
+		if err != nil {
+			return
+		}
+	}
 
-			err = nft.updateMarkDNSMap(conn, tp.Mark, chain.Name)
-			if err != nil {
-				return
-			}
+	for name, redirect := range nft.redirects {
+		if _, ok := cfg.Redirects[name]; ok {
+			continue
 		}
 
-		nft.log.Debug("Chain and rules generated for this tproxy.",
-			"tproxy", tp,
-		)
+		nft.removeChainAndRulesForRedirect(conn, redirect)
+	}
+
+	for name, route := range nft.routes {
+		if _, ok := cfg.Routes[name]; ok {
+			continue
+		}
+
+		nft.removeChainAndRulesForRoute(conn, route)
+	}
+
+	staleTargetChains := []string{}
+	for name := range nft.targetChains {
+		if _, ok := targetChains[name]; ok {
+			continue
+		}
+
+		staleTargetChains = append(staleTargetChains, name)
+	}
+
+	// Rule chains goto log chains and other target chains,
+	// log chains goto other target chains,
+	// so they must be deleted before the chains they refer to.
+	order := func(name string) int {
+		if isRuleChain(name) {
+			return 0
+		}
+		if isLogChain(name) {
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(staleTargetChains, func(i, j int) bool {
+		return order(staleTargetChains[i]) < order(staleTargetChains[j])
+	})
+
+	removedCounters := map[string]struct{}{}
+	for _, name := range staleTargetChains {
+		conn.DelChain(&nftables.Chain{Table: nft.table, Name: name})
+
+		// Counters of a rule are still in use
+		// if the rule has another chain now.
+		counter := nft.targetChains[name]
+		if counter == "" || hasCounter(targetChains, counter) {
+			continue
+		}
+
+		if _, ok := removedCounters[counter]; ok {
+			continue
+		}
+		removedCounters[counter] = struct{}{}
+
+		nft.removeCounters(conn, counter, counterProtos)
 	}
 
 	err = conn.Flush()
@@ -213,8 +546,32 @@ func (nft *NFTManager) AddChainAndRulesForTProxies(tps []*config.TProxy) (err er
 		return
 	}
 
-	nft.log.Debug("Chain and rules added for these tproxies.",
-		"tproxies", tps,
+	nft.bypassIPv4 = bypassIPv4
+	nft.bypassIPv6 = bypassIPv6
+	nft.cgroupMapElement = cgroupMapElement
+	nft.cgroupNATMapElement = cgroupNATMapElement
+	nft.targetChains = targetChains
+
+	nft.tproxies = make(map[string]*config.TProxy, len(cfg.TProxies))
+	for name, tp := range cfg.TProxies {
+		nft.tproxies[name] = tp
+	}
+
+	nft.redirects = make(map[string]*config.Redirect, len(cfg.Redirects))
+	for name, redirect := range cfg.Redirects {
+		nft.redirects[name] = redirect
+	}
+
+	nft.routes = make(map[string]*config.Route, len(cfg.Routes))
+	for name, route := range cfg.Routes {
+		nft.routes[name] = route
+	}
+
+	nft.log.Infow("Nftable reloaded.",
+		"cgroups", len(cgroupMapElement),
+		"tproxies", len(nft.tproxies),
+		"redirects", len(nft.redirects),
+		"routes", len(nft.routes),
 	)
 
 	nft.dumpNFTableRules()
@@ -250,6 +607,269 @@ func (nft *NFTManager) Clear() (err error) {
 	return
 }
 
+// Counters reads named counters of targets from the table.
+// It can be used without InitStructure,
+// e.g. from another process than the one maintaining the table.
+func (nft *NFTManager) Counters() (ret []types.Counter, err error) {
+	defer Wrap(&err, "read counters from nftable")
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	var objs []nftables.Obj
+	objs, err = conn.GetObjects(&nftables.Table{
+		Name:   NftTableName,
+		Family: nftables.TableFamilyINet,
+	})
+	if err != nil {
+		return
+	}
+
+	counters := []types.Counter{}
+	for i := range objs {
+		obj, ok := objs[i].(*nftables.CounterObj)
+		if !ok {
+			continue
+		}
+
+		counter, ok := parseCounter(obj)
+		if !ok {
+			continue
+		}
+
+		counters = append(counters, counter)
+	}
+
+	ret = counters
+	return
+}
+
+// HasCGroup tells whether there is an element
+// for the cgroup at path in the cgroup map of the cgtproxy nftable.
+// Like Counters, it reads the nftable directly.
+func (nft *NFTManager) HasCGroup(path string) (ret bool, err error) {
+	defer Wrap(&err, "lookup cgroup %s in nftable", path)
+
+	var fileInfo os.FileInfo
+	fileInfo, err = os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	key := binaryutil.NativeEndian.PutUint64(
+		fileInfo.Sys().(*syscall.Stat_t).Ino,
+	)
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	var set *nftables.Set
+	set, err = conn.GetSetByName(&nftables.Table{
+		Name:   NftTableName,
+		Family: nftables.TableFamilyINet,
+	}, cgroupMapName)
+	if err != nil {
+		return
+	}
+
+	var elements []nftables.SetElement
+	elements, err = conn.GetSetElements(set)
+	if err != nil {
+		return
+	}
+
+	for i := range elements {
+		if !bytes.Equal(elements[i].Key, key) {
+			continue
+		}
+
+		ret = true
+		return
+	}
+
+	return
+}
+
+// CGroupElements returns elements of cgroups in the cgroup map,
+// both those added by NFTManager,
+// and those in kernel which NFTManager does not know.
+func (nft *NFTManager) CGroupElements() (ret []types.CGroupElement, err error) {
+	defer Wrap(&err, "list elements of cgroup map")
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	var keys map[uint64]struct{}
+	keys, err = kernelKeys(conn, nft.cgroupMap)
+	if err != nil {
+		return
+	}
+
+	elements := []types.CGroupElement{}
+	for path, element := range nft.cgroupMapElement {
+		inode := binaryutil.NativeEndian.Uint64(element.Key)
+
+		_, ok := keys[inode]
+		delete(keys, inode)
+
+		elements = append(elements, types.CGroupElement{
+			Path:    filepath.Join(string(nft.cgroupRoot), path),
+			Inode:   inode,
+			Missing: !ok,
+		})
+	}
+
+	for inode := range keys {
+		elements = append(elements, types.CGroupElement{Inode: inode})
+	}
+
+	sort.Slice(elements, func(i, j int) bool {
+		if elements[i].Path != elements[j].Path {
+			return elements[i].Path < elements[j].Path
+		}
+
+		return elements[i].Inode < elements[j].Inode
+	})
+
+	ret = elements
+	return
+}
+
+// RemoveCGroupElements removes elements returned by CGroupElements
+// from the cgroup map and the cgroup nat map,
+// elements not in kernel are only forgotten.
+// Unlike RemoveRoutes,
+// it removes elements by their keys instead of paths,
+// so that elements nobody knows can be removed as well.
+func (nft *NFTManager) RemoveCGroupElements(elements []types.CGroupElement) (err error) {
+	if len(elements) == 0 {
+		return
+	}
+
+	defer Wrap(&err, "remove %d element(s) from cgroup map", len(elements))
+	defer nft.observeApply(metrics.OpRemoveRoutes, time.Now(), &err)
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	var keys, natKeys map[uint64]struct{}
+	keys, err = kernelKeys(conn, nft.cgroupMap)
+	if err != nil {
+		return
+	}
+
+	natKeys, err = kernelKeys(conn, nft.cgroupNATMap)
+	if err != nil {
+		return
+	}
+
+	deleted := []nftables.SetElement{}
+	natDeleted := []nftables.SetElement{}
+	for i := range elements {
+		element := nftables.SetElement{
+			Key: binaryutil.NativeEndian.PutUint64(elements[i].Inode),
+		}
+
+		if _, ok := keys[elements[i].Inode]; ok {
+			deleted = append(deleted, element)
+			delete(keys, elements[i].Inode)
+		}
+
+		if _, ok := natKeys[elements[i].Inode]; ok {
+			natDeleted = append(natDeleted, element)
+			delete(natKeys, elements[i].Inode)
+		}
+	}
+
+	err = conn.SetDeleteElements(nft.cgroupMap, deleted)
+	if err != nil {
+		return
+	}
+
+	err = conn.SetDeleteElements(nft.cgroupNATMap, natDeleted)
+	if err != nil {
+		return
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+
+	for i := range elements {
+		if elements[i].Path == "" {
+			continue
+		}
+
+		path := nft.removeCgroupRootFromPath(elements[i].Path)
+		element, ok := nft.cgroupMapElement[path]
+		if !ok ||
+			binaryutil.NativeEndian.Uint64(element.Key) != elements[i].Inode {
+			continue
+		}
+
+		delete(nft.cgroupMapElement, path)
+		delete(nft.cgroupNATMapElement, path)
+	}
+
+	nft.log.Infow("Elements removed from cgroup map.",
+		"size", len(elements),
+	)
+
+	nft.dumpNFTableRules()
+
+	return
+}
+
+// RemoveLeftover removes the cgtproxy nftable
+// left by a previous cgtproxy which did not exit normally.
+// Like Counters, it can be used without InitStructure.
+// It reports whether there was such a table.
+func (nft *NFTManager) RemoveLeftover() (ret bool, err error) {
+	defer Wrap(&err, "remove leftover nftable")
+
+	var conn *nftables.Conn
+	conn, err = nft.connector.Connect()
+	if err != nil {
+		return
+	}
+
+	var tables []*nftables.Table
+	tables, err = conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return
+	}
+
+	for i := range tables {
+		if tables[i].Name != NftTableName {
+			continue
+		}
+
+		conn.DelTable(tables[i])
+		err = conn.Flush()
+		if err != nil {
+			return
+		}
+
+		ret = true
+		return
+	}
+
+	return
+}
+
 func (nft *NFTManager) Release() (err error) {
 	defer Wrap(&err, "release NFTManager")
 	return nft.connector.Release()
@@ -266,6 +886,11 @@ func (nft *NFTManager) InitStructure() (err error) {
 		return
 	}
 
+	nft.tproxies = make(map[string]*config.TProxy)
+	nft.redirects = make(map[string]*config.Redirect)
+	nft.routes = make(map[string]*config.Route)
+	nft.targetChains = make(map[string]string)
+
 	nft.table = conn.CreateTable(&nftables.Table{
 		Name:   NftTableName,
 		Family: nftables.TableFamilyINet,
@@ -294,6 +919,11 @@ func (nft *NFTManager) InitStructure() (err error) {
 		return
 	}
 
+	err = nft.initCgroupNATMap(conn)
+	if err != nil {
+		return
+	}
+
 	err = nft.initMarkMap(conn)
 	if err != nil {
 		return
@@ -311,6 +941,10 @@ func (nft *NFTManager) InitStructure() (err error) {
 		return
 	}
 
+	nft.initDirectAndDropChains(conn)
+
+	nft.initMarkDNSChain(conn)
+
 	err = nft.initOutputNATChain(conn)
 	if err != nil {
 		return
@@ -321,6 +955,8 @@ func (nft *NFTManager) InitStructure() (err error) {
 		return
 	}
 
+	nft.initPostroutingChain(conn)
+
 	err = conn.Flush()
 	if err != nil {
 		return
@@ -10,4 +10,9 @@ var (
 	ErrNFTManagerMissing      = errors.New("nft manager is missing.")
 	ErrConfigMissing          = errors.New("config is missing.")
 	ErrCGroupEventChanMissing = errors.New("cgroup event channel is missing.")
+	ErrCGroupRootChanged      = errors.New("cgroup root cannot be changed without restart.")
+	ErrOverrideTargetInvalid  = errors.New("override target is invalid.")
+	ErrOverrideNotFound       = errors.New("override not found.")
+	ErrOverridesFileMissing   = errors.New("overrides-file is not configured.")
+	ErrRouteManagerStopped    = errors.New("route manager is not running.")
 )
@@ -5,7 +5,9 @@
 package routeman
 
 import (
+	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
 	"github.com/black-desk/cgtproxy/pkg/interfaces"
@@ -22,15 +24,60 @@ type RouteManager struct {
 	cfg *config.Config
 	log *zap.SugaredLogger
 
-	matchers []*struct {
-		reg    *regexp.Regexp
-		target types.Target
-	}
+	matchers []*matcher
+
+	// cgroups records all the cgroups known by route manager,
+	// including those no rule matches,
+	// so that they can be checked again when configuration reloaded.
+	cgroups map[string]struct{}
+
+	// overrides are keyed by paths of cgroups in cgroupfs.
+	overrides map[string]*override
+
+	// waiters are channels to send results of handling cgroups to,
+	// keyed by paths of cgroups route manager does not know yet.
+	waiters map[string][]chan<- error
+
+	ops chan op
+	// done is closed when RunRouteManager returns,
+	// after which ops are never run.
+	done chan struct{}
+
+	// reconcileTimer fires when cgroups should be reconciled,
+	// it is created by RunRouteManager.
+	reconcileTimer *time.Timer
+
+	rule  []*netlink.Rule
+	route []*netlink.Route
+
+	// policyRoutes records rules and routes added for routes in config.
+	policyRoutes map[string]*policyRoute
+}
 
+// policyRoute is rules and routes sending traffic through an interface.
+type policyRoute struct {
 	rule  []*netlink.Rule
 	route []*netlink.Route
 }
 
+type matcher struct {
+	// reg is nil if the rule has no regex.
+	reg *regexp.Regexp
+
+	appID string
+	unit  string
+	slice string
+	uid   *uint32
+
+	target types.Target
+}
+
+// op is a function needs to be run in the goroutine of RunRouteManager.
+type op struct {
+	fn     func() error
+	result chan<- error
+}
+
 //go:generate go run github.com/rjeczalik/interfaces/cmd/interfacer@v0.3.0 -for github.com/black-desk/cgtproxy/pkg/routeman.RouteManager -as interfaces.RouteManager -o ../interfaces/routeman.go
 
 func New(opts ...Opt) (ret *RouteManager, err error) {
@@ -48,40 +95,80 @@ func New(opts ...Opt) (ret *RouteManager, err error) {
 		m.log = zap.NewNop().Sugar()
 	}
 
-	for i := range m.cfg.Rules {
-		regex := m.cfg.Rules[i].Match
-		var matcher struct {
-			reg    *regexp.Regexp
-			target types.Target
-		}
+	m.matchers, err = compileMatchers(m.cfg)
+	if err != nil {
+		return
+	}
 
-		matcher.reg, err = regexp.Compile(regex)
-		if err != nil {
-			return
+	m.cgroups = map[string]struct{}{}
+	m.waiters = map[string][]chan<- error{}
+	m.overrides = map[string]*override{}
+	m.policyRoutes = map[string]*policyRoute{}
+	m.ops = make(chan op)
+	m.done = make(chan struct{})
+
+	ret = m
+
+	m.log.Debugw("Create a new route manager.")
+	return
+}
+
+func compileMatchers(cfg *config.Config) (ret []*matcher, err error) {
+	defer Wrap(&err, "compile rules")
+
+	matchers := []*matcher{}
+
+	for i := range cfg.Rules {
+		regex := cfg.Rules[i].Match
+		var matcher matcher
+
+		if regex != "" {
+			matcher.reg, err = regexp.Compile(regex)
+			if err != nil {
+				return
+			}
 		}
 
-		if m.cfg.Rules[i].Direct {
+		matcher.appID = cfg.Rules[i].AppID
+		matcher.unit = cfg.Rules[i].Unit
+		matcher.slice = cfg.Rules[i].Slice
+		matcher.uid = cfg.Rules[i].UID
+
+		if cfg.Rules[i].Direct {
 			matcher.target.Op = types.TargetDirect
-		} else if m.cfg.Rules[i].Drop {
+		} else if cfg.Rules[i].Drop {
 			matcher.target.Op = types.TargetDrop
-		} else if m.cfg.Rules[i].TProxy != "" {
+		} else if cfg.Rules[i].TProxy != "" {
 			matcher.target.Op = types.TargetTProxy
 			matcher.target.Chain =
-				m.cfg.TProxies[m.cfg.Rules[i].TProxy].Name
+				cfg.TProxies[cfg.Rules[i].TProxy].Name + "-MARK"
+		} else if cfg.Rules[i].Redirect != "" {
+			matcher.target.Op = types.TargetRedirect
+			matcher.target.Chain =
+				cfg.Redirects[cfg.Rules[i].Redirect].Name + "-REDIRECT"
+		} else if cfg.Rules[i].Route != "" {
+			matcher.target.Op = types.TargetRoute
+			matcher.target.Chain =
+				cfg.Routes[cfg.Rules[i].Route].Name + "-ROUTE"
+		} else if cfg.Rules[i].Mark != nil {
+			matcher.target.Op = types.TargetMark
+			matcher.target.Mark = uint32(cfg.Rules[i].Mark.Value)
+			matcher.target.MarkMask = uint32(cfg.Rules[i].Mark.Mask)
+		} else if cfg.Rules[i].Reject != "" {
+			matcher.target.Op = types.TargetReject
+			matcher.target.RejectWith = cfg.Rules[i].Reject
 		} else {
 			panic("this should never happened.")
 		}
 
-		if matcher.target.Chain != "" {
-			matcher.target.Chain += "-MARK"
-		}
+		matcher.target.DNS = cfg.Rules[i].DNS
+		matcher.target.Log = cfg.Rules[i].Log
+		matcher.target.Rule = fmt.Sprintf("rule-%d", i)
 
-		m.matchers = append(m.matchers, &matcher)
+		matchers = append(matchers, &matcher)
 	}
 
-	ret = m
-
-	m.log.Debugw("Create a new route manager.")
+	ret = matchers
 	return
 }
 
@@ -5,15 +5,25 @@
 package routeman
 
 import (
+	"encoding/json"
 	"errors"
+	"io/fs"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/black-desk/cgtproxy/pkg/cgpath"
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/errwrap"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/sys/unix"
 )
 
@@ -30,6 +40,16 @@ func (m *RouteManager) initializeNftableRuels() (err error) {
 		return
 	}
 
+	err = m.nft.AddChainAndRulesForRedirects(maps.Values(m.cfg.Redirects))
+	if err != nil {
+		return
+	}
+
+	err = m.nft.AddChainAndRulesForRoutes(maps.Values(m.cfg.Routes))
+	if err != nil {
+		return
+	}
+
 	for _, tp := range m.cfg.TProxies {
 		err = m.addRule(tp.Mark)
 		if err != nil {
@@ -37,6 +57,16 @@ func (m *RouteManager) initializeNftableRuels() (err error) {
 		}
 	}
 
+	for name, route := range m.cfg.Routes {
+		var p *policyRoute
+		p, err = m.addPolicyRoute(route, nil)
+		if err != nil {
+			return
+		}
+
+		m.policyRoutes[name] = p
+	}
+
 	return
 }
 
@@ -52,15 +82,11 @@ func (m *RouteManager) removeNftableRules() {
 	}
 
 	for _, rule := range m.rule {
-		err = netlink.RuleDel(rule)
-		if err == nil {
-			continue
-		}
+		m.delRule(rule)
+	}
 
-		m.log.Errorw("Failed to delete route rule.",
-			"rule", rule,
-			"error", err,
-		)
+	for _, p := range m.policyRoutes {
+		m.delPolicyRoute(p, nil)
 	}
 
 	err = m.nft.Release()
@@ -77,22 +103,47 @@ func (m *RouteManager) removeNftableRules() {
 func (m *RouteManager) addRuleWithFamily(
 	mark config.FireWallMark, family int,
 ) (err error) {
+	var rule *netlink.Rule
+	rule, err = m.addRuleToTable(mark, m.cfg.RouteTable, family)
+	if err != nil {
+		return
+	}
+
+	if rule == nil {
+		return
+	}
+
+	m.rule = append(m.rule, rule)
+
+	return
+}
+
+// addRuleToTable adds a rule looking up table for traffic with mark.
+// It returns nil if the rule already exists,
+// as the rule is not added by route manager,
+// which must not be removed when route manager exits.
+func (m *RouteManager) addRuleToTable(
+	mark config.FireWallMark, table int, family int,
+) (ret *netlink.Rule, err error) {
 	rule := netlink.NewRule()
 	rule.Family = family
 	rule.Mark = uint32(mark)
-	rule.Table = m.cfg.RouteTable
+	rule.Table = table
 
 	err = netlink.RuleAdd(rule)
 	if errors.Is(err, os.ErrExist) {
-		m.log.Infow("Rule already exists.")
+		m.log.Infow("Rule already exists, it will be kept when exiting.",
+			"mark", mark,
+			"table", table,
+		)
 		err = nil
+		return
 	}
 	if err != nil {
 		return
 	}
 
-	m.rule = append(m.rule, rule)
-
+	ret = rule
 	return
 }
 
@@ -171,24 +222,381 @@ func (m *RouteManager) addRoute() (err error) {
 	return
 }
 
+// addPolicyRoute adds rules and routes
+// to send traffic marked with route.Mark through route.Interface.
+// Rules and routes already existing are recorded in the result
+// only if they are recorded by any of owned,
+// so that those not added by route manager are never removed.
+func (m *RouteManager) addPolicyRoute(
+	route *config.Route, owned map[string]*policyRoute,
+) (
+	ret *policyRoute, err error,
+) {
+	defer Wrap(&err, "add policy route %s", route.Name)
+
+	m.log.Infow("Adding policy route.",
+		"route", route.Name,
+		"interface", route.Interface,
+		"mark", route.Mark,
+		"table", route.Table,
+	)
+
+	p := &policyRoute{}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		m.delPolicyRoute(p, nil)
+	}()
+
+	var link netlink.Link
+	link, err = netlink.LinkByName(route.Interface)
+	if err != nil {
+		return
+	}
+
+	families := []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+	cidrStrs := []string{"0.0.0.0/0", "0::0/0"}
+	gateways := []*string{route.Gateway, route.Gateway6}
+
+	for i := range families {
+		// ip rule add fwmark <mark> lookup <table>
+		var rule *netlink.Rule
+		rule, err = m.addRuleToTable(route.Mark, route.Table, families[i])
+		if err != nil && families[i] == netlink.FAMILY_V6 {
+			m.log.Errorw("Failed to add ipv6 rule.",
+				"route", route.Name,
+				"error", err,
+			)
+
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if rule == nil {
+			rule = ownedRule(owned, route.Mark, route.Table, families[i])
+		}
+
+		if rule != nil {
+			p.rule = append(p.rule, rule)
+		}
+
+		var cidr *net.IPNet
+		_, cidr, err = net.ParseCIDR(cidrStrs[i])
+		if err != nil {
+			return
+		}
+
+		// ip route add default dev <interface> table <table>
+		r := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       cidr,
+			Table:     route.Table,
+		}
+
+		// ip route add default via <gateway> dev <interface> table <table>
+		if gateways[i] != nil {
+			r.Scope = netlink.SCOPE_UNIVERSE
+			r.Gw = net.ParseIP(*gateways[i])
+		}
+
+		err = netlink.RouteAdd(r)
+		if errors.Is(err, os.ErrExist) {
+			m.log.Infow("Route already exists, it will be kept when exiting.",
+				"route", route.Name,
+				"table", route.Table,
+			)
+			err = nil
+			r = ownedRoute(owned, r)
+		}
+		if err != nil {
+			return
+		}
+
+		if r != nil {
+			p.route = append(p.route, r)
+		}
+	}
+
+	ret = p
+	return
+}
+
+// ownedRule returns the rule looking up table for traffic with mark
+// recorded by any of policy routes in owned,
+// or nil if there is no such rule.
+func ownedRule(
+	owned map[string]*policyRoute, mark config.FireWallMark, table int, family int,
+) *netlink.Rule {
+	for _, p := range owned {
+		for _, rule := range p.rule {
+			if rule.Family == family &&
+				rule.Mark == uint32(mark) &&
+				rule.Table == table {
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// ownedRoute returns the route same as route
+// recorded by any of policy routes in owned,
+// or nil if there is no such route.
+func ownedRoute(owned map[string]*policyRoute, route *netlink.Route) *netlink.Route {
+	for _, p := range owned {
+		for _, r := range p.route {
+			if sameRoute(r, route) {
+				return r
+			}
+		}
+	}
+
+	return nil
+}
+
+func sameRoute(a, b *netlink.Route) bool {
+	return a.Table == b.Table &&
+		a.LinkIndex == b.LinkIndex &&
+		a.Dst.String() == b.Dst.String() &&
+		a.Gw.Equal(b.Gw)
+}
+
+// delPolicyRoute removes rules and routes of p,
+// except those also in any of keep.
+func (m *RouteManager) delPolicyRoute(
+	p *policyRoute, keep map[string]*policyRoute,
+) {
+	rules := []*netlink.Rule{}
+	routes := []*netlink.Route{}
+	for _, k := range keep {
+		if k == p {
+			continue
+		}
+
+		rules = append(rules, k.rule...)
+		routes = append(routes, k.route...)
+	}
+
+	for _, rule := range p.rule {
+		if slices.ContainsFunc(rules, func(r *netlink.Rule) bool {
+			return r.Family == rule.Family &&
+				r.Mark == rule.Mark &&
+				r.Table == rule.Table
+		}) {
+			continue
+		}
+
+		m.delRule(rule)
+	}
+
+	for _, route := range p.route {
+		if slices.ContainsFunc(routes, func(r *netlink.Route) bool {
+			return sameRoute(r, route)
+		}) {
+			continue
+		}
+
+		m.delRoute(route)
+	}
+}
+
 func (m *RouteManager) removeRoute() {
 	for i := range m.route {
-		err := netlink.RouteDel(m.route[i])
+		m.delRoute(m.route[i])
+	}
 
-		if err == nil {
+	return
+}
+
+// removeLeftovers removes the nftable, routes and rules
+// a previous cgtproxy with the same configuration could have created,
+// which are left if it did not exit normally, e.g. killed by SIGKILL.
+// They have to be removed, or adding them again fails with EEXIST.
+func (m *RouteManager) removeLeftovers() (err error) {
+	defer Wrap(&err, "remove leftovers")
+
+	var found bool
+	found, err = m.nft.RemoveLeftover()
+	if err != nil {
+		return
+	}
+
+	if found {
+		m.log.Warnw("Leftover nftable removed.")
+	}
+
+	families := []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+
+	var lo *net.Interface
+	lo, err = net.InterfaceByName("lo")
+	if err != nil {
+		return
+	}
+
+	for _, family := range families {
+		// ip route del local default dev lo table <table>
+		err = m.removeLeftoverRoutes(family, &netlink.Route{
+			LinkIndex: lo.Index,
+			Table:     m.cfg.RouteTable,
+			Type:      unix.RTN_LOCAL,
+		})
+		if err != nil {
+			return
+		}
+
+		// ip rule del fwmark <mark> lookup <table>
+		//
+		// NOTE:
+		// Only rules of tproxies in configuration are removed,
+		// rules with other marks looking up route-table
+		// might be added by someone else.
+		for _, tp := range m.cfg.TProxies {
+			err = m.removeLeftoverRules(family, &netlink.Rule{
+				Table: m.cfg.RouteTable,
+				Mark:  uint32(tp.Mark),
+			}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_MARK)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	for _, route := range m.cfg.Routes {
+		for _, family := range families {
+			err = m.removeLeftoverRules(family, &netlink.Rule{
+				Table: route.Table,
+				Mark:  uint32(route.Mark),
+			}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_MARK)
+			if err != nil {
+				return
+			}
+		}
+
+		link, linkErr := netlink.LinkByName(route.Interface)
+		if linkErr != nil {
+			// No route via an interface which does not exist.
+			continue
+		}
+
+		for _, family := range families {
+			// ip route del default dev <interface> table <table>
+			err = m.removeLeftoverRoutes(family, &netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Table:     route.Table,
+				Type:      unix.RTN_UNICAST,
+			})
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// removeLeftoverRoutes removes default routes matching filter.
+func (m *RouteManager) removeLeftoverRoutes(
+	family int, filter *netlink.Route,
+) (err error) {
+	var routes []netlink.Route
+	routes, err = netlink.RouteListFiltered(family, filter,
+		netlink.RT_FILTER_TABLE|
+			netlink.RT_FILTER_TYPE|
+			netlink.RT_FILTER_OIF|
+			netlink.RT_FILTER_DST,
+	)
+	if err != nil {
+		return
+	}
+
+	for i := range routes {
+		m.log.Warnw("Removing leftover route.",
+			"route", routes[i].String(),
+		)
+
+		err = netlink.RouteDel(&routes[i])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// removeLeftoverRules removes rules with a fire wall mark matching filter.
+func (m *RouteManager) removeLeftoverRules(
+	family int, filter *netlink.Rule, mask uint64,
+) (err error) {
+	var rules []netlink.Rule
+	rules, err = netlink.RuleListFiltered(family, filter, mask)
+	if err != nil {
+		return
+	}
+
+	for i := range rules {
+		if rules[i].Mark == 0 {
 			continue
 		}
 
-		m.log.Warnw("Failed to remove route",
-			"error", err)
+		m.log.Warnw("Removing leftover rule.",
+			"rule", rules[i].String(),
+		)
+
+		err = netlink.RuleDel(&rules[i])
+		if err != nil {
+			return
+		}
 	}
 
 	return
 }
 
+func (m *RouteManager) delRoute(route *netlink.Route) {
+	err := netlink.RouteDel(route)
+	if err == nil {
+		return
+	}
+
+	m.log.Warnw("Failed to remove route",
+		"error", err)
+}
+
+func (m *RouteManager) delRule(rule *netlink.Rule) {
+	err := netlink.RuleDel(rule)
+	if err == nil {
+		return
+	}
+
+	m.log.Errorw("Failed to delete route rule.",
+		"rule", rule,
+		"error", err,
+	)
+}
+
 func (m *RouteManager) handleNewCgroups(paths []string) (err error) {
 	defer Wrap(&err, "handle %d new cgroups", len(paths))
 
+	for i := range paths {
+		m.cgroups[paths[i]] = struct{}{}
+	}
+
+	err = m.nft.AddRoutes(m.genRoutes(paths))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *RouteManager) genRoutes(paths []string) (ret []types.Route) {
 	routes := []types.Route{}
 
 	for i := range paths {
@@ -198,23 +606,21 @@ func (m *RouteManager) handleNewCgroups(paths []string) (err error) {
 			"path", path,
 		)
 
-		var target types.Target
-		for i := range m.matchers {
-			if !m.matchers[i].reg.Match([]byte(path)) {
-				continue
-			}
-
-			m.log.Debugw("Rule found for this cgroup",
+		if target, ok := m.overrideOf(path); ok {
+			m.log.Debugw("Override found for this cgroup",
 				"cgroup", path,
-				"rule", m.cfg.Rules[i].String(),
 			)
 
-			target = m.matchers[i].target
+			routes = append(routes, types.Route{
+				Path:   path,
+				Target: target,
+			})
 
-			break
+			continue
 		}
 
-		if target.Op == types.TargetNoop {
+		index := firstMatch(m.matchers, m.cfg.CgroupRoot, path)
+		if index < 0 {
 			m.log.Debugw("No rule match this cgroup",
 				"cgroup", path,
 			)
@@ -222,18 +628,59 @@ func (m *RouteManager) handleNewCgroups(paths []string) (err error) {
 			continue
 		}
 
+		m.log.Debugw("Rule found for this cgroup",
+			"cgroup", path,
+			"rule", m.cfg.Rules[index].String(),
+		)
+
+		target := m.matchers[index].target
+
 		routes = append(routes, types.Route{
 			Path:   path,
 			Target: target,
 		})
 	}
 
-	err = m.nft.AddRoutes(routes)
-	if err != nil {
-		return
+	ret = routes
+	return
+}
+
+// firstMatch returns the index of the first matcher
+// matching the cgroup at path, or -1 if no matcher matches.
+func firstMatch(matchers []*matcher, root config.CGroupRoot, path string) int {
+	info := cgpath.Parse(strings.TrimPrefix(path, string(root)))
+
+	for i := range matchers {
+		if matchers[i].match(path, info) {
+			return i
+		}
 	}
 
-	return
+	return -1
+}
+
+func (m *matcher) match(path string, info *cgpath.Info) bool {
+	if m.reg != nil && !m.reg.MatchString(path) {
+		return false
+	}
+
+	if m.appID != "" && m.appID != info.AppID {
+		return false
+	}
+
+	if m.unit != "" && m.unit != info.Unit {
+		return false
+	}
+
+	if m.slice != "" && !info.InSlice(m.slice) {
+		return false
+	}
+
+	if m.uid != nil && (info.UID == nil || *m.uid != *info.UID) {
+		return false
+	}
+
+	return true
 }
 
 func (m *RouteManager) handleDeleteCgroups(paths []string) (err error) {
@@ -243,6 +690,10 @@ func (m *RouteManager) handleDeleteCgroups(paths []string) (err error) {
 		"size", len(paths),
 	)
 
+	for i := range paths {
+		delete(m.cgroups, paths[i])
+	}
+
 	err = m.nft.RemoveRoutes(paths)
 	if err != nil {
 		return
@@ -250,3 +701,821 @@ func (m *RouteManager) handleDeleteCgroups(paths []string) (err error) {
 
 	return
 }
+
+// notifyWaiters sends result of handling new cgroups at paths
+// to those waiting for them.
+func (m *RouteManager) notifyWaiters(paths []string, err error) {
+	for i := range paths {
+		waiters := m.waiters[paths[i]]
+		delete(m.waiters, paths[i])
+
+		for j := range waiters {
+			waiters[j] <- err
+		}
+	}
+}
+
+func (m *RouteManager) removeWaiter(path string, result chan<- error) {
+	waiters := m.waiters[path]
+	for i := range waiters {
+		if waiters[i] != result {
+			continue
+		}
+
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		break
+	}
+
+	if len(waiters) == 0 {
+		delete(m.waiters, path)
+		return
+	}
+
+	m.waiters[path] = waiters
+}
+
+// routeOf returns the route of the cgroup at path.
+func (m *RouteManager) routeOf(path string) types.Route {
+	routes := m.genRoutes([]string{path})
+	if len(routes) == 0 {
+		return types.Route{Path: path}
+	}
+
+	return routes[0]
+}
+
+// do runs fn in the goroutine of RunRouteManager and waits for its result.
+// It fails with ErrRouteManagerStopped if RunRouteManager has returned.
+func (m *RouteManager) do(fn func() error) (err error) {
+	result := make(chan error, 1)
+
+	select {
+	case <-m.done:
+		err = ErrRouteManagerStopped
+		return
+	case m.ops <- op{fn: fn, result: result}:
+	}
+
+	select {
+	case <-m.done:
+		// NOTE:
+		// The result of an op taken is sent before RunRouteManager returns.
+		select {
+		case err = <-result:
+		default:
+			err = ErrRouteManagerStopped
+		}
+	case err = <-result:
+	}
+	return
+}
+
+func (m *RouteManager) reload(cfg *config.Config) (err error) {
+	defer Wrap(&err, "reload configuration")
+
+	if cfg.CgroupRoot != m.cfg.CgroupRoot {
+		err = ErrCGroupRootChanged
+		return
+	}
+
+	var matchers []*matcher
+	matchers, err = compileMatchers(cfg)
+	if err != nil {
+		return
+	}
+
+	oldCfg, oldMatchers := m.cfg, m.matchers
+	oldRoute, oldRule := m.route, m.rule
+	oldPolicyRoutes := m.policyRoutes
+	oldOverrides := m.overrides
+
+	m.cfg, m.matchers = cfg, matchers
+	m.overrides = m.resolveOverrides(cfg, oldOverrides)
+	m.policyRoutes = make(map[string]*policyRoute, len(cfg.Routes))
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		m.log.Warnw("Failed to reload, rolling back.",
+			"error", err,
+		)
+
+		for _, route := range m.route[len(oldRoute):] {
+			m.delRoute(route)
+		}
+
+		for _, rule := range m.rule[len(oldRule):] {
+			m.delRule(rule)
+		}
+
+		for name, p := range m.policyRoutes {
+			if oldPolicyRoutes[name] == p {
+				continue
+			}
+
+			m.delPolicyRoute(p, oldPolicyRoutes)
+		}
+
+		m.cfg, m.matchers = oldCfg, oldMatchers
+		m.route, m.rule = oldRoute, oldRule
+		m.policyRoutes = oldPolicyRoutes
+		m.overrides = oldOverrides
+	}()
+
+	if cfg.RouteTable != oldCfg.RouteTable {
+		err = m.addRoute()
+		if err != nil {
+			return
+		}
+	}
+
+	for _, tp := range cfg.TProxies {
+		if m.hasRule(tp.Mark, cfg.RouteTable) {
+			continue
+		}
+
+		err = m.addRule(tp.Mark)
+		if err != nil {
+			return
+		}
+	}
+
+	for name, route := range cfg.Routes {
+		old, ok := oldCfg.Routes[name]
+		if ok && reflect.DeepEqual(old, route) {
+			m.policyRoutes[name] = oldPolicyRoutes[name]
+			continue
+		}
+
+		var p *policyRoute
+		p, err = m.addPolicyRoute(route, oldPolicyRoutes)
+		if err != nil {
+			return
+		}
+
+		m.policyRoutes[name] = p
+	}
+
+	paths := maps.Keys(m.cgroups)
+
+	err = m.nft.Reload(cfg, m.genRoutes(paths))
+	if err != nil {
+		return
+	}
+
+	for name, p := range oldPolicyRoutes {
+		if m.policyRoutes[name] == p {
+			continue
+		}
+
+		m.delPolicyRoute(p, m.policyRoutes)
+	}
+
+	// The new configuration is in use now,
+	// remove routes and rules nobody needs.
+
+	if cfg.RouteTable != oldCfg.RouteTable {
+		for _, route := range oldRoute {
+			m.delRoute(route)
+		}
+
+		m.route = m.route[len(oldRoute):]
+	}
+
+	marks := map[config.FireWallMark]struct{}{}
+	for _, tp := range cfg.TProxies {
+		marks[tp.Mark] = struct{}{}
+	}
+
+	rules := []*netlink.Rule{}
+	for _, rule := range m.rule {
+		_, ok := marks[config.FireWallMark(rule.Mark)]
+		if ok && rule.Table == cfg.RouteTable {
+			rules = append(rules, rule)
+			continue
+		}
+
+		m.delRule(rule)
+	}
+	m.rule = rules
+
+	if m.reconcileTimer != nil &&
+		!reflect.DeepEqual(cfg.ReconcileInterval, oldCfg.ReconcileInterval) {
+		m.resetReconcileTimer()
+	}
+
+	m.log.Infow("Configuration reloaded.",
+		"cgroups", len(paths),
+	)
+
+	return
+}
+
+func (m *RouteManager) resync() (err error) {
+	defer Wrap(&err, "resync cgroups")
+
+	var paths []string
+	paths, err = m.walkCGroups()
+	if err != nil {
+		return
+	}
+
+	err = m.nft.Reload(m.cfg, m.genRoutes(paths))
+	if err != nil {
+		return
+	}
+
+	cgroups := make(map[string]struct{}, len(paths))
+	for i := range paths {
+		cgroups[paths[i]] = struct{}{}
+	}
+
+	added, removed := 0, 0
+	for path := range cgroups {
+		if _, ok := m.cgroups[path]; !ok {
+			added++
+		}
+	}
+	for path := range m.cgroups {
+		if _, ok := cgroups[path]; !ok {
+			removed++
+		}
+	}
+
+	m.cgroups = cgroups
+
+	m.notifyWaiters(paths, nil)
+
+	m.log.Infow("Cgroups resynced.",
+		"cgroups", len(cgroups),
+		"added", added,
+		"removed", removed,
+	)
+
+	return
+}
+
+func (m *RouteManager) reconcile() (ret types.Drift, err error) {
+	defer Wrap(&err, "reconcile cgroups")
+
+	var paths []string
+	paths, err = m.walkCGroups()
+	if err != nil {
+		return
+	}
+
+	inodes := make(map[string]uint64, len(paths))
+	for i := range paths {
+		var info os.FileInfo
+		info, err = os.Stat(paths[i])
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		inodes[paths[i]] = info.Sys().(*syscall.Stat_t).Ino
+	}
+
+	var elements []types.CGroupElement
+	elements, err = m.nft.CGroupElements()
+	if err != nil {
+		return
+	}
+
+	drift := types.Drift{}
+
+	// NOTE:
+	// Elements wrong in kernel are removed first,
+	// so that cgroups of them can be added again.
+	// Elements of cgroups removed are left to RemoveRoutes,
+	// unless they are not in kernel, which RemoveRoutes cannot handle.
+	wrong := []types.CGroupElement{}
+	stale := []string{}
+	for i := range elements {
+		element := elements[i]
+
+		if element.Path == "" {
+			drift.Orphans++
+			wrong = append(wrong, element)
+			continue
+		}
+
+		inode, ok := inodes[element.Path]
+		if !ok {
+			if element.Missing {
+				wrong = append(wrong, element)
+			}
+			continue
+		}
+
+		if !element.Missing && element.Inode == inode {
+			continue
+		}
+
+		wrong = append(wrong, element)
+
+		if _, known := m.cgroups[element.Path]; known {
+			drift.Stale++
+			stale = append(stale, element.Path)
+		}
+	}
+
+	err = m.nft.RemoveCGroupElements(wrong)
+	if err != nil {
+		return
+	}
+
+	deleted := []string{}
+	for path := range m.cgroups {
+		if _, ok := inodes[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+
+	if len(deleted) != 0 {
+		sort.Strings(deleted)
+
+		err = m.handleDeleteCgroups(deleted)
+		if err != nil {
+			return
+		}
+
+		drift.Deleted = len(deleted)
+	}
+
+	created := []string{}
+	for path := range inodes {
+		if _, ok := m.cgroups[path]; !ok {
+			created = append(created, path)
+		}
+	}
+
+	sort.Strings(created)
+
+	err = m.handleNewCgroups(created)
+	m.notifyWaiters(created, err)
+	if err != nil {
+		return
+	}
+
+	drift.Created = len(created)
+
+	err = m.nft.AddRoutes(m.genRoutes(stale))
+	if err != nil {
+		return
+	}
+
+	if drift.Total() == 0 {
+		m.log.Debugw("Cgroups reconciled, nothing changed.",
+			"cgroups", len(m.cgroups),
+		)
+	} else {
+		m.log.Warnw("Cgroups reconciled, some cgroup events had been missed.",
+			"cgroups", len(m.cgroups),
+			"created", drift.Created,
+			"deleted", drift.Deleted,
+			"stale", drift.Stale,
+			"orphans", drift.Orphans,
+		)
+	}
+
+	ret = drift
+	return
+}
+
+// resetReconcileTimer makes reconcileTimer fire
+// after the reconcile interval in configuration,
+// it never fires if the interval is 0.
+func (m *RouteManager) resetReconcileTimer() {
+	m.reconcileTimer.Stop()
+
+	if m.cfg.ReconcileInterval == nil || *m.cfg.ReconcileInterval == 0 {
+		return
+	}
+
+	m.reconcileTimer.Reset(*m.cfg.ReconcileInterval)
+}
+
+// walkCGroups returns paths of all cgroups under cgroup root.
+func (m *RouteManager) walkCGroups() (ret []string, err error) {
+	defer Wrap(&err, "go through cgroupfs")
+
+	root := string(m.cfg.CgroupRoot)
+	paths := []string{}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Cgroup had been removed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() || path == root {
+			return nil
+		}
+
+		paths = append(paths, strings.TrimRight(path, "/"))
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	ret = paths
+	return
+}
+
+func (m *RouteManager) hasRule(mark config.FireWallMark, table int) bool {
+	for _, rule := range m.rule {
+		if rule.Mark == uint32(mark) && rule.Table == table {
+			return true
+		}
+	}
+
+	return false
+}
+
+// override is an override with its target resolved.
+type override struct {
+	types.Override
+	target types.Target
+}
+
+// parseOverrideTarget resolves target of an override against cfg.
+func parseOverrideTarget(cfg *config.Config, spec string) (ret types.Target, err error) {
+	defer Wrap(&err, "parse override target %q", spec)
+
+	kind, name, _ := strings.Cut(spec, ":")
+
+	switch kind {
+	case "direct":
+		ret.Op = types.TargetDirect
+		if name == "" {
+			return
+		}
+	case "drop":
+		ret.Op = types.TargetDrop
+		if name == "" {
+			return
+		}
+	case "reject":
+		ret.Op = types.TargetReject
+		ret.RejectWith = name
+		switch name {
+		case "":
+			ret.RejectWith = config.RejectWithAdminProhibited
+			return
+		case config.RejectWithAdminProhibited,
+			config.RejectWithPortUnreachable,
+			config.RejectWithHostUnreachable,
+			config.RejectWithNoRoute:
+			return
+		}
+	case "tproxy":
+		if tp, ok := cfg.TProxies[name]; ok {
+			ret.Op = types.TargetTProxy
+			ret.Chain = tp.Name + "-MARK"
+			return
+		}
+	case "redirect":
+		if redirect, ok := cfg.Redirects[name]; ok {
+			ret.Op = types.TargetRedirect
+			ret.Chain = redirect.Name + "-REDIRECT"
+			return
+		}
+	case "route":
+		if route, ok := cfg.Routes[name]; ok {
+			ret.Op = types.TargetRoute
+			ret.Chain = route.Name + "-ROUTE"
+			return
+		}
+	case "mark":
+		if parseOverrideMark(cfg, name, &ret) {
+			ret.Op = types.TargetMark
+			return
+		}
+	}
+
+	ret = types.Target{}
+	err = ErrOverrideTargetInvalid
+	return
+}
+
+// parseOverrideMark parses VALUE[/MASK] of a mark target into ret.
+// Like marks of rules, the mark must not be one of marks of tproxies and routes.
+func parseOverrideMark(cfg *config.Config, spec string, ret *types.Target) bool {
+	valueStr, maskStr, hasMask := strings.Cut(spec, "/")
+
+	value, err := strconv.ParseUint(valueStr, 0, 32)
+	if err != nil {
+		return false
+	}
+
+	var mask uint64
+	if hasMask {
+		mask, err = strconv.ParseUint(maskStr, 0, 32)
+		if err != nil {
+			return false
+		}
+	}
+
+	mark := config.FireWallMark(value)
+	if mask != 0 {
+		mark &= config.FireWallMark(mask)
+	}
+
+	for _, tp := range cfg.TProxies {
+		if tp.Mark == mark {
+			return false
+		}
+	}
+
+	for _, route := range cfg.Routes {
+		if route.Mark == mark {
+			return false
+		}
+	}
+
+	ret.Mark = uint32(value)
+	ret.MarkMask = uint32(mask)
+	return true
+}
+
+// resolveOverrides resolves targets of overrides against cfg again,
+// overrides whose target is gone are dropped.
+func (m *RouteManager) resolveOverrides(
+	cfg *config.Config, overrides map[string]*override,
+) map[string]*override {
+	ret := make(map[string]*override, len(overrides))
+
+	for path, o := range overrides {
+		target, err := parseOverrideTarget(cfg, o.Target)
+		if err != nil {
+			m.log.Warnw("Drop override whose target is gone.",
+				"path", path,
+				"error", err,
+			)
+			continue
+		}
+
+		ret[path] = &override{Override: o.Override, target: target}
+	}
+
+	return ret
+}
+
+// overrideOf returns the target of the override
+// applying to the cgroup at path.
+func (m *RouteManager) overrideOf(path string) (ret types.Target, ok bool) {
+	if len(m.overrides) == 0 {
+		return
+	}
+
+	root := filepath.Clean(string(m.cfg.CgroupRoot))
+
+	for p := path; strings.HasPrefix(p, root+"/"); p = filepath.Dir(p) {
+		o, found := m.overrides[p]
+		if !found || (p != path && !o.Subtree) {
+			continue
+		}
+
+		ret, ok = o.target, true
+		return
+	}
+
+	return
+}
+
+// cgroupPath returns the path in cgroupfs of the cgroup at path,
+// which is either in cgroupfs or relative to cgroup root.
+func (m *RouteManager) cgroupPath(path string) string {
+	root := filepath.Clean(string(m.cfg.CgroupRoot))
+	path = filepath.Clean(path)
+
+	if path == root || strings.HasPrefix(path, root+"/") {
+		return path
+	}
+
+	return filepath.Join(root, path)
+}
+
+// cgroupsUnder returns known cgroups at path or below it.
+func (m *RouteManager) cgroupsUnder(path string) (ret []string) {
+	for p := range m.cgroups {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			ret = append(ret, p)
+		}
+	}
+
+	return
+}
+
+// applyOverride updates elements of known cgroups at path or below it
+// in the cgroup map, so that changes of the override at path take effect.
+func (m *RouteManager) applyOverride(path string) (err error) {
+	paths := m.cgroupsUnder(path)
+	if len(paths) == 0 {
+		return
+	}
+
+	err = m.nft.ReplaceRoutes(paths, m.genRoutes(paths))
+	return
+}
+
+// restoreOverride tries to bring elements of cgroups at path or below it
+// back to match overrides, after applyOverride failed.
+func (m *RouteManager) restoreOverride(path string) {
+	err := m.applyOverride(path)
+	if err == nil {
+		return
+	}
+
+	m.log.Errorw("Failed to restore elements in cgroup map.",
+		"path", path,
+		"error", err,
+	)
+}
+
+func (m *RouteManager) setOverride(o types.Override) (err error) {
+	o.Path = m.cgroupPath(o.Path)
+
+	if o.Persist && m.cfg.OverridesFile == "" {
+		err = ErrOverridesFileMissing
+		return
+	}
+
+	var target types.Target
+	target, err = parseOverrideTarget(m.cfg, o.Target)
+	if err != nil {
+		return
+	}
+
+	old, existed := m.overrides[o.Path]
+	m.overrides[o.Path] = &override{Override: o, target: target}
+
+	err = m.applyOverride(o.Path)
+	if err != nil {
+		if existed {
+			m.overrides[o.Path] = old
+		} else {
+			delete(m.overrides, o.Path)
+		}
+		m.restoreOverride(o.Path)
+		return
+	}
+
+	m.log.Infow("Override set.",
+		"path", o.Path,
+		"subtree", o.Subtree,
+		"target", o.Target,
+		"persist", o.Persist,
+	)
+
+	if o.Persist || (existed && old.Persist) {
+		err = m.saveOverrides()
+	}
+
+	return
+}
+
+func (m *RouteManager) removeOverride(path string) (err error) {
+	path = m.cgroupPath(path)
+
+	old, ok := m.overrides[path]
+	if !ok {
+		err = ErrOverrideNotFound
+		return
+	}
+
+	delete(m.overrides, path)
+
+	err = m.applyOverride(path)
+	if err != nil {
+		m.overrides[path] = old
+		m.restoreOverride(path)
+		return
+	}
+
+	m.log.Infow("Override removed.",
+		"path", path,
+	)
+
+	if old.Persist {
+		err = m.saveOverrides()
+	}
+
+	return
+}
+
+// loadOverrides applies overrides persisted in the overrides file.
+func (m *RouteManager) loadOverrides() (err error) {
+	defer Wrap(&err, "load overrides from %s", m.cfg.OverridesFile)
+
+	if m.cfg.OverridesFile == "" {
+		return
+	}
+
+	var content []byte
+	content, err = os.ReadFile(m.cfg.OverridesFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var overrides []types.Override
+	err = json.Unmarshal(content, &overrides)
+	if err != nil {
+		return
+	}
+
+	for i := range overrides {
+		o := overrides[i]
+		o.Path = m.cgroupPath(o.Path)
+		o.Persist = true
+
+		target, parseErr := parseOverrideTarget(m.cfg, o.Target)
+		if parseErr != nil {
+			m.log.Warnw("Skip persisted override.",
+				"path", o.Path,
+				"error", parseErr,
+			)
+			continue
+		}
+
+		m.overrides[o.Path] = &override{Override: o, target: target}
+	}
+
+	m.log.Infow("Persisted overrides loaded.",
+		"overrides", len(m.overrides),
+	)
+
+	return
+}
+
+// saveOverrides writes persisted overrides to the overrides file.
+func (m *RouteManager) saveOverrides() (err error) {
+	defer Wrap(&err, "save overrides to %s", m.cfg.OverridesFile)
+
+	if m.cfg.OverridesFile == "" {
+		err = ErrOverridesFileMissing
+		return
+	}
+
+	overrides := []types.Override{}
+	for _, o := range m.overrides {
+		if !o.Persist {
+			continue
+		}
+
+		overrides = append(overrides, o.Override)
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].Path < overrides[j].Path
+	})
+
+	var content []byte
+	content, err = json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(m.cfg.OverridesFile), 0755)
+	if err != nil {
+		return
+	}
+
+	// Write to a temporary file then rename it,
+	// so the overrides file is never half written.
+	tmp := m.cfg.OverridesFile + ".tmp"
+	err = os.WriteFile(tmp, append(content, '\n'), 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, m.cfg.OverridesFile)
+	return
+}
+
+// sortedValues returns values in m sorted by their keys.
+func sortedValues[V any](m map[string]V) []V {
+	keys := maps.Keys(m)
+	sort.Strings(keys)
+
+	ret := make([]V, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, m[key])
+	}
+
+	return ret
+}
@@ -7,13 +7,32 @@ package routeman
 import (
 	"context"
 	"errors"
+	"sort"
+	"time"
 
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/errwrap"
+	"golang.org/x/exp/maps"
 )
 
+// RunRouteManager sets up routes, rules and the nftable,
+// then handles cgroup events and calls of other methods
+// until ctx is done, and removes all of them on return.
+//
+// It returns as soon as ctx is done without draining anything:
+// cgroup events not received yet are dropped,
+// as routes of cgroups are removed on return anyway,
+// and calls waiting to be handled fail with ErrRouteManagerStopped.
+// Calls already being handled finish before it returns.
 func (m *RouteManager) RunRouteManager(ctx context.Context) (err error) {
 	defer Wrap(&err, "running route manager")
+	defer close(m.done)
+
+	err = m.removeLeftovers()
+	if err != nil {
+		return
+	}
 
 	defer m.removeRoute()
 	err = m.addRoute()
@@ -27,31 +46,304 @@ func (m *RouteManager) RunRouteManager(ctx context.Context) (err error) {
 		return
 	}
 
-	for events := range m.cgroupEventsChan {
-		newCGroups := []string{}
-		deleteCGroups := []string{}
+	err = m.loadOverrides()
+	if err != nil {
+		m.log.Warnw("Failed to load persisted overrides.",
+			"error", err,
+		)
+		err = nil
+	}
+
+	cgroupEventsChan := m.cgroupEventsChan
+
+	m.reconcileTimer = time.NewTimer(0)
+	m.resetReconcileTimer()
+	defer m.reconcileTimer.Stop()
 
-		for i := range events.Events {
-			event := &events.Events[i]
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-m.reconcileTimer.C:
+			_, reconcileErr := m.reconcile()
+			if reconcileErr != nil {
+				m.log.Errorw("Failed to reconcile cgroups.",
+					"error", reconcileErr,
+				)
+			}
 
-			switch event.EventType {
-			case types.CgroupEventTypeNew:
-				newCGroups = append(newCGroups, event.Path)
-			case types.CgroupEventTypeDelete:
-				deleteCGroups = append(deleteCGroups, event.Path)
+			m.resetReconcileTimer()
+		case op := <-m.ops:
+			op.result <- op.fn()
+			close(op.result)
+		case events, ok := <-cgroupEventsChan:
+			if !ok {
+				// Wait for the context to be cancelled,
+				// but keep handling ops.
+				cgroupEventsChan = nil
+				continue
 			}
+
+			m.handleCGroupEvents(&events)
 		}
+	}
+}
+
+// Cleanup removes everything cgtproxy could have created
+// with the configuration of route manager,
+// which is left if cgtproxy did not exit normally.
+// It must not be used while any cgtproxy is running
+// with the same configuration.
+func (m *RouteManager) Cleanup() (err error) {
+	defer Wrap(&err, "clean up")
+
+	err = m.removeLeftovers()
+	return
+}
+
+// FillNftable builds the nftable for the configuration of route manager
+// and all cgroups currently under cgroup root,
+// the same as RunRouteManager does on start,
+// but leaves ip rules and routes untouched
+// and does not wait for cgroup events.
+// Chains of tproxies, redirects and routes are added in order of names,
+// so the same configuration always results in the same nftable.
+func (m *RouteManager) FillNftable() (err error) {
+	defer Wrap(&err, "fill nftable")
+
+	err = m.nft.InitStructure()
+	if err != nil {
+		return
+	}
+
+	err = m.nft.AddChainAndRulesForTProxies(sortedValues(m.cfg.TProxies))
+	if err != nil {
+		return
+	}
+
+	err = m.nft.AddChainAndRulesForRedirects(sortedValues(m.cfg.Redirects))
+	if err != nil {
+		return
+	}
+
+	err = m.nft.AddChainAndRulesForRoutes(sortedValues(m.cfg.Routes))
+	if err != nil {
+		return
+	}
+
+	var paths []string
+	paths, err = m.walkCGroups()
+	if err != nil {
+		return
+	}
 
-		newErr := m.handleNewCgroups(newCGroups)
-		delErr := m.handleDeleteCgroups(deleteCGroups)
-		eventsErr := errors.Join(newErr, delErr)
+	err = m.handleNewCgroups(paths)
+	if err != nil {
+		return
+	}
 
-		if events.Result != nil {
-			events.Result <- eventsErr
-			close(events.Result)
+	return
+}
+
+// Reload makes route manager use a new configuration.
+// Every known cgroup is checked against the new rules.
+// If anything goes wrong,
+// route manager keeps using the old configuration.
+func (m *RouteManager) Reload(cfg *config.Config) (err error) {
+	defer Wrap(&err, "reload route manager")
+
+	if cfg == nil {
+		err = ErrConfigMissing
+		return
+	}
+
+	return m.do(func() error {
+		return m.reload(cfg)
+	})
+}
+
+// Routes returns targets of cgroups routed by route manager,
+// sorted by path.
+func (m *RouteManager) Routes() (ret []types.Route, err error) {
+	defer Wrap(&err, "get routes of cgroups")
+
+	err = m.do(func() error {
+		paths := maps.Keys(m.cgroups)
+		sort.Strings(paths)
+
+		ret = m.genRoutes(paths)
+		return nil
+	})
+	return
+}
+
+// Config returns the configuration route manager is using.
+func (m *RouteManager) Config() (ret *config.Config, err error) {
+	defer Wrap(&err, "get configuration of route manager")
+
+	err = m.do(func() error {
+		ret = m.cfg
+		return nil
+	})
+	return
+}
+
+// Resync goes through cgroupfs again and updates routes of all cgroups,
+// which fixes routes of cgroups whose events have been lost.
+func (m *RouteManager) Resync() (err error) {
+	defer Wrap(&err, "resync route manager")
+
+	return m.do(m.resync)
+}
+
+// Reconcile goes through cgroupfs,
+// compares cgroups in it with cgroups known by route manager
+// and elements in the cgroup map, both recorded and in kernel,
+// then fixes differences found, which are left by cgroup events missed.
+// Unlike Resync, it only touches elements which are wrong.
+func (m *RouteManager) Reconcile() (ret types.Drift, err error) {
+	defer Wrap(&err, "reconcile route manager")
+
+	err = m.do(func() (err error) {
+		ret, err = m.reconcile()
+		return
+	})
+	return
+}
+
+// WaitCGroup waits until route manager has handled the cgroup at path,
+// which means rules for it have been installed if any rule matches it,
+// then returns the route of the cgroup.
+// Target of the route is noop if no rule matches the cgroup.
+func (m *RouteManager) WaitCGroup(ctx context.Context, path string) (ret types.Route, err error) {
+	defer Wrap(&err, "wait for cgroup %s", path)
+
+	result := make(chan error, 1)
+	err = m.do(func() error {
+		if _, ok := m.cgroups[path]; ok {
+			result <- nil
+			return nil
 		}
+
+		m.waiters[path] = append(m.waiters[path], result)
+		return nil
+	})
+	if err != nil {
+		return
 	}
 
-	<-ctx.Done()
-	return context.Cause(ctx)
+	select {
+	case <-ctx.Done():
+		_ = m.do(func() error {
+			m.removeWaiter(path, result)
+			return nil
+		})
+		err = context.Cause(ctx)
+		return
+	case <-m.done:
+		err = ErrRouteManagerStopped
+		return
+	case err = <-result:
+	}
+	if err != nil {
+		return
+	}
+
+	err = m.do(func() error {
+		ret = m.routeOf(path)
+		return nil
+	})
+	return
+}
+
+// SetOverride pins cgroups to a target regardless of rules in configuration,
+// the override of the same path is replaced.
+// Path of the override can be either in cgroupfs or relative to cgroup root.
+func (m *RouteManager) SetOverride(o types.Override) (err error) {
+	defer Wrap(&err, "set override of %s", o.Path)
+
+	return m.do(func() error {
+		return m.setOverride(o)
+	})
+}
+
+// RemoveOverride removes the override of the cgroup at path.
+func (m *RouteManager) RemoveOverride(path string) (err error) {
+	defer Wrap(&err, "remove override of %s", path)
+
+	return m.do(func() error {
+		return m.removeOverride(path)
+	})
+}
+
+// Overrides returns overrides in use, sorted by path.
+func (m *RouteManager) Overrides() (ret []types.Override, err error) {
+	defer Wrap(&err, "get overrides")
+
+	err = m.do(func() error {
+		ret = make([]types.Override, 0, len(m.overrides))
+		for _, o := range m.overrides {
+			ret = append(ret, o.Override)
+		}
+
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].Path < ret[j].Path
+		})
+		return nil
+	})
+	return
+}
+
+// Match checks the cgroup at path against rules in cfg
+// with the same first match logic route manager uses.
+// It returns the index of the matched rule and its target,
+// index is -1 if no rule matches.
+func Match(cfg *config.Config, path string) (index int, target types.Target, err error) {
+	defer Wrap(&err, "match cgroup %s", path)
+
+	if cfg == nil {
+		err = ErrConfigMissing
+		return
+	}
+
+	var matchers []*matcher
+	matchers, err = compileMatchers(cfg)
+	if err != nil {
+		return
+	}
+
+	index = firstMatch(matchers, cfg.CgroupRoot, path)
+	if index < 0 {
+		return
+	}
+
+	target = matchers[index].target
+	return
+}
+
+func (m *RouteManager) handleCGroupEvents(events *types.CGroupEvents) {
+	newCGroups := []string{}
+	deleteCGroups := []string{}
+
+	for i := range events.Events {
+		event := &events.Events[i]
+
+		switch event.EventType {
+		case types.CgroupEventTypeNew:
+			newCGroups = append(newCGroups, event.Path)
+		case types.CgroupEventTypeDelete:
+			deleteCGroups = append(deleteCGroups, event.Path)
+		}
+	}
+
+	newErr := m.handleNewCgroups(newCGroups)
+	delErr := m.handleDeleteCgroups(deleteCGroups)
+	eventsErr := errors.Join(newErr, delErr)
+
+	m.notifyWaiters(newCGroups, newErr)
+
+	if events.Result != nil {
+		events.Result <- eventsErr
+		close(events.Result)
+	}
 }
@@ -7,17 +7,28 @@ package routeman
 import (
 	"context"
 	"errors"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/cgtrace/replayer"
 	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/nftman"
+	"github.com/black-desk/cgtproxy/pkg/nftman/nfttest"
 	"github.com/black-desk/cgtproxy/pkg/types"
 	. "github.com/black-desk/lib/go/ginkgo-helper"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
 )
 
 func TestRouteManager(t *testing.T) {
@@ -28,9 +39,18 @@ func TestRouteManager(t *testing.T) {
 // fakeNFTManager is a test double for interfaces.NFTManager that records
 // every call instead of touching the kernel.
 type fakeNFTManager struct {
-	addedRoutes  []types.Route
-	removedPaths []string
-	addedChains  []*config.TProxy
+	addedRoutes       []types.Route
+	removedPaths      []string
+	replacedPaths     []string
+	replacedRoutes    []types.Route
+	addedChains       []*config.TProxy
+	addedRedirects    []*config.Redirect
+	addedRouteTargets []*config.Route
+	reloadedCfg       *config.Config
+	leftoverRemoved   bool
+	reloadedRoutes    []types.Route
+	elements          []types.CGroupElement
+	removedElements   []types.CGroupElement
 
 	inited   bool
 	cleared  bool
@@ -40,8 +60,10 @@ type fakeNFTManager struct {
 	addChainErr      error
 	addRoutesErr     error
 	removeRoutesErr  error
+	replaceRoutesErr error
 	clearErr         error
 	releaseErr       error
+	reloadErr        error
 }
 
 var _ interfaces.NFTManager = (*fakeNFTManager)(nil)
@@ -56,6 +78,16 @@ func (f *fakeNFTManager) AddChainAndRulesForTProxies(tps []*config.TProxy) error
 	return f.addChainErr
 }
 
+func (f *fakeNFTManager) AddChainAndRulesForRedirects(redirects []*config.Redirect) error {
+	f.addedRedirects = append(f.addedRedirects, redirects...)
+	return f.addChainErr
+}
+
+func (f *fakeNFTManager) AddChainAndRulesForRoutes(routes []*config.Route) error {
+	f.addedRouteTargets = append(f.addedRouteTargets, routes...)
+	return f.addChainErr
+}
+
 func (f *fakeNFTManager) AddRoutes(routes []types.Route) error {
 	f.addedRoutes = append(f.addedRoutes, routes...)
 	return f.addRoutesErr
@@ -66,16 +98,54 @@ func (f *fakeNFTManager) RemoveRoutes(paths []string) error {
 	return f.removeRoutesErr
 }
 
+func (f *fakeNFTManager) ReplaceRoutes(paths []string, routes []types.Route) error {
+	f.replacedPaths = append(f.replacedPaths, paths...)
+	f.replacedRoutes = append(f.replacedRoutes, routes...)
+	return f.replaceRoutesErr
+}
+
+func (f *fakeNFTManager) CGroupElements() ([]types.CGroupElement, error) {
+	return f.elements, nil
+}
+
+func (f *fakeNFTManager) RemoveCGroupElements(elements []types.CGroupElement) error {
+	f.removedElements = append(f.removedElements, elements...)
+	return nil
+}
+
 func (f *fakeNFTManager) Clear() error {
 	f.cleared = true
 	return f.clearErr
 }
 
+func (f *fakeNFTManager) Counters() ([]types.Counter, error) {
+	return nil, nil
+}
+
+func (f *fakeNFTManager) HasCGroup(path string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeNFTManager) RemoveLeftover() (bool, error) {
+	f.leftoverRemoved = true
+	return false, nil
+}
+
 func (f *fakeNFTManager) Release() error {
 	f.released = true
 	return f.releaseErr
 }
 
+func (f *fakeNFTManager) Reload(cfg *config.Config, routes []types.Route) error {
+	if f.reloadErr != nil {
+		return f.reloadErr
+	}
+
+	f.reloadedCfg = cfg
+	f.reloadedRoutes = routes
+	return nil
+}
+
 // mustConfig builds a validated *config.Config from raw YAML, panicking the
 // spec on failure.
 func mustConfig(yamlContent string) *config.Config {
@@ -92,6 +162,9 @@ tproxies:
   clash:
     port: 7893
     mark: 520
+redirects:
+  redsocks:
+    port: 12345
 rules:
   - match: .*proxy.*
     tproxy: clash
@@ -99,6 +172,42 @@ rules:
     direct: true
   - match: .*drop.*
     drop: true
+  - match: .*redsocks.*
+    redirect: redsocks
+  - match: .*/tc/.*
+    mark:
+      value: 0x100
+      mask: 0xff00
+  - match: .*/filtered/.*
+    direct: true
+    dns:
+      ip: 127.0.0.1
+      port: 5353
+  - match: .*/sandbox/.*
+    reject: port-unreachable
+  - match: .*/audited/.*
+    drop: true
+    log:
+      prefix: "audit: "
+      group: 2
+`
+
+const structuredConfigYAML = `
+version: 1
+cgroup-root: AUTO
+route-table: 300
+tproxies:
+  clash:
+    port: 7893
+    mark: 520
+rules:
+  - app-id: org.mozilla.firefox
+    uid: 1000
+    tproxy: clash
+  - unit: clash-meta
+    direct: true
+  - slice: cgtproxy-drop
+    drop: true
 `
 
 var _ = Describe("RouteManager", func() {
@@ -128,7 +237,7 @@ var _ = Describe("RouteManager", func() {
 				)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(m).ToNot(BeNil())
-				Expect(m.matchers).To(HaveLen(3))
+				Expect(m.matchers).To(HaveLen(8))
 			})
 
 			It("should accept a non-nil event channel", func() {
@@ -195,6 +304,8 @@ var _ = Describe("RouteManager", func() {
 				types.TargetDirect, "").WithFmt("/user/direct/app.service"),
 			ContextTableEntry("/user/drop/app.service",
 				types.TargetDrop, "").WithFmt("/user/drop/app.service"),
+			ContextTableEntry("/user/redsocks/app.service",
+				types.TargetRedirect, "redsocks-REDIRECT").WithFmt("/user/redsocks/app.service"),
 			func(path string, expectedOp types.TargetOp, expectedChain string) {
 				It("should produce a single route with the expected target", func() {
 					err := m.handleNewCgroups([]string{path})
@@ -208,6 +319,63 @@ var _ = Describe("RouteManager", func() {
 				})
 			})
 
+		Context("when a mark rule matches", func() {
+			It("should carry the mark in the target", func() {
+				err := m.handleNewCgroups([]string{"/user/tc/app.service"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(nft.addedRoutes).To(HaveLen(1))
+				Expect(nft.addedRoutes[0].Target).To(Equal(types.Target{
+					Op:       types.TargetMark,
+					Mark:     0x100,
+					MarkMask: 0xff00,
+					Rule:     "rule-4",
+				}))
+			})
+		})
+
+		Context("when a reject rule matches", func() {
+			It("should carry the reason in the target", func() {
+				err := m.handleNewCgroups([]string{"/user/sandbox/app.service"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(nft.addedRoutes).To(HaveLen(1))
+				Expect(nft.addedRoutes[0].Target).To(Equal(types.Target{
+					Op:         types.TargetReject,
+					RejectWith: config.RejectWithPortUnreachable,
+					Rule:       "rule-6",
+				}))
+			})
+		})
+
+		Context("when a rule with log matches", func() {
+			It("should carry the log in the target", func() {
+				err := m.handleNewCgroups([]string{"/user/audited/app.service"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(nft.addedRoutes).To(HaveLen(1))
+				target := nft.addedRoutes[0].Target
+				Expect(target.Op).To(Equal(types.TargetDrop))
+				Expect(target.Log).ToNot(BeNil())
+				Expect(target.Log.Prefix).To(Equal("audit: "))
+				Expect(*target.Log.Group).To(Equal(uint16(2)))
+			})
+		})
+
+		Context("when a rule with dns matches", func() {
+			It("should carry the dns in the target", func() {
+				err := m.handleNewCgroups([]string{"/user/filtered/app.service"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(nft.addedRoutes).To(HaveLen(1))
+				target := nft.addedRoutes[0].Target
+				Expect(target.Op).To(Equal(types.TargetDirect))
+				Expect(target.DNS).ToNot(BeNil())
+				Expect(*target.DNS.IP).To(Equal("127.0.0.1"))
+				Expect(target.DNS.Port).To(Equal(uint16(5353)))
+			})
+		})
+
 		Context("when no rule matches", func() {
 			It("should not add any route", func() {
 				err := m.handleNewCgroups([]string{"/nothing-matches-here"})
@@ -256,6 +424,58 @@ var _ = Describe("RouteManager", func() {
 		})
 	})
 
+	Describe("handleNewCgroups with structured rules", func() {
+		var (
+			m   *RouteManager
+			nft *fakeNFTManager
+			cfg *config.Config
+		)
+
+		BeforeEach(func() {
+			nft = &fakeNFTManager{}
+			cfg = mustConfig(structuredConfigYAML)
+			m, _ = New(WithConfig(cfg), WithNFTMan(nft))
+		})
+
+		ContextTable("cgroup %s",
+			ContextTableEntry(
+				"/user.slice/user-1000.slice/user@1000.service/app.slice/app-gnome-org.mozilla.firefox-1.scope",
+				types.TargetTProxy,
+			).WithFmt("of application launched by GNOME"),
+			ContextTableEntry(
+				"/user.slice/user-1000.slice/user@1000.service/app.slice/app-org.mozilla.firefox@a1.service",
+				types.TargetTProxy,
+			).WithFmt("of application launched by KDE"),
+			ContextTableEntry(
+				"/user.slice/user-1001.slice/user@1001.service/app.slice/app-gnome-org.mozilla.firefox-1.scope",
+				types.TargetNoop,
+			).WithFmt("of application of another user"),
+			ContextTableEntry(
+				"/system.slice/clash-meta.service",
+				types.TargetDirect,
+			).WithFmt("of a service"),
+			ContextTableEntry(
+				"/user.slice/user-1001.slice/user@1001.service/cgtproxy.slice/cgtproxy-drop.slice/run-u1.service",
+				types.TargetDrop,
+			).WithFmt("in a slice"),
+			func(path string, expectedOp types.TargetOp) {
+				It("should match the expected rule", func() {
+					err := m.handleNewCgroups(
+						[]string{string(cfg.CgroupRoot) + path},
+					)
+					Expect(err).ToNot(HaveOccurred())
+
+					if expectedOp == types.TargetNoop {
+						Expect(nft.addedRoutes).To(BeEmpty())
+						return
+					}
+
+					Expect(nft.addedRoutes).To(HaveLen(1))
+					Expect(nft.addedRoutes[0].Target.Op).To(Equal(expectedOp))
+				})
+			})
+	})
+
 	Describe("handleDeleteCgroups", func() {
 		var (
 			m   *RouteManager
@@ -288,6 +508,782 @@ var _ = Describe("RouteManager", func() {
 	})
 })
 
+// reloadConfigYAML has no tproxy, so reloading between it and
+// reloadedConfigYAML never touches ip rules or routes.
+const reloadConfigYAML = `
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: .*direct.*
+    direct: true
+`
+
+const reloadedConfigYAML = `
+version: 1
+cgroup-root: AUTO
+route-table: 300
+rules:
+  - match: .*direct.*
+    drop: true
+  - match: .*unmatched.*
+    direct: true
+`
+
+var _ = Describe("reload", func() {
+	var (
+		m   *RouteManager
+		nft *fakeNFTManager
+	)
+
+	BeforeEach(func() {
+		var err error
+		nft = &fakeNFTManager{}
+		m, err = New(
+			WithConfig(mustConfig(reloadConfigYAML)),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(m.handleNewCgroups([]string{
+			"/user/direct/app.service",
+			"/user/unmatched/app.service",
+			"/user/gone/app.service",
+		})).To(Succeed())
+		Expect(m.handleDeleteCgroups([]string{
+			"/user/gone/app.service",
+		})).To(Succeed())
+	})
+
+	It("should check every known cgroup against the new rules", func() {
+		cfg := mustConfig(reloadedConfigYAML)
+		Expect(m.reload(cfg)).To(Succeed())
+
+		Expect(nft.reloadedCfg).To(BeIdenticalTo(cfg))
+		Expect(nft.reloadedRoutes).To(ConsistOf(
+			types.Route{
+				Path:   "/user/direct/app.service",
+				Target: types.Target{Op: types.TargetDrop, Rule: "rule-0"},
+			},
+			types.Route{
+				Path:   "/user/unmatched/app.service",
+				Target: types.Target{Op: types.TargetDirect, Rule: "rule-1"},
+			},
+		))
+
+		Expect(m.cfg).To(BeIdenticalTo(cfg))
+		Expect(m.matchers).To(HaveLen(2))
+	})
+
+	It("should keep the old configuration if nft rejects the new one", func() {
+		old := m.cfg
+		injected := errors.New("injected reload failure")
+		nft.reloadErr = injected
+
+		err := m.reload(mustConfig(reloadedConfigYAML))
+		Expect(err).To(MatchError(injected))
+
+		Expect(m.cfg).To(BeIdenticalTo(old))
+		Expect(m.matchers).To(HaveLen(1))
+	})
+
+	It("should keep the old configuration if the new rules are invalid", func() {
+		old := m.cfg
+		cfg := mustConfig(reloadedConfigYAML)
+		cfg.Rules[0].Match = "["
+
+		Expect(m.reload(cfg)).ToNot(Succeed())
+		Expect(nft.reloadedCfg).To(BeNil())
+		Expect(m.cfg).To(BeIdenticalTo(old))
+	})
+
+	It("should refuse to change the cgroup root", func() {
+		cfg := mustConfig(reloadedConfigYAML)
+		cfg.CgroupRoot = "/somewhere/else"
+
+		Expect(m.reload(cfg)).To(MatchError(ErrCGroupRootChanged))
+		Expect(nft.reloadedCfg).To(BeNil())
+	})
+})
+
+var _ = Describe("overrides", func() {
+	var (
+		m    *RouteManager
+		nft  *fakeNFTManager
+		root string
+		file string
+	)
+
+	BeforeEach(func() {
+		var err error
+		cfg := mustConfig(testConfigYAML)
+		file = filepath.Join(GinkgoT().TempDir(), "state", "overrides.json")
+		cfg.OverridesFile = file
+
+		nft = &fakeNFTManager{}
+		m, err = New(
+			WithConfig(cfg),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		root = string(cfg.CgroupRoot)
+		Expect(m.handleNewCgroups([]string{
+			root + "/user/proxy/app.service",
+			root + "/user/proxy/app.service/sub",
+			root + "/user/other.service",
+		})).To(Succeed())
+		nft.addedRoutes = nil
+	})
+
+	It("should pin a cgroup to the target regardless of rules", func() {
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/proxy/app.service",
+			Target: "direct",
+		})).To(Succeed())
+
+		Expect(nft.replacedPaths).To(ConsistOf(
+			root+"/user/proxy/app.service",
+			root+"/user/proxy/app.service/sub",
+		))
+		Expect(nft.replacedRoutes).To(ConsistOf(
+			types.Route{
+				Path:   root + "/user/proxy/app.service",
+				Target: types.Target{Op: types.TargetDirect},
+			},
+			types.Route{
+				Path: root + "/user/proxy/app.service/sub",
+				Target: types.Target{
+					Op: types.TargetTProxy, Chain: "clash-MARK", Rule: "rule-0",
+				},
+			},
+		))
+	})
+
+	It("should pin a subtree to the target", func() {
+		Expect(m.setOverride(types.Override{
+			Path:    root + "/user/proxy/app.service",
+			Subtree: true,
+			Target:  "reject",
+		})).To(Succeed())
+
+		target := types.Target{
+			Op:         types.TargetReject,
+			RejectWith: config.RejectWithAdminProhibited,
+		}
+		Expect(nft.replacedRoutes).To(ConsistOf(
+			types.Route{Path: root + "/user/proxy/app.service", Target: target},
+			types.Route{Path: root + "/user/proxy/app.service/sub", Target: target},
+		))
+
+		Expect(m.handleNewCgroups([]string{
+			root + "/user/proxy/app.service/new",
+		})).To(Succeed())
+		Expect(nft.addedRoutes).To(ConsistOf(
+			types.Route{Path: root + "/user/proxy/app.service/new", Target: target},
+		))
+	})
+
+	It("should restore rules after the override is removed", func() {
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/other.service",
+			Target: "tproxy:clash",
+		})).To(Succeed())
+		Expect(nft.replacedRoutes).To(ConsistOf(types.Route{
+			Path:   root + "/user/other.service",
+			Target: types.Target{Op: types.TargetTProxy, Chain: "clash-MARK"},
+		}))
+
+		nft.replacedRoutes = nil
+		Expect(m.removeOverride("/user/other.service")).To(Succeed())
+		Expect(nft.replacedRoutes).To(BeEmpty())
+		Expect(nft.replacedPaths).To(Equal([]string{
+			root + "/user/other.service",
+			root + "/user/other.service",
+		}))
+
+		Expect(m.removeOverride("/user/other.service")).
+			To(MatchError(ErrOverrideNotFound))
+	})
+
+	It("should pin a cgroup to a mark", func() {
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/other.service",
+			Target: "mark:0x1ff/0xff",
+		})).To(Succeed())
+		Expect(nft.replacedRoutes).To(ConsistOf(types.Route{
+			Path: root + "/user/other.service",
+			Target: types.Target{
+				Op:       types.TargetMark,
+				Mark:     0x1ff,
+				MarkMask: 0xff,
+			},
+		}))
+	})
+
+	It("should refuse invalid targets", func() {
+		for _, target := range []string{
+			"", "proxy", "tproxy:unknown", "redirect:", "reject:nope", "direct:x",
+			"mark:", "mark:x", "mark:1/x", "mark:0x1ffffffff",
+			// NOTE: 520 is the mark of tproxy clash.
+			"mark:520", "mark:0x1208/0xfff",
+		} {
+			Expect(m.setOverride(types.Override{
+				Path:   "/user/other.service",
+				Target: target,
+			})).To(MatchError(ErrOverrideTargetInvalid), target)
+		}
+
+		Expect(m.overrides).To(BeEmpty())
+		Expect(nft.replacedPaths).To(BeEmpty())
+	})
+
+	It("should keep the old override if nft fails", func() {
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/other.service",
+			Target: "drop",
+		})).To(Succeed())
+
+		injected := errors.New("injected replace failure")
+		nft.replaceRoutesErr = injected
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/other.service",
+			Target: "direct",
+		})).To(MatchError(injected))
+
+		Expect(m.overrides).To(HaveKey(root + "/user/other.service"))
+		Expect(m.overrides[root+"/user/other.service"].Target).To(Equal("drop"))
+	})
+
+	It("should persist overrides and load them again", func() {
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/other.service",
+			Target: "redirect:redsocks",
+		})).To(Succeed())
+		Expect(file).ToNot(BeAnExistingFile())
+
+		Expect(m.setOverride(types.Override{
+			Path:    "/user/proxy/app.service",
+			Subtree: true,
+			Target:  "drop",
+			Persist: true,
+		})).To(Succeed())
+		Expect(file).To(BeAnExistingFile())
+
+		cfg := mustConfig(testConfigYAML)
+		cfg.OverridesFile = file
+		another, err := New(WithConfig(cfg), WithNFTMan(&fakeNFTManager{}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(another.loadOverrides()).To(Succeed())
+
+		Expect(maps.Keys(another.overrides)).To(ConsistOf(
+			root + "/user/proxy/app.service",
+		))
+		Expect(another.overrides[root+"/user/proxy/app.service"].Override).
+			To(Equal(types.Override{
+				Path:    root + "/user/proxy/app.service",
+				Subtree: true,
+				Target:  "drop",
+				Persist: true,
+			}))
+
+		Expect(m.removeOverride("/user/proxy/app.service")).To(Succeed())
+		content, err := os.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(content)).To(Equal("[]\n"))
+	})
+
+	It("should refuse to persist without an overrides file", func() {
+		m.cfg.OverridesFile = ""
+		Expect(m.setOverride(types.Override{
+			Path:    "/user/other.service",
+			Target:  "direct",
+			Persist: true,
+		})).To(MatchError(ErrOverridesFileMissing))
+	})
+
+	It("should drop overrides whose target is gone on reload", func() {
+		// Configurations without tproxy,
+		// so that reloading never touches ip rules or routes.
+		cfg := mustConfig(reloadConfigYAML)
+		cfg.Redirects = mustConfig(testConfigYAML).Redirects
+		nft = &fakeNFTManager{}
+		m, err := New(WithConfig(cfg), WithNFTMan(nft))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.handleNewCgroups([]string{
+			root + "/user/proxy/app.service",
+			root + "/user/other.service",
+		})).To(Succeed())
+
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/other.service",
+			Target: "redirect:redsocks",
+		})).To(Succeed())
+		Expect(m.setOverride(types.Override{
+			Path:   "/user/proxy/app.service",
+			Target: "direct",
+		})).To(Succeed())
+
+		Expect(m.reload(mustConfig(reloadedConfigYAML))).To(Succeed())
+
+		Expect(maps.Keys(m.overrides)).To(ConsistOf(
+			root + "/user/proxy/app.service",
+		))
+		Expect(nft.reloadedRoutes).To(ConsistOf(types.Route{
+			Path:   root + "/user/proxy/app.service",
+			Target: types.Target{Op: types.TargetDirect},
+		}))
+	})
+})
+
+var _ = Describe("WaitCGroup", func() {
+	var (
+		m      *RouteManager
+		nft    *fakeNFTManager
+		events chan types.CGroupEvents
+		ctx    context.Context
+		cancel context.CancelFunc
+		done   chan error
+	)
+
+	BeforeEach(func() {
+		var err error
+		nft = &fakeNFTManager{}
+		events = make(chan types.CGroupEvents)
+		m, err = New(
+			WithConfig(mustConfig(testConfigYAML)),
+			WithNFTMan(nft),
+			WithCGroupEventChan(events),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Run the event loop only, which is all WaitCGroup needs.
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					close(m.done)
+					close(done)
+					return
+				case op := <-m.ops:
+					op.result <- op.fn()
+					close(op.result)
+				case e := <-events:
+					m.handleCGroupEvents(&e)
+				}
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(BeClosed())
+	})
+
+	newCGroup := func(path string) {
+		events <- types.CGroupEvents{Events: []types.CGroupEvent{
+			{Path: path, EventType: types.CgroupEventTypeNew},
+		}}
+	}
+
+	It("should return at once for known cgroups", func() {
+		newCGroup("/user/proxy/app.service")
+
+		route, err := m.WaitCGroup(ctx, "/user/proxy/app.service")
+		Expect(err).To(Succeed())
+		Expect(route.Target).To(Equal(types.Target{
+			Op: types.TargetTProxy, Chain: "clash-MARK", Rule: "rule-0",
+		}))
+	})
+
+	It("should wait until the cgroup is handled", func() {
+		result := make(chan types.Route)
+		go func() {
+			defer GinkgoRecover()
+
+			route, err := m.WaitCGroup(ctx, "/user/direct/app.service")
+			Expect(err).To(Succeed())
+			result <- route
+		}()
+
+		Consistently(result).ShouldNot(Receive())
+		Eventually(func() int {
+			n := 0
+			Expect(m.do(func() error {
+				n = len(m.waiters)
+				return nil
+			})).To(Succeed())
+			return n
+		}).Should(Equal(1))
+
+		newCGroup("/user/direct/app.service")
+
+		var route types.Route
+		Eventually(result).Should(Receive(&route))
+		Expect(route.Target.Op).To(Equal(types.TargetDirect))
+		Expect(nft.addedRoutes).To(ContainElement(route))
+	})
+
+	It("should return a noop target if no rule matches", func() {
+		newCGroup("/user/unmatched/app.service")
+
+		route, err := m.WaitCGroup(ctx, "/user/unmatched/app.service")
+		Expect(err).To(Succeed())
+		Expect(route.Target.Op).To(Equal(types.TargetNoop))
+	})
+
+	It("should report failure of installing rules", func() {
+		injected := errors.New("injected add failure")
+		nft.addRoutesErr = injected
+
+		result := make(chan error)
+		go func() {
+			_, err := m.WaitCGroup(ctx, "/user/proxy/app.service")
+			result <- err
+		}()
+
+		Eventually(func() int {
+			n := 0
+			Expect(m.do(func() error {
+				n = len(m.waiters)
+				return nil
+			})).To(Succeed())
+			return n
+		}).Should(Equal(1))
+
+		newCGroup("/user/proxy/app.service")
+		Eventually(result).Should(Receive(MatchError(injected)))
+	})
+
+	It("should stop waiting when cancelled", func() {
+		waitCtx, waitCancel := context.WithCancel(ctx)
+		waitCancel()
+
+		_, err := m.WaitCGroup(waitCtx, "/user/proxy/app.service")
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(m.do(func() error {
+			Expect(m.waiters).To(BeEmpty())
+			return nil
+		})).To(Succeed())
+	})
+
+	It("should stop waiting when route manager stops", func() {
+		result := make(chan error)
+		go func() {
+			_, err := m.WaitCGroup(context.Background(), "/user/proxy/app.service")
+			result <- err
+		}()
+
+		Eventually(func() int {
+			n := 0
+			Expect(m.do(func() error {
+				n = len(m.waiters)
+				return nil
+			})).To(Succeed())
+			return n
+		}).Should(Equal(1))
+
+		cancel()
+		Eventually(result).Should(Receive(MatchError(ErrRouteManagerStopped)))
+	})
+
+	It("should fail calls after route manager stops", func() {
+		cancel()
+		Eventually(done).Should(BeClosed())
+
+		_, err := m.Routes()
+		Expect(err).To(MatchError(ErrRouteManagerStopped))
+		Expect(m.Reload(mustConfig(testConfigYAML))).To(MatchError(ErrRouteManagerStopped))
+	})
+})
+
+var _ = Describe("Match", func() {
+	var cfg *config.Config
+
+	BeforeEach(func() {
+		cfg = mustConfig(testConfigYAML)
+	})
+
+	It("should return the first matching rule", func() {
+		index, target, err := Match(cfg, "/user/proxy/direct/app.service")
+		Expect(err).To(Succeed())
+		Expect(index).To(Equal(0))
+		Expect(target).To(Equal(types.Target{
+			Op: types.TargetTProxy, Chain: "clash-MARK", Rule: "rule-0",
+		}))
+	})
+
+	It("should return -1 if no rule matches", func() {
+		index, target, err := Match(cfg, "/user/unmatched/app.service")
+		Expect(err).To(Succeed())
+		Expect(index).To(Equal(-1))
+		Expect(target.Op).To(Equal(types.TargetNoop))
+	})
+
+	It("should fail on invalid rules", func() {
+		cfg.Rules[0].Match = "["
+
+		_, _, err := Match(cfg, "/user/proxy/app.service")
+		Expect(err).ToNot(Succeed())
+	})
+})
+
+var _ = Describe("resync", func() {
+	var (
+		m    *RouteManager
+		nft  *fakeNFTManager
+		root string
+	)
+
+	BeforeEach(func() {
+		var err error
+		nft = &fakeNFTManager{}
+		m, err = New(
+			WithConfig(mustConfig(testConfigYAML)),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		root = GinkgoT().TempDir()
+		m.cfg.CgroupRoot = config.CGroupRoot(root)
+
+		for _, dir := range []string{
+			"user/proxy/app.service",
+			"user/unmatched/app.service",
+		} {
+			Expect(os.MkdirAll(filepath.Join(root, dir), 0755)).To(Succeed())
+		}
+
+		Expect(m.handleNewCgroups([]string{
+			root + "/user/gone/app.service",
+		})).To(Succeed())
+	})
+
+	It("should route cgroups found in cgroupfs only", func() {
+		Expect(m.resync()).To(Succeed())
+
+		Expect(nft.reloadedCfg).To(BeIdenticalTo(m.cfg))
+		target := types.Target{
+			Op: types.TargetTProxy, Chain: "clash-MARK", Rule: "rule-0",
+		}
+		Expect(nft.reloadedRoutes).To(ConsistOf(
+			types.Route{Path: root + "/user/proxy", Target: target},
+			types.Route{Path: root + "/user/proxy/app.service", Target: target},
+		))
+
+		Expect(m.cgroups).To(HaveKey(root + "/user/unmatched/app.service"))
+		Expect(m.cgroups).ToNot(HaveKey(root + "/user/gone/app.service"))
+	})
+
+	It("should keep tracked cgroups if nft fails", func() {
+		injected := errors.New("injected reload failure")
+		nft.reloadErr = injected
+
+		Expect(m.resync()).To(MatchError(injected))
+		Expect(m.cgroups).To(HaveKey(root + "/user/gone/app.service"))
+	})
+})
+
+var _ = Describe("FillNftable", func() {
+	It("should add chains in order of names and route existing cgroups", func() {
+		nft := &fakeNFTManager{}
+		m, err := New(
+			WithConfig(mustConfig(testConfigYAML)),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		root := GinkgoT().TempDir()
+		m.cfg.CgroupRoot = config.CGroupRoot(root)
+		Expect(os.MkdirAll(filepath.Join(root, "user/proxy"), 0755)).To(Succeed())
+
+		Expect(m.FillNftable()).To(Succeed())
+
+		Expect(nft.inited).To(BeTrue())
+		Expect(nft.addedChains).To(HaveLen(1))
+		Expect(nft.addedRedirects).To(HaveLen(1))
+		target := types.Target{
+			Op: types.TargetTProxy, Chain: "clash-MARK", Rule: "rule-0",
+		}
+		Expect(nft.addedRoutes).To(ConsistOf(
+			types.Route{Path: root + "/user/proxy", Target: target},
+		))
+	})
+})
+
+// Traces in testdata are recorded by `cgtproxy --record-events`,
+// they are replayed into a route manager
+// using a real NFTManager on an in-memory ruleset.
+var _ = Describe("replay", func() {
+	var (
+		root string
+		conn *nfttest.Connector
+		m    *RouteManager
+	)
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+
+		var err error
+		conn, err = nfttest.New()
+		Expect(err).ToNot(HaveOccurred())
+
+		nft, err := nftman.New(
+			nftman.WithCgroupRoot(config.CGroupRoot(root)),
+			nftman.WithConnFactory(conn),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		m, err = New(
+			WithConfig(mustConfig(testConfigYAML)),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		m.cfg.CgroupRoot = config.CGroupRoot(root)
+
+		Expect(m.FillNftable()).To(Succeed())
+	})
+
+	replay := func(trace string) {
+		r, err := replayer.New(
+			replayer.WithTrace(trace),
+			replayer.WithCgroupRoot(config.CGroupRoot(root)),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		done := make(chan error, 1)
+		go func() { done <- r.RunCGroupMonitor(context.Background()) }()
+
+		for events := range r.Events() {
+			m.handleCGroupEvents(&events)
+		}
+
+		Expect(<-done).To(Succeed())
+	}
+
+	It("should keep routes of cgroups survived a storm at boot only", func() {
+		replay("testdata/boot-storm.jsonl")
+
+		r, err := conn.Ruleset()
+		Expect(err).ToNot(HaveOccurred())
+
+		cgroupMap := r.Table(nftables.TableFamilyINet, nftman.NftTableName).
+			Set("cgroup-vmap")
+		Expect(cgroupMap.Elements).To(HaveLen(1))
+
+		info, err := os.Stat(filepath.Join(root, "user.slice/direct.service"))
+		Expect(err).ToNot(HaveOccurred())
+		e := cgroupMap.Element(binaryutil.NativeEndian.PutUint64(
+			info.Sys().(*syscall.Stat_t).Ino,
+		))
+		Expect(e).ToNot(BeNil())
+		Expect(e.VerdictData.Chain).To(Equal("RULE-1-DIRECT"))
+	})
+})
+
+var _ = Describe("reconcile", func() {
+	var (
+		root string
+		conn *nfttest.Connector
+		m    *RouteManager
+	)
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		Expect(os.MkdirAll(filepath.Join(root, "user.slice/proxy.service"), 0o755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(root, "user.slice/direct.service"), 0o755)).To(Succeed())
+
+		var err error
+		conn, err = nfttest.New()
+		Expect(err).ToNot(HaveOccurred())
+
+		nft, err := nftman.New(
+			nftman.WithCgroupRoot(config.CGroupRoot(root)),
+			nftman.WithConnFactory(conn),
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		m, err = New(
+			WithConfig(mustConfig(testConfigYAML)),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		m.cfg.CgroupRoot = config.CGroupRoot(root)
+
+		Expect(m.FillNftable()).To(Succeed())
+	})
+
+	keyOf := func(path string) []byte {
+		info, err := os.Stat(filepath.Join(root, path))
+		Expect(err).ToNot(HaveOccurred())
+		return binaryutil.NativeEndian.PutUint64(info.Sys().(*syscall.Stat_t).Ino)
+	}
+
+	It("should find nothing if no event has been missed", func() {
+		drift, err := m.reconcile()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(drift).To(Equal(types.Drift{}))
+	})
+
+	It("should fix cgroups whose events have been missed", func() {
+		Expect(os.Mkdir(filepath.Join(root, "user.slice/late-direct.service"), 0o755)).To(Succeed())
+		Expect(os.Remove(filepath.Join(root, "user.slice/direct.service"))).To(Succeed())
+
+		// Elements changed behind route manager:
+		// the one of proxy.service is lost,
+		// and one nobody knows shows up.
+		c, err := conn.Connect()
+		Expect(err).ToNot(HaveOccurred())
+
+		cgroupMap := &nftables.Set{
+			Table: &nftables.Table{
+				Name:   nftman.NftTableName,
+				Family: nftables.TableFamilyINet,
+			},
+			Name:         "cgroup-vmap",
+			KeyType:      nftables.TypeCGroupV2,
+			DataType:     nftables.TypeVerdict,
+			IsMap:        true,
+			KeyByteOrder: binaryutil.NativeEndian,
+		}
+		Expect(c.SetDeleteElements(cgroupMap, []nftables.SetElement{{
+			Key: keyOf("user.slice/proxy.service"),
+		}})).To(Succeed())
+		Expect(c.SetAddElements(cgroupMap, []nftables.SetElement{{
+			Key:         binaryutil.NativeEndian.PutUint64(1 << 40),
+			VerdictData: &expr.Verdict{Kind: expr.VerdictGoto, Chain: "DIRECT"},
+		}})).To(Succeed())
+		Expect(c.Flush()).To(Succeed())
+
+		drift, err := m.reconcile()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(drift).To(Equal(types.Drift{
+			Created: 1, Deleted: 1, Stale: 1, Orphans: 1,
+		}))
+
+		r, err := conn.Ruleset()
+		Expect(err).ToNot(HaveOccurred())
+
+		set := r.Table(nftables.TableFamilyINet, nftman.NftTableName).
+			Set("cgroup-vmap")
+		Expect(set.Elements).To(HaveLen(2))
+
+		e := set.Element(keyOf("user.slice/proxy.service"))
+		Expect(e).ToNot(BeNil())
+		Expect(e.VerdictData.Chain).To(Equal("RULE-0-clash-MARK"))
+
+		e = set.Element(keyOf("user.slice/late-direct.service"))
+		Expect(e).ToNot(BeNil())
+		Expect(e.VerdictData.Chain).To(Equal("RULE-1-DIRECT"))
+
+		drift, err = m.reconcile()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(drift.Total()).To(BeZero())
+	})
+})
+
 // RunRouteManager drives real netlink (ip rule / ip route) on top of the
 // NFTManager interface, so it is exercised against the sandbox network
 // namespace with a fake NFTManager injected. This covers addRoute, addRule,
@@ -383,4 +1379,281 @@ var _ = Describe("RunRouteManager (sandbox)", Ordered, func() {
 		Expect(nft.cleared).To(BeTrue())
 		Expect(nft.released).To(BeTrue())
 	})
+
+	It("should stop at once without handling what is left", func() {
+		result := make(chan error, 1)
+		go func() {
+			ch <- types.CGroupEvents{
+				Events: []types.CGroupEvent{{
+					Path:      "/user/proxy/app.service",
+					EventType: types.CgroupEventTypeNew,
+				}},
+				Result: result,
+			}
+		}()
+		Eventually(result, "5s").Should(Receive(BeNil()))
+
+		cancel()
+		tearedDown = true
+
+		var err error
+		Eventually(done, "5s").Should(Receive(&err))
+		Expect(err).To(MatchError(context.Canceled))
+
+		By("dropping cgroup events not received yet")
+		left := types.CGroupEvents{Events: []types.CGroupEvent{{
+			Path:      "/user/direct/app.service",
+			EventType: types.CgroupEventTypeNew,
+		}}}
+		Consistently(ch).ShouldNot(BeSent(left))
+		close(ch)
+		Expect(nft.addedRoutes).To(HaveLen(1))
+
+		By("failing calls not handled yet")
+		_, err = m.Routes()
+		Expect(err).To(MatchError(ErrRouteManagerStopped))
+		Expect(m.Reload(mustConfig(testConfigYAML))).
+			To(MatchError(ErrRouteManagerStopped))
+	})
+
+	It("should move ip rules to the new marks on reload", func() {
+		cfg := mustConfig(testConfigYAML)
+		cfg.TProxies["clash"].Mark = 521
+
+		Expect(m.Reload(cfg)).To(Succeed())
+		Expect(nft.reloadedCfg).To(BeIdenticalTo(cfg))
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+
+		marks := []uint32{}
+		for _, rule := range rules {
+			if rule.Table == cfg.RouteTable {
+				marks = append(marks, rule.Mark)
+			}
+		}
+		Expect(marks).To(ConsistOf(uint32(521)))
+	})
+
+	It("should add and remove policy routes on reload", func() {
+		// Not every sandbox kernel can create dummy links,
+		// so loopback plays the VPN interface here.
+		link, err := netlink.LinkByName("lo")
+		Expect(err).ToNot(HaveOccurred())
+
+		cfg := mustConfig(testConfigYAML + `
+routes:
+  vpn:
+    interface: lo
+    table: 400
+    mark: 600
+`)
+		Expect(m.Reload(cfg)).To(Succeed())
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rules).To(ContainElement(And(
+			HaveField("Mark", uint32(600)),
+			HaveField("Table", 400),
+		)))
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: 400}, netlink.RT_FILTER_TABLE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routes).To(ContainElement(
+			HaveField("LinkIndex", link.Attrs().Index),
+		))
+
+		Expect(m.Reload(mustConfig(testConfigYAML))).To(Succeed())
+
+		rules, err = netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rules).ToNot(ContainElement(HaveField("Table", 400)))
+
+		routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: 400}, netlink.RT_FILTER_TABLE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routes).To(BeEmpty())
+	})
+
+	It("should send traffic of policy routes to the gateway", func() {
+		link, err := netlink.LinkByName("lo")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(m.Reload(mustConfig(testConfigYAML + `
+routes:
+  lan:
+    interface: lo
+    gateway: 127.0.0.1
+    table: 402
+    mark: 602
+`))).To(Succeed())
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: 402}, netlink.RT_FILTER_TABLE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routes).To(ConsistOf(And(
+			HaveField("LinkIndex", link.Attrs().Index),
+			HaveField("Gw", Equal(net.IPv4(127, 0, 0, 1).To4())),
+		)))
+
+		Expect(m.Reload(mustConfig(testConfigYAML))).To(Succeed())
+
+		routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: 402}, netlink.RT_FILTER_TABLE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routes).To(BeEmpty())
+	})
+
+	It("should keep rules and routes not added by itself", func() {
+		link, err := netlink.LinkByName("lo")
+		Expect(err).ToNot(HaveOccurred())
+
+		By("adding a rule and a route as the administrator does")
+		rule := netlink.NewRule()
+		rule.Family = netlink.FAMILY_V4
+		rule.Mark = 603
+		rule.Table = 403
+		Expect(netlink.RuleAdd(rule)).To(Succeed())
+		DeferCleanup(netlink.RuleDel, rule)
+
+		_, cidr, err := net.ParseCIDR("0.0.0.0/0")
+		Expect(err).ToNot(HaveOccurred())
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       cidr,
+			Table:     403,
+		}
+		Expect(netlink.RouteAdd(route)).To(Succeed())
+		DeferCleanup(netlink.RouteDel, route)
+
+		By("adding and removing a policy route using them")
+		cfg := testConfigYAML + `
+routes:
+  vpn:
+    interface: lo
+    table: 403
+    mark: 603
+`
+		Expect(m.Reload(mustConfig(cfg))).To(Succeed())
+
+		// Changing the route makes the policy route added again,
+		// which must not take the rule of the administrator as its own.
+		Expect(m.Reload(mustConfig(strings.Replace(
+			cfg, "table: 403", "table: 403\n    masquerade: true", 1,
+		)))).To(Succeed())
+
+		Expect(m.Reload(mustConfig(testConfigYAML))).To(Succeed())
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rules).To(ContainElement(And(
+			HaveField("Mark", uint32(603)),
+			HaveField("Table", 403),
+		)))
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4,
+			&netlink.Route{Table: 403}, netlink.RT_FILTER_TABLE)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routes).To(HaveLen(1))
+	})
+
+	It("should remove ip rules added for a rejected reload", func() {
+		nft.reloadErr = errors.New("injected reload failure")
+
+		cfg := mustConfig(testConfigYAML)
+		cfg.TProxies["clash"].Mark = 522
+
+		Expect(m.Reload(cfg)).ToNot(Succeed())
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+
+		marks := []uint32{}
+		for _, rule := range rules {
+			if rule.Table == cfg.RouteTable {
+				marks = append(marks, rule.Mark)
+			}
+		}
+		Expect(marks).To(ConsistOf(uint32(520)))
+	})
+})
+
+var _ = Describe("Cleanup (sandbox)", func() {
+	BeforeEach(func() {
+		if !(os.Geteuid() == 0 && os.Getenv("CGTPROXY_TEST_NFTMAN") == "1") {
+			Skip("Cleanup needs the sandbox network namespace; run via `make test`")
+		}
+
+		lo, err := netlink.LinkByName("lo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(netlink.LinkSetUp(lo)).To(Succeed())
+	})
+
+	const cfgYAML = testConfigYAML + `
+routes:
+  vpn:
+    interface: lo
+    table: 401
+    mark: 601
+`
+
+	It("should remove routes and rules left by a killed cgtproxy", func() {
+		By("leaving routes and rules as a killed cgtproxy does")
+		killed, err := New(
+			WithConfig(mustConfig(cfgYAML)),
+			WithNFTMan(&fakeNFTManager{}),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(killed.addRoute()).To(Succeed())
+		Expect(killed.addRule(520)).To(Succeed())
+		_, err = killed.addPolicyRoute(killed.cfg.Routes["vpn"], nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		By("adding a rule looking up route-table as the administrator does")
+		// A mark not in configuration.
+		rule := netlink.NewRule()
+		rule.Family = netlink.FAMILY_V4
+		rule.Mark = 519
+		rule.Table = 300
+		Expect(netlink.RuleAdd(rule)).To(Succeed())
+		DeferCleanup(netlink.RuleDel, rule)
+
+		By("cleaning up with another route manager")
+		nft := &fakeNFTManager{}
+		m, err := New(
+			WithConfig(mustConfig(cfgYAML)),
+			WithNFTMan(nft),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Cleanup()).To(Succeed())
+		Expect(nft.leftoverRemoved).To(BeTrue())
+
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			rules, err := netlink.RuleList(family)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules).ToNot(ContainElement(SatisfyAll(
+				HaveField("Table", 300), HaveField("Mark", uint32(520)),
+			)))
+			Expect(rules).ToNot(ContainElement(HaveField("Table", 401)))
+
+			for _, table := range []int{300, 401} {
+				routes, err := netlink.RouteListFiltered(family,
+					&netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(routes).To(BeEmpty())
+			}
+		}
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rules).To(ContainElement(SatisfyAll(
+			HaveField("Table", 300), HaveField("Mark", uint32(519)),
+		)))
+
+		By("adding them again without EEXIST")
+		Expect(m.addRoute()).To(Succeed())
+		m.removeRoute()
+	})
 })
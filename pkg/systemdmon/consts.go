@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	systemdName       = "org.freedesktop.systemd1"
+	systemdPath       = dbus.ObjectPath("/org/freedesktop/systemd1")
+	unitPathNamespace = dbus.ObjectPath("/org/freedesktop/systemd1/unit")
+
+	managerInterface    = "org.freedesktop.systemd1.Manager"
+	unitInterface       = "org.freedesktop.systemd1.Unit"
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+
+	controlGroupProperty = "ControlGroup"
+)
+
+// DefaultRuntimeDir is where runtime directories of users are,
+// the user bus of a user is the socket "bus" in the runtime directory.
+const DefaultRuntimeDir = "/run/user"
+
+// userBusRetryInterval is how long to wait
+// before connecting to a user bus again,
+// as the user bus is started after the user manager.
+const userBusRetryInterval = time.Second
+
+// cgroupInterfaces maps suffixes of units which can have cgroups
+// to interfaces having their ControlGroup property.
+var cgroupInterfaces = map[string]string{
+	".service": "org.freedesktop.systemd1.Service",
+	".scope":   "org.freedesktop.systemd1.Scope",
+	".slice":   "org.freedesktop.systemd1.Slice",
+	".socket":  "org.freedesktop.systemd1.Socket",
+	".mount":   "org.freedesktop.systemd1.Mount",
+	".swap":    "org.freedesktop.systemd1.Swap",
+}
@@ -0,0 +1,17 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import "errors"
+
+var (
+	ErrCGroupRootNotFound    = errors.New("cgroup v2 file system mount point is missing.")
+	ErrBufferSizeInvalid     = errors.New("buffer size must not be negative.")
+	ErrRuntimeDirMissing     = errors.New("runtime directory of users is missing.")
+	ErrLoggerMissing         = errors.New("logger is missing.")
+	ErrMetricsMissing        = errors.New("metrics is missing.")
+	ErrBusDisconnected       = errors.New("disconnected from D-Bus.")
+	ErrControlGroupMalformed = errors.New("ControlGroup property is not a string.")
+)
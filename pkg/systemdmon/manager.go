@@ -0,0 +1,413 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/godbus/dbus/v5"
+	"go.uber.org/zap"
+)
+
+// manager follows cgroups of units of a systemd manager on a bus.
+type manager struct {
+	conn    *dbus.Conn
+	root    string
+	log     *zap.SugaredLogger
+	metrics interfaces.Metrics
+	signals chan *dbus.Signal
+
+	// uid is the user running the manager,
+	// it is nil for the system manager.
+	uid *uint32
+	// units records units known, keyed by their object paths.
+	units map[dbus.ObjectPath]unit
+}
+
+type unit struct {
+	name string
+	// cgroup is the path of the cgroup of the unit,
+	// it is empty if the unit has no cgroup.
+	cgroup string
+}
+
+func (m *SystemdMonitor) newManager(conn *dbus.Conn, uid *uint32) *manager {
+	log := m.log
+	if uid != nil {
+		log = log.With("uid", *uid)
+	}
+
+	return &manager{
+		conn:    conn,
+		root:    string(m.root),
+		log:     log,
+		metrics: m.metrics,
+		signals: make(chan *dbus.Signal, m.bufferSize),
+		uid:     uid,
+		units:   map[dbus.ObjectPath]unit{},
+	}
+}
+
+// start subscribes to signals of the manager
+// and returns events of cgroups of units loaded.
+//
+// NOTE:
+// Signals are subscribed before units are listed,
+// so that units changed in the meantime
+// are found either in the list or by signals.
+func (mgr *manager) start(ctx context.Context) (ret []types.CGroupEvent, err error) {
+	defer Wrap(&err, "subscribe to systemd manager")
+
+	mgr.conn.Signal(mgr.signals)
+
+	err = mgr.conn.AddMatchSignalContext(ctx,
+		dbus.WithMatchSender(systemdName),
+		dbus.WithMatchObjectPath(systemdPath),
+		dbus.WithMatchInterface(managerInterface),
+	)
+	if err != nil {
+		return
+	}
+
+	err = mgr.conn.AddMatchSignalContext(ctx,
+		dbus.WithMatchSender(systemdName),
+		dbus.WithMatchPathNamespace(unitPathNamespace),
+		dbus.WithMatchInterface(propertiesInterface),
+		dbus.WithMatchMember("PropertiesChanged"),
+	)
+	if err != nil {
+		return
+	}
+
+	obj := mgr.conn.Object(systemdName, systemdPath)
+
+	err = obj.CallWithContext(ctx, managerInterface+".Subscribe", 0).Err
+	if err != nil {
+		return
+	}
+
+	var units []struct {
+		Name        string
+		Description string
+		LoadState   string
+		ActiveState string
+		SubState    string
+		Following   string
+		Path        dbus.ObjectPath
+		JobID       uint32
+		JobType     string
+		JobPath     dbus.ObjectPath
+	}
+	err = obj.CallWithContext(ctx, managerInterface+".ListUnits", 0).Store(&units)
+	if err != nil {
+		return
+	}
+
+	events := []types.CGroupEvent{}
+	for i := range units {
+		iface, ok := cgroupInterface(units[i].Name)
+		if !ok {
+			continue
+		}
+
+		var cgroup string
+		cgroup, err = mgr.controlGroup(ctx, units[i].Path, iface)
+		if err != nil {
+			mgr.log.Debugw("Unit had been unloaded.",
+				"unit", units[i].Name,
+				"error", err,
+			)
+			err = nil
+			continue
+		}
+
+		events = append(events, mgr.update(units[i].Path, units[i].Name, cgroup)...)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Path < events[j].Path
+	})
+
+	ret = events
+	return
+}
+
+// run handles signals of the manager and sends events to out
+// until ctx is done or stop is closed.
+// It fails if the bus is disconnected.
+func (mgr *manager) run(
+	ctx context.Context, stop <-chan struct{}, out chan<- []types.CGroupEvent,
+) (err error) {
+	for {
+		var sig *dbus.Signal
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case sig, ok = <-mgr.signals:
+		}
+		if !ok {
+			err = ErrBusDisconnected
+			return
+		}
+
+		events, handleErr := mgr.handle(ctx, sig)
+		if handleErr != nil {
+			mgr.log.Errorw("Failed to handle signal of systemd manager.",
+				"signal", sig.Name,
+				"path", sig.Path,
+				"error", handleErr,
+			)
+			continue
+		}
+
+		if len(events) == 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- events:
+		}
+	}
+}
+
+// handle returns events of cgroups changed by sig.
+//
+// NOTE:
+// Properties of units removed are never read,
+// as reading them makes systemd load the unit again.
+func (mgr *manager) handle(ctx context.Context, sig *dbus.Signal) (ret []types.CGroupEvent, err error) {
+	defer Wrap(&err, "handle signal %s of %s", sig.Name, sig.Path)
+
+	switch sig.Name {
+	case managerInterface + ".UnitNew":
+		mgr.metrics.AddEventsReceived(1)
+
+		var name string
+		var path dbus.ObjectPath
+		err = dbus.Store(sig.Body, &name, &path)
+		if err != nil {
+			return
+		}
+
+		iface, ok := cgroupInterface(name)
+		if !ok {
+			return
+		}
+
+		var cgroup string
+		cgroup, err = mgr.controlGroup(ctx, path, iface)
+		if err != nil {
+			return
+		}
+
+		ret = mgr.update(path, name, cgroup)
+		return
+
+	case managerInterface + ".UnitRemoved":
+		mgr.metrics.AddEventsReceived(1)
+
+		var name string
+		var path dbus.ObjectPath
+		err = dbus.Store(sig.Body, &name, &path)
+		if err != nil {
+			return
+		}
+
+		ret = mgr.update(path, name, "")
+		delete(mgr.units, path)
+		return
+
+	case propertiesInterface + ".PropertiesChanged":
+		var iface string
+		var changed map[string]dbus.Variant
+		var invalidated []string
+		err = dbus.Store(sig.Body, &iface, &changed, &invalidated)
+		if err != nil {
+			return
+		}
+
+		if !isCgroupInterface(iface) {
+			return
+		}
+
+		var cgroup string
+		if value, ok := changed[controlGroupProperty]; ok {
+			var isString bool
+			cgroup, isString = value.Value().(string)
+			if !isString {
+				err = ErrControlGroupMalformed
+				return
+			}
+		} else if slices.Contains(invalidated, controlGroupProperty) {
+			cgroup, err = mgr.controlGroup(ctx, sig.Path, iface)
+			if err != nil {
+				return
+			}
+		} else {
+			return
+		}
+
+		mgr.metrics.AddEventsReceived(1)
+
+		name := mgr.units[sig.Path].name
+		if name == "" {
+			var value dbus.Variant
+			value, err = mgr.property(ctx, sig.Path, unitInterface, "Id")
+			if err != nil {
+				return
+			}
+
+			name, _ = value.Value().(string)
+		}
+
+		ret = mgr.update(sig.Path, name, cgroup)
+		return
+	}
+
+	return
+}
+
+// update records cgroup as the ControlGroup property
+// of the unit at path,
+// and returns events of the change if any.
+func (mgr *manager) update(path dbus.ObjectPath, name, cgroup string) (ret []types.CGroupEvent) {
+	cgroup = mgr.cgroupPath(cgroup)
+
+	old := mgr.units[path]
+	mgr.units[path] = unit{name: name, cgroup: cgroup}
+
+	if old.cgroup == cgroup {
+		return
+	}
+
+	events := []types.CGroupEvent{}
+
+	if old.cgroup != "" {
+		events = append(events, mgr.event(old, types.CgroupEventTypeDelete))
+	}
+
+	if cgroup != "" {
+		events = append(events, mgr.event(mgr.units[path], types.CgroupEventTypeNew))
+	}
+
+	for i := range events {
+		mgr.log.Debugw("Cgroup of unit changed.",
+			"unit", events[i].Unit,
+			"event", events[i].EventType,
+			"path", events[i].Path,
+		)
+	}
+
+	ret = events
+	return
+}
+
+// forget returns events of removal of all cgroups known,
+// deepest ones first, and forgets them.
+func (mgr *manager) forget() (ret []types.CGroupEvent) {
+	events := []types.CGroupEvent{}
+	for _, u := range mgr.units {
+		if u.cgroup == "" {
+			continue
+		}
+
+		events = append(events, mgr.event(u, types.CgroupEventTypeDelete))
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Path > events[j].Path
+	})
+
+	mgr.units = map[dbus.ObjectPath]unit{}
+
+	ret = events
+	return
+}
+
+func (mgr *manager) event(u unit, typ types.CgroupEventType) types.CGroupEvent {
+	return types.CGroupEvent{
+		Path:      u.cgroup,
+		EventType: typ,
+		Unit:      u.name,
+		UID:       mgr.uid,
+	}
+}
+
+// cgroupPath returns the path of cgroup in cgroupfs,
+// the cgroup root itself is not a cgroup sending events.
+func (mgr *manager) cgroupPath(cgroup string) string {
+	if cgroup == "" || cgroup == "/" {
+		return ""
+	}
+
+	return filepath.Join(mgr.root, cgroup)
+}
+
+func (mgr *manager) controlGroup(
+	ctx context.Context, path dbus.ObjectPath, iface string,
+) (
+	ret string, err error,
+) {
+	var value dbus.Variant
+	value, err = mgr.property(ctx, path, iface, controlGroupProperty)
+	if err != nil {
+		return
+	}
+
+	cgroup, ok := value.Value().(string)
+	if !ok {
+		err = ErrControlGroupMalformed
+		return
+	}
+
+	ret = cgroup
+	return
+}
+
+func (mgr *manager) property(
+	ctx context.Context, path dbus.ObjectPath, iface, name string,
+) (
+	ret dbus.Variant, err error,
+) {
+	err = mgr.conn.Object(systemdName, path).
+		CallWithContext(ctx, propertiesInterface+".Get", 0, iface, name).
+		Store(&ret)
+	return
+}
+
+// cgroupInterface returns the interface
+// having the ControlGroup property of the unit,
+// units which cannot have cgroups have none.
+func cgroupInterface(name string) (ret string, ok bool) {
+	idx := strings.LastIndex(name, ".")
+	if idx < 0 {
+		return
+	}
+
+	ret, ok = cgroupInterfaces[name[idx:]]
+	return
+}
+
+func isCgroupInterface(iface string) bool {
+	for _, i := range cgroupInterfaces {
+		if i == iface {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import (
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+	"github.com/black-desk/cgtproxy/pkg/interfaces"
+	"github.com/black-desk/cgtproxy/pkg/metrics"
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"go.uber.org/zap"
+)
+
+// SystemdMonitor is an implementation of interfaces.CGroupMonitor,
+// which follows cgroups of units through D-Bus
+// instead of watching cgroupfs.
+// It subscribes to signals of the systemd system manager on the system bus,
+// and to those of the user manager of each user on the user bus,
+// which is connected when the unit of the user manager gets a cgroup.
+// Events it sends have the unit and the user of cgroups.
+type SystemdMonitor struct {
+	eventsOut  chan types.CGroupEvents
+	root       config.CGroupRoot
+	bufferSize int
+	log        *zap.SugaredLogger
+	metrics    interfaces.Metrics
+
+	// systemBus is the address of the system bus,
+	// empty means the default one.
+	systemBus string
+	// runtimeDir is where user buses are found.
+	runtimeDir string
+}
+
+type Opt = (func(*SystemdMonitor) (*SystemdMonitor, error))
+
+func New(opts ...Opt) (ret *SystemdMonitor, err error) {
+	defer Wrap(&err, "create systemd cgroup monitor")
+
+	m := &SystemdMonitor{}
+
+	for i := range opts {
+		m, err = opts[i](m)
+		if err != nil {
+			return
+		}
+	}
+
+	if m.log == nil {
+		m.log = zap.NewNop().Sugar()
+	}
+
+	if m.metrics == nil {
+		var mt *metrics.Metrics
+		mt, err = metrics.New(metrics.WithLogger(m.log))
+		if err != nil {
+			return
+		}
+
+		m.metrics = mt
+	}
+
+	if m.root == "" {
+		err = ErrCGroupRootNotFound
+		return
+	}
+
+	if m.bufferSize == 0 {
+		m.bufferSize = config.DefaultMonitorBufferSize
+	}
+
+	if m.runtimeDir == "" {
+		m.runtimeDir = DefaultRuntimeDir
+	}
+
+	m.eventsOut = make(chan types.CGroupEvents)
+
+	ret = m
+
+	m.log.Debugw("Create a systemd cgroup monitor.",
+		"buffer_size", m.bufferSize,
+		"system_bus", m.systemBus,
+		"runtime_dir", m.runtimeDir,
+	)
+
+	return
+}
+
+func WithCgroupRoot(root config.CGroupRoot) Opt {
+	return func(m *SystemdMonitor) (ret *SystemdMonitor, err error) {
+		if root == "" {
+			err = ErrCGroupRootNotFound
+			return
+		}
+
+		m.root = root
+		ret = m
+		return
+	}
+}
+
+// WithBufferSize sets how many D-Bus signals of a bus are queued
+// before being handled, 0 means the default one.
+func WithBufferSize(size int) Opt {
+	return func(m *SystemdMonitor) (ret *SystemdMonitor, err error) {
+		if size < 0 {
+			err = ErrBufferSizeInvalid
+			return
+		}
+
+		m.bufferSize = size
+		ret = m
+		return
+	}
+}
+
+// WithSystemBus sets the address of the system bus,
+// e.g. "unix:path=/run/dbus/system_bus_socket".
+func WithSystemBus(address string) Opt {
+	return func(m *SystemdMonitor) (ret *SystemdMonitor, err error) {
+		m.systemBus = address
+		ret = m
+		return
+	}
+}
+
+// WithRuntimeDir sets where runtime directories of users are,
+// the user bus of user 1000 is "<dir>/1000/bus".
+func WithRuntimeDir(dir string) Opt {
+	return func(m *SystemdMonitor) (ret *SystemdMonitor, err error) {
+		if dir == "" {
+			err = ErrRuntimeDirMissing
+			return
+		}
+
+		m.runtimeDir = dir
+		ret = m
+		return
+	}
+}
+
+func WithLogger(log *zap.SugaredLogger) Opt {
+	return func(m *SystemdMonitor) (ret *SystemdMonitor, err error) {
+		if log == nil {
+			err = ErrLoggerMissing
+			return
+		}
+
+		m.log = log
+		ret = m
+		return
+	}
+}
+
+func WithMetrics(mt interfaces.Metrics) Opt {
+	return func(m *SystemdMonitor) (ret *SystemdMonitor, err error) {
+		if mt == nil {
+			err = ErrMetricsMissing
+			return
+		}
+
+		m.metrics = mt
+		ret = m
+		return
+	}
+}
@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/godbus/dbus/v5"
+)
+
+// followUsers starts following the user manager
+// of each user manager unit of the system manager got a cgroup in events,
+// and stops following those whose cgroups have been removed.
+func (m *SystemdMonitor) followUsers(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	users map[uint32]chan struct{},
+	events []types.CGroupEvent,
+	out chan<- []types.CGroupEvent,
+) {
+	for i := range events {
+		if events[i].UID != nil {
+			continue
+		}
+
+		uid, ok := userManagerUID(events[i].Unit)
+		if !ok {
+			continue
+		}
+
+		stop, following := users[uid]
+
+		if events[i].EventType == types.CgroupEventTypeDelete {
+			if following {
+				close(stop)
+				delete(users, uid)
+			}
+			continue
+		}
+
+		if following {
+			continue
+		}
+
+		stop = make(chan struct{})
+		users[uid] = stop
+		wg.Go(func() { m.runUser(ctx, uid, stop, out) })
+	}
+}
+
+// runUser follows the user manager of uid until ctx is done or stop is closed,
+// connecting to the user bus again if it cannot be connected or disconnected.
+func (m *SystemdMonitor) runUser(
+	ctx context.Context, uid uint32, stop <-chan struct{}, out chan<- []types.CGroupEvent,
+) {
+	address := "unix:path=" + filepath.Join(
+		m.runtimeDir, strconv.FormatUint(uint64(uid), 10), "bus",
+	)
+
+	for {
+		err := m.followUser(ctx, uid, address, stop, out)
+		if err != nil {
+			m.log.Debugw("Failed to follow systemd user manager, retrying later.",
+				"uid", uid,
+				"error", err,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		case <-time.After(userBusRetryInterval):
+		}
+	}
+}
+
+// followUser sends events of cgroups of units of the user manager on the bus
+// at address until ctx is done, stop is closed or the bus is disconnected,
+// then sends events of removal of cgroups known
+// unless ctx is done.
+func (m *SystemdMonitor) followUser(
+	ctx context.Context,
+	uid uint32,
+	address string,
+	stop <-chan struct{},
+	out chan<- []types.CGroupEvent,
+) (err error) {
+	defer Wrap(&err, "follow systemd user manager of user %d", uid)
+
+	var conn *dbus.Conn
+	conn, err = dbus.Connect(address, dbus.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	mgr := m.newManager(conn, &uid)
+
+	var events []types.CGroupEvent
+	events, err = mgr.start(ctx)
+	if err != nil {
+		return
+	}
+
+	m.log.Infow("Following systemd user manager.",
+		"uid", uid,
+		"units", len(mgr.units),
+	)
+
+	defer func() {
+		events := mgr.forget()
+		if len(events) == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case out <- events:
+		}
+	}()
+
+	if len(events) != 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case out <- events:
+		}
+	}
+
+	err = mgr.run(ctx, stop, out)
+	return
+}
+
+// userManagerUID returns the user of the user manager unit,
+// which is named "user@UID.service".
+func userManagerUID(unit string) (ret uint32, ok bool) {
+	str, found := strings.CutPrefix(unit, "user@")
+	if !found {
+		return
+	}
+
+	str, found = strings.CutSuffix(str, ".service")
+	if !found {
+		return
+	}
+
+	uid, err := strconv.ParseUint(str, 10, 32)
+	if err != nil {
+		return
+	}
+
+	ret = uint32(uid)
+	ok = true
+	return
+}
+
+func (m *SystemdMonitor) send(ctx context.Context, cgEvents types.CGroupEvents) (err error) {
+	m.log.Debugw("New cgroup envents.",
+		"size", len(cgEvents.Events),
+	)
+
+	cnt := len(cgEvents.Events)
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case m.eventsOut <- cgEvents:
+		m.log.Debugw("Cgroup events sent.",
+			"size", cnt,
+		)
+	}
+
+	return
+}
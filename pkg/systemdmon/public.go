@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import (
+	"context"
+	"sync"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	. "github.com/black-desk/lib/go/errwrap"
+	"github.com/godbus/dbus/v5"
+)
+
+func (m *SystemdMonitor) Events() <-chan types.CGroupEvents {
+	return m.eventsOut
+}
+
+// RunCGroupMonitor sends events of cgroups of units loaded at first,
+// and then events of changes until ctx is done.
+// It fails if the system bus is disconnected,
+// while user buses are connected again.
+func (m *SystemdMonitor) RunCGroupMonitor(ctx context.Context) (err error) {
+	defer Wrap(&err, "running systemd cgroup monitor")
+	defer close(m.eventsOut)
+
+	var conn *dbus.Conn
+	if m.systemBus == "" {
+		conn, err = dbus.ConnectSystemBus(dbus.WithContext(ctx))
+	} else {
+		conn, err = dbus.Connect(m.systemBus, dbus.WithContext(ctx))
+	}
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	system := m.newManager(conn, nil)
+
+	m.log.Info("Listing units of systemd system manager...")
+	var events []types.CGroupEvent
+	events, err = system.start(ctx)
+	m.log.Info("Listing units of systemd system manager...Done.")
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel(nil)
+		wg.Wait()
+	}()
+
+	out := make(chan []types.CGroupEvent)
+	users := map[uint32]chan struct{}{}
+
+	m.followUsers(ctx, &wg, users, events, out)
+
+	// NOTE:
+	// The first batch is sent even if it is empty,
+	// the same as the cgroupfs monitor does.
+	err = m.send(ctx, types.CGroupEvents{Events: events})
+	if err != nil {
+		return
+	}
+
+	wg.Go(func() {
+		runErr := system.run(ctx, nil, out)
+		if runErr != nil {
+			cancel(runErr)
+		}
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			err = context.Cause(ctx)
+			return
+		case events = <-out:
+		}
+
+		m.followUsers(ctx, &wg, users, events, out)
+
+		err = m.send(ctx, types.CGroupEvents{Events: events})
+		if err != nil {
+			err = context.Cause(ctx)
+			return
+		}
+	}
+}
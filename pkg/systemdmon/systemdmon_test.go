@@ -0,0 +1,393 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemdmon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/black-desk/cgtproxy/pkg/types"
+	"github.com/godbus/dbus/v5"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSystemdMonitor(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SystemdMonitor Suite")
+}
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startBus starts a private dbus-daemon listening on the socket at path,
+// specs are skipped if dbus-daemon is not installed.
+func startBus(path string) (address string, daemon *exec.Cmd) {
+	bin, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		Skip("dbus-daemon is not installed")
+	}
+
+	Expect(os.MkdirAll(filepath.Dir(path), 0o755)).To(Succeed())
+
+	conf := filepath.Join(GinkgoT().TempDir(), "bus.conf")
+	Expect(os.WriteFile(conf, fmt.Appendf(nil, busConfig, path), 0o644)).To(Succeed())
+
+	daemon = exec.Command(bin, "--nofork", "--config-file="+conf)
+	daemon.Stderr = GinkgoWriter
+	Expect(daemon.Start()).To(Succeed())
+	DeferCleanup(func() {
+		_ = daemon.Process.Kill()
+		_ = daemon.Wait()
+	})
+
+	address = "unix:path=" + path
+
+	Eventually(func() error {
+		conn, err := dbus.Connect(address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}).Should(Succeed())
+
+	return
+}
+
+// fakeSystemd is a systemd manager on a private bus,
+// whose units are changed by specs.
+type fakeSystemd struct {
+	conn *dbus.Conn
+
+	mu    sync.Mutex
+	units map[string]string
+}
+
+type listedUnit struct {
+	Name, Description, LoadState, ActiveState, SubState, Following string
+	Path                                                           dbus.ObjectPath
+	JobID                                                          uint32
+	JobType                                                        string
+	JobPath                                                        dbus.ObjectPath
+}
+
+func newFakeSystemd(address string, units map[string]string) *fakeSystemd {
+	conn, err := dbus.Connect(address)
+	Expect(err).To(Succeed())
+	DeferCleanup(conn.Close)
+
+	s := &fakeSystemd{conn: conn, units: units}
+
+	Expect(conn.Export(s, systemdPath, managerInterface)).To(Succeed())
+	Expect(conn.ExportSubtreeMethodTable(map[string]any{
+		"Get": s.get,
+	}, unitPathNamespace, propertiesInterface)).To(Succeed())
+
+	reply, err := conn.RequestName(systemdName, dbus.NameFlagDoNotQueue)
+	Expect(err).To(Succeed())
+	Expect(reply).To(Equal(dbus.RequestNameReplyPrimaryOwner))
+
+	return s
+}
+
+// unitPath escapes name into the object path of the unit
+// the same way as systemd.
+func unitPath(name string) dbus.ObjectPath {
+	escaped := strings.Builder{}
+	for _, c := range []byte(name) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			escaped.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&escaped, "_%02x", c)
+	}
+
+	return unitPathNamespace + "/" + dbus.ObjectPath(escaped.String())
+}
+
+func (s *fakeSystemd) Subscribe() *dbus.Error {
+	return nil
+}
+
+func (s *fakeSystemd) ListUnits() ([]listedUnit, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := []listedUnit{}
+	for name := range s.units {
+		ret = append(ret, listedUnit{
+			Name:    name,
+			Path:    unitPath(name),
+			JobPath: "/",
+		})
+	}
+
+	return ret, nil
+}
+
+func (s *fakeSystemd) get(msg dbus.Message, iface, property string) (dbus.Variant, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := msg.Headers[dbus.FieldPath].Value().(dbus.ObjectPath)
+
+	for name, cgroup := range s.units {
+		if unitPath(name) != path {
+			continue
+		}
+
+		switch {
+		case iface == unitInterface && property == "Id":
+			return dbus.MakeVariant(name), nil
+		case strings.HasPrefix(iface, "org.freedesktop.systemd1.") &&
+			property == controlGroupProperty:
+			return dbus.MakeVariant(cgroup), nil
+		}
+	}
+
+	return dbus.Variant{}, dbus.NewError(
+		"org.freedesktop.DBus.Error.UnknownObject", nil,
+	)
+}
+
+func (s *fakeSystemd) add(name, cgroup string) {
+	s.mu.Lock()
+	s.units[name] = cgroup
+	s.mu.Unlock()
+
+	Expect(s.conn.Emit(systemdPath, managerInterface+".UnitNew",
+		name, unitPath(name),
+	)).To(Succeed())
+}
+
+// set changes the cgroup of the unit,
+// the new value is sent in the signal or invalidated.
+func (s *fakeSystemd) set(name, cgroup string, invalidate bool) {
+	s.mu.Lock()
+	s.units[name] = cgroup
+	s.mu.Unlock()
+
+	iface, _ := cgroupInterface(name)
+
+	changed := map[string]dbus.Variant{}
+	invalidated := []string{}
+	if invalidate {
+		invalidated = append(invalidated, controlGroupProperty)
+	} else {
+		changed[controlGroupProperty] = dbus.MakeVariant(cgroup)
+	}
+
+	Expect(s.conn.Emit(unitPath(name), propertiesInterface+".PropertiesChanged",
+		iface, changed, invalidated,
+	)).To(Succeed())
+}
+
+func (s *fakeSystemd) remove(name string) {
+	s.mu.Lock()
+	delete(s.units, name)
+	s.mu.Unlock()
+
+	Expect(s.conn.Emit(systemdPath, managerInterface+".UnitRemoved",
+		name, unitPath(name),
+	)).To(Succeed())
+}
+
+const root = "/sys/fs/cgroup"
+
+func event(unit, cgroup string, typ types.CgroupEventType, uid *uint32) types.CGroupEvent {
+	return types.CGroupEvent{
+		Path:      root + cgroup,
+		EventType: typ,
+		Unit:      unit,
+		UID:       uid,
+	}
+}
+
+var _ = Describe("New", func() {
+	It("should fail when no cgroup root is provided", func() {
+		_, err := New()
+		Expect(err).To(MatchError(ErrCGroupRootNotFound))
+	})
+
+	It("should fail on negative buffer size", func() {
+		_, err := New(WithCgroupRoot(root), WithBufferSize(-1))
+		Expect(err).To(MatchError(ErrBufferSizeInvalid))
+	})
+
+	It("should fail on empty runtime directory", func() {
+		_, err := New(WithCgroupRoot(root), WithRuntimeDir(""))
+		Expect(err).To(MatchError(ErrRuntimeDirMissing))
+	})
+})
+
+var _ = DescribeTable("userManagerUID",
+	func(unit string, uid uint32, ok bool) {
+		ret, found := userManagerUID(unit)
+		Expect(found).To(Equal(ok))
+		Expect(ret).To(Equal(uid))
+	},
+	Entry("user manager", "user@1000.service", uint32(1000), true),
+	Entry("other template", "user-runtime-dir@1000.service", uint32(0), false),
+	Entry("template itself", "user@.service", uint32(0), false),
+	Entry("not a number", "user@foo.service", uint32(0), false),
+)
+
+var _ = Describe("SystemdMonitor", func() {
+	var (
+		runtimeDir string
+		daemon     *exec.Cmd
+		systemd    *fakeSystemd
+		m          *SystemdMonitor
+
+		cancel context.CancelFunc
+		done   chan error
+
+		received []types.CGroupEvent
+		collect  func() []types.CGroupEvent
+	)
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		runtimeDir = filepath.Join(dir, "user")
+
+		var address string
+		address, daemon = startBus(filepath.Join(dir, "system_bus_socket"))
+
+		systemd = newFakeSystemd(address, map[string]string{
+			"-.slice":            "/",
+			"init.scope":         "/init.scope",
+			"system.slice":       "/system.slice",
+			"foo.service":        "",
+			"sys-devices.device": "",
+		})
+
+		var err error
+		m, err = New(
+			WithCgroupRoot(root),
+			WithSystemBus(address),
+			WithRuntimeDir(runtimeDir),
+		)
+		Expect(err).To(Succeed())
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		DeferCleanup(cancel)
+
+		done = make(chan error, 1)
+		go func(m *SystemdMonitor, done chan<- error) {
+			done <- m.RunCGroupMonitor(ctx)
+		}(m, done)
+
+		Eventually(m.Events()).Should(Receive(Equal(types.CGroupEvents{
+			Events: []types.CGroupEvent{
+				event("init.scope", "/init.scope", types.CgroupEventTypeNew, nil),
+				event("system.slice", "/system.slice", types.CgroupEventTypeNew, nil),
+			},
+		})))
+
+		received = nil
+		collect = func() []types.CGroupEvent {
+			select {
+			case events := <-m.Events():
+				received = append(received, events.Events...)
+			default:
+			}
+			return received
+		}
+	})
+
+	It("should send changes of cgroups of units until cancelled", func() {
+		By("sending cgroups of units loaded")
+		systemd.add("bar.service", "/system.slice/bar.service")
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("bar.service", "/system.slice/bar.service", types.CgroupEventTypeNew, nil),
+		}))
+
+		By("sending cgroups of units started")
+		received = nil
+		systemd.set("foo.service", "/system.slice/foo.service", false)
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("foo.service", "/system.slice/foo.service", types.CgroupEventTypeNew, nil),
+		}))
+
+		By("sending cgroups of units stopped")
+		received = nil
+		systemd.set("foo.service", "", true)
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("foo.service", "/system.slice/foo.service", types.CgroupEventTypeDelete, nil),
+		}))
+
+		By("sending cgroups of units unloaded")
+		received = nil
+		systemd.remove("bar.service")
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("bar.service", "/system.slice/bar.service", types.CgroupEventTypeDelete, nil),
+		}))
+
+		By("stopping when the context is cancelled")
+		cancel()
+		Eventually(done, "3s").Should(Receive(MatchError(context.Canceled)))
+	})
+
+	It("should follow user managers", func() {
+		uid := uint32(1000)
+		manager := "/user.slice/user-1000.slice/user@1000.service"
+
+		By("sending the cgroup of the user manager")
+		systemd.add("user@1000.service", manager)
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("user@1000.service", manager, types.CgroupEventTypeNew, nil),
+		}))
+
+		By("sending cgroups of units of the user manager once the user bus is up")
+		received = nil
+		address, _ := startBus(filepath.Join(runtimeDir, "1000", "bus"))
+		user := newFakeSystemd(address, map[string]string{
+			"app.slice": manager + "/app.slice",
+		})
+		Eventually(collect, "5s").Should(Equal([]types.CGroupEvent{
+			event("app.slice", manager+"/app.slice", types.CgroupEventTypeNew, &uid),
+		}))
+
+		By("sending changes of units of the user manager")
+		received = nil
+		user.add("app-foo.scope", manager+"/app.slice/app-foo.scope")
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("app-foo.scope", manager+"/app.slice/app-foo.scope", types.CgroupEventTypeNew, &uid),
+		}))
+
+		By("removing cgroups of units of the user manager stopped")
+		received = nil
+		systemd.set("user@1000.service", "", false)
+		Eventually(collect, "3s").Should(Equal([]types.CGroupEvent{
+			event("user@1000.service", manager, types.CgroupEventTypeDelete, nil),
+			event("app-foo.scope", manager+"/app.slice/app-foo.scope", types.CgroupEventTypeDelete, &uid),
+			event("app.slice", manager+"/app.slice", types.CgroupEventTypeDelete, &uid),
+		}))
+	})
+
+	It("should fail if the system bus is disconnected", func() {
+		Expect(daemon.Process.Kill()).To(Succeed())
+		Eventually(done, "3s").Should(Receive(MatchError(ErrBusDisconnected)))
+	})
+})
@@ -4,6 +4,8 @@
 
 package types
 
+import "fmt"
+
 type CgroupEventType uint8
 
 const (
@@ -13,7 +15,29 @@ const (
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type=CgroupEventType -linecomment
 
+// MarshalText makes CgroupEventType encoded as its name, e.g. in JSON.
+func (t CgroupEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *CgroupEventType) UnmarshalText(text []byte) error {
+	for i := range CgroupEventType(len(_CgroupEventType_index) - 1) {
+		if i.String() == string(text) {
+			*t = i
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown cgroup event type %q", text)
+}
+
 type CGroupEvent struct {
 	Path      string
 	EventType CgroupEventType
+	// Unit is the name of the systemd unit the cgroup belongs to,
+	// it is empty if the cgroup monitor does not know it.
+	Unit string
+	// UID is the user running the systemd manager of Unit,
+	// it is nil for units of the system manager.
+	UID *uint32
 }
@@ -0,0 +1,20 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package types
+
+// Counter is the amount of traffic of a protocol handled by a target
+// or matched by a rule.
+type Counter struct {
+	// Target is the kind of the target followed by its name if any,
+	// e.g. "direct", "tproxy-clash", "reject-port-unreachable",
+	// or the name of a rule, e.g. "rule-0".
+	Target string `json:"target"`
+	// Proto is "tcp" or "udp".
+	Proto string `json:"proto"`
+	// Family is "ipv4" or "ipv6".
+	Family  string `json:"family"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
@@ -0,0 +1,28 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package types
+
+// Drift counts differences between cgroupfs and the cgroup map
+// fixed by a reconciliation.
+type Drift struct {
+	// Created is the number of cgroups in cgroupfs
+	// whose creation had been missed.
+	Created int `json:"created"`
+	// Deleted is the number of cgroups not in cgroupfs any more
+	// whose removal had been missed.
+	Deleted int `json:"deleted"`
+	// Stale is the number of elements added again,
+	// as they were missing in kernel,
+	// or the cgroups at their paths had been created again.
+	Stale int `json:"stale"`
+	// Orphans is the number of elements removed,
+	// as they were in kernel but nobody knew them.
+	Orphans int `json:"orphans"`
+}
+
+// Total returns the number of all differences.
+func (d Drift) Total() int {
+	return d.Created + d.Deleted + d.Stale + d.Orphans
+}
@@ -0,0 +1,17 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package types
+
+// CGroupElement is an element of a cgroup in the cgroup map.
+type CGroupElement struct {
+	// Path is the path in cgroupfs of the cgroup the element was added for,
+	// it is empty if the element is in kernel but nobody knows it.
+	Path string `json:"path,omitempty"`
+	// Inode is the inode number of the cgroup when the element was added,
+	// which is the key of the element.
+	Inode uint64 `json:"inode"`
+	// Missing tells that the element was added but is not in kernel.
+	Missing bool `json:"missing,omitempty"`
+}
@@ -0,0 +1,20 @@
+// SPDX-FileCopyrightText: 2025 Chen Linxuan <me@black-desk.cn>
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package types
+
+// Override pins a cgroup to a target
+// regardless of rules in configuration.
+type Override struct {
+	// Path is the path of the cgroup in cgroupfs.
+	Path string `json:"path"`
+	// Subtree makes the override apply to all cgroups under Path as well.
+	// Overrides of cgroups deeper in the tree take precedence.
+	Subtree bool `json:"subtree,omitempty"`
+	// Target is one of "direct", "drop", "reject[:REASON]",
+	// "tproxy:NAME", "redirect:NAME" and "route:NAME".
+	Target string `json:"target"`
+	// Persist makes the override survive restarts of cgtproxy.
+	Persist bool `json:"persist,omitempty"`
+}
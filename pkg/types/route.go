@@ -4,23 +4,72 @@
 
 package types
 
+import (
+	"fmt"
+
+	"github.com/black-desk/cgtproxy/pkg/cgtproxy/config"
+)
+
 type TargetOp uint32
 
 const (
-	TargetNoop   TargetOp = iota // noop
-	TargetDrop                   // drop
-	TargetTProxy                 //tproxy
-	TargetDirect                 //direct
+	TargetNoop     TargetOp = iota // noop
+	TargetDrop                     // drop
+	TargetTProxy                   //tproxy
+	TargetDirect                   //direct
+	TargetRedirect                 //redirect
+	TargetRoute                    //route
+	TargetMark                     //mark
+	TargetReject                   //reject
 )
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type=TargetOp -linecomment
 
+// MarshalText makes TargetOp encoded as its name, e.g. in JSON.
+func (op TargetOp) MarshalText() ([]byte, error) {
+	return []byte(op.String()), nil
+}
+
+func (op *TargetOp) UnmarshalText(text []byte) error {
+	for i := range TargetOp(len(_TargetOp_index) - 1) {
+		if i.String() == string(text) {
+			*op = i
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown target op %q", text)
+}
+
 type Target struct {
-	Op    TargetOp
-	Chain string
+	Op    TargetOp `json:"op"`
+	Chain string   `json:"chain,omitempty"`
+
+	// Mark and MarkMask are the fire wall mark to set for TargetMark.
+	// MarkMask 0 means all bits of Mark are set.
+	Mark     uint32 `json:"mark,omitempty"`
+	MarkMask uint32 `json:"mark_mask,omitempty"`
+
+	// RejectWith is the reason to reject non-tcp traffic for TargetReject,
+	// it is one of the RejectWith constants in package config.
+	RejectWith string `json:"reject_with,omitempty"`
+
+	// DNS is where dns request traffic should be sent to.
+	// nil means dns request traffic is handled as other traffic.
+	DNS *config.DNSHijack `json:"dns,omitempty"`
+
+	// Log describes how to log packets before handled by the target.
+	// nil means packets are not logged.
+	Log *config.Log `json:"log,omitempty"`
+
+	// Rule is the name of the rule this target comes from, e.g. "rule-0",
+	// traffic is counted for each rule in addition to its target.
+	// Empty Rule means the traffic is only counted for the target,
+	// e.g. for overrides.
+	Rule string `json:"rule,omitempty"`
 }
 
 type Route struct {
-	Path   string
-	Target Target
+	Path   string `json:"path"`
+	Target Target `json:"target"`
 }
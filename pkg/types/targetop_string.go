@@ -12,11 +12,15 @@ func _() {
 	_ = x[TargetDrop-1]
 	_ = x[TargetTProxy-2]
 	_ = x[TargetDirect-3]
+	_ = x[TargetRedirect-4]
+	_ = x[TargetRoute-5]
+	_ = x[TargetMark-6]
+	_ = x[TargetReject-7]
 }
 
-const _TargetOp_name = "noopdroptproxydirect"
+const _TargetOp_name = "noopdroptproxydirectredirectroutemarkreject"
 
-var _TargetOp_index = [...]uint8{0, 4, 8, 14, 20}
+var _TargetOp_index = [...]uint8{0, 4, 8, 14, 20, 28, 33, 37, 43}
 
 func (i TargetOp) String() string {
 	idx := int(i) - 0